@@ -2,4 +2,4 @@ module tcpip
 
 go 1.20
 
-require github.com/google/gopacket v1.1.19 // indirect
+require github.com/google/gopacket v1.1.19
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"tcpip/tcpip"
+	"time"
+)
+
+func main() {
+	// メモリ上のケーブルでつないだ2つのスタック(root権限もNICもいらない)
+	devA, devB := tcpip.NewPipe(
+		net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01},
+		net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02},
+	)
+	client, server := tcpip.NewStack(), tcpip.NewStack()
+	defer client.Close()
+	defer server.Close()
+
+	client.AddNIC("pipe0", devA, net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(24, 32)})
+	server.AddNIC("pipe0", devB, net.IPNet{IP: net.IPv4(10, 0, 0, 2), Mask: net.CIDRMask(24, 32)})
+
+	// クライアント側のセグメントと状態遷移を記録し，最後にシーケンス図で表示する
+	trace := tcpip.NewTCPTrace()
+	client.SetTCPTracer(trace)
+
+	// ユーザランドTCPの上でnet/httpのサーバを動かす
+	ln, err := server.Listen(nil, 80, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Hello HTTP over tcpip! (from %s)\n", r.RemoteAddr)
+	}))
+
+	// net/httpのクライアントもユーザランドTCPで接続する
+	httpClient := &http.Client{Transport: &http.Transport{DialContext: client.DialContext}}
+	resp, err := httpClient.Get("http://10.0.0.2/")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s %s", resp.Status, body)
+
+	// 接続を閉じてから，3Way Handshakeから切断までを表示する
+	httpClient.CloseIdleConnections()
+	time.Sleep(10 * time.Millisecond)
+	for _, flow := range trace.Flows() {
+		fmt.Println()
+		trace.WriteDiagram(os.Stdout, flow, tcpip.TCPDiagramASCII)
+	}
+}
@@ -1,16 +1,83 @@
 package main
 
-import "tcpip/tcpip"
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"tcpip/tcpip"
+	"time"
+)
 
 func main() {
+	// TODO: `networksetup -listallhardwareports`コマンドで確認
+	interfaceName := flag.String("I", "en0", "使用するインタフェース名")
+	count := flag.Int("c", 4, "送信するエコーリクエストの数")
+	interval := flag.Duration("i", time.Second, "送信間隔")
+	size := flag.Int("s", 56, "ICMPデータ部の長さ")
+	captureFile := flag.String("w", "", "送受信したフレームを書き出すファイル(.pcapか.pcapng)")
+	flag.Parse()
+
 	// TODO: 宛先IPアドレスを変更して試すとより良い！
 	dstIP := "192.168.1.1"
+	if flag.NArg() > 0 {
+		dstIP = flag.Arg(0)
+	}
+	dst := net.ParseIP(dstIP)
+	if dst == nil {
+		log.Fatalf("無効なIPアドレス: %s", dstIP)
+	}
 
-	// TODO: `networksetup -listallhardwareports`コマンドで確認
-	interfaceName := "en0"
+	stack, err := tcpip.OpenStack(*interfaceName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer stack.Close()
+
+	if *captureFile != "" {
+		capture, err := tcpip.CreateCapture(*captureFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer capture.Close()
+		stack.SetCapture(capture)
+	}
 
-	// ARPリクエストを送信
-	if err := tcpip.ArpRequest(interfaceName, dstIP); err != nil {
-		panic(err)
+	// IPヘッダとICMPヘッダの長さ(IPv6なら40+8バイト)
+	headerLen := 28
+	if dst.To4() == nil {
+		headerLen = 48
+		if err := stack.NIC(*interfaceName).EnableIPv6(); err != nil {
+			log.Fatal(err)
+		}
 	}
+
+	// iputilsのpingと同じ形式で表示する
+	fmt.Printf("PING %s (%s) %d(%d) bytes of data.\n", dstIP, dst, *size, *size+headerLen)
+
+	opts := tcpip.PingOptions{
+		Count:    *count,
+		Interval: *interval,
+		Size:     *size,
+	}
+	stats, err := stack.Ping(dst, opts, func(r tcpip.PingReply) {
+		fmt.Printf("%d bytes from %v: icmp_seq=%d ttl=%d time=%s ms\n",
+			r.Bytes, r.From, r.Seq, r.TTL, msec(r.RTT))
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("\n--- %s ping statistics ---\n", dstIP)
+	fmt.Printf("%d packets transmitted, %d received, %.0f%% packet loss, time %dms\n",
+		stats.Transmitted, stats.Received, stats.Loss(), stats.Time.Milliseconds())
+	if stats.Received > 0 {
+		fmt.Printf("rtt min/avg/max/mdev = %s/%s/%s/%s ms\n",
+			msec(stats.MinRTT), msec(stats.AvgRTT), msec(stats.MaxRTT), msec(stats.MdevRTT))
+	}
+}
+
+// ミリ秒を小数点以下3桁で表示
+func msec(d time.Duration) string {
+	return fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond))
 }
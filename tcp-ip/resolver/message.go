@@ -0,0 +1,67 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// UDPで送れるDNSメッセージの最大長(RFC 1035 Section 4.2.1)
+const maxUDPMessageLen = 512
+
+// 問い合わせのDNSメッセージを作る
+func encodeQuery(id uint16, name string, qtype layers.DNSType) ([]byte, error) {
+	msg := &layers.DNS{
+		ID: id,
+		RD: true, // 再帰問い合わせを頼む
+		Questions: []layers.DNSQuestion{{
+			Name:  []byte(name),
+			Type:  qtype,
+			Class: layers.DNSClassIN,
+		}},
+	}
+	return encodeMessage(msg)
+}
+
+// DNSメッセージをバイト列にする
+func encodeMessage(msg *layers.DNS) ([]byte, error) {
+	buf := gopacket.NewSerializeBuffer()
+	if err := msg.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		return nil, fmt.Errorf("DNSメッセージの作成に失敗: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// 受け取ったDNSメッセージを読み取る(名前の圧縮も展開する)
+func decodeMessage(data []byte) (*layers.DNS, error) {
+	msg := &layers.DNS{}
+	if err := msg.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		return nil, fmt.Errorf("DNSメッセージの解析に失敗: %v", err)
+	}
+	return msg, nil
+}
+
+// 問い合わせに対する応答か確かめる
+func isResponseTo(msg *layers.DNS, id uint16, name string, qtype layers.DNSType) bool {
+	if !msg.QR || msg.ID != id || len(msg.Questions) != 1 {
+		return false
+	}
+	q := msg.Questions[0]
+	return q.Type == qtype && strings.EqualFold(string(q.Name), name)
+}
+
+// TCPではメッセージの前に2バイトの長さを付ける(RFC 1035 Section 4.2.2)
+func withLengthPrefix(msg []byte) []byte {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	return buf
+}
+
+// 問い合わせる名前にする．末尾のドットを取り，大文字と小文字を区別しない
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
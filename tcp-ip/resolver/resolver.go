@@ -0,0 +1,396 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"tcpip/tcpip"
+
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	// 名前が存在しない(NXDOMAIN)か，問い合わせた種類のレコードがない
+	ErrNotFound = errors.New("DNSレコードが見つかりません")
+	// どのサーバからも応答が得られなかった
+	ErrNoAnswer = errors.New("DNSサーバから応答がありません")
+)
+
+const (
+	// DNSサーバのポート番号
+	dnsPort = 53
+	// 1回の問い合わせで応答を待つ時間の既定値
+	defaultTimeout = 2 * time.Second
+	// すべてのサーバに問い合わせる回数の既定値
+	defaultAttempts = 3
+	// CNAMEをたどる回数の上限
+	maxCNAMEChain = 8
+)
+
+// tcpipのUDP(切り詰められた応答はTCP)でDNSサーバへ問い合わせるスタブリゾルバ
+// 応答はTTLの間キャッシュする
+type Resolver struct {
+	stack   *tcpip.Stack
+	servers []*net.UDPAddr
+
+	// 1回の問い合わせで応答を待つ時間
+	Timeout time.Duration
+	// すべてのサーバに問い合わせる回数
+	Attempts int
+
+	mu    sync.Mutex
+	cache map[cacheKey]cacheEntry
+}
+
+// tcpip.HostResolverとしてStack.SetResolverに渡せる
+var _ tcpip.HostResolver = (*Resolver)(nil)
+
+type cacheKey struct {
+	name  string
+	qtype layers.DNSType
+}
+
+type cacheEntry struct {
+	answers []layers.DNSResourceRecord
+	expires time.Time
+}
+
+// serversに問い合わせるリゾルバを作る．サーバは"IPアドレス"か"IPアドレス:ポート番号"で指定する
+func New(stack *tcpip.Stack, servers ...string) (*Resolver, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("DNSサーバが指定されていません")
+	}
+	r := &Resolver{
+		stack:    stack,
+		Timeout:  defaultTimeout,
+		Attempts: defaultAttempts,
+		cache:    make(map[cacheKey]cacheEntry),
+	}
+	for _, s := range servers {
+		addr, err := parseServer(s)
+		if err != nil {
+			return nil, err
+		}
+		r.servers = append(r.servers, addr)
+	}
+	return r, nil
+}
+
+func parseServer(s string) (*net.UDPAddr, error) {
+	host, port := s, dnsPort
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		host = h
+		if _, err := fmt.Sscanf(p, "%d", &port); err != nil {
+			return nil, fmt.Errorf("無効なDNSサーバのポート番号: %s", s)
+		}
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("無効なDNSサーバのアドレス: %s", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
+
+// ホスト名のIPv4(A)とIPv6(AAAA)アドレスを返す
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	var ips []net.IP
+	var firstErr error
+	for _, qtype := range []layers.DNSType{layers.DNSTypeA, layers.DNSTypeAAAA} {
+		answers, err := r.Query(ctx, host, qtype)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, rr := range answers {
+			ips = append(ips, rr.IP)
+		}
+	}
+	if len(ips) == 0 {
+		if firstErr == nil {
+			firstErr = ErrNotFound
+		}
+		return nil, firstErr
+	}
+	return ips, nil
+}
+
+// CNAMEをたどった正規名を返す(末尾にドットを付ける)．CNAMEがなければhostそのもの
+// net.LookupCNAMEと同じく，Aレコードの応答に含まれるCNAMEをたどる
+func (r *Resolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	answers, err := r.query(ctx, host, layers.DNSTypeA)
+	if err != nil {
+		return "", err
+	}
+	name := canonicalName(host)
+	for i := 0; i < maxCNAMEChain; i++ {
+		next := ""
+		for _, rr := range answers {
+			if rr.Type == layers.DNSTypeCNAME && canonicalName(string(rr.Name)) == name {
+				next = canonicalName(string(rr.CNAME))
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+	return name + ".", nil
+}
+
+// メールサーバ(MX)を優先度の高い順に返す
+func (r *Resolver) LookupMX(ctx context.Context, host string) ([]*net.MX, error) {
+	answers, err := r.Query(ctx, host, layers.DNSTypeMX)
+	if err != nil {
+		return nil, err
+	}
+	var mxs []*net.MX
+	for _, rr := range answers {
+		mxs = append(mxs, &net.MX{Host: canonicalName(string(rr.MX.Name)) + ".", Pref: rr.MX.Preference})
+	}
+	sort.Slice(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	return mxs, nil
+}
+
+// TXTレコードを返す．1つのレコードに複数の文字列があればつなげる
+func (r *Resolver) LookupTXT(ctx context.Context, host string) ([]string, error) {
+	answers, err := r.Query(ctx, host, layers.DNSTypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	var txts []string
+	for _, rr := range answers {
+		var b strings.Builder
+		for _, t := range rr.TXTs {
+			b.Write(t)
+		}
+		txts = append(txts, b.String())
+	}
+	return txts, nil
+}
+
+// nameのqtypeのレコードを問い合わせる
+// 応答のCNAMEのうち，nameからたどれる名前のレコードだけを返す
+func (r *Resolver) Query(ctx context.Context, name string, qtype layers.DNSType) ([]layers.DNSResourceRecord, error) {
+	answers, err := r.query(ctx, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{canonicalName(name): true}
+	for i := 0; i < maxCNAMEChain; i++ {
+		for _, rr := range answers {
+			if rr.Type == layers.DNSTypeCNAME && names[canonicalName(string(rr.Name))] {
+				names[canonicalName(string(rr.CNAME))] = true
+			}
+		}
+	}
+	var records []layers.DNSResourceRecord
+	for _, rr := range answers {
+		if rr.Type == qtype && names[canonicalName(string(rr.Name))] {
+			records = append(records, rr)
+		}
+	}
+	if len(records) == 0 {
+		return nil, ErrNotFound
+	}
+	return records, nil
+}
+
+// キャッシュを見てから問い合わせ，応答のAnswerセクションを返す
+func (r *Resolver) query(ctx context.Context, name string, qtype layers.DNSType) ([]layers.DNSResourceRecord, error) {
+	name = canonicalName(name)
+	key := cacheKey{name: name, qtype: qtype}
+
+	// TTLはスタックの時計で測る(VirtualClockなら時計を進めるとキャッシュが切れる)
+	now := r.stack.Clock().Now()
+	r.mu.Lock()
+	entry, ok := r.cache[key]
+	if ok && now.Before(entry.expires) {
+		r.mu.Unlock()
+		return entry.answers, nil
+	}
+	delete(r.cache, key)
+	r.mu.Unlock()
+
+	msg, err := r.exchange(ctx, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	switch msg.ResponseCode {
+	case layers.DNSResponseCodeNoErr:
+	case layers.DNSResponseCodeNXDomain:
+		return nil, ErrNotFound
+	default:
+		return nil, fmt.Errorf("DNSサーバがエラーを返しました: %v", msg.ResponseCode)
+	}
+
+	// 最も短いTTLの間だけキャッシュする
+	if len(msg.Answers) > 0 {
+		ttl := msg.Answers[0].TTL
+		for _, rr := range msg.Answers[1:] {
+			if rr.TTL < ttl {
+				ttl = rr.TTL
+			}
+		}
+		if ttl > 0 {
+			r.mu.Lock()
+			r.cache[key] = cacheEntry{
+				answers: msg.Answers,
+				expires: r.stack.Clock().Now().Add(time.Duration(ttl) * time.Second),
+			}
+			r.mu.Unlock()
+		}
+	}
+	return msg.Answers, nil
+}
+
+// キャッシュを捨てる
+func (r *Resolver) FlushCache() {
+	r.mu.Lock()
+	r.cache = make(map[cacheKey]cacheEntry)
+	r.mu.Unlock()
+}
+
+// サーバへ順に問い合わせ，応答がなければAttempts回まで繰り返す
+// サーバの障害(SERVFAILなど)なら次のサーバへ問い合わせる
+func (r *Resolver) exchange(ctx context.Context, name string, qtype layers.DNSType) (*layers.DNS, error) {
+	lastErr := ErrNoAnswer
+	for attempt := 0; attempt < r.Attempts; attempt++ {
+		for _, server := range r.servers {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			msg, err := r.exchangeWith(ctx, server, name, qtype)
+			if err != nil {
+				fmt.Printf("DNS問い合わせに失敗[%v](%s %v): %v\n", server, name, qtype, err)
+				lastErr = err
+				continue
+			}
+			switch msg.ResponseCode {
+			case layers.DNSResponseCodeNoErr, layers.DNSResponseCodeNXDomain:
+				return msg, nil
+			}
+			lastErr = fmt.Errorf("DNSサーバがエラーを返しました: %v", msg.ResponseCode)
+		}
+	}
+	return nil, fmt.Errorf("%sの問い合わせに失敗: %v", name, lastErr)
+}
+
+// 1つのサーバへUDPで問い合わせる．応答が切り詰められていたらTCPで問い合わせ直す
+func (r *Resolver) exchangeWith(ctx context.Context, server *net.UDPAddr, name string, qtype layers.DNSType) (*layers.DNS, error) {
+	id := uint16(rand.Intn(1 << 16))
+	query, err := encodeQuery(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+	msg, err := r.exchangeUDP(ctx, server, query, id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	if msg.TC {
+		fmt.Printf("DNS応答が切り詰められたのでTCPで問い合わせ直します[%v]\n", server)
+		return r.exchangeTCP(ctx, server, query, id, name, qtype)
+	}
+	return msg, nil
+}
+
+func (r *Resolver) exchangeUDP(ctx context.Context, server *net.UDPAddr, query []byte, id uint16, name string, qtype layers.DNSType) (*layers.DNS, error) {
+	conn, err := r.stack.Bind(0)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := wakeOnDone(ctx, conn)
+	defer stop()
+
+	if _, err := conn.WriteTo(query, server); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxUDPMessageLen)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		// 別のサーバからの応答や，IDや質問が一致しない応答は偽装かもしれないので無視する
+		addr, ok := from.(*net.UDPAddr)
+		if !ok || !addr.IP.Equal(server.IP) || addr.Port != server.Port {
+			continue
+		}
+		msg, err := decodeMessage(buf[:n])
+		if err != nil || !isResponseTo(msg, id, name, qtype) {
+			continue
+		}
+		return msg, nil
+	}
+}
+
+func (r *Resolver) exchangeTCP(ctx context.Context, server *net.UDPAddr, query []byte, id uint16, name string, qtype layers.DNSType) (*layers.DNS, error) {
+	conn, err := r.stack.DialContext(ctx, "tcp", server.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(withLengthPrefix(query)); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, int(length[0])<<8|int(length[1]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	msg, err := decodeMessage(buf)
+	if err != nil {
+		return nil, err
+	}
+	if !isResponseTo(msg, id, name, qtype) {
+		return nil, fmt.Errorf("問い合わせと一致しないDNS応答です")
+	}
+	return msg, nil
+}
+
+// ctxが終わったら，ReadFromで待っているソケットを起こす
+func wakeOnDone(ctx context.Context, conn *tcpip.UDPConn) (stop func()) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,277 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"tcpip/tcpip"
+
+	"github.com/google/gopacket/layers"
+)
+
+// テスト用のDNSサーバ．zoneのレコードを返す
+type stubServer struct {
+	zone map[string][]layers.DNSResourceRecord
+
+	mu sync.Mutex
+	// 受け取った問い合わせの数
+	udpQueries, tcpQueries int
+	// 応答せずに捨てるUDPの問い合わせの数
+	drop int
+}
+
+// 問い合わせへの応答を作る．CNAMEがあれば，その先のレコードも入れる
+// UDPで512バイトに収まらなければ，Answerを空にしてTCビットを立てる
+func (s *stubServer) answer(query []byte, udp bool) []byte {
+	q, err := decodeMessage(query)
+	if err != nil || len(q.Questions) != 1 {
+		return nil
+	}
+	resp := &layers.DNS{ID: q.ID, QR: true, RD: q.RD, RA: true, Questions: q.Questions}
+	qtype := q.Questions[0].Type
+	name := canonicalName(string(q.Questions[0].Name))
+	if _, ok := s.zone[name]; !ok {
+		resp.ResponseCode = layers.DNSResponseCodeNXDomain
+	}
+	for i := 0; i < maxCNAMEChain && name != ""; i++ {
+		next := ""
+		for _, rr := range s.zone[name] {
+			switch {
+			case rr.Type == qtype:
+				resp.Answers = append(resp.Answers, rr)
+			case rr.Type == layers.DNSTypeCNAME:
+				resp.Answers = append(resp.Answers, rr)
+				next = canonicalName(string(rr.CNAME))
+			}
+		}
+		name = next
+	}
+	b, err := encodeMessage(resp)
+	if err != nil {
+		return nil
+	}
+	if udp && len(b) > maxUDPMessageLen {
+		resp.Answers = nil
+		resp.TC = true
+		if b, err = encodeMessage(resp); err != nil {
+			return nil
+		}
+	}
+	return b
+}
+
+func (s *stubServer) counts() (udp, tcp int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.udpQueries, s.tcpQueries
+}
+
+// UDPとTCPの53番ポートで応答する
+func (s *stubServer) serve(t *testing.T, stack *tcpip.Stack) {
+	t.Helper()
+	uc, err := stack.Bind(dnsPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := stack.Listen(nil, dnsPort, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		uc.Close()
+		l.Close()
+	})
+
+	go func() {
+		buf := make([]byte, maxUDPMessageLen)
+		for {
+			n, from, err := uc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.udpQueries++
+			drop := s.drop > 0
+			if drop {
+				s.drop--
+			}
+			s.mu.Unlock()
+			if !drop {
+				uc.WriteTo(s.answer(buf[:n], true), from)
+			}
+		}
+	}()
+	go func() {
+		for {
+			c, err := l.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(c, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(c, query); err != nil {
+					return
+				}
+				s.mu.Lock()
+				s.tcpQueries++
+				s.mu.Unlock()
+				c.Write(withLengthPrefix(s.answer(query, false)))
+			}()
+		}
+	}()
+}
+
+// パイプでつないだクライアント(10.0.0.1)とstubServerを動かすサーバ(10.0.0.2)
+// クライアントのスタックはclockを使う
+func setup(t *testing.T, s *stubServer, clock tcpip.Clock) *Resolver {
+	t.Helper()
+	a, b := tcpip.NewPipe(net.HardwareAddr{2, 0, 0, 0, 0, 1}, net.HardwareAddr{2, 0, 0, 0, 0, 2})
+	client, server := tcpip.NewStackWithClock(clock), tcpip.NewStack()
+	client.SetDADConfig(tcpip.DADConfig{})
+	server.SetDADConfig(tcpip.DADConfig{})
+	client.AddNIC("a", a, net.IPNet{IP: net.IPv4(10, 0, 0, 1).To4(), Mask: net.CIDRMask(24, 32)})
+	server.AddNIC("b", b, net.IPNet{IP: net.IPv4(10, 0, 0, 2).To4(), Mask: net.CIDRMask(24, 32)})
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	s.serve(t, server)
+
+	r, err := New(client, "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Timeout = 100 * time.Millisecond
+	return r
+}
+
+func aRecord(name string, ttl uint32, ip net.IP) layers.DNSResourceRecord {
+	return layers.DNSResourceRecord{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: ttl, IP: ip}
+}
+
+func cnameRecord(name, target string) layers.DNSResourceRecord {
+	return layers.DNSResourceRecord{Name: []byte(name), Type: layers.DNSTypeCNAME, Class: layers.DNSClassIN, TTL: 60, CNAME: []byte(target)}
+}
+
+// 応答がなければAttempts回まで問い合わせ直す
+func TestResolverRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		attempts int
+		drop     int
+		ok       bool
+	}{
+		{"2回目で応答", 3, 1, true},
+		{"最後の1回で応答", 3, 2, true},
+		{"応答なし", 2, 2, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &stubServer{zone: map[string][]layers.DNSResourceRecord{
+				"host.example": {aRecord("host.example", 60, net.IPv4(10, 0, 0, 2))},
+			}, drop: tc.drop}
+			r := setup(t, s, tcpip.SystemClock)
+			r.Attempts = tc.attempts
+
+			_, err := r.Query(context.Background(), "host.example", layers.DNSTypeA)
+			if (err == nil) != tc.ok {
+				t.Fatalf("エラー: %v", err)
+			}
+			want := tc.drop + 1
+			if !tc.ok {
+				want = tc.attempts
+			}
+			if udp, _ := s.counts(); udp != want {
+				t.Fatalf("問い合わせの数: %d, 期待: %d", udp, want)
+			}
+		})
+	}
+}
+
+// UDPの応答が切り詰められていたらTCPで問い合わせ直す
+func TestResolverTCPFallback(t *testing.T) {
+	var records []layers.DNSResourceRecord
+	for i := 0; i < 60; i++ {
+		records = append(records, aRecord("big.example", 60, net.IPv4(10, 1, 0, byte(i))))
+	}
+	s := &stubServer{zone: map[string][]layers.DNSResourceRecord{"big.example": records}}
+	r := setup(t, s, tcpip.SystemClock)
+
+	answers, err := r.Query(context.Background(), "big.example", layers.DNSTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answers) != len(records) {
+		t.Fatalf("レコードの数: %d", len(answers))
+	}
+	if udp, tcp := s.counts(); udp != 1 || tcp != 1 {
+		t.Fatalf("UDPの問い合わせ: %d, TCPの問い合わせ: %d", udp, tcp)
+	}
+}
+
+// CNAMEをたどった先のレコードを返す
+func TestResolverCNAME(t *testing.T) {
+	s := &stubServer{zone: map[string][]layers.DNSResourceRecord{
+		"www.example":   {cnameRecord("www.example", "alias.example")},
+		"alias.example": {cnameRecord("alias.example", "host.example")},
+		"host.example":  {aRecord("host.example", 60, net.IPv4(10, 0, 0, 2))},
+		// たどれない名前のレコードは返さない
+		"other.example": {aRecord("other.example", 60, net.IPv4(10, 0, 0, 3))},
+	}}
+	r := setup(t, s, tcpip.SystemClock)
+	ctx := context.Background()
+
+	name, err := r.LookupCNAME(ctx, "WWW.example.")
+	if err != nil || name != "host.example." {
+		t.Fatalf("正規名: %q, %v", name, err)
+	}
+	answers, err := r.Query(ctx, "www.example", layers.DNSTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answers) != 1 || !answers[0].IP.Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Fatalf("レコード: %v", answers)
+	}
+	if _, err := r.Query(ctx, "nope.example", layers.DNSTypeA); err != ErrNotFound {
+		t.Fatalf("エラー: %v", err)
+	}
+}
+
+// 応答はスタックの時計で最も短いTTLの間だけキャッシュする
+func TestResolverCacheTTL(t *testing.T) {
+	s := &stubServer{zone: map[string][]layers.DNSResourceRecord{
+		"www.example":  {cnameRecord("www.example", "host.example")},
+		"host.example": {aRecord("host.example", 5, net.IPv4(10, 0, 0, 2))},
+	}}
+	clock := tcpip.NewVirtualClock(time.Unix(1000, 0))
+	r := setup(t, s, clock)
+	ctx := context.Background()
+
+	for _, step := range []struct {
+		advance time.Duration
+		queries int
+	}{
+		{0, 1},
+		{4 * time.Second, 1},
+		// CNAMEのTTLは60秒だが，Aの5秒で切れる
+		{time.Second, 2},
+		{0, 2},
+	} {
+		clock.Advance(step.advance)
+		if _, err := r.Query(ctx, "www.example", layers.DNSTypeA); err != nil {
+			t.Fatal(err)
+		}
+		if udp, _ := s.counts(); udp != step.queries {
+			t.Fatalf("%v後の問い合わせの数: %d, 期待: %d", clock.Now().Sub(time.Unix(1000, 0)), udp, step.queries)
+		}
+	}
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"fmt"
 	"log"
+	"tcpip/resolver"
 	"tcpip/tcpip"
 	"time"
 )
 
 func main() {
-	dest := "192.168.1.1"
+	// 宛先はIPアドレスでもホスト名でもよい(ホスト名はDNSサーバに問い合わせる)
+	dest := "example.com"
+	dnsServer := "192.168.1.1"
 	var port uint16 = 49152
 
 	// TCP接続を開始するためのSYNパケットを作成
@@ -20,23 +23,47 @@ func main() {
 
 	// 送信元IPアドレスとポート番号を設定
 	ifaceName := "en0"
-	sendfd := tcpip.NewTCP(ifaceName, port)
+	stack, err := tcpip.OpenStack(ifaceName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer stack.Close()
+
+	// 送受信したフレームを記録する(Wiresharkで3Way Handshakeを確認できる)
+	capture, err := tcpip.CreateCapture("tcp_conn.pcapng")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer capture.Close()
+	stack.SetCapture(capture)
+
+	// ホスト名を解決するリゾルバを設定
+	r, err := resolver.New(stack, dnsServer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stack.SetResolver(r)
+
+	sendfd := tcpip.NewTCP(stack, port)
 	defer sendfd.Close()
 
 	// 3Way HandshakeでTCP接続を確立
-	ack, err := sendfd.StartTCPConnection(syn)
+	_, err = sendfd.StartTCPConnection(syn)
 	if err != nil {
 		log.Fatal(err)
 	}
 	fmt.Printf("TCP Connection is success!!\n\n")
+
+	// 確立した接続でデータを送信
+	if _, err := sendfd.Write([]byte("Hello TCP!")); err != nil {
+		log.Fatal(err)
+	}
 	time.Sleep(10 * time.Millisecond)
 
 	fin := tcpip.TCPIP{
-		DestIP:    dest,
-		DestPort:  port,
-		TcpFlag:   "FINACK",
-		SeqNumber: ack.SeqNumber,
-		AckNumber: ack.AckNumber,
+		DestIP:   dest,
+		DestPort: port,
+		TcpFlag:  "FINACK",
 	}
 	_, err = sendfd.StartTCPConnection(fin)
 	if err != nil {
@@ -0,0 +1,67 @@
+package tcpip
+
+import (
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// AF_PACKETの受信リング(TPACKET_V3)の設定
+// リングはブロックに分かれていて，カーネルはブロックが一杯になるかタイムアウトしたらまとめて渡す
+type AFPacketConfig struct {
+	// 1ブロックの大きさ(ページサイズの倍数)
+	BlockSize int
+	// ブロックの数
+	BlockCount int
+	// 1フレームの最大長(リングのフレーム数の計算に使う)
+	FrameSize int
+	// ブロックが一杯にならなくてもユーザに渡すまでの時間(ミリ秒単位に切り上げる)
+	// 長くするとまとめて読めるが，そのぶん1パケットの遅延が増える
+	BlockTimeout time.Duration
+	// 受信するフレームを絞り込むBPFプログラム(nilならすべて受信する)
+	Filter []BPFInstruction
+}
+
+// 既定の設定(4MBのリング)
+var DefaultAFPacketConfig = AFPacketConfig{
+	BlockSize:    1 << 17,
+	BlockCount:   32,
+	FrameSize:    1 << 11,
+	BlockTimeout: time.Millisecond,
+}
+
+// classic BPFの1命令(linux/filter.hのsock_filter)
+type BPFInstruction struct {
+	Code uint16
+	Jt   uint8
+	Jf   uint8
+	K    uint32
+}
+
+// BPFの命令コード(linux/bpf_common.h)
+const (
+	bpfLdHAbs  = 0x28 // BPF_LD | BPF_H | BPF_ABS
+	bpfJeqK    = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfRetK    = 0x06 // BPF_RET | BPF_K
+	bpfMaxSnap = 0x40000
+)
+
+// 指定したEtherTypeのフレームだけを受け取るBPFプログラム
+// スタックが使うのはARP，IPv4，IPv6だけなので，それ以外をカーネルの中で捨てられる
+func BPFEtherTypes(types ...layers.EthernetType) []BPFInstruction {
+	n := len(types)
+	prog := []BPFInstruction{{Code: bpfLdHAbs, K: 12}}
+	for i, t := range types {
+		// 一致したら最後の「受け取る」命令へ飛ぶ
+		prog = append(prog, BPFInstruction{Code: bpfJeqK, Jt: uint8(n - i), K: uint32(t)})
+	}
+	return append(prog,
+		BPFInstruction{Code: bpfRetK, K: 0},
+		BPFInstruction{Code: bpfRetK, K: bpfMaxSnap},
+	)
+}
+
+// スタックが処理するフレーム(ARP，IPv4，IPv6)だけを受け取るBPFプログラム
+func StackBPFFilter() []BPFInstruction {
+	return BPFEtherTypes(layers.EthernetTypeARP, layers.EthernetTypeIPv4, layers.EthernetTypeIPv6)
+}
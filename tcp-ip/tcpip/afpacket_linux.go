@@ -0,0 +1,353 @@
+package tcpip
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// linux/if_packet.hとlinux/if_ether.hの定数
+const (
+	ethPAll       = 0x0003
+	packetRxRing  = 5
+	packetVersion = 10
+	tpacketV3     = 2
+	// ブロックをどちらが使っているか
+	tpStatusKernel = 0
+	tpStatusUser   = 1
+	// 1回のsendmmsgで送るフレーム数の上限(UIO_MAXIOV)
+	maxSendBatch = 1024
+)
+
+// tpacket_block_descとtpacket3_hdrのフィールドの位置
+const (
+	blockStatusOff    = 8
+	blockNumPktsOff   = 12
+	blockFirstPktOff  = 16
+	pktNextOff        = 0
+	pktSnaplenOff     = 12
+	pktMacOff         = 24
+	pktSockaddrLLOff  = 48
+	sockaddrLLTypeOff = 10
+)
+
+// tpacket_req3構造体
+type tpacketReq3 struct {
+	blockSize      uint32
+	blockNr        uint32
+	frameSize      uint32
+	frameNr        uint32
+	retireBlkTov   uint32
+	sizeofPriv     uint32
+	featureReqWord uint32
+}
+
+// mmsghdr構造体
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// pollfd構造体
+type pollFd struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+// AF_PACKETのrawソケットで実際のNICを読み書きするデバイス
+// 受信はカーネルと共有するメモリ上のリング(TPACKET_V3)から読み，送信はsendmmsgでまとめて送る
+// libpcapもcgoも使わないので静的にビルドできる(root権限かCAP_NET_RAWが必要)
+type AFPacketDevice struct {
+	iface  *net.Interface
+	config AFPacketConfig
+
+	// fdとringを閉じるときは書き込みロックを取る
+	mu     sync.RWMutex
+	fd     int
+	ring   []byte
+	closed chan struct{}
+	// Closeで読み込み待ちのpollを起こすためのパイプ
+	wakeR, wakeW int
+	closeOnce    sync.Once
+
+	// ReadFrameの状態
+	rmu     sync.Mutex
+	block   int
+	pending [][]byte
+}
+
+// インタフェースのAF_PACKETソケットを開き，受信リングを用意する
+func OpenAFPacket(ifaceName string, config AFPacketConfig) (*AFPacketDevice, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("インタフェースの取得に失敗: %v", err)
+	}
+	page := os.Getpagesize()
+	if config.BlockSize <= 0 || config.BlockSize%page != 0 || config.BlockCount <= 0 ||
+		config.FrameSize <= 0 || config.FrameSize%16 != 0 || config.FrameSize > config.BlockSize {
+		return nil, fmt.Errorf("無効なリングの設定: ブロック%dバイト×%d，フレーム%dバイト", config.BlockSize, config.BlockCount, config.FrameSize)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, int(htons(ethPAll)))
+	if err != nil {
+		return nil, fmt.Errorf("AF_PACKETソケットの作成に失敗: %v", err)
+	}
+	d := &AFPacketDevice{iface: iface, config: config, fd: fd, closed: make(chan struct{}), wakeR: -1, wakeW: -1}
+	if err := d.setup(); err != nil {
+		d.release()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *AFPacketDevice) setup() error {
+	// バインドする前にフィルタを付け，条件に合わないフレームがリングに入らないようにする
+	if d.config.Filter != nil {
+		if err := d.SetBPF(d.config.Filter); err != nil {
+			return err
+		}
+	}
+	if err := syscall.SetsockoptInt(d.fd, syscall.SOL_PACKET, packetVersion, tpacketV3); err != nil {
+		return fmt.Errorf("TPACKET_V3の設定に失敗: %v", err)
+	}
+
+	timeout := (d.config.BlockTimeout + time.Millisecond - 1) / time.Millisecond
+	if timeout <= 0 {
+		timeout = 1
+	}
+	req := tpacketReq3{
+		blockSize:    uint32(d.config.BlockSize),
+		blockNr:      uint32(d.config.BlockCount),
+		frameSize:    uint32(d.config.FrameSize),
+		frameNr:      uint32(d.config.BlockSize / d.config.FrameSize * d.config.BlockCount),
+		retireBlkTov: uint32(timeout),
+	}
+	// 構造体をバイト列のまま渡す(syscallパッケージにはポインタを渡すsetsockoptがない)
+	opt := unsafe.Slice((*byte)(unsafe.Pointer(&req)), unsafe.Sizeof(req))
+	if err := syscall.SetsockoptString(d.fd, syscall.SOL_PACKET, packetRxRing, string(opt)); err != nil {
+		return fmt.Errorf("受信リングの作成に失敗: %v", err)
+	}
+
+	ring, err := syscall.Mmap(d.fd, 0, d.config.BlockSize*d.config.BlockCount, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("受信リングのマップに失敗: %v", err)
+	}
+	d.ring = ring
+
+	addr := &syscall.SockaddrLinklayer{Protocol: htons(ethPAll), Ifindex: d.iface.Index}
+	if err := syscall.Bind(d.fd, addr); err != nil {
+		return fmt.Errorf("インタフェース%sへのバインドに失敗: %v", d.iface.Name, err)
+	}
+
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return fmt.Errorf("パイプの作成に失敗: %v", err)
+	}
+	d.wakeR, d.wakeW = p[0], p[1]
+	return nil
+}
+
+// BPFプログラムを付け替える．カーネルの中で条件に合わないフレームを捨てる
+func (d *AFPacketDevice) SetBPF(prog []BPFInstruction) error {
+	filter := make([]syscall.SockFilter, len(prog))
+	for i, ins := range prog {
+		filter[i] = syscall.SockFilter{Code: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if err := syscall.AttachLsf(d.fd, filter); err != nil {
+		return fmt.Errorf("BPFフィルタの設定に失敗: %v", err)
+	}
+	return nil
+}
+
+// リングから次のフレームを読む．ブロックの中のフレームは一度に取り出しておく
+func (d *AFPacketDevice) ReadFrame() ([]byte, error) {
+	d.rmu.Lock()
+	defer d.rmu.Unlock()
+	for len(d.pending) == 0 {
+		select {
+		case <-d.closed:
+			return nil, ErrLinkClosed
+		default:
+		}
+		if !d.readBlock() {
+			if err := d.wait(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	frame := d.pending[0]
+	d.pending[0] = nil
+	d.pending = d.pending[1:]
+	return frame, nil
+}
+
+// ユーザに渡されたブロックがあれば中のフレームをコピーしてカーネルに返す
+func (d *AFPacketDevice) readBlock() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.ring == nil {
+		return false
+	}
+	base := d.block * d.config.BlockSize
+	blk := d.ring[base : base+d.config.BlockSize]
+	status := (*uint32)(unsafe.Pointer(&blk[blockStatusOff]))
+	if atomic.LoadUint32(status)&tpStatusUser == 0 {
+		return false
+	}
+
+	num := int(nativeUint32(blk[blockNumPktsOff:]))
+	off := int(nativeUint32(blk[blockFirstPktOff:]))
+	for i := 0; i < num; i++ {
+		hdr := blk[off:]
+		// 自分が送ったフレームは受け取らない
+		if hdr[pktSockaddrLLOff+sockaddrLLTypeOff] != syscall.PACKET_OUTGOING {
+			mac := int(nativeUint16(hdr[pktMacOff:]))
+			snaplen := int(nativeUint32(hdr[pktSnaplenOff:]))
+			d.pending = append(d.pending, append([]byte(nil), hdr[mac:mac+snaplen]...))
+		}
+		off += int(nativeUint32(hdr[pktNextOff:]))
+	}
+	atomic.StoreUint32(status, tpStatusKernel)
+	d.block = (d.block + 1) % d.config.BlockCount
+	return true
+}
+
+// 次のブロックが渡されるか，Closeされるまで待つ
+func (d *AFPacketDevice) wait() error {
+	d.mu.RLock()
+	if d.isClosed() {
+		d.mu.RUnlock()
+		return ErrLinkClosed
+	}
+	fds := []pollFd{
+		{fd: int32(d.fd), events: 0x1},    // POLLIN
+		{fd: int32(d.wakeR), events: 0x1}, // POLLIN
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&fds[0])), uintptr(len(fds)), 0, 0, 0, 0)
+	d.mu.RUnlock()
+	if errno != 0 && errno != syscall.EINTR {
+		return fmt.Errorf("受信待ちに失敗: %v", errno)
+	}
+	return nil
+}
+
+func (d *AFPacketDevice) WriteFrame(frame []byte) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.isClosed() {
+		return ErrLinkClosed
+	}
+	if _, err := syscall.Write(d.fd, frame); err != nil {
+		return err
+	}
+	return nil
+}
+
+// sendmmsgで複数のフレームを1回のシステムコールで送る
+func (d *AFPacketDevice) WriteFrames(frames [][]byte) (int, error) {
+	if len(frames) > maxSendBatch {
+		frames = frames[:maxSendBatch]
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.isClosed() {
+		return 0, ErrLinkClosed
+	}
+	if sysSendmmsg == 0 {
+		// sendmmsgの番号がわからないアーキテクチャでは1つずつ送る
+		for i, frame := range frames {
+			if _, err := syscall.Write(d.fd, frame); err != nil {
+				return i, err
+			}
+		}
+		return len(frames), nil
+	}
+
+	iovs := make([]syscall.Iovec, len(frames))
+	msgs := make([]mmsghdr, len(frames))
+	for i, frame := range frames {
+		if len(frame) == 0 {
+			return 0, fmt.Errorf("空のフレームは送れません")
+		}
+		iovs[i].Base = &frame[0]
+		iovs[i].SetLen(len(frame))
+		msgs[i].hdr.Iov = &iovs[i]
+		msgs[i].hdr.Iovlen = 1
+	}
+	n, _, errno := syscall.Syscall6(sysSendmmsg, uintptr(d.fd), uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)), 0, 0, 0)
+	runtime.KeepAlive(frames)
+	runtime.KeepAlive(iovs)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+func (d *AFPacketDevice) MTU() int {
+	return d.iface.MTU
+}
+
+func (d *AFPacketDevice) HardwareAddr() net.HardwareAddr {
+	return d.iface.HardwareAddr
+}
+
+func (d *AFPacketDevice) isClosed() bool {
+	select {
+	case <-d.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// ソケットを閉じ，読み込み待ちのReadFrameを起こす
+func (d *AFPacketDevice) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.closed)
+		if d.wakeW >= 0 {
+			syscall.Write(d.wakeW, []byte{0})
+		}
+		d.release()
+	})
+	return nil
+}
+
+// リングとファイルディスクリプタを解放する
+func (d *AFPacketDevice) release() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ring != nil {
+		syscall.Munmap(d.ring)
+		d.ring = nil
+	}
+	for _, fd := range []int{d.fd, d.wakeR, d.wakeW} {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}
+	d.fd, d.wakeR, d.wakeW = -1, -1, -1
+}
+
+// ネットワークバイトオーダの16ビット値を，メモリ上でそのまま並ぶ値に変換する
+func htons(v uint16) uint16 {
+	b := [2]byte{byte(v >> 8), byte(v)}
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
+
+// リングのヘッダはホストのバイトオーダ
+func nativeUint32(b []byte) uint32 {
+	return *(*uint32)(unsafe.Pointer(&b[0]))
+}
+
+func nativeUint16(b []byte) uint16 {
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
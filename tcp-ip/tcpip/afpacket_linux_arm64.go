@@ -0,0 +1,4 @@
+package tcpip
+
+// sendmmsgのシステムコール番号(syscallパッケージにはない)
+const sysSendmmsg = 269
@@ -0,0 +1,6 @@
+//go:build linux && !amd64 && !arm64
+
+package tcpip
+
+// sendmmsgのシステムコール番号がわからないので，WriteFramesは1つずつ送る
+const sysSendmmsg = 0
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package tcpip
+
+import (
+	"fmt"
+	"net"
+)
+
+// AF_PACKETのデバイス(Linux以外では未対応なのでpcapかパイプを使う)
+type AFPacketDevice struct{}
+
+func OpenAFPacket(ifaceName string, config AFPacketConfig) (*AFPacketDevice, error) {
+	return nil, fmt.Errorf("AF_PACKETはLinuxのみ対応しています")
+}
+
+func (d *AFPacketDevice) SetBPF(prog []BPFInstruction) error       { return ErrLinkClosed }
+func (d *AFPacketDevice) ReadFrame() ([]byte, error)               { return nil, ErrLinkClosed }
+func (d *AFPacketDevice) WriteFrame(frame []byte) error            { return ErrLinkClosed }
+func (d *AFPacketDevice) WriteFrames(frames [][]byte) (int, error) { return 0, ErrLinkClosed }
+func (d *AFPacketDevice) MTU() int                                 { return 0 }
+func (d *AFPacketDevice) HardwareAddr() net.HardwareAddr           { return nil }
+func (d *AFPacketDevice) Close() error                             { return nil }
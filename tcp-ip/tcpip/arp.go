@@ -3,11 +3,8 @@ package tcpip
 import (
 	"fmt"
 	"net"
-	"time"
 
-	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 )
 
 // 新しいARPリクエストパケットを作成
@@ -25,46 +22,20 @@ func NewArpRequest(srcIP net.IP, srcMAC net.HardwareAddr, targetIP net.IP) layer
 	}
 }
 
-// 指定されたインタフェース名と宛先IPアドレスに対してARPリクエストを送信し，レスポンスを受信する関数
-func Send(ifaceName string, targetIP net.IP) (*layers.ARP, error) {
-	// パケットを送るために使用するインタフェース情報(例:有線LAN, 無線LAN)を取得
-	// これは送信元が持つ情報だから送信元IPアドレスが登録されている
-	iface, err := net.InterfaceByName(ifaceName)
-	if err != nil {
-		return nil, fmt.Errorf("インタフェースの取得に失敗: %v", err)
-	}
-
-	// インタフェースに割り当てられているIPアドレス一覧を取得
-	addrs, err := iface.Addrs()
-	if err != nil {
-		return nil, fmt.Errorf("IPアドレスの取得に失敗: %v", err)
-	}
-
-	// IPv4アドレスを選択
-	var srcIP net.IP
-	for _, addr := range addrs {
-		if ipnet, ok := addr.(*net.IPNet); ok {
-			if ipnet.IP.To4() != nil {
-				srcIP = ipnet.IP.To4()
-				break
-			}
-		}
-	}
-	if srcIP == nil {
-		return nil, fmt.Errorf("有効なIPv4アドレスが見つかりません")
-	}
+// 新しいARPリプライパケットを作成
+func NewArpReply(srcIP net.IP, srcMAC net.HardwareAddr, dstIP net.IP, dstMAC net.HardwareAddr) layers.ARP {
+	arp := NewArpRequest(srcIP, srcMAC, dstIP)
+	arp.Operation = layers.ARPReply
+	arp.DstHwAddress = []byte(dstMAC)
+	return arp
+}
 
+// ARPリクエストをブロードキャストする(リプライは近隣テーブルが受け取る)
+func (s *Stack) sendArpRequest(nic *NIC, srcIP net.IP, targetIP net.IP) error {
 	// 送信元MACアドレスと宛先MACアドレス(まだわからないため全員へブロードキャスト)を設定
-	srcMAC := iface.HardwareAddr
+	srcMAC := nic.HardwareAddr()
 	dstMAC := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
 
-	// パケットキャプチャ用のハンドルを開く(パケットを送受信するための窓口)
-	handle, err := pcap.OpenLive(ifaceName, 65536, true, pcap.BlockForever)
-	if err != nil {
-		return nil, fmt.Errorf("pcapハンドルのオープンに失敗: %v", err)
-	}
-	defer handle.Close()
-
 	// 実際に送信するパケットの中身を作成
 	// ARP型のEthernetヘッダを作成
 	eth := NewEthernet(srcMAC, dstMAC, "ARP")
@@ -72,42 +43,78 @@ func Send(ifaceName string, targetIP net.IP) (*layers.ARP, error) {
 	// ARPリクエストパケットを作成
 	arp := NewArpRequest(srcIP, srcMAC, targetIP)
 
-	// パケットをシリアライズ(バイト列に変換)
-	buf := gopacket.NewSerializeBuffer()
-	opts := gopacket.SerializeOptions{
-		FixLengths:       true,
-		ComputeChecksums: true,
+	// パケットをシリアライズ(バイト列に変換)してARPリクエストパケットを送信
+	if err := nic.writeLayers(&eth, &arp); err != nil {
+		return err
 	}
-	if err := gopacket.SerializeLayers(buf, opts, &eth, &arp); err != nil {
-		return nil, fmt.Errorf("パケットのシリアライズに失敗: %v", err)
+
+	fmt.Printf("ARPリクエストを[%v]へ送信\n", targetIP)
+	return nil
+}
+
+// ARPリクエストに対してARPリプライを返す
+func (s *Stack) sendArpReply(nic *NIC, srcIP net.IP, dstIP net.IP, dstMAC net.HardwareAddr) error {
+	srcMAC := nic.HardwareAddr()
+
+	// 問い合わせてきた相手にだけユニキャストで返す
+	eth := NewEthernet(srcMAC, dstMAC, "ARP")
+	arp := NewArpReply(srcIP, srcMAC, dstIP, dstMAC)
+
+	if err := nic.writeLayers(&eth, &arp); err != nil {
+		return err
 	}
 
-	// ARPリクエストパケットを送信
-	if err := handle.WritePacketData(buf.Bytes()); err != nil {
-		return nil, fmt.Errorf("パケットの送信に失敗: %v", err)
+	fmt.Printf("ARPリプライを[%v]へ送信: %v is-at %v\n", dstIP, srcIP, srcMAC)
+	return nil
+}
+
+// Gratuitous ARP(送信元IP=宛先IPのリクエスト)をブロードキャストし，自分のアドレスを周知する
+func (s *Stack) sendGratuitousArp(nic *NIC, ip net.IP) error {
+	srcMAC := nic.HardwareAddr()
+	dstMAC := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+	eth := NewEthernet(srcMAC, dstMAC, "ARP")
+	arp := NewArpRequest(ip, srcMAC, ip)
+
+	return nic.writeLayers(&eth, &arp)
+}
+
+// 受信したARPパケットのうち自分のアドレスに関わるものを処理する
+// 自分宛てのリクエストには応答し，他人が自分のアドレスを名乗っていれば衝突として防御する
+func (n *NIC) handleARP(arp *layers.ARP) {
+	senderIP := net.IP(arp.SourceProtAddress)
+	senderMAC := net.HardwareAddr(arp.SourceHwAddress)
+	targetIP := net.IP(arp.DstProtAddress)
+	ours := senderMAC.String() == n.HardwareAddr().String()
+
+	// 他のホストが自分のアドレスを使っている
+	if !ours && n.hasAddress(senderIP) {
+		n.defendAddress(senderIP, senderMAC)
 	}
 
-	fmt.Printf("ARPリクエストを[%v]へ送信\n", targetIP)
+	if arp.Operation != layers.ARPRequest || ours || !n.hasAddress(targetIP) {
+		return
+	}
+	// Gratuitous ARPには応答しない
+	if senderIP.Equal(targetIP) {
+		return
+	}
+	// プローブ(送信元IPが0.0.0.0)にも通常どおり応答すれば，相手は衝突に気付ける
+	if err := n.stack.sendArpReply(n, targetIP, senderIP, senderMAC); err != nil {
+		fmt.Printf("ARPリプライの送信に失敗: %v\n", err)
+	}
+}
 
-	// ARPリプライを待ち受ける(3秒間)
-	src := gopacket.NewPacketSource(handle, handle.LinkType())
-	timeout := time.After(3 * time.Second)
-
-	for {
-		select {
-		case packet := <-src.Packets():
-			// ARPレイヤを抽出
-			if arpLayer := packet.Layer(layers.LayerTypeARP); arpLayer != nil {
-				arpResponse := arpLayer.(*layers.ARP)
-				// 宛先IPからのARPリプライか判定
-				if net.IP(arpResponse.SourceProtAddress).Equal(targetIP) && arpResponse.Operation == layers.ARPReply {
-					return arpResponse, nil
-				}
-			}
-		case <-timeout:
-			return nil, fmt.Errorf("タイムアウト: ARPリプライを受信できませんでした")
-		}
+// 宛先IPアドレスへ送るときに使うMACアドレスを解決する
+// 別のサブネットなら経路のゲートウェイのMACアドレスになる
+// 近隣テーブルにあればそれを使い，なければARPリクエストを送ってリプライを待つ
+func (s *Stack) Resolve(targetIP net.IP) (net.HardwareAddr, error) {
+	// 宛先へ送るためのインタフェース，送信元IPアドレス，次の転送先を選ぶ
+	nic, srcIP, nextHop, err := s.route(targetIP)
+	if err != nil {
+		return nil, err
 	}
+	return s.neighbors.resolve(nic, srcIP, nextHop)
 }
 
 // ARPリクエストを実行する関数
@@ -118,18 +125,21 @@ func ArpRequest(ifaceName string, targetIPStr string) error {
 		return fmt.Errorf("無効なIPアドレス: %s", targetIPStr)
 	}
 
+	// インタフェースを開いてスタックを作成
+	s, err := OpenStack(ifaceName)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
 	// ARPリクエストを送信
-	arpReply, err := Send(ifaceName, targetIP)
+	mac, err := s.Resolve(targetIP)
 	if err != nil {
 		return fmt.Errorf("ARPリクエストの送信に失敗: %v", err)
 	}
 
 	// 結果を表示
-	fmt.Printf(
-		"ARPの結果: IP [%v]: MAC [%v]\n",
-		net.IP(arpReply.SourceProtAddress),
-		net.HardwareAddr(arpReply.SourceHwAddress),
-	)
+	fmt.Printf("ARPの結果: IP [%v]: MAC [%v]\n", targetIP, mac)
 
 	return nil
 }
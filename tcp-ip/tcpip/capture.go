@@ -0,0 +1,565 @@
+package tcpip
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// キャプチャファイルの形式
+type CaptureFormat int
+
+const (
+	// pcapng．インタフェース名とフレームの向きも記録する
+	CaptureFormatPcapNG CaptureFormat = iota
+	// 従来のpcap(ナノ秒精度)．インタフェースと向きは記録されない
+	CaptureFormatPcap
+)
+
+// フレームの向き
+type CaptureDirection int
+
+const (
+	// 向きがわからない(pcapや向きのないpcapngから読んだ)
+	CaptureUnknown CaptureDirection = iota
+	// スタックが受信した
+	CaptureInbound
+	// スタックが送信した
+	CaptureOutbound
+)
+
+func (d CaptureDirection) String() string {
+	switch d {
+	case CaptureInbound:
+		return "受信"
+	case CaptureOutbound:
+		return "送信"
+	default:
+		return "不明"
+	}
+}
+
+// キャプチャした1フレーム
+type CapturedFrame struct {
+	Time time.Time
+	// インタフェース名(pcapでは空)
+	Interface string
+	Direction CaptureDirection
+	LinkType  layers.LinkType
+	Data      []byte
+}
+
+// pcapngのブロックとオプション(draft-ietf-opsawg-pcapng)
+const (
+	pcapngSectionHeader  = 0x0A0D0D0A
+	pcapngInterface      = 0x00000001
+	pcapngSimplePacket   = 0x00000003
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic = 0x1A2B3C4D
+
+	pcapngOptEnd       = 0
+	pcapngOptIfName    = 2
+	pcapngOptIfTsresol = 9
+	pcapngOptEPBFlags  = 2
+
+	pcapngFlagInbound  = 1
+	pcapngFlagOutbound = 2
+
+	// if_tsresolがなければマイクロ秒，書くときはナノ秒にする
+	pcapngDefaultTsresol    = 6
+	pcapngTsresolNanosecond = 9
+
+	pcapngBlockHeaderLen  = 8
+	pcapngBlockTrailerLen = 4
+	// これより大きいブロックは壊れているとみなす
+	pcapngMaxBlockLen = 16 << 20
+)
+
+// pcapのマジックナンバー(タイムスタンプの小数部の単位で変わる)とスナップ長
+const (
+	pcapMagicMicroseconds = 0xA1B2C3D4
+	pcapMagicNanoseconds  = 0xA1B23C4D
+	pcapSnapLen           = 262144
+)
+
+// 送受信したフレームをpcapngかpcapで書き出す
+// Stack.SetCaptureで設定すると，スタックが送受信したすべてのフレームを記録する
+type CaptureWriter struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	closer io.Closer
+	format CaptureFormat
+	// pcapngのインタフェース名と番号
+	ifaces map[string]uint32
+	// 最初に起きた書き込みのエラー
+	err error
+}
+
+// wへ書き出すCaptureWriterを作成し，ファイルのヘッダを書く
+func NewCaptureWriter(w io.Writer, format CaptureFormat) (*CaptureWriter, error) {
+	c := &CaptureWriter{
+		w:      bufio.NewWriter(w),
+		format: format,
+		ifaces: make(map[string]uint32),
+	}
+	switch format {
+	case CaptureFormatPcapNG:
+		c.writeSectionHeader()
+	case CaptureFormatPcap:
+		hdr := make([]byte, 24)
+		binary.LittleEndian.PutUint32(hdr[0:], pcapMagicNanoseconds)
+		binary.LittleEndian.PutUint16(hdr[4:], 2)
+		binary.LittleEndian.PutUint16(hdr[6:], 4)
+		binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+		binary.LittleEndian.PutUint32(hdr[20:], uint32(layers.LinkTypeEthernet))
+		c.write(hdr)
+	default:
+		return nil, fmt.Errorf("未対応のキャプチャ形式: %d", format)
+	}
+	if c.err != nil {
+		return nil, fmt.Errorf("キャプチャファイルのヘッダの書き込みに失敗: %v", c.err)
+	}
+	return c, nil
+}
+
+// ファイルを作ってCaptureWriterを作成する．拡張子が.pcapならpcap，それ以外はpcapngで書く
+func CreateCapture(path string) (*CaptureWriter, error) {
+	format := CaptureFormatPcapNG
+	if strings.EqualFold(filepath.Ext(path), ".pcap") {
+		format = CaptureFormatPcap
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("キャプチャファイルの作成に失敗: %v", err)
+	}
+	c, err := NewCaptureWriter(f, format)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	c.closer = f
+	return c, nil
+}
+
+// フレームを1つ書く．pcapngではインタフェースが初めて出てきたときにその情報も書く
+func (c *CaptureWriter) WriteFrame(f CapturedFrame) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	ts := f.Time.UnixNano()
+	if c.format == CaptureFormatPcap {
+		hdr := make([]byte, 16)
+		binary.LittleEndian.PutUint32(hdr[0:], uint32(ts/int64(time.Second)))
+		binary.LittleEndian.PutUint32(hdr[4:], uint32(ts%int64(time.Second)))
+		binary.LittleEndian.PutUint32(hdr[8:], uint32(len(f.Data)))
+		binary.LittleEndian.PutUint32(hdr[12:], uint32(len(f.Data)))
+		c.write(hdr)
+		c.write(f.Data)
+		return c.err
+	}
+
+	id, ok := c.ifaces[f.Interface]
+	if !ok {
+		id = uint32(len(c.ifaces))
+		c.ifaces[f.Interface] = id
+		c.writeInterface(f.Interface)
+	}
+	body := make([]byte, 20, 20+len(f.Data)+3+12)
+	binary.LittleEndian.PutUint32(body[0:], id)
+	binary.LittleEndian.PutUint32(body[4:], uint32(uint64(ts)>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(f.Data)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(f.Data)))
+	body = append(body, f.Data...)
+	body = pad4(body)
+	var flags uint32
+	switch f.Direction {
+	case CaptureInbound:
+		flags = pcapngFlagInbound
+	case CaptureOutbound:
+		flags = pcapngFlagOutbound
+	}
+	if flags != 0 {
+		opt := make([]byte, 4)
+		binary.LittleEndian.PutUint32(opt, flags)
+		body = appendOption(body, pcapngOptEPBFlags, opt)
+		body = appendOption(body, pcapngOptEnd, nil)
+	}
+	c.writeBlock(pcapngEnhancedPacket, body)
+	return c.err
+}
+
+// バッファに溜まっている分を書き出す
+func (c *CaptureWriter) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = c.w.Flush()
+	}
+	return c.err
+}
+
+// 書き出してファイルを閉じる(CreateCaptureで作った場合)
+func (c *CaptureWriter) Close() error {
+	err := c.Flush()
+	if c.closer != nil {
+		if cerr := c.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (c *CaptureWriter) write(b []byte) {
+	if c.err == nil {
+		_, c.err = c.w.Write(b)
+	}
+}
+
+// ブロックの種類と長さで本体を挟んで書く
+func (c *CaptureWriter) writeBlock(typ uint32, body []byte) {
+	n := uint32(pcapngBlockHeaderLen + len(body) + pcapngBlockTrailerLen)
+	hdr := make([]byte, 8)
+	binary.LittleEndian.PutUint32(hdr[0:], typ)
+	binary.LittleEndian.PutUint32(hdr[4:], n)
+	c.write(hdr)
+	c.write(body)
+	c.write(hdr[4:])
+}
+
+func (c *CaptureWriter) writeSectionHeader() {
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(body[4:], 1)
+	binary.LittleEndian.PutUint16(body[6:], 0)
+	// セクションの長さは書かない(-1)
+	binary.LittleEndian.PutUint64(body[8:], ^uint64(0))
+	c.writeBlock(pcapngSectionHeader, body)
+}
+
+// タイムスタンプはナノ秒単位にする
+func (c *CaptureWriter) writeInterface(name string) {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:], uint16(layers.LinkTypeEthernet))
+	// スナップ長0は制限なし
+	if name != "" {
+		body = appendOption(body, pcapngOptIfName, []byte(name))
+	}
+	body = appendOption(body, pcapngOptIfTsresol, []byte{pcapngTsresolNanosecond})
+	body = appendOption(body, pcapngOptEnd, nil)
+	c.writeBlock(pcapngInterface, body)
+}
+
+// オプション(種類，長さ，4バイト境界まで埋めた値)を追加する
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	var hdr [4]byte
+	binary.LittleEndian.PutUint16(hdr[0:], code)
+	binary.LittleEndian.PutUint16(hdr[2:], uint16(len(value)))
+	b = append(b, hdr[:]...)
+	return pad4(append(b, value...))
+}
+
+func pad4(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// pcapかpcapngのキャプチャファイルからフレームを読む
+type CaptureReader struct {
+	r      *bufio.Reader
+	closer io.Closer
+	// pcapngならtrue
+	ng    bool
+	order binary.ByteOrder
+	// pcapのタイムスタンプの小数部がナノ秒か
+	nano     bool
+	linkType layers.LinkType
+	// pcapngのセクション内のインタフェース
+	ifaces []captureInterface
+}
+
+type captureInterface struct {
+	name     string
+	linkType layers.LinkType
+	tsresol  uint8
+}
+
+// rから読むCaptureReaderを作成する．形式は先頭のマジックナンバーで判別する
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	c := &CaptureReader{r: bufio.NewReader(r)}
+	magic, err := c.r.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("キャプチャファイルの読み込みに失敗: %v", err)
+	}
+	if binary.LittleEndian.Uint32(magic) == pcapngSectionHeader {
+		c.ng = true
+		// 最初のブロックはセクションヘッダ
+		if _, err := c.readBlock(); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(c.r, hdr); err != nil {
+		return nil, fmt.Errorf("pcapのヘッダの読み込みに失敗: %v", err)
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(hdr) {
+		case pcapMagicMicroseconds:
+			c.order = order
+		case pcapMagicNanoseconds:
+			c.order, c.nano = order, true
+		}
+	}
+	if c.order == nil {
+		return nil, errors.New("pcapでもpcapngでもありません")
+	}
+	c.linkType = layers.LinkType(c.order.Uint32(hdr[20:]) & 0xFFFF)
+	return c, nil
+}
+
+// ファイルを開いてCaptureReaderを作成する
+func OpenCapture(path string) (*CaptureReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("キャプチャファイルのオープンに失敗: %v", err)
+	}
+	c, err := NewCaptureReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	c.closer = f
+	return c, nil
+}
+
+// 次のフレームを読む．終わりに達したらio.EOF
+func (c *CaptureReader) ReadFrame() (*CapturedFrame, error) {
+	if !c.ng {
+		return c.readPcapRecord()
+	}
+	for {
+		f, err := c.readBlock()
+		if err != nil || f != nil {
+			return f, err
+		}
+	}
+}
+
+// OpenCaptureで開いたファイルを閉じる
+func (c *CaptureReader) Close() error {
+	if c.closer != nil {
+		return c.closer.Close()
+	}
+	return nil
+}
+
+func (c *CaptureReader) readPcapRecord() (*CapturedFrame, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, hdr); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("pcapのレコードが途中で切れています")
+		}
+		return nil, err
+	}
+	sec, frac := int64(c.order.Uint32(hdr[0:])), int64(c.order.Uint32(hdr[4:]))
+	if !c.nano {
+		frac *= int64(time.Microsecond)
+	}
+	n := c.order.Uint32(hdr[8:])
+	if n > pcapngMaxBlockLen {
+		return nil, fmt.Errorf("pcapのレコードが大きすぎます: %dバイト", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return nil, fmt.Errorf("pcapのレコードの読み込みに失敗: %v", err)
+	}
+	return &CapturedFrame{Time: time.Unix(sec, frac), LinkType: c.linkType, Data: data}, nil
+}
+
+// pcapngのブロックを1つ読む．パケットのブロックならフレームを返す
+func (c *CaptureReader) readBlock() (*CapturedFrame, error) {
+	hdr := make([]byte, 8)
+	if _, err := io.ReadFull(c.r, hdr); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("pcapngのブロックが途中で切れています")
+		}
+		return nil, err
+	}
+	typ := binary.LittleEndian.Uint32(hdr[0:])
+	if typ == pcapngSectionHeader {
+		// セクションごとにバイトオーダが変わりうる
+		magic, err := c.r.Peek(4)
+		if err != nil {
+			return nil, fmt.Errorf("pcapngのセクションヘッダの読み込みに失敗: %v", err)
+		}
+		switch {
+		case binary.LittleEndian.Uint32(magic) == pcapngByteOrderMagic:
+			c.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(magic) == pcapngByteOrderMagic:
+			c.order = binary.BigEndian
+		default:
+			return nil, errors.New("pcapngのバイトオーダがわかりません")
+		}
+		c.ifaces = nil
+	}
+	typ = c.order.Uint32(hdr[0:])
+	n := c.order.Uint32(hdr[4:])
+	if n < pcapngBlockHeaderLen+pcapngBlockTrailerLen || n%4 != 0 || n > pcapngMaxBlockLen {
+		return nil, fmt.Errorf("pcapngのブロックの長さが不正です: %d", n)
+	}
+	body := make([]byte, n-pcapngBlockHeaderLen)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return nil, fmt.Errorf("pcapngのブロックの読み込みに失敗: %v", err)
+	}
+	body = body[:len(body)-pcapngBlockTrailerLen]
+
+	switch typ {
+	case pcapngInterface:
+		if len(body) < 8 {
+			return nil, errors.New("pcapngのインタフェースブロックが短すぎます")
+		}
+		iface := captureInterface{linkType: layers.LinkType(c.order.Uint16(body[0:])), tsresol: pcapngDefaultTsresol}
+		c.readOptions(body[8:], func(code uint16, value []byte) {
+			switch code {
+			case pcapngOptIfName:
+				iface.name = string(value)
+			case pcapngOptIfTsresol:
+				if len(value) > 0 {
+					iface.tsresol = value[0]
+				}
+			}
+		})
+		c.ifaces = append(c.ifaces, iface)
+	case pcapngEnhancedPacket:
+		if len(body) < 20 {
+			return nil, errors.New("pcapngのパケットブロックが短すぎます")
+		}
+		id := c.order.Uint32(body[0:])
+		if int(id) >= len(c.ifaces) {
+			return nil, fmt.Errorf("pcapngのパケットのインタフェース%dが定義されていません", id)
+		}
+		iface := c.ifaces[id]
+		ts := uint64(c.order.Uint32(body[4:]))<<32 | uint64(c.order.Uint32(body[8:]))
+		capLen := int(c.order.Uint32(body[12:]))
+		if 20+capLen > len(body) {
+			return nil, errors.New("pcapngのパケットの長さが不正です")
+		}
+		f := &CapturedFrame{
+			Time:      iface.time(ts),
+			Interface: iface.name,
+			LinkType:  iface.linkType,
+			Data:      body[20 : 20+capLen],
+		}
+		opts := body[len(body):]
+		if end := 20 + (capLen+3)&^3; end <= len(body) {
+			opts = body[end:]
+		}
+		c.readOptions(opts, func(code uint16, value []byte) {
+			if code == pcapngOptEPBFlags && len(value) == 4 {
+				switch c.order.Uint32(value) & 3 {
+				case pcapngFlagInbound:
+					f.Direction = CaptureInbound
+				case pcapngFlagOutbound:
+					f.Direction = CaptureOutbound
+				}
+			}
+		})
+		return f, nil
+	case pcapngSimplePacket:
+		if len(body) < 4 || len(c.ifaces) == 0 {
+			return nil, errors.New("pcapngのシンプルパケットブロックが不正です")
+		}
+		iface := c.ifaces[0]
+		return &CapturedFrame{Interface: iface.name, LinkType: iface.linkType, Data: body[4:]}, nil
+	}
+	// 統計や名前解決などのブロックは読み飛ばす
+	return nil, nil
+}
+
+// オプションを順に読む．壊れていればそこで止める
+func (c *CaptureReader) readOptions(b []byte, f func(code uint16, value []byte)) {
+	for len(b) >= 4 {
+		code, n := c.order.Uint16(b[0:]), int(c.order.Uint16(b[2:]))
+		if code == pcapngOptEnd || 4+n > len(b) {
+			return
+		}
+		f(code, b[4:4+n])
+		next := 4 + (n+3)&^3
+		if next > len(b) {
+			return
+		}
+		b = b[next:]
+	}
+}
+
+// if_tsresolに従ってタイムスタンプを時刻にする
+// 最上位ビットが0なら10のマイナス乗，1なら2のマイナス乗の単位
+func (i captureInterface) time(ts uint64) time.Time {
+	exp := uint(i.tsresol & 0x7F)
+	if i.tsresol&0x80 != 0 {
+		if exp >= 64 {
+			return time.Unix(0, 0)
+		}
+		sec := ts >> exp
+		hi, lo := bits.Mul64(ts&(1<<exp-1), uint64(time.Second))
+		ns, _ := bits.Div64(hi, lo, 1<<exp)
+		return time.Unix(int64(sec), int64(ns))
+	}
+	if exp > 19 {
+		return time.Unix(0, 0)
+	}
+	unit := uint64(1)
+	for j := uint(0); j < exp; j++ {
+		unit *= 10
+	}
+	sec := ts / unit
+	frac := ts % unit
+	for j := exp; j < 9; j++ {
+		frac *= 10
+	}
+	for j := uint(9); j < exp; j++ {
+		frac /= 10
+	}
+	return time.Unix(int64(sec), int64(frac))
+}
+
+// スタックが送受信するすべてのフレームをwに記録する．nilなら記録をやめる
+// 時刻はスタックの時計で付けるので，VirtualClockを使えば同じ実行から同じタイムスタンプになる
+func (s *Stack) SetCapture(w *CaptureWriter) {
+	s.mu.Lock()
+	s.capture = w
+	s.mu.Unlock()
+}
+
+// フレームをキャプチャに書く
+func (s *Stack) record(nic *NIC, frame []byte, dir CaptureDirection) {
+	s.mu.RLock()
+	w := s.capture
+	s.mu.RUnlock()
+	if w == nil {
+		return
+	}
+	w.WriteFrame(CapturedFrame{
+		Time:      s.clock.Now(),
+		Interface: nic.name,
+		Direction: dir,
+		LinkType:  layers.LinkTypeEthernet,
+		Data:      frame,
+	})
+}
@@ -0,0 +1,225 @@
+package tcpip
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// キャプチャのフレームを最後まで読む
+func readAll(t *testing.T, r *CaptureReader) []*CapturedFrame {
+	t.Helper()
+	var frames []*CapturedFrame
+	for {
+		f, err := r.ReadFrame()
+		if err == io.EOF {
+			return frames
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, f)
+	}
+}
+
+// pcapngはインタフェース名と向き(epb_flags)を，どちらの形式もナノ秒までの時刻を保つ
+func TestCaptureRoundTrip(t *testing.T) {
+	ts := time.Unix(1700000000, 123456789)
+	frames := []CapturedFrame{
+		{Time: ts, Interface: "eth0", Direction: CaptureInbound, Data: []byte{1, 2, 3}},
+		{Time: ts.Add(time.Nanosecond), Interface: "eth1", Direction: CaptureOutbound, Data: bytes.Repeat([]byte{4}, 61)},
+		{Time: ts.Add(time.Second), Interface: "eth0", Data: []byte{9}},
+	}
+	for _, tc := range []struct {
+		name   string
+		format CaptureFormat
+		// pcapにはインタフェース名と向きがない
+		keepMeta bool
+	}{
+		{"pcapng", CaptureFormatPcapNG, true},
+		{"pcap", CaptureFormatPcap, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := NewCaptureWriter(&buf, tc.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range frames {
+				if err := w.WriteFrame(f); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			r, err := NewCaptureReader(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := readAll(t, r)
+			if len(got) != len(frames) {
+				t.Fatalf("フレームの数: %d", len(got))
+			}
+			for i, want := range frames {
+				if !tc.keepMeta {
+					want.Interface, want.Direction = "", CaptureUnknown
+				}
+				g := got[i]
+				if !g.Time.Equal(want.Time) || !bytes.Equal(g.Data, want.Data) || g.Interface != want.Interface || g.Direction != want.Direction {
+					t.Errorf("%d番目: %v %q %v %x, 期待: %v %q %v %x", i, g.Time, g.Interface, g.Direction, g.Data, want.Time, want.Interface, want.Direction, want.Data)
+				}
+			}
+		})
+	}
+}
+
+// 拡張子で形式を選び，ファイルから読み戻せる
+func TestCaptureFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "x.pcap")
+	w, err := CreateCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1700000000, 123456789)
+	if err := w.WriteFrame(CapturedFrame{Time: ts, Interface: "a", Direction: CaptureInbound, Data: []byte{1, 2, 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	frames := readAll(t, r)
+	if len(frames) != 1 || !frames[0].Time.Equal(ts) || frames[0].Direction != CaptureUnknown {
+		t.Fatalf("読み戻したフレーム: %v", frames)
+	}
+
+	if _, err := NewCaptureReader(strings.NewReader("pcapでもpcapngでもないデータ")); err == nil {
+		t.Fatal("形式の違うデータを読めてしまいました")
+	}
+}
+
+// 受けた側で記録したハンドシェイクを，同じアドレス・時計・ISNの鍵を持つ新しいスタックに流すと，同じように接続が確立する
+func TestCaptureReplayHandshake(t *testing.T) {
+	p := newTCPPair(t)
+	var buf bytes.Buffer
+	w, err := NewCaptureWriter(&buf, CaptureFormatPcapNG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.sb.SetCapture(w)
+	p.dial(t)
+	p.sb.SetCapture(nil)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := NewVirtualClock(time.Unix(1000, 0))
+	port := NewSwitch(clock, 1).AddPort(p.ports[1].HardwareAddr())
+	s := NewStackWithClock(clock)
+	defer s.Close()
+	s.SetDADConfig(DADConfig{})
+	s.AddNIC("sw", port, ipn("10.1.0.2/24"))
+	s.isnSecret = p.sb.isnSecret
+	if err := s.Neighbors().AddStatic(net.IPv4(10, 1, 0, 1), p.ports[0].HardwareAddr()); err != nil {
+		t.Fatal(err)
+	}
+	tr := NewTCPTrace()
+	s.SetTCPTracer(tr)
+	l, err := s.Listen(nil, 80, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	r, err := NewCaptureReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SYNとACKの2つだけを流す(SYN+ACKは送信なので流さない)
+	if n, err := s.Replay(r, ReplayOptions{}); err != nil || n != 2 {
+		t.Fatalf("流したフレーム: %d, %v", n, err)
+	}
+	clock.Advance(0)
+	c, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := c.State(); st != StateEstablished {
+		t.Fatalf("状態: %v", st)
+	}
+
+	diagram := func(tr *TCPTrace) string {
+		var b strings.Builder
+		if err := tr.WriteDiagram(&b, tr.Flows()[0], TCPDiagramASCII); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+	if got, want := diagram(tr), diagram(p.tb); got != want {
+		t.Fatalf("流し込んだ接続:\n%s\n記録した接続:\n%s", got, want)
+	}
+}
+
+// 仮想時計では，フレームの間隔を待つ代わりに時計を進める
+func TestCaptureReplayKeepTimingVirtualClock(t *testing.T) {
+	ts := time.Unix(1700000000, 0)
+	var buf bytes.Buffer
+	w, err := NewCaptureWriter(&buf, CaptureFormatPcapNG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 宛先が自分でないので，受け取っても捨てられる
+	frame := make([]byte, 60)
+	copy(frame, []byte{2, 0, 0, 0, 0, 9})
+	for _, d := range []time.Duration{0, time.Second, 3 * time.Second} {
+		if err := w.WriteFrame(CapturedFrame{Time: ts.Add(d), Interface: "sw", Direction: CaptureInbound, Data: frame}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Unix(1000, 0)
+	clock := NewVirtualClock(start)
+	s := NewStackWithClock(clock)
+	defer s.Close()
+	s.SetDADConfig(DADConfig{})
+	s.AddNIC("sw", NewSwitch(clock, 1).AddPort(net.HardwareAddr{2, 0, 0, 0, 1, 1}), ipn("10.1.0.1/24"))
+
+	// 途中で発火するタイマー
+	var fired time.Time
+	clock.AfterFunc(2*time.Second, func() { fired = clock.Now() })
+
+	r, err := NewCaptureReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if n, err := s.Replay(r, ReplayOptions{KeepTiming: true}); err != nil || n != 3 {
+			t.Errorf("流したフレーム: %d, %v", n, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("仮想時計で待ったまま戻りません")
+	}
+	if got := clock.Now().Sub(start); got != 3*time.Second {
+		t.Fatalf("時計の進み: %v", got)
+	}
+	if !fired.Equal(start.Add(2 * time.Second)) {
+		t.Fatalf("タイマーの発火時刻: %v", fired)
+	}
+}
@@ -0,0 +1,259 @@
+package tcpip
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// スタックが使う時計
+// タイマーや再送はすべてこの時計で測るので，VirtualClockに差し替えると時間を自由に進められる
+type Clock interface {
+	Now() time.Time
+	// dが経ったらC()に現在時刻を送るタイマー
+	NewTimer(d time.Duration) Timer
+	// dが経ったらfを呼ぶタイマー
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Clockが返すタイマー
+type Timer interface {
+	// NewTimerで作ったタイマーの通知先(AfterFuncで作ったタイマーではnil)
+	C() <-chan time.Time
+	// 止める．まだ発火していなければtrue
+	Stop() bool
+	// dが経ったら発火するようにやり直す．まだ発火していなければtrue
+	Reset(d time.Duration) bool
+}
+
+// 実際の時刻を使う時計
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	t := time.NewTimer(d)
+	return &systemTimer{t: t, c: t.C}
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return &systemTimer{t: time.AfterFunc(d, f)}
+}
+
+type systemTimer struct {
+	t *time.Timer
+	c <-chan time.Time
+}
+
+func (t *systemTimer) C() <-chan time.Time        { return t.c }
+func (t *systemTimer) Stop() bool                 { return t.t.Stop() }
+func (t *systemTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
+
+// 仮想時計に，別のゴルーチンへ渡した処理の数をnだけ増減して知らせる
+// 仮想時計のAdvanceは，これが0になるまで次のタイマーを発火させずに待つ．ほかの時計では何もしない
+func addWork(c Clock, n int) {
+	if vc, ok := c.(*VirtualClock); ok {
+		vc.addWork(n)
+	}
+}
+
+// 時計でdだけ待つ
+func sleep(c Clock, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	<-c.NewTimer(d).C()
+}
+
+// Advanceを呼んだときだけ進む時計
+// 再送やタイムアウトを実際に待たずに試せる．発火する順番は時刻順(同じ時刻なら登録順)で決まる
+type VirtualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers virtualTimerHeap
+	// 同じ時刻のタイマーを登録順に並べるための通し番号
+	seq uint64
+	// スイッチやスタックで処理中の仕事(届いたフレームやTCPセグメント)の数と，それが0になったことの通知
+	work int
+	idle *sync.Cond
+}
+
+// startから始まる仮想時計を作成
+func NewVirtualClock(start time.Time) *VirtualClock {
+	c := &VirtualClock{now: start}
+	c.idle = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *VirtualClock) NewTimer(d time.Duration) Timer {
+	t := &virtualTimer{clock: c, c: make(chan time.Time, 1), index: -1}
+	t.Reset(d)
+	return t
+}
+
+func (c *VirtualClock) AfterFunc(d time.Duration, f func()) Timer {
+	t := &virtualTimer{clock: c, f: f, index: -1}
+	t.Reset(d)
+	return t
+}
+
+// 時計をdだけ進め，その間に期限が来たタイマーを時刻順に発火させる
+// AfterFuncの関数はAdvanceを呼んだゴルーチンで実行され，その中で登録したタイマーも期限内なら発火する．
+// タイマーを発火させる前と戻る前に，スイッチを通るフレームとスタックの受信・TCPの処理が終わるのを待つので，
+// その処理で登録したタイマーも飛ばされない．Advance(0)は処理が終わるのを待つだけになる
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		c.waitIdleLocked()
+		if len(c.timers) == 0 || c.timers[0].when.After(end) {
+			break
+		}
+		t := heap.Pop(&c.timers).(*virtualTimer)
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+		now := c.now
+		c.mu.Unlock()
+		t.fire(now)
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// 次にタイマーが発火する時刻まで進める．待っているタイマーがなければfalse
+func (c *VirtualClock) AdvanceToNext() bool {
+	c.mu.Lock()
+	c.waitIdleLocked()
+	if len(c.timers) == 0 {
+		c.mu.Unlock()
+		return false
+	}
+	d := c.timers[0].when.Sub(c.now)
+	c.mu.Unlock()
+	c.Advance(d)
+	return true
+}
+
+// 発火を待っているタイマーの数
+func (c *VirtualClock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// 処理中の仕事の数をnだけ増減する
+func (c *VirtualClock) addWork(n int) {
+	c.mu.Lock()
+	c.work += n
+	if c.work <= 0 {
+		c.idle.Broadcast()
+	}
+	c.mu.Unlock()
+}
+
+// 処理中の仕事がなくなるまで待つ．c.muを持って呼ぶこと
+func (c *VirtualClock) waitIdleLocked() {
+	for c.work > 0 {
+		c.idle.Wait()
+	}
+}
+
+type virtualTimer struct {
+	clock *VirtualClock
+	c     chan time.Time
+	f     func()
+	when  time.Time
+	seq   uint64
+	// ヒープ内の位置(ヒープになければ-1)
+	index int
+}
+
+func (t *virtualTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *virtualTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&c.timers, t.index)
+	return true
+}
+
+func (t *virtualTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	active := t.index >= 0
+	if active {
+		heap.Remove(&c.timers, t.index)
+	}
+	if d < 0 {
+		d = 0
+	}
+	t.when = c.now.Add(d)
+	t.seq = c.seq
+	c.seq++
+	heap.Push(&c.timers, t)
+	return active
+}
+
+func (t *virtualTimer) fire(now time.Time) {
+	if t.f != nil {
+		t.f()
+		return
+	}
+	// time.Timerと同じく，受け取られていない通知があれば捨てずに残す
+	select {
+	case t.c <- now:
+	default:
+	}
+}
+
+// 発火時刻順のタイマーのヒープ
+type virtualTimerHeap []*virtualTimer
+
+func (h virtualTimerHeap) Len() int { return len(h) }
+
+func (h virtualTimerHeap) Less(i, j int) bool {
+	if h[i].when.Equal(h[j].when) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].when.Before(h[j].when)
+}
+
+func (h virtualTimerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *virtualTimerHeap) Push(x interface{}) {
+	t := x.(*virtualTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *virtualTimerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
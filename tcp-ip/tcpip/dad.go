@@ -0,0 +1,228 @@
+package tcpip
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// 他のホストがすでに同じアドレスを使っているときのエラー
+var ErrAddressConflict = errors.New("アドレスが他のホストと衝突しています")
+
+// RFC 5227のアドレス衝突検出(プローブとアナウンス)のタイマ設定
+type DADConfig struct {
+	// 最初のプローブまでに待つ時間の上限(0からこの値までランダム)
+	ProbeWait time.Duration
+	// プローブを送る回数
+	ProbeNum int
+	// プローブの間隔(ProbeMinからProbeMaxまでランダム)
+	ProbeMin time.Duration
+	ProbeMax time.Duration
+	// 最後のプローブから使い始めるまでに待つ時間
+	AnnounceWait time.Duration
+	// アナウンス(Gratuitous ARP)を送る回数と間隔
+	AnnounceNum      int
+	AnnounceInterval time.Duration
+	// 衝突に対して防御のGratuitous ARPを送る最小間隔
+	DefendInterval time.Duration
+}
+
+// RFC 5227 Section 1.1の既定値
+var DefaultDADConfig = DADConfig{
+	ProbeWait:        time.Second,
+	ProbeNum:         3,
+	ProbeMin:         time.Second,
+	ProbeMax:         2 * time.Second,
+	AnnounceWait:     2 * time.Second,
+	AnnounceNum:      2,
+	AnnounceInterval: 2 * time.Second,
+	DefendInterval:   10 * time.Second,
+}
+
+// アドレス衝突検出のタイマ設定を変更する
+func (s *Stack) SetDADConfig(config DADConfig) {
+	s.mu.Lock()
+	s.dadConfig = config
+	s.mu.Unlock()
+}
+
+func (s *Stack) getDADConfig() DADConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.dadConfig
+}
+
+// インタフェースがそのIPアドレスを持っているか
+func (n *NIC) hasAddress(ip net.IP) bool {
+	n.stack.mu.RLock()
+	defer n.stack.mu.RUnlock()
+	for _, a := range n.addrs {
+		if a.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// インタフェースに割り当てられているアドレス一覧
+func (n *NIC) Addresses() []net.IPNet {
+	n.stack.mu.RLock()
+	defer n.stack.mu.RUnlock()
+	return append([]net.IPNet(nil), n.addrs...)
+}
+
+// プローブで衝突がないことを確かめてからアドレスを追加し，アナウンスする
+// カーネルが知らないアドレスでもスタック自身が応答できるようになる
+// IPv6アドレスはARPの代わりに近隣探索で重複アドレス検出をする
+func (n *NIC) AddAddress(addr net.IPNet) error {
+	if isIPv6(addr.IP) {
+		return n.addIPv6Address(addr)
+	}
+	ip := addr.IP.To4()
+	if ip == nil {
+		return fmt.Errorf("無効なIPv4アドレス: %v", addr.IP)
+	}
+	if n.hasAddress(ip) {
+		return nil
+	}
+
+	config := n.stack.getDADConfig()
+	if err := n.probe(ip, config); err != nil {
+		return err
+	}
+
+	mask := addr.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[net.IPv6len-net.IPv4len:]
+	}
+	n.stack.mu.Lock()
+	n.addrs = append(n.addrs, net.IPNet{IP: ip, Mask: mask})
+	n.stack.mu.Unlock()
+	n.stack.addConnectedRoute(n, net.IPNet{IP: ip, Mask: mask})
+
+	go n.announce(ip, config)
+	return nil
+}
+
+// アドレスと，その直接接続の経路を取り除く
+func (n *NIC) RemoveAddress(ip net.IP) {
+	n.stack.mu.Lock()
+	var removed *net.IPNet
+	for i, a := range n.addrs {
+		if a.IP.Equal(ip) {
+			removed = &net.IPNet{IP: a.IP.Mask(a.Mask), Mask: a.Mask}
+			n.addrs = append(n.addrs[:i], n.addrs[i+1:]...)
+			break
+		}
+	}
+	n.stack.mu.Unlock()
+
+	if removed != nil {
+		n.stack.routes.removeConnected(n.name, *removed)
+	}
+}
+
+// 送信元IPを0.0.0.0にしたARPプローブを送り，誰かがそのアドレスを使っていないか確かめる
+func (n *NIC) probe(ip net.IP, config DADConfig) error {
+	arps, cancel := n.stack.subscribeARP()
+	defer cancel()
+
+	// 待っている間に衝突を示すARPが届いたらエラー
+	wait := func(d time.Duration) error {
+		timer := n.stack.clock.NewTimer(d)
+		defer timer.Stop()
+		for {
+			select {
+			case p := <-arps:
+				if mac, ok := n.conflicts(p, ip); ok {
+					return fmt.Errorf("%w: %v は %v が使用中", ErrAddressConflict, ip, mac)
+				}
+			case <-timer.C():
+				return nil
+			}
+		}
+	}
+
+	if err := wait(randDuration(0, config.ProbeWait)); err != nil {
+		return err
+	}
+	for i := 0; i < config.ProbeNum; i++ {
+		if err := n.stack.sendArpRequest(n, net.IPv4zero, ip); err != nil {
+			return err
+		}
+		interval := randDuration(config.ProbeMin, config.ProbeMax)
+		if i == config.ProbeNum-1 {
+			interval = config.AnnounceWait
+		}
+		if err := wait(interval); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// プローブ中に受信したARPが衝突を示しているか判定する
+// 誰かがそのアドレスを送信元として使っているか，同じアドレスを同時にプローブしている場合
+func (n *NIC) conflicts(p *arpPacket, ip net.IP) (net.HardwareAddr, bool) {
+	arp := p.arp
+	senderMAC := net.HardwareAddr(arp.SourceHwAddress)
+	if p.nic != n || senderMAC.String() == n.HardwareAddr().String() {
+		return nil, false
+	}
+	senderIP := net.IP(arp.SourceProtAddress)
+	if senderIP.Equal(ip) {
+		return senderMAC, true
+	}
+	if senderIP.IsUnspecified() && net.IP(arp.DstProtAddress).Equal(ip) {
+		return senderMAC, true
+	}
+	return nil, false
+}
+
+// Gratuitous ARPを送って自分のアドレスを周知する
+func (n *NIC) announce(ip net.IP, config DADConfig) {
+	for i := 0; i < config.AnnounceNum; i++ {
+		if i > 0 {
+			sleep(n.stack.clock, config.AnnounceInterval)
+		}
+		if err := n.stack.sendGratuitousArp(n, ip); err != nil {
+			return
+		}
+	}
+}
+
+// 使用中のアドレスを他のホストが名乗ってきたときに防御する
+// DefendInterval以内に2回目の衝突が起きた場合は何もしない
+func (n *NIC) defendAddress(ip net.IP, mac net.HardwareAddr) {
+	fmt.Printf("アドレスの衝突を検出: %v を %v も使用しています\n", ip, mac)
+
+	config := n.stack.getDADConfig()
+	key := ipAddr(ip)
+	now := n.stack.clock.Now()
+
+	n.stack.mu.Lock()
+	if n.defended == nil {
+		n.defended = make(map[netip.Addr]time.Time)
+	}
+	last, ok := n.defended[key]
+	defend := !ok || now.Sub(last) > config.DefendInterval
+	if defend {
+		n.defended[key] = now
+	}
+	n.stack.mu.Unlock()
+
+	if defend {
+		n.stack.sendGratuitousArp(n, ip)
+	}
+}
+
+// minからmaxまでのランダムな時間
+func randDuration(min, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+	return min + time.Duration(rand.Int63n(int64(max-min)))
+}
@@ -0,0 +1,218 @@
+package tcpip
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// 生のパイプに届いたARPパケット
+func readRawARP(t *testing.T, raw *PipeDevice) *layers.ARP {
+	t.Helper()
+	for {
+		if arp, ok := readFrame(t, raw).Layer(layers.LayerTypeARP).(*layers.ARP); ok {
+			return arp
+		}
+	}
+}
+
+// 仮想時計のタイマーを発火させながらAddAddressの結果を待つ
+func addAddressAdvancing(t *testing.T, clock *VirtualClock, nic *NIC, addr net.IPNet) error {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() { errc <- nic.AddAddress(addr) }()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-errc:
+			return err
+		default:
+		}
+		clock.AdvanceToNext()
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("AddAddressが終わりません")
+	return nil
+}
+
+// プローブ中に，そのアドレスを使っているホストのリプライか同じアドレスのプローブを受けたら衝突になる
+func TestDADProbeConflict(t *testing.T) {
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 0x77}
+	for _, tc := range []struct {
+		name string
+		arp  func(ip net.IP) layers.ARP
+	}{
+		{"リプライ", func(ip net.IP) layers.ARP {
+			return NewArpReply(ip, mac, net.IPv4zero, net.HardwareAddr{0, 0, 0, 0, 0, 0})
+		}},
+		{"Gratuitous ARP", func(ip net.IP) layers.ARP { return NewArpRequest(ip, mac, ip) }},
+		{"同時のプローブ", func(ip net.IP) layers.ARP { return NewArpRequest(net.IPv4zero, mac, ip) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := NewVirtualClock(time.Unix(1000, 0))
+			s, raw := rawPeer(t, clock)
+			s.SetDADConfig(DADConfig{ProbeNum: 3, ProbeMin: time.Second, ProbeMax: 2 * time.Second, AnnounceWait: 2 * time.Second, AnnounceNum: 1})
+			nic := s.NIC("b")
+			ip := net.IPv4(10, 0, 0, 7).To4()
+
+			base := clock.Pending()
+			errc := make(chan error, 1)
+			go func() { errc <- nic.AddAddress(ipn("10.0.0.7/24")) }()
+			eventually(t, "プローブの待ち時間のタイマ", func() bool { return clock.Pending() > base })
+			clock.Advance(0)
+			probe := readRawARP(t, raw)
+			if probe.Operation != layers.ARPRequest || !net.IP(probe.SourceProtAddress).Equal(net.IPv4zero) ||
+				!net.IP(probe.DstProtAddress).Equal(ip) || net.HardwareAddr(probe.SourceHwAddress).String() != nic.HardwareAddr().String() {
+				t.Fatalf("プローブ: %+v", probe)
+			}
+			sendARP(t, raw, tc.arp(ip))
+
+			var err error
+			select {
+			case err = <-errc:
+			case <-time.After(3 * time.Second):
+				t.Fatal("衝突を検出しません")
+			}
+			if !errors.Is(err, ErrAddressConflict) || !strings.Contains(err.Error(), mac.String()) {
+				t.Fatalf("エラー: %v", err)
+			}
+			if nic.hasAddress(ip) {
+				t.Fatal("衝突したアドレスが追加されました")
+			}
+		})
+	}
+}
+
+// 誰も答えなければProbeNum回プローブしてからアドレスを追加し，Gratuitous ARPでアナウンスする
+func TestDADProbeNoConflict(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(1000, 0))
+	s, raw := rawPeer(t, clock)
+	s.SetDADConfig(DADConfig{ProbeNum: 3, ProbeMin: time.Second, ProbeMax: 2 * time.Second, AnnounceWait: 2 * time.Second, AnnounceNum: 1})
+	nic := s.NIC("b")
+	ip := net.IPv4(10, 0, 0, 7).To4()
+
+	arps := make(chan *layers.ARP, 16)
+	go func() {
+		for {
+			frame, err := raw.ReadFrame()
+			if err != nil {
+				return
+			}
+			if arp, ok := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default).Layer(layers.LayerTypeARP).(*layers.ARP); ok {
+				arps <- arp
+			}
+		}
+	}()
+	start := clock.Now()
+	if err := addAddressAdvancing(t, clock, nic, ipn("10.0.0.7/24")); err != nil {
+		t.Fatal(err)
+	}
+	// 最後のプローブからAnnounceWait待ち，プローブの間隔はProbeMinからProbeMaxまで
+	if d := clock.Now().Sub(start); d < 2*time.Second+2*time.Second || d > 2*2*time.Second+2*time.Second {
+		t.Fatalf("アドレスを追加するまで: %v", d)
+	}
+	if !nic.hasAddress(ip) {
+		t.Fatal("アドレスが追加されていません")
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case p := <-arps:
+			if !net.IP(p.SourceProtAddress).Equal(net.IPv4zero) || !net.IP(p.DstProtAddress).Equal(ip) {
+				t.Fatalf("%d回目のプローブ: %+v", i+1, p)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%d回目のプローブが届きません", i+1)
+		}
+	}
+
+	select {
+	case p := <-arps:
+		if !net.IP(p.SourceProtAddress).Equal(ip) || !net.IP(p.DstProtAddress).Equal(ip) {
+			t.Fatalf("アナウンス: %+v", p)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("アナウンスが届きません")
+	}
+}
+
+// 使用中のアドレスへのプローブにはユニキャストでリプライを返し，相手に衝突を知らせる
+func TestDADProbeReply(t *testing.T) {
+	s, raw := rawPeer(t, NewVirtualClock(time.Unix(1000, 0)))
+	nic := s.NIC("b")
+	own := net.IPv4(10, 0, 0, 2).To4()
+
+	// 持っていないアドレスへのプローブには答えない
+	sendARP(t, raw, NewArpRequest(net.IPv4zero, raw.HardwareAddr(), net.IPv4(10, 0, 0, 77)))
+	sendARP(t, raw, NewArpRequest(net.IPv4zero, raw.HardwareAddr(), own))
+
+	pkt := readFrame(t, raw)
+	eth, _ := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	arp, _ := pkt.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if eth == nil || arp == nil {
+		t.Fatalf("ARPリプライではありません: %v", pkt)
+	}
+	if eth.DstMAC.String() != raw.HardwareAddr().String() {
+		t.Fatalf("リプライの宛先: %v", eth.DstMAC)
+	}
+	if arp.Operation != layers.ARPReply || !net.IP(arp.SourceProtAddress).Equal(own) ||
+		net.HardwareAddr(arp.SourceHwAddress).String() != nic.HardwareAddr().String() ||
+		net.HardwareAddr(arp.DstHwAddress).String() != raw.HardwareAddr().String() {
+		t.Fatalf("プローブへのリプライ: %+v", arp)
+	}
+
+	// プローブの送信元0.0.0.0は近隣テーブルに入らない
+	if n, ok := lookupNeighbor(s, net.IPv4zero); ok {
+		t.Fatalf("プローブの送信元を覚えました: %+v", n)
+	}
+}
+
+// 他のホストが使用中のアドレスを名乗ったらGratuitous ARPで防御するが，DefendInterval以内の衝突には防御しない
+func TestDADDefendInterval(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(1000, 0))
+	s, raw := rawPeer(t, clock)
+	s.SetDADConfig(DADConfig{DefendInterval: 10 * time.Second})
+	own := net.IPv4(10, 0, 0, 2).To4()
+	intruder := net.HardwareAddr{2, 0, 0, 0, 0, 0x66}
+
+	// 衝突するARPを送り，次に届くのが防御のGratuitous ARPか確かめる
+	// 防御しなければ，続けて送ったプローブへのリプライが先に届く
+	defended := func() bool {
+		t.Helper()
+		sendARP(t, raw, NewArpRequest(own, intruder, own))
+		sendARP(t, raw, NewArpRequest(net.IPv4zero, raw.HardwareAddr(), own))
+		arp := readRawARP(t, raw)
+		if arp.Operation == layers.ARPReply {
+			return false
+		}
+		if !net.IP(arp.SourceProtAddress).Equal(own) || !net.IP(arp.DstProtAddress).Equal(own) {
+			t.Fatalf("防御のARP: %+v", arp)
+		}
+		if reply := readRawARP(t, raw); reply.Operation != layers.ARPReply {
+			t.Fatalf("プローブへのリプライ: %+v", reply)
+		}
+		return true
+	}
+
+	if !defended() {
+		t.Fatal("最初の衝突を防御しません")
+	}
+	if defended() {
+		t.Fatal("すぐ後の衝突も防御しました")
+	}
+	clock.Advance(10 * time.Second)
+	if defended() {
+		t.Fatal("DefendIntervalちょうどで防御しました")
+	}
+	clock.Advance(time.Nanosecond)
+	if !defended() {
+		t.Fatal("DefendIntervalを過ぎても防御しません")
+	}
+	if defended() {
+		t.Fatal("2回目の防御のすぐ後の衝突も防御しました")
+	}
+}
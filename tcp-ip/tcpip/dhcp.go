@@ -0,0 +1,654 @@
+package tcpip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// DHCPのポート番号
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+)
+
+// 応答をブロードキャストで送ってもらうフラグ(アドレスが決まる前はユニキャストを受け取れない)
+const dhcpFlagBroadcast = 0x8000
+
+// REQUESTを送り直す回数．応答がなければDISCOVERからやり直す
+const dhcpRequestTries = 4
+
+var (
+	// DHCPクライアントが止められた
+	ErrDHCPStopped = errors.New("DHCPクライアントは停止しています")
+	// 待っている間に応答がなかった
+	errDHCPTimeout = errors.New("DHCPサーバから応答がありません")
+	// サーバがリースの延長を断った
+	errDHCPNak = errors.New("DHCPサーバがNAKを返しました")
+)
+
+// DHCPクライアントのタイマ設定
+type DHCPConfig struct {
+	// DISCOVERとREQUESTの最初の再送間隔．応答がなければMaxRetransmitまで倍にしていく
+	InitialRetransmit time.Duration
+	MaxRetransmit     time.Duration
+	// RENEWINGとREBINDINGでREQUESTを送り直す最小間隔
+	MinRenewRetransmit time.Duration
+	// DECLINEしてからDISCOVERをやり直すまでに待つ時間
+	DeclineWait time.Duration
+	// サーバへ伝えるホスト名(空なら送らない)
+	Hostname string
+}
+
+// RFC 2131 Section 3.1, 4.1, 4.4.5の既定値
+var DefaultDHCPConfig = DHCPConfig{
+	InitialRetransmit:  4 * time.Second,
+	MaxRetransmit:      64 * time.Second,
+	MinRenewRetransmit: 60 * time.Second,
+	DeclineWait:        10 * time.Second,
+}
+
+// DHCPクライアントのタイマ設定を変更する(これから始めるクライアントに使われる)
+func (s *Stack) SetDHCPConfig(config DHCPConfig) {
+	s.mu.Lock()
+	s.dhcpConfig = config
+	s.mu.Unlock()
+}
+
+func (s *Stack) getDHCPConfig() DHCPConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	config := s.dhcpConfig
+	if config.InitialRetransmit <= 0 {
+		config.InitialRetransmit = DefaultDHCPConfig.InitialRetransmit
+	}
+	if config.MaxRetransmit <= 0 {
+		config.MaxRetransmit = DefaultDHCPConfig.MaxRetransmit
+	}
+	if config.MinRenewRetransmit <= 0 {
+		config.MinRenewRetransmit = DefaultDHCPConfig.MinRenewRetransmit
+	}
+	if config.DeclineWait <= 0 {
+		config.DeclineWait = DefaultDHCPConfig.DeclineWait
+	}
+	return config
+}
+
+// DHCPクライアントの状態(RFC 2131 Figure 5)
+type DHCPState int
+
+const (
+	DHCPInit DHCPState = iota
+	DHCPSelecting
+	DHCPRequesting
+	DHCPBound
+	DHCPRenewing
+	DHCPRebinding
+	DHCPStopped
+)
+
+func (st DHCPState) String() string {
+	switch st {
+	case DHCPInit:
+		return "INIT"
+	case DHCPSelecting:
+		return "SELECTING"
+	case DHCPRequesting:
+		return "REQUESTING"
+	case DHCPBound:
+		return "BOUND"
+	case DHCPRenewing:
+		return "RENEWING"
+	case DHCPRebinding:
+		return "REBINDING"
+	case DHCPStopped:
+		return "STOPPED"
+	}
+	return fmt.Sprintf("DHCPState(%d)", int(st))
+}
+
+// DHCPサーバから借りたアドレスと設定
+type DHCPLease struct {
+	// 割り当てられたアドレスとサブネットマスク
+	Addr net.IPNet
+	// デフォルトゲートウェイ(なければnil)
+	Router net.IP
+	// DNSサーバ
+	DNS []net.IP
+	// インタフェースのMTU(0なら指定なし)
+	MTU int
+	// リースを貸したサーバ
+	Server net.IP
+	// リース期間，延長を始める時間(T1)，どのサーバにでも延長を頼む時間(T2)
+	LeaseTime     time.Duration
+	RenewalTime   time.Duration
+	RebindingTime time.Duration
+	// リースを受け取った時刻(T1，T2，期限はここから数える)
+	Obtained time.Time
+}
+
+// インタフェースのアドレスをDHCPで設定するクライアント
+// リースを受け取るとアドレス，デフォルトルート，DNSサーバ，MTUをスタックに設定し，期限が来る前に延長する
+type DHCPClient struct {
+	stack  *Stack
+	nic    *NIC
+	config DHCPConfig
+	rx     <-chan *udpDatagram
+
+	mu    sync.Mutex
+	state DHCPState
+	lease *DHCPLease
+	// 状態が変わるたびに閉じて作り直す(待っている側を起こす)
+	changed chan struct{}
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// インタフェースでDHCPクライアントを始める
+// クライアントはスタックに1つだけ(ポート68を使うため)
+func (s *Stack) StartDHCP(nic *NIC) (*DHCPClient, error) {
+	_, rx, err := s.bindUDP(dhcpClientPort)
+	if err != nil {
+		return nil, err
+	}
+	c := &DHCPClient{
+		stack:   s,
+		nic:     nic,
+		config:  s.getDHCPConfig(),
+		rx:      rx,
+		changed: make(chan struct{}),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go c.run()
+	return c, nil
+}
+
+// 現在の状態
+func (c *DHCPClient) State() DHCPState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// 現在のリース．まだ借りていなければfalse
+func (c *DHCPClient) Lease() (DHCPLease, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lease == nil {
+		return DHCPLease{}, false
+	}
+	return *c.lease, true
+}
+
+// リースを借りてBOUNDになるまで待つ
+func (c *DHCPClient) WaitBound(timeout time.Duration) (DHCPLease, error) {
+	timer := c.stack.clock.NewTimer(timeout)
+	defer timer.Stop()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		switch c.state {
+		case DHCPBound, DHCPRenewing, DHCPRebinding:
+			if c.lease != nil {
+				return *c.lease, nil
+			}
+		case DHCPStopped:
+			return DHCPLease{}, ErrDHCPStopped
+		}
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+			c.mu.Lock()
+		case <-timer.C():
+			c.mu.Lock()
+			return DHCPLease{}, fmt.Errorf("タイムアウト: DHCPでアドレスを取得できませんでした(%v)", c.state)
+		}
+	}
+}
+
+// クライアントを止める．借りているアドレスはそのまま残す
+func (c *DHCPClient) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+		<-c.done
+		c.stack.unbindUDP(dhcpClientPort)
+		c.setState(DHCPStopped)
+	})
+}
+
+// リースをサーバへ返し(RELEASE)，スタックから設定を取り除いてクライアントを止める
+func (c *DHCPClient) Release() error {
+	c.Stop()
+
+	c.mu.Lock()
+	lease := c.lease
+	c.mu.Unlock()
+	if lease == nil {
+		return nil
+	}
+
+	msg := c.newMessage(layers.DHCPMsgTypeRelease, rand.Uint32())
+	msg.Flags = 0
+	msg.ClientIP = lease.Addr.IP
+	msg.Options = append(msg.Options, layers.NewDHCPOption(layers.DHCPOptServerID, lease.Server.To4()))
+	err := c.sendToServer(lease)(msg)
+	fmt.Printf("DHCP RELEASEを[%v]へ送信: %v\n", lease.Server, lease.Addr.IP)
+	c.unbind(lease)
+	return err
+}
+
+func (c *DHCPClient) setState(state DHCPState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setStateLocked(state)
+}
+
+// c.muを持って呼ぶこと
+func (c *DHCPClient) setStateLocked(state DHCPState) {
+	if c.state == state {
+		return
+	}
+	fmt.Printf("DHCP状態[%s]: %v -> %v\n", c.nic.name, c.state, state)
+	c.state = state
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// 止められるまでリースを借りて延長し続ける
+func (c *DHCPClient) run() {
+	defer close(c.done)
+	for {
+		c.setState(DHCPInit)
+		lease, err := c.acquire()
+		if err != nil {
+			return
+		}
+		if err := c.bind(lease); err != nil {
+			// 他のホストがすでに使っているアドレスだった(RFC 2131 Section 3.1 5.)
+			fmt.Printf("DHCPで割り当てられたアドレス%vは使えません: %v\n", lease.Addr.IP, err)
+			c.decline(lease)
+			if !c.sleepUntil(c.stack.clock.Now().Add(c.config.DeclineWait)) {
+				return
+			}
+			continue
+		}
+		if !c.maintain(lease) {
+			return
+		}
+	}
+}
+
+// DISCOVER/OFFER/REQUEST/ACKでリースを借りる
+func (c *DHCPClient) acquire() (*DHCPLease, error) {
+	for {
+		xid := rand.Uint32()
+		c.setState(DHCPSelecting)
+		offer, err := c.transact(c.newMessage(layers.DHCPMsgTypeDiscover, xid), c.broadcastFrom(nil), 0, layers.DHCPMsgTypeOffer)
+		if err != nil {
+			return nil, err
+		}
+		offered, err := parseDHCPLease(offer, c.stack.clock.Now())
+		if err != nil {
+			fmt.Printf("DHCP OFFERを無視: %v\n", err)
+			continue
+		}
+		fmt.Printf("DHCP OFFERを受信: %v (サーバ %v)\n", offered.Addr.IP, offered.Server)
+
+		// 最初に届いたOFFERを選び，そのサーバにREQUESTを送る
+		c.setState(DHCPRequesting)
+		req := c.newMessage(layers.DHCPMsgTypeRequest, xid)
+		req.Options = append(req.Options,
+			layers.NewDHCPOption(layers.DHCPOptRequestIP, offered.Addr.IP.To4()),
+			layers.NewDHCPOption(layers.DHCPOptServerID, offered.Server.To4()))
+		reply, err := c.transact(req, c.broadcastFrom(nil), dhcpRequestTries, layers.DHCPMsgTypeAck, layers.DHCPMsgTypeNak)
+		if err == errDHCPTimeout {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if dhcpMessageType(reply) == layers.DHCPMsgTypeNak {
+			fmt.Printf("DHCP NAKを受信: DISCOVERからやり直します\n")
+			continue
+		}
+		lease, err := parseDHCPLease(reply, c.stack.clock.Now())
+		if err != nil {
+			fmt.Printf("DHCP ACKを無視: %v\n", err)
+			continue
+		}
+		return lease, nil
+	}
+}
+
+// リースをT1で延長し(RENEWING)，できなければT2から他のサーバにも頼む(REBINDING)
+// 期限が切れたかNAKを受け取ったら設定を取り除いてtrueを返す．止められたらfalse
+func (c *DHCPClient) maintain(lease *DHCPLease) bool {
+	for {
+		c.setState(DHCPBound)
+		t1 := lease.Obtained.Add(lease.RenewalTime)
+		t2 := lease.Obtained.Add(lease.RebindingTime)
+		expiry := lease.Obtained.Add(lease.LeaseTime)
+		if !c.sleepUntil(t1) {
+			return false
+		}
+
+		c.setState(DHCPRenewing)
+		renewed, err := c.renew(lease, t2, c.sendToServer(lease))
+		if err == errDHCPTimeout {
+			c.setState(DHCPRebinding)
+			renewed, err = c.renew(lease, expiry, c.broadcastFrom(lease.Addr.IP))
+		}
+		switch err {
+		case nil:
+		case ErrDHCPStopped:
+			return false
+		default:
+			fmt.Printf("DHCPリース%vを延長できませんでした: %v\n", lease.Addr.IP, err)
+			c.unbind(lease)
+			return true
+		}
+
+		fmt.Printf("DHCPリースを延長: %v (リース %v)\n", renewed.Addr.IP, renewed.LeaseTime)
+		c.applyLease(renewed)
+		lease = renewed
+	}
+}
+
+// ciaddrに今のアドレスを入れたREQUESTでリースの延長を頼む
+// 応答がなければuntilまで，残り時間の半分(最小MinRenewRetransmit)ごとに送り直す(RFC 2131 Section 4.4.5)
+func (c *DHCPClient) renew(lease *DHCPLease, until time.Time, send func(*layers.DHCPv4) error) (*DHCPLease, error) {
+	msg := c.newMessage(layers.DHCPMsgTypeRequest, rand.Uint32())
+	msg.Flags = 0
+	msg.ClientIP = lease.Addr.IP
+	for {
+		now := c.stack.clock.Now()
+		if !now.Before(until) {
+			return nil, errDHCPTimeout
+		}
+		if err := send(msg); err != nil {
+			fmt.Printf("DHCP REQUESTの送信に失敗: %v\n", err)
+		}
+		wait := until.Sub(now) / 2
+		if wait < c.config.MinRenewRetransmit {
+			wait = c.config.MinRenewRetransmit
+		}
+		deadline := now.Add(wait)
+		if deadline.After(until) {
+			deadline = until
+		}
+
+		reply, err := c.receive(msg.Xid, deadline, layers.DHCPMsgTypeAck, layers.DHCPMsgTypeNak)
+		if err == errDHCPTimeout {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if dhcpMessageType(reply) == layers.DHCPMsgTypeNak {
+			return nil, errDHCPNak
+		}
+		renewed, err := parseDHCPLease(reply, c.stack.clock.Now())
+		if err != nil {
+			fmt.Printf("DHCP ACKを無視: %v\n", err)
+			continue
+		}
+		return renewed, nil
+	}
+}
+
+// msgを送り，xidが一致するwantのいずれかの応答を待つ
+// 応答がなければ間隔を倍にしながら送り直し，tries回送っても応答がなければerrDHCPTimeoutを返す(0なら止められるまで続ける)
+func (c *DHCPClient) transact(msg *layers.DHCPv4, send func(*layers.DHCPv4) error, tries int, want ...layers.DHCPMsgType) (*layers.DHCPv4, error) {
+	interval := c.config.InitialRetransmit
+	for i := 0; tries == 0 || i < tries; i++ {
+		if err := send(msg); err != nil {
+			fmt.Printf("DHCP %vの送信に失敗: %v\n", dhcpMessageType(msg), err)
+		}
+		// 他のクライアントと同時に送らないよう揺らがせる(RFC 2131 Section 4.1では±1秒)
+		jitter := interval / 4
+		if jitter > time.Second {
+			jitter = time.Second
+		}
+		reply, err := c.receive(msg.Xid, c.stack.clock.Now().Add(randDuration(interval-jitter, interval+jitter)), want...)
+		if err != errDHCPTimeout {
+			return reply, err
+		}
+		if interval *= 2; interval > c.config.MaxRetransmit {
+			interval = c.config.MaxRetransmit
+		}
+	}
+	return nil, errDHCPTimeout
+}
+
+// xidとMACアドレスが一致するwantのいずれかの応答をdeadlineまで待つ
+func (c *DHCPClient) receive(xid uint32, deadline time.Time, want ...layers.DHCPMsgType) (*layers.DHCPv4, error) {
+	timer := c.stack.clock.NewTimer(deadline.Sub(c.stack.clock.Now()))
+	defer timer.Stop()
+	for {
+		select {
+		case d := <-c.rx:
+			msg := &layers.DHCPv4{}
+			if err := msg.DecodeFromBytes(d.payload, gopacket.NilDecodeFeedback); err != nil {
+				continue
+			}
+			if msg.Operation != layers.DHCPOpReply || msg.Xid != xid || !bytes.Equal(msg.ClientHWAddr, c.nic.HardwareAddr()) {
+				continue
+			}
+			typ := dhcpMessageType(msg)
+			for _, w := range want {
+				if typ == w {
+					return msg, nil
+				}
+			}
+		case <-timer.C():
+			return nil, errDHCPTimeout
+		case <-c.stop:
+			return nil, ErrDHCPStopped
+		}
+	}
+}
+
+// tまで待つ．止められたらfalse
+func (c *DHCPClient) sleepUntil(t time.Time) bool {
+	timer := c.stack.clock.NewTimer(t.Sub(c.stack.clock.Now()))
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return true
+	case <-c.stop:
+		return false
+	}
+}
+
+// リースのアドレスをプローブしてから設定する
+func (c *DHCPClient) bind(lease *DHCPLease) error {
+	if err := c.nic.AddAddress(lease.Addr); err != nil {
+		return err
+	}
+	fmt.Printf("DHCPでアドレスを取得: %v (ルータ %v, DNS %v, リース %v)\n", &lease.Addr, lease.Router, lease.DNS, lease.LeaseTime)
+	c.applyLease(lease)
+	return nil
+}
+
+// デフォルトルート，DNSサーバ，MTUをリースに合わせる
+func (c *DHCPClient) applyLease(lease *DHCPLease) {
+	c.mu.Lock()
+	old := c.lease
+	c.lease = lease
+	c.mu.Unlock()
+
+	if old != nil && old.Router != nil && !old.Router.Equal(lease.Router) {
+		c.stack.routes.removeVia(defaultRouteDest(), old.Router, c.nic.name)
+	}
+	if lease.Router != nil {
+		c.stack.routes.AddDefault(lease.Router, c.nic.name)
+	}
+	c.stack.setDNSServers(lease.DNS)
+	c.nic.setMTU(lease.MTU)
+}
+
+// リースで設定したものを取り除く
+func (c *DHCPClient) unbind(lease *DHCPLease) {
+	c.nic.RemoveAddress(lease.Addr.IP)
+	if lease.Router != nil {
+		c.stack.routes.removeVia(defaultRouteDest(), lease.Router, c.nic.name)
+	}
+	c.stack.setDNSServers(nil)
+	c.nic.setMTU(0)
+
+	// リースがなくなったのにRENEWINGやREBINDINGのままだと，WaitBoundが借りていると思ってしまう
+	c.mu.Lock()
+	c.lease = nil
+	if c.state != DHCPStopped {
+		c.setStateLocked(DHCPInit)
+	}
+	c.mu.Unlock()
+}
+
+// 使えなかったアドレスをサーバへ知らせる
+func (c *DHCPClient) decline(lease *DHCPLease) {
+	msg := c.newMessage(layers.DHCPMsgTypeDecline, rand.Uint32())
+	msg.Flags = 0
+	msg.Options = append(msg.Options,
+		layers.NewDHCPOption(layers.DHCPOptRequestIP, lease.Addr.IP.To4()),
+		layers.NewDHCPOption(layers.DHCPOptServerID, lease.Server.To4()))
+	if err := c.broadcastFrom(nil)(msg); err != nil {
+		fmt.Printf("DHCP DECLINEの送信に失敗: %v\n", err)
+	}
+}
+
+// クライアントが送るDHCPメッセージを作る
+func (c *DHCPClient) newMessage(typ layers.DHCPMsgType, xid uint32) *layers.DHCPv4 {
+	mac := c.nic.HardwareAddr()
+	msg := &layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  uint8(len(mac)),
+		Xid:          xid,
+		Flags:        dhcpFlagBroadcast,
+		ClientHWAddr: mac,
+		Options: layers.DHCPOptions{
+			layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(typ)}),
+			layers.NewDHCPOption(layers.DHCPOptClientID, append([]byte{byte(layers.LinkTypeEthernet)}, mac...)),
+		},
+	}
+	if typ == layers.DHCPMsgTypeDiscover || typ == layers.DHCPMsgTypeRequest {
+		msg.Options = append(msg.Options, layers.NewDHCPOption(layers.DHCPOptParamsRequest, []byte{
+			byte(layers.DHCPOptSubnetMask),
+			byte(layers.DHCPOptRouter),
+			byte(layers.DHCPOptDNS),
+			byte(layers.DHCPOptInterfaceMTU),
+			byte(layers.DHCPOptLeaseTime),
+			byte(layers.DHCPOptT1),
+			byte(layers.DHCPOptT2),
+		}))
+		if c.config.Hostname != "" {
+			msg.Options = append(msg.Options, layers.NewDHCPOption(layers.DHCPOptHostname, []byte(c.config.Hostname)))
+		}
+	}
+	return msg
+}
+
+// 送信元をsrcIP(nilなら0.0.0.0)にしてブロードキャストで送る
+func (c *DHCPClient) broadcastFrom(srcIP net.IP) func(*layers.DHCPv4) error {
+	return func(msg *layers.DHCPv4) error {
+		return c.nic.sendIPv4Broadcast(srcIP, layers.IPProtocolUDP, NewUDPHeader(dhcpClientPort, dhcpServerPort), msg)
+	}
+}
+
+// リースを貸したサーバへユニキャストで送る
+func (c *DHCPClient) sendToServer(lease *DHCPLease) func(*layers.DHCPv4) error {
+	return func(msg *layers.DHCPv4) error {
+		return c.stack.sendIPv4(lease.Addr.IP, lease.Server, layers.IPProtocolUDP, NewUDPHeader(dhcpClientPort, dhcpServerPort), msg)
+	}
+}
+
+func defaultRouteDest() net.IPNet {
+	return net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+}
+
+// DHCPメッセージの種類(オプション53)
+func dhcpMessageType(msg *layers.DHCPv4) layers.DHCPMsgType {
+	for _, o := range msg.Options {
+		if o.Type == layers.DHCPOptMessageType && len(o.Data) == 1 {
+			return layers.DHCPMsgType(o.Data[0])
+		}
+	}
+	return layers.DHCPMsgTypeUnspecified
+}
+
+// OFFERとACKからリースを読み取る
+func parseDHCPLease(msg *layers.DHCPv4, now time.Time) (*DHCPLease, error) {
+	ip := msg.YourClientIP.To4()
+	if ip == nil || ip.IsUnspecified() {
+		return nil, fmt.Errorf("割り当てるアドレスがありません")
+	}
+	ip = append(net.IP(nil), ip...)
+	lease := &DHCPLease{
+		Addr:     net.IPNet{IP: ip, Mask: ip.DefaultMask()},
+		Obtained: now,
+	}
+	for _, o := range msg.Options {
+		switch o.Type {
+		case layers.DHCPOptSubnetMask:
+			if len(o.Data) == 4 {
+				lease.Addr.Mask = net.IPMask(append([]byte(nil), o.Data...))
+			}
+		case layers.DHCPOptRouter:
+			if len(o.Data) >= 4 {
+				lease.Router = append(net.IP(nil), o.Data[:4]...)
+			}
+		case layers.DHCPOptDNS:
+			for i := 0; i+4 <= len(o.Data); i += 4 {
+				lease.DNS = append(lease.DNS, append(net.IP(nil), o.Data[i:i+4]...))
+			}
+		case layers.DHCPOptInterfaceMTU:
+			if len(o.Data) == 2 {
+				lease.MTU = int(binary.BigEndian.Uint16(o.Data))
+			}
+		case layers.DHCPOptServerID:
+			if len(o.Data) == 4 {
+				lease.Server = append(net.IP(nil), o.Data...)
+			}
+		case layers.DHCPOptLeaseTime:
+			if len(o.Data) == 4 {
+				lease.LeaseTime = time.Duration(binary.BigEndian.Uint32(o.Data)) * time.Second
+			}
+		case layers.DHCPOptT1:
+			if len(o.Data) == 4 {
+				lease.RenewalTime = time.Duration(binary.BigEndian.Uint32(o.Data)) * time.Second
+			}
+		case layers.DHCPOptT2:
+			if len(o.Data) == 4 {
+				lease.RebindingTime = time.Duration(binary.BigEndian.Uint32(o.Data)) * time.Second
+			}
+		}
+	}
+	if lease.Server == nil {
+		return nil, fmt.Errorf("サーバ識別子がありません")
+	}
+	if lease.LeaseTime <= 0 {
+		return nil, fmt.Errorf("リース期間がありません")
+	}
+	// T1とT2がなければリース期間の1/2と7/8にする(RFC 2131 Section 4.4.5)
+	if lease.RenewalTime <= 0 || lease.RenewalTime > lease.LeaseTime {
+		lease.RenewalTime = lease.LeaseTime / 2
+	}
+	if lease.RebindingTime <= lease.RenewalTime || lease.RebindingTime > lease.LeaseTime {
+		lease.RebindingTime = lease.LeaseTime * 7 / 8
+	}
+	return lease, nil
+}
@@ -0,0 +1,466 @@
+package tcpip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// テスト用のDHCPサーバが受け取ったメッセージ
+type dhcpServerEvent struct {
+	typ layers.DHCPMsgType
+	// 受け取った時刻(仮想時計)
+	at time.Time
+	// ブロードキャストで届いたか
+	broadcast bool
+	// ciaddr
+	clientIP net.IP
+	// 受け取ったときのクライアントの状態
+	state DHCPState
+}
+
+// テスト用の最小限のDHCPサーバ
+// 10.1.0.50から順にアドレスを貸し，応答はすべてブロードキャストで返す
+type testDHCPServer struct {
+	nic   *NIC
+	ip    net.IP
+	rx    <-chan *udpDatagram
+	lease time.Duration
+
+	mu     sync.Mutex
+	client *DHCPClient
+	// クライアントのMACアドレスごとに貸したアドレス
+	leases map[string]net.IP
+	// DECLINEされたアドレス
+	declined map[string]bool
+	// REQUESTに応答しない(ユニキャストだけか，すべてか)
+	ignoreUnicast, ignoreAll bool
+	events                   []dhcpServerEvent
+}
+
+func (s *testDHCPServer) serve(done <-chan struct{}) {
+	for {
+		var d *udpDatagram
+		select {
+		case d = <-s.rx:
+		case <-done:
+			return
+		}
+		msg := &layers.DHCPv4{}
+		if err := msg.DecodeFromBytes(d.payload, gopacket.NilDecodeFeedback); err != nil || msg.Operation != layers.DHCPOpRequest {
+			continue
+		}
+		if reply := s.handle(msg, d.dst.Equal(net.IPv4bcast)); reply != nil {
+			s.nic.sendIPv4Broadcast(s.ip, layers.IPProtocolUDP, NewUDPHeader(dhcpServerPort, dhcpClientPort), reply)
+		}
+	}
+}
+
+// メッセージを記録して応答を作る(応答しなければnil)
+func (s *testDHCPServer) handle(msg *layers.DHCPv4, broadcast bool) *layers.DHCPv4 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	typ := dhcpMessageType(msg)
+	ev := dhcpServerEvent{typ: typ, at: s.nic.stack.clock.Now(), broadcast: broadcast, clientIP: msg.ClientIP}
+	if s.client != nil {
+		ev.state = s.client.State()
+	}
+	s.events = append(s.events, ev)
+
+	mac := msg.ClientHWAddr.String()
+	var reply layers.DHCPMsgType
+	switch typ {
+	case layers.DHCPMsgTypeDiscover:
+		reply = layers.DHCPMsgTypeOffer
+	case layers.DHCPMsgTypeRequest:
+		if s.ignoreAll || (s.ignoreUnicast && !broadcast) {
+			return nil
+		}
+		reply = layers.DHCPMsgTypeAck
+	case layers.DHCPMsgTypeDecline:
+		for _, o := range msg.Options {
+			if o.Type == layers.DHCPOptRequestIP {
+				s.declined[net.IP(o.Data).String()] = true
+			}
+		}
+		delete(s.leases, mac)
+		return nil
+	case layers.DHCPMsgTypeRelease:
+		delete(s.leases, mac)
+		return nil
+	default:
+		return nil
+	}
+
+	ip, ok := s.leases[mac]
+	for host := byte(50); !ok; host++ {
+		ip = net.IPv4(10, 1, 0, host).To4()
+		ok = !s.declined[ip.String()]
+	}
+	s.leases[mac] = ip
+
+	leaseTime := make([]byte, 4)
+	binary.BigEndian.PutUint32(leaseTime, uint32(s.lease/time.Second))
+	return &layers.DHCPv4{
+		Operation:    layers.DHCPOpReply,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		Xid:          msg.Xid,
+		ClientHWAddr: msg.ClientHWAddr,
+		YourClientIP: ip,
+		Options: layers.DHCPOptions{
+			layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(reply)}),
+			layers.NewDHCPOption(layers.DHCPOptServerID, s.ip),
+			layers.NewDHCPOption(layers.DHCPOptLeaseTime, leaseTime),
+			layers.NewDHCPOption(layers.DHCPOptSubnetMask, []byte{255, 255, 255, 0}),
+			layers.NewDHCPOption(layers.DHCPOptRouter, s.ip),
+			layers.NewDHCPOption(layers.DHCPOptDNS, s.ip),
+			layers.NewDHCPOption(layers.DHCPOptInterfaceMTU, []byte{0x05, 0x78}),
+		},
+	}
+}
+
+func (s *testDHCPServer) setIgnore(unicast, all bool) {
+	s.mu.Lock()
+	s.ignoreUnicast, s.ignoreAll = unicast, all
+	s.mu.Unlock()
+}
+
+func (s *testDHCPServer) received() []dhcpServerEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]dhcpServerEvent(nil), s.events...)
+}
+
+// 仮想時計とスイッチでつないだDHCPサーバ(10.1.0.254)とクライアント
+type dhcpEnv struct {
+	clock  *VirtualClock
+	sw     *Switch
+	server *testDHCPServer
+	stack  *Stack
+	nic    *NIC
+	client *DHCPClient
+	start  time.Time
+}
+
+// リース期間leaseのサーバと，dadでプローブするクライアントを用意する
+func newDHCPEnv(t *testing.T, lease time.Duration, dad DADConfig) *dhcpEnv {
+	t.Helper()
+	e := &dhcpEnv{start: time.Unix(1000, 0)}
+	e.clock = NewVirtualClock(e.start)
+	e.sw = NewSwitch(e.clock, 1)
+
+	serverPort := e.sw.AddPort(net.HardwareAddr{2, 0, 0, 0, 1, 0xfe})
+	ss := NewStackWithClock(e.clock)
+	ss.SetDADConfig(DADConfig{})
+	nic := ss.AddNIC("sw", serverPort, ipn("10.1.0.254/24"))
+	_, rx, err := ss.bindUDP(dhcpServerPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.server = &testDHCPServer{
+		nic:      nic,
+		ip:       net.IPv4(10, 1, 0, 254).To4(),
+		rx:       rx,
+		lease:    lease,
+		leases:   make(map[string]net.IP),
+		declined: make(map[string]bool),
+	}
+	done := make(chan struct{})
+	go e.server.serve(done)
+
+	e.stack = NewStackWithClock(e.clock)
+	e.stack.SetDADConfig(dad)
+	e.nic = e.stack.AddNIC("sw", e.sw.AddPort(net.HardwareAddr{2, 0, 0, 0, 1, 1}))
+	// ユニキャストで送るときにアドレス解決のタイマーを使わないよう，サーバのMACアドレスを登録しておく
+	if err := e.stack.Neighbors().AddStatic(e.server.ip, serverPort.HardwareAddr()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if e.client != nil {
+			e.client.Stop()
+		}
+		close(done)
+		e.stack.Close()
+		ss.Close()
+	})
+	return e
+}
+
+// クライアントを始める
+func (e *dhcpEnv) startClient(t *testing.T) {
+	t.Helper()
+	c, err := e.stack.StartDHCP(e.nic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.server.mu.Lock()
+	e.server.client = c
+	e.server.mu.Unlock()
+	e.client = c
+}
+
+// condが成り立つまで，時計をstepずつ進めながら待つ
+// DHCPクライアントは仮想時計のタイマーを別のゴルーチンで待つので，Advanceでは待ちきれない．
+// Advanceのたびに状態を見直す(step=0なら期限の来たタイマーだけを発火させ，時刻は進めない)
+func (e *dhcpEnv) waitFor(t *testing.T, what string, step time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%sになりません(状態 %v，時刻 %v)", what, e.client.State(), e.elapsed())
+		}
+		e.clock.Advance(step)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// クライアントがstateでタイマーを1つだけ待っていて，サーバがn個のメッセージを受け取るまで待つ
+func (e *dhcpEnv) waitIdle(t *testing.T, state DHCPState, n int) {
+	t.Helper()
+	e.waitFor(t, fmt.Sprintf("%v(メッセージ%d個)", state, n), 0, func() bool {
+		return e.client.State() == state && e.clock.Pending() == 1 && len(e.server.received()) == n
+	})
+}
+
+// 始めてからdの時刻まで時計を進める
+func (e *dhcpEnv) advanceTo(d time.Duration) {
+	e.clock.Advance(e.start.Add(d).Sub(e.clock.Now()))
+}
+
+func (e *dhcpEnv) elapsed() time.Duration {
+	return e.clock.Now().Sub(e.start)
+}
+
+// サーバが受け取ったメッセージを確かめる
+func checkDHCPEvent(t *testing.T, ev dhcpServerEvent, typ layers.DHCPMsgType, at time.Time, broadcast bool, state DHCPState) {
+	t.Helper()
+	if ev.typ != typ || !ev.at.Equal(at) || ev.broadcast != broadcast || ev.state != state {
+		t.Fatalf("受け取ったメッセージ: %v %v ブロードキャスト=%v %v, 期待: %v %v %v %v", ev.typ, ev.at, ev.broadcast, ev.state, typ, at, broadcast, state)
+	}
+}
+
+// リースを借りてT1で貸したサーバへ延長を頼み，応答がなければT2から誰にでも頼む
+func TestDHCPLeaseRenewAndRebind(t *testing.T) {
+	e := newDHCPEnv(t, 100*time.Second, DADConfig{})
+	e.startClient(t)
+	e.waitIdle(t, DHCPBound, 2)
+
+	ev := e.server.received()
+	checkDHCPEvent(t, ev[0], layers.DHCPMsgTypeDiscover, e.start, true, DHCPSelecting)
+	checkDHCPEvent(t, ev[1], layers.DHCPMsgTypeRequest, e.start, true, DHCPRequesting)
+	lease, ok := e.client.Lease()
+	if !ok {
+		t.Fatal("リースがありません")
+	}
+	if lease.Addr.String() != "10.1.0.50/24" || !lease.Server.Equal(e.server.ip) || !lease.Obtained.Equal(e.start) ||
+		lease.LeaseTime != 100*time.Second || lease.RenewalTime != 50*time.Second || lease.RebindingTime != 87500*time.Millisecond {
+		t.Fatalf("リース: %+v", lease)
+	}
+	if !e.nic.hasAddress(lease.Addr.IP) || e.nic.MTU() != 1400 || len(e.stack.DNSServers()) != 1 {
+		t.Fatalf("設定: アドレス %v MTU %d DNS %v", e.nic.Addresses(), e.nic.MTU(), e.stack.DNSServers())
+	}
+	if _, _, gw, err := e.stack.route(net.IPv4(192, 0, 2, 1)); err != nil || !gw.Equal(e.server.ip) {
+		t.Fatalf("デフォルトルート: %v %v", gw, err)
+	}
+
+	// T1の直前まではBOUNDのまま
+	e.server.setIgnore(true, false)
+	e.advanceTo(50*time.Second - time.Millisecond)
+	e.waitIdle(t, DHCPBound, 2)
+
+	// T1で貸したサーバへユニキャストで延長を頼む
+	e.advanceTo(50 * time.Second)
+	e.waitIdle(t, DHCPRenewing, 3)
+	ev = e.server.received()
+	checkDHCPEvent(t, ev[2], layers.DHCPMsgTypeRequest, e.start.Add(50*time.Second), false, DHCPRenewing)
+	if !ev[2].clientIP.Equal(lease.Addr.IP) {
+		t.Fatalf("ciaddr: %v", ev[2].clientIP)
+	}
+
+	// T2からはブロードキャストで頼み，ACKを受け取ったらBOUNDに戻る
+	e.advanceTo(87500 * time.Millisecond)
+	e.waitIdle(t, DHCPBound, 4)
+	checkDHCPEvent(t, e.server.received()[3], layers.DHCPMsgTypeRequest, e.start.Add(87500*time.Millisecond), true, DHCPRebinding)
+	renewed, _ := e.client.Lease()
+	if !renewed.Obtained.Equal(e.start.Add(87500*time.Millisecond)) || !e.nic.hasAddress(lease.Addr.IP) {
+		t.Fatalf("延長したリース: %+v", renewed)
+	}
+}
+
+// 延長できないまま期限が切れたら設定を取り除き，DISCOVERからやり直す
+func TestDHCPLeaseExpires(t *testing.T) {
+	e := newDHCPEnv(t, 100*time.Second, DADConfig{})
+	e.startClient(t)
+	e.waitIdle(t, DHCPBound, 2)
+
+	e.server.setIgnore(false, true)
+	e.advanceTo(50 * time.Second)
+	e.waitIdle(t, DHCPRenewing, 3)
+	e.advanceTo(87500 * time.Millisecond)
+	e.waitIdle(t, DHCPRebinding, 4)
+
+	// 期限の直前まではアドレスを使い続ける
+	e.advanceTo(100*time.Second - time.Millisecond)
+	if !e.nic.hasAddress(net.IPv4(10, 1, 0, 50)) {
+		t.Fatal("期限の前にアドレスがなくなりました")
+	}
+	// DISCOVERからやり直す(REQUESTには応答がない)
+	e.advanceTo(100 * time.Second)
+	e.waitIdle(t, DHCPRequesting, 6)
+	if e.nic.hasAddress(net.IPv4(10, 1, 0, 50)) || len(e.stack.DNSServers()) != 0 || e.nic.MTU() == 1400 {
+		t.Fatalf("設定が残っています: アドレス %v DNS %v MTU %d", e.nic.Addresses(), e.stack.DNSServers(), e.nic.MTU())
+	}
+	if _, _, _, err := e.stack.route(net.IPv4(192, 0, 2, 1)); err == nil {
+		t.Fatal("デフォルトルートが残っています")
+	}
+	checkDHCPEvent(t, e.server.received()[4], layers.DHCPMsgTypeDiscover, e.start.Add(100*time.Second), true, DHCPSelecting)
+}
+
+// リースを取り除くと同時にINITに戻り，リースのないRENEWINGやREBINDINGでWaitBoundが返らない
+func TestDHCPWaitBoundWithoutLease(t *testing.T) {
+	e := newDHCPEnv(t, 100*time.Second, DADConfig{})
+	e.startClient(t)
+	e.waitIdle(t, DHCPBound, 2)
+	c := e.client
+	lease, _ := c.Lease()
+
+	c.setState(DHCPRebinding)
+	c.unbind(&lease)
+	if st := c.State(); st != DHCPInit {
+		t.Fatalf("リースを取り除いた後の状態: %v", st)
+	}
+
+	c.setState(DHCPRebinding)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.WaitBound(time.Second)
+		errc <- err
+	}()
+	e.waitFor(t, "WaitBoundのタイムアウト", 100*time.Millisecond, func() bool { return len(errc) == 1 })
+	if err := <-errc; err == nil {
+		t.Fatal("リースがないのにWaitBoundが成功しました")
+	}
+}
+
+// 期限が切れてリースを取り除く間もWaitBoundを呼び続け，リースのない状態を返さないことを確かめる
+func TestDHCPWaitBoundAcrossExpiry(t *testing.T) {
+	e := newDHCPEnv(t, 100*time.Second, DADConfig{})
+	e.startClient(t)
+	e.waitIdle(t, DHCPBound, 2)
+	e.server.setIgnore(false, true)
+	e.advanceTo(50 * time.Second)
+	e.waitIdle(t, DHCPRenewing, 3)
+	e.advanceTo(87500 * time.Millisecond)
+	e.waitIdle(t, DHCPRebinding, 4)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	errc := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				lease, err := e.client.WaitBound(time.Minute)
+				if err == nil && lease.Addr.IP == nil {
+					errc <- fmt.Errorf("空のリースが返りました(状態 %v)", e.client.State())
+					return
+				}
+			}
+		}()
+	}
+
+	// 期限が切れてDISCOVERからやり直し，また借りられるまで進める
+	e.advanceTo(100 * time.Second)
+	e.waitFor(t, "アドレスの削除", 0, func() bool { return !e.nic.hasAddress(net.IPv4(10, 1, 0, 50)) })
+	e.server.setIgnore(false, false)
+	e.waitFor(t, "BOUND", time.Second, func() bool { return e.client.State() == DHCPBound })
+	close(stop)
+	wg.Wait()
+	select {
+	case err := <-errc:
+		t.Fatal(err)
+	default:
+	}
+}
+
+// プローブで衝突したアドレスはDECLINEし，DeclineWaitだけ待ってからDISCOVERをやり直す
+func TestDHCPDeclineOnConflict(t *testing.T) {
+	const declineWait = 10 * time.Second
+	e := newDHCPEnv(t, 100*time.Second, DADConfig{ProbeNum: 1, AnnounceWait: time.Second})
+	e.stack.SetDHCPConfig(DHCPConfig{DeclineWait: declineWait})
+
+	// サーバが最初に貸すアドレスをすでに使っているホスト
+	owner := NewStackWithClock(e.clock)
+	defer owner.Close()
+	owner.SetDADConfig(DADConfig{})
+	owner.AddNIC("sw", e.sw.AddPort(net.HardwareAddr{2, 0, 0, 0, 1, 2}), ipn("10.1.0.50/24"))
+
+	e.startClient(t)
+	// プローブへの応答で衝突に気づくので，時計を進めずにDECLINEが届く
+	e.waitIdle(t, DHCPRequesting, 3)
+	ev := e.server.received()
+	checkDHCPEvent(t, ev[2], layers.DHCPMsgTypeDecline, e.start, true, DHCPRequesting)
+	if e.nic.hasAddress(net.IPv4(10, 1, 0, 50)) {
+		t.Fatal("衝突したアドレスを追加しました")
+	}
+
+	// DeclineWaitの後にやり直し，次のアドレスを借りる
+	e.advanceTo(declineWait - time.Millisecond)
+	e.waitIdle(t, DHCPRequesting, 3)
+	e.advanceTo(declineWait)
+	e.waitIdle(t, DHCPRequesting, 5)
+	ev = e.server.received()
+	checkDHCPEvent(t, ev[3], layers.DHCPMsgTypeDiscover, e.start.Add(declineWait), true, DHCPSelecting)
+	// ACKを受け取ったかどうかは外から見えないので，少しずつ進めてプローブを終わらせる
+	e.waitFor(t, "BOUND", 100*time.Millisecond, func() bool { return e.client.State() == DHCPBound })
+	lease, _ := e.client.Lease()
+	if !lease.Addr.IP.Equal(net.IPv4(10, 1, 0, 51)) || !e.nic.hasAddress(lease.Addr.IP) {
+		t.Fatalf("リース: %+v", lease)
+	}
+}
+
+// RELEASEでリースを返し，設定を取り除く
+func TestDHCPRelease(t *testing.T) {
+	e := newDHCPEnv(t, 100*time.Second, DADConfig{})
+	e.startClient(t)
+	e.waitIdle(t, DHCPBound, 2)
+	lease, _ := e.client.Lease()
+
+	if err := e.client.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if st := e.client.State(); st != DHCPStopped {
+		t.Fatalf("状態: %v", st)
+	}
+	if e.nic.hasAddress(lease.Addr.IP) || len(e.stack.DNSServers()) != 0 {
+		t.Fatalf("設定が残っています: アドレス %v DNS %v", e.nic.Addresses(), e.stack.DNSServers())
+	}
+	if _, ok := e.client.Lease(); ok {
+		t.Fatal("リースが残っています")
+	}
+	e.waitFor(t, "RELEASEの受信", 0, func() bool { return len(e.server.received()) == 3 })
+	ev := e.server.received()[2]
+	checkDHCPEvent(t, ev, layers.DHCPMsgTypeRelease, e.start, false, DHCPStopped)
+	if !ev.clientIP.Equal(lease.Addr.IP) {
+		t.Fatalf("ciaddr: %v", ev.clientIP)
+	}
+	e.server.mu.Lock()
+	_, ok := e.server.leases[e.nic.HardwareAddr().String()]
+	e.server.mu.Unlock()
+	if ok {
+		t.Fatal("サーバにリースが残っています")
+	}
+}
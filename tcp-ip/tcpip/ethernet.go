@@ -18,6 +18,8 @@ func NewEthernet(srcMAC net.HardwareAddr, dstMAC net.HardwareAddr, ethType strin
 	switch ethType {
 	case "IPv4":
 		ethernet.EthernetType = layers.EthernetTypeIPv4
+	case "IPv6":
+		ethernet.EthernetType = layers.EthernetTypeIPv6
 	case "ARP":
 		ethernet.EthernetType = layers.EthernetTypeARP
 	}
@@ -0,0 +1,318 @@
+package tcpip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// 受信したICMP(ICMPv6)エコーリプライ
+type icmpEcho struct {
+	from net.IP
+	ttl  uint8
+	seq  uint16
+	// ICMPヘッダを含む長さ
+	bytes    int
+	received time.Time
+}
+
+// 新しいICMPヘッダを作成
+func NewICMPHeader(icmpType, code uint8, id, seq uint16) *layers.ICMPv4 {
+	return &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(icmpType, code),
+		Id:       id,
+		Seq:      seq,
+	}
+}
+
+// 受信したICMPパケットを処理する
+// 自分宛てのエコーリクエストには応答し，エコーリプライは識別子が一致するpingへ渡す
+func (s *Stack) handleICMP(nic *NIC, ip *layers.IPv4, icmp *layers.ICMPv4) {
+	switch icmp.TypeCode.Type() {
+	case layers.ICMPv4TypeEchoRequest:
+		// カーネルと共有しているアドレスならカーネルが応答する
+		if !nic.acceptsIPv4(ip.DstIP) || nic.isKernelShared() {
+			return
+		}
+		// 受け取ったデータをそのまま送り返す
+		reply := NewICMPHeader(layers.ICMPv4TypeEchoReply, 0, icmp.Id, icmp.Seq)
+		var src net.IP
+		if nic.hasAddress(ip.DstIP) {
+			src = ip.DstIP
+		}
+		s.sendReply(ip.SrcIP, func() {
+			if err := s.sendIPv4(src, ip.SrcIP, layers.IPProtocolICMPv4, reply, gopacket.Payload(icmp.Payload)); err != nil {
+				fmt.Printf("ICMPエコーリプライの送信に失敗: %v\n", err)
+			}
+		})
+	case layers.ICMPv4TypeEchoReply:
+		s.mu.RLock()
+		ch, ok := s.icmp[icmp.Id]
+		s.mu.RUnlock()
+		if !ok {
+			return
+		}
+		select {
+		case ch <- &icmpEcho{from: ip.SrcIP, ttl: ip.TTL, seq: icmp.Seq, bytes: len(icmp.Payload) + 8, received: s.clock.Now()}:
+		default:
+		}
+	case layers.ICMPv4TypeDestinationUnreachable:
+		fmt.Printf("ICMP到達不能を受信[%v]: %v\n", ip.SrcIP, icmp.TypeCode)
+	case layers.ICMPv4TypeTimeExceeded:
+		fmt.Printf("ICMP時間超過を受信[%v]: %v\n", ip.SrcIP, icmp.TypeCode)
+	}
+}
+
+// ICMPエラーに入れる，元のデータグラムの先頭の長さ(RFC 792)
+const icmpErrorDataLen = 8
+
+// 受け取ったパケットの送信元へICMP(ICMPv6)ポート到達不能を返す
+func (s *Stack) sendPortUnreachable(l gopacket.NetworkLayer) {
+	ip, ok := l.(*layers.IPv4)
+	if !ok {
+		s.sendPortUnreachableIPv6(l.(*layers.IPv6))
+		return
+	}
+	// 受信したフレームのバッファを参照しないようコピーする
+	orig := append(append([]byte(nil), ip.Contents...), ip.Payload...)
+	src := append(net.IP(nil), ip.DstIP...)
+	dst := append(net.IP(nil), ip.SrcIP...)
+	s.sendICMPError(src, dst, layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort, orig)
+}
+
+// ICMPエラーを送る
+// 相手がどのパケットへのエラーか判断できるよう，元のIPヘッダ(origの先頭)とデータの先頭8バイトを入れる
+func (s *Stack) sendICMPError(src, dst net.IP, icmpType, code uint8, orig []byte) {
+	n := int(orig[0]&0x0f)*4 + icmpErrorDataLen
+	if n > len(orig) {
+		n = len(orig)
+	}
+	data := orig[:n]
+
+	msg := NewICMPHeader(icmpType, code, 0, 0)
+	s.sendReply(dst, func() {
+		if err := s.sendIPv4(src, dst, layers.IPProtocolICMPv4, msg, gopacket.Payload(data)); err != nil {
+			fmt.Printf("ICMPエラー(%v)の送信に失敗: %v\n", msg.TypeCode, err)
+		}
+	})
+}
+
+// ICMPエコーの識別子にエンドポイントを登録
+func (s *Stack) registerICMP() (uint16, <-chan *icmpEcho) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		id := uint16(rand.Intn(math.MaxUint16 + 1))
+		if _, ok := s.icmp[id]; ok {
+			continue
+		}
+		ch := make(chan *icmpEcho, endpointQueueLen)
+		s.icmp[id] = ch
+		return id, ch
+	}
+}
+
+func (s *Stack) unregisterICMP(id uint16) {
+	s.mu.Lock()
+	delete(s.icmp, id)
+	s.mu.Unlock()
+}
+
+// pingの設定
+type PingOptions struct {
+	// 送るエコーリクエストの数(0なら4)
+	Count int
+	// 送信間隔(0なら1秒)
+	Interval time.Duration
+	// ICMPデータ部の長さ(0なら56バイト)
+	Size int
+	// 最後のリクエストを送った後にリプライを待つ時間(0なら1秒)
+	Timeout time.Duration
+}
+
+// 受信した1つのエコーリプライ
+type PingReply struct {
+	From net.IP
+	Seq  int
+	// ICMPヘッダを含む長さ
+	Bytes int
+	TTL   uint8
+	RTT   time.Duration
+}
+
+// pingの統計
+type PingStatistics struct {
+	Transmitted int
+	Received    int
+	// 全体の所要時間
+	Time   time.Duration
+	MinRTT time.Duration
+	AvgRTT time.Duration
+	MaxRTT time.Duration
+	// RTTの標準偏差
+	MdevRTT time.Duration
+}
+
+// パケットロス率(%)
+func (st *PingStatistics) Loss() float64 {
+	if st.Transmitted == 0 {
+		return 0
+	}
+	return float64(st.Transmitted-st.Received) * 100 / float64(st.Transmitted)
+}
+
+// ICMPエコーリクエストを送り，リプライを受け取るたびにonReplyを呼ぶ
+func (s *Stack) Ping(dst net.IP, opts PingOptions, onReply func(PingReply)) (*PingStatistics, error) {
+	if dst.To16() == nil {
+		return nil, fmt.Errorf("無効な宛先IPアドレス: %v", dst)
+	}
+	if opts.Count <= 0 {
+		opts.Count = 4
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.Size <= 0 {
+		opts.Size = 56
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = time.Second
+	}
+
+	id, replies := s.registerICMP()
+	defer s.unregisterICMP(id)
+
+	var (
+		mu sync.Mutex
+		// 送信時刻(通し番号ごと)と，最後に送った通し番号
+		sent = make(map[int]time.Time)
+		last int
+		rtts []time.Duration
+	)
+	stats := &PingStatistics{}
+	start := s.clock.Now()
+
+	// 受信側: 送信時刻と突き合わせてRTTを測る
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	allReceived := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case r := <-replies:
+				mu.Lock()
+				seq := pingSeq(last, r.seq)
+				sentAt, ok := sent[seq]
+				delete(sent, seq)
+				if !ok {
+					// 重複したリプライ
+					mu.Unlock()
+					continue
+				}
+				rtt := r.received.Sub(sentAt)
+				rtts = append(rtts, rtt)
+				stats.Received++
+				if stats.Received == opts.Count {
+					close(allReceived)
+				}
+				mu.Unlock()
+
+				if onReply != nil {
+					onReply(PingReply{
+						From:  r.from,
+						Seq:   seq,
+						Bytes: r.bytes,
+						TTL:   r.ttl,
+						RTT:   rtt,
+					})
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// 送信側: データ部の先頭に送信時刻を入れ，残りは決まったパターンで埋める
+	for seq := 1; seq <= opts.Count; seq++ {
+		if seq > 1 {
+			sleep(s.clock, opts.Interval)
+		}
+		payload := make([]byte, opts.Size)
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+		if len(payload) >= 8 {
+			binary.BigEndian.PutUint64(payload, uint64(s.clock.Now().UnixNano()))
+		}
+
+		mu.Lock()
+		sent[seq] = s.clock.Now()
+		// ヘッダのシーケンス番号が一周して同じ値になったリクエストは，もう返ってこないものとする
+		delete(sent, seq-(math.MaxUint16+1))
+		last = seq
+		stats.Transmitted++
+		mu.Unlock()
+
+		if err := s.sendEchoRequest(dst, id, uint16(seq), payload); err != nil {
+			close(done)
+			<-finished
+			return stats, err
+		}
+	}
+
+	// すべて返ってくるか，タイムアウトするまで待つ
+	timer := s.clock.NewTimer(opts.Timeout)
+	select {
+	case <-allReceived:
+	case <-timer.C():
+	}
+	timer.Stop()
+	close(done)
+	<-finished
+
+	mu.Lock()
+	defer mu.Unlock()
+	stats.Time = s.clock.Now().Sub(start)
+	if len(rtts) > 0 {
+		var sum, sum2 float64
+		stats.MinRTT = rtts[0]
+		for _, rtt := range rtts {
+			if rtt < stats.MinRTT {
+				stats.MinRTT = rtt
+			}
+			if rtt > stats.MaxRTT {
+				stats.MaxRTT = rtt
+			}
+			sum += float64(rtt)
+			sum2 += float64(rtt) * float64(rtt)
+		}
+		avg := sum / float64(len(rtts))
+		stats.AvgRTT = time.Duration(avg)
+		stats.MdevRTT = time.Duration(math.Sqrt(math.Max(sum2/float64(len(rtts))-avg*avg, 0)))
+	}
+	return stats, nil
+}
+
+// 16bitのシーケンス番号を，最後に送った通し番号から65536個以内の通し番号に戻す
+func pingSeq(last int, seq uint16) int {
+	return last - int(uint16(last)-seq)
+}
+
+// ICMP(ICMPv6)エコーリクエストを送る
+func (s *Stack) sendEchoRequest(dst net.IP, id, seq uint16, payload []byte) error {
+	if isIPv6(dst) {
+		icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0)}
+		echo := &layers.ICMPv6Echo{Identifier: id, SeqNumber: seq}
+		return s.sendIPv6(nil, dst, layers.IPProtocolICMPv6, icmp, echo, gopacket.Payload(payload))
+	}
+	icmp := NewICMPHeader(layers.ICMPv4TypeEchoRequest, 0, id, seq)
+	return s.sendIPv4(nil, dst, layers.IPProtocolICMPv4, icmp, gopacket.Payload(payload))
+}
@@ -0,0 +1,28 @@
+package tcpip
+
+import (
+	"math"
+	"testing"
+)
+
+// ヘッダの16bitのシーケンス番号が一周しても，送った通し番号に戻せる
+func TestPingSeq(t *testing.T) {
+	for _, tc := range []struct {
+		last int
+		seq  uint16
+		want int
+	}{
+		{1, 1, 1},
+		{10, 7, 7},
+		{math.MaxUint16, math.MaxUint16, math.MaxUint16},
+		{math.MaxUint16 + 1, 0, math.MaxUint16 + 1},
+		// 一周した後に，一周する前のリクエストへのリプライが届いた
+		{math.MaxUint16 + 3, math.MaxUint16, math.MaxUint16},
+		{math.MaxUint16 + 3, 2, math.MaxUint16 + 3},
+		{3*(math.MaxUint16+1) + 5, 4, 3*(math.MaxUint16+1) + 4},
+	} {
+		if got := pingSeq(tc.last, tc.seq); got != tc.want {
+			t.Errorf("pingSeq(%d, %d) = %d, 期待 %d", tc.last, tc.seq, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package tcpip
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// 受信したICMPv6パケットを処理する
+// 近隣探索のメッセージは重複アドレス検出中のアドレス宛てでも受け取る
+func (s *Stack) handleICMPv6(nic *NIC, ip *layers.IPv6, icmp *layers.ICMPv6, packet gopacket.Packet) {
+	if !nic.acceptsIPv6(ip.DstIP) {
+		return
+	}
+	switch icmp.TypeCode.Type() {
+	case layers.ICMPv6TypeNeighborSolicitation, layers.ICMPv6TypeNeighborAdvertisement, layers.ICMPv6TypeRouterAdvertisement:
+		nic.handleNDP(ip, icmp, packet)
+	case layers.ICMPv6TypeEchoRequest:
+		echoLayer := packet.Layer(layers.LayerTypeICMPv6Echo)
+		if echoLayer == nil || nic.isTentative(ip.DstIP) || nic.isKernelShared() {
+			return
+		}
+		echo := echoLayer.(*layers.ICMPv6Echo)
+		// マルチキャスト宛てなら経路から選んだアドレスで答える
+		var src net.IP
+		if nic.hasAddress(ip.DstIP) {
+			src = cloneIP(ip.DstIP)
+		}
+		dst := cloneIP(ip.SrcIP)
+		reply := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoReply, 0)}
+		replyEcho := &layers.ICMPv6Echo{Identifier: echo.Identifier, SeqNumber: echo.SeqNumber}
+		// ICMPv6Echoはデータ部をPayloadに入れないので，識別子とシーケンス番号の後ろを取り出す
+		data := append([]byte(nil), icmp.Payload[4:]...)
+		s.sendReply(dst, func() {
+			if err := s.sendIPv6(src, dst, layers.IPProtocolICMPv6, reply, replyEcho, gopacket.Payload(data)); err != nil {
+				fmt.Printf("ICMPv6エコーリプライの送信に失敗: %v\n", err)
+			}
+		})
+	case layers.ICMPv6TypeEchoReply:
+		echoLayer := packet.Layer(layers.LayerTypeICMPv6Echo)
+		if echoLayer == nil {
+			return
+		}
+		echo := echoLayer.(*layers.ICMPv6Echo)
+		s.mu.RLock()
+		ch, ok := s.icmp[echo.Identifier]
+		s.mu.RUnlock()
+		if !ok {
+			return
+		}
+		select {
+		case ch <- &icmpEcho{from: cloneIP(ip.SrcIP), ttl: ip.HopLimit, seq: echo.SeqNumber, bytes: len(icmp.Contents) + len(icmp.Payload), received: s.clock.Now()}:
+		default:
+		}
+	case layers.ICMPv6TypeDestinationUnreachable:
+		fmt.Printf("ICMPv6到達不能を受信[%v]: %v\n", ip.SrcIP, icmp.TypeCode)
+	}
+}
+
+// ICMPv6ポート到達不能を返す
+// エラーメッセージ全体が最小MTUに収まる範囲で，元のパケットをできるだけ入れる(RFC 4443 Section 2.4)
+func (s *Stack) sendPortUnreachableIPv6(ip *layers.IPv6) {
+	orig := append(append([]byte(nil), ip.Contents...), ip.Payload...)
+	if limit := ipv6MinMTU - ipv6HeaderLen - 8; len(orig) > limit {
+		orig = orig[:limit]
+	}
+	src := cloneIP(ip.DstIP)
+	dst := cloneIP(ip.SrcIP)
+
+	// 未使用の4バイトの後ろに元のパケットを続ける
+	msg := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodePortUnreachable)}
+	data := append(make([]byte, 4), orig...)
+	s.sendReply(dst, func() {
+		if err := s.sendIPv6(src, dst, layers.IPProtocolICMPv6, msg, gopacket.Payload(data)); err != nil {
+			fmt.Printf("ICMPv6ポート到達不能の送信に失敗: %v\n", err)
+		}
+	})
+}
@@ -3,15 +3,100 @@ package tcpip
 import (
 	"net"
 
+	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
+// IPヘッダのTTLの既定値
+const defaultTTL = 64
+
 func NewIPHeader(srcIP, dstIP net.IP) *layers.IPv4 {
 	return &layers.IPv4{
 		Version:  4,
 		IHL:      5,
+		TTL:      defaultTTL,
 		Protocol: layers.IPProtocolUDP,
 		SrcIP:    srcIP,
 		DstIP:    dstIP,
 	}
 }
+
+// 上位層のチェックサム計算にIPヘッダ(疑似ヘッダ)が必要な層
+type checksumLayer interface {
+	SetNetworkLayerForChecksum(gopacket.NetworkLayer) error
+}
+
+// 経路に従ってIPv4パケットを送信する
+// srcIPがnilなら経路から選んだ送信元アドレスを使う
+func (s *Stack) sendIPv4(srcIP, dstIP net.IP, proto layers.IPProtocol, l ...gopacket.SerializableLayer) error {
+	// 経路から送信に使うインタフェース，送信元IPアドレス，次の転送先を選ぶ
+	nic, routeSrc, nextHop, err := s.route(dstIP)
+	if err != nil {
+		return err
+	}
+	if srcIP == nil {
+		srcIP = routeSrc
+	}
+
+	// 次の転送先のMACアドレスを取得(近隣テーブルにあればそれを使う)
+	dstMAC, err := s.neighbors.resolve(nic, srcIP, nextHop)
+	if err != nil {
+		return err
+	}
+
+	ip := NewIPHeader(srcIP, dstIP.To4())
+	ip.Protocol = proto
+	return nic.writeIPv4(dstMAC, ip, l...)
+}
+
+// インタフェースから制限ブロードキャスト(255.255.255.255)でIPv4パケットを送る
+// アドレスが決まる前(DHCP)でも送れるよう，経路もARPも使わない．srcIPがnilなら0.0.0.0にする
+func (n *NIC) sendIPv4Broadcast(srcIP net.IP, proto layers.IPProtocol, l ...gopacket.SerializableLayer) error {
+	if srcIP == nil {
+		srcIP = net.IPv4zero
+	}
+	ip := NewIPHeader(srcIP.To4(), net.IPv4bcast.To4())
+	ip.Protocol = proto
+	return n.writeIPv4(layers.EthernetBroadcast, ip, l...)
+}
+
+// 自分のアドレス宛て(またはブロードキャスト)のパケットか判定
+func (n *NIC) acceptsIPv4(dst net.IP) bool {
+	if dst.Equal(net.IPv4bcast) || dst.IsMulticast() {
+		return true
+	}
+	n.stack.mu.RLock()
+	defer n.stack.mu.RUnlock()
+	for _, a := range n.addrs {
+		if a.IP.Equal(dst) {
+			return true
+		}
+		// サブネットのブロードキャストアドレス
+		if a.Contains(dst) && isBroadcast(dst, a.Mask) {
+			return true
+		}
+	}
+	return false
+}
+
+// 宛先アドレスの種類に合わせて，自分宛てのパケットか判定する
+func (n *NIC) acceptsIP(dst net.IP) bool {
+	if isIPv6(dst) {
+		return n.acceptsIPv6(dst) && !n.isTentative(dst)
+	}
+	return n.acceptsIPv4(dst)
+}
+
+// ホスト部がすべて1ならブロードキャストアドレス
+func isBroadcast(ip net.IP, mask net.IPMask) bool {
+	ip4 := ip.To4()
+	if ip4 == nil || len(mask) != net.IPv4len {
+		return false
+	}
+	for i := range ip4 {
+		if ip4[i]|mask[i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
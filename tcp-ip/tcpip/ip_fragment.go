@@ -0,0 +1,393 @@
+package tcpip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// IPv4データグラムの最大長(全長フィールドは16ビット)
+const maxIPv4DatagramLen = 65535
+
+// IPv4ヘッダの最小長(オプションなし)
+const ipv4HeaderLen = 20
+
+// DFビットが立っているデータグラムがMTUを超えた
+var ErrFragmentationNeeded = errors.New("DFビットが立っているためフラグメントできません")
+
+// フラグメントの再構築の設定
+type ReassemblyConfig struct {
+	// 最初のフラグメントを受け取ってから，すべて揃うまで待つ時間
+	Timeout time.Duration
+	// 再構築待ちのフラグメントに使うメモリの上限(バイト)．超えたら古いデータグラムから捨てる
+	MemoryLimit int
+	// 1つのデータグラムあたりのフラグメント数の上限
+	MaxFragments int
+}
+
+// Linuxの既定値(ipfrag_time，ipfrag_high_thresh)
+var DefaultReassemblyConfig = ReassemblyConfig{
+	Timeout:      30 * time.Second,
+	MemoryLimit:  4 * 1024 * 1024,
+	MaxFragments: 64,
+}
+
+// フラグメントの再構築の設定を変更する．0の項目は既定値を使う
+func (s *Stack) SetReassemblyConfig(config ReassemblyConfig) {
+	s.mu.Lock()
+	s.reassemblyConfig = config
+	s.mu.Unlock()
+}
+
+func (s *Stack) getReassemblyConfig() ReassemblyConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	config := s.reassemblyConfig
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultReassemblyConfig.Timeout
+	}
+	if config.MemoryLimit <= 0 {
+		config.MemoryLimit = DefaultReassemblyConfig.MemoryLimit
+	}
+	if config.MaxFragments <= 0 {
+		config.MaxFragments = DefaultReassemblyConfig.MaxFragments
+	}
+	return config
+}
+
+// 送信するIPv4データグラムの識別子
+func (s *Stack) nextIPID() uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ipID++
+	return s.ipID
+}
+
+// IPヘッダの後ろに続く層をシリアライズし，MTUを超えるならフラグメントに分けて送信する
+func (n *NIC) writeIPv4(dstMAC net.HardwareAddr, ip *layers.IPv4, l ...gopacket.SerializableLayer) error {
+	for _, layer := range l {
+		if c, ok := layer.(checksumLayer); ok {
+			c.SetNetworkLayerForChecksum(ip)
+		}
+	}
+	// チェックサムはIPヘッダ(疑似ヘッダ)を使うので，分ける前にまとめて計算しておく
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		return fmt.Errorf("パケットのシリアライズに失敗: %v", err)
+	}
+	payload := buf.Bytes()
+	if ipv4HeaderLen+len(payload) > maxIPv4DatagramLen {
+		return fmt.Errorf("IPv4データグラムが大きすぎます: %dバイト", ipv4HeaderLen+len(payload))
+	}
+	if ip.Id == 0 {
+		ip.Id = n.stack.nextIPID()
+	}
+
+	ethernet := NewEthernet(n.HardwareAddr(), dstMAC, "IPv4")
+	mtu := n.MTU()
+	if ipv4HeaderLen+len(payload) <= mtu {
+		return n.writeLayers(&ethernet, ip, gopacket.Payload(payload))
+	}
+	if ip.Flags&layers.IPv4DontFragment != 0 {
+		return fmt.Errorf("%w: %dバイト(MTU %d)", ErrFragmentationNeeded, ipv4HeaderLen+len(payload), mtu)
+	}
+	return n.writeFragments(&ethernet, ip, payload, mtu)
+}
+
+// データ部を8バイト単位のフラグメントに分けて送る(RFC 791)
+func (n *NIC) writeFragments(ethernet *layers.Ethernet, ip *layers.IPv4, payload []byte, mtu int) error {
+	size := (mtu - ipv4HeaderLen) &^ 7
+	if size <= 0 {
+		return fmt.Errorf("MTUが小さすぎてフラグメントできません: %d", mtu)
+	}
+	// フレームを先に作っておき，デバイスが対応していればまとめて送る
+	var frames [][]byte
+	for off := 0; off < len(payload); off += size {
+		end := off + size
+		frag := *ip
+		frag.Flags = ip.Flags | layers.IPv4MoreFragments
+		if end >= len(payload) {
+			end = len(payload)
+			frag.Flags = ip.Flags &^ layers.IPv4MoreFragments
+		}
+		frag.FragOffset = uint16(off / 8)
+		// オプションは最初のフラグメントにだけ付ける(コピーするオプションには対応しない)
+		if off > 0 {
+			frag.Options = nil
+		}
+		frame, err := serializeFrame(ethernet, &frag, gopacket.Payload(payload[off:end]))
+		if err != nil {
+			return err
+		}
+		frames = append(frames, frame)
+	}
+	return n.writeFrames(frames)
+}
+
+// 再構築中のデータグラムを見分けるキー(RFC 791)
+type fragmentKey struct {
+	src, dst netip.Addr
+	proto    layers.IPProtocol
+	id       uint16
+}
+
+// 受け取ったフラグメントのデータ部
+type fragment struct {
+	offset int
+	data   []byte
+}
+
+func (f fragment) end() int {
+	return f.offset + len(f.data)
+}
+
+// 再構築中のデータグラム
+type reassembly struct {
+	nic *NIC
+	// 最初のフラグメント(オフセット0)のIPヘッダ
+	header []byte
+	// オフセット順に並んだ，互いに重ならないフラグメント
+	fragments []fragment
+	// 最後のフラグメントを受け取るまでは-1
+	total   int
+	size    int
+	created time.Time
+	timer   Timer
+}
+
+// フラグメントを集めて元のデータグラムに戻す
+type reassembler struct {
+	stack   *Stack
+	mu      sync.Mutex
+	pending map[fragmentKey]*reassembly
+	memory  int
+}
+
+func newReassembler(s *Stack) *reassembler {
+	return &reassembler{
+		stack:   s,
+		pending: make(map[fragmentKey]*reassembly),
+	}
+}
+
+// フラグメントを加える．すべて揃ったら再構築したパケットを返す
+func (r *reassembler) add(nic *NIC, ip *layers.IPv4) gopacket.Packet {
+	config := r.stack.getReassemblyConfig()
+	key := fragmentKey{src: ipAddr(ip.SrcIP), dst: ipAddr(ip.DstIP), proto: ip.Protocol, id: ip.Id}
+	offset := int(ip.FragOffset) * 8
+	more := ip.Flags&layers.IPv4MoreFragments != 0
+	end := offset + len(ip.Payload)
+
+	// 最後以外のフラグメントの長さは8の倍数．全長が65535を超えるもの(Ping of Death)は捨てる
+	if more && len(ip.Payload)%8 != 0 {
+		fmt.Printf("長さが8の倍数でないフラグメントを破棄: %v -> %v (ID %d)\n", ip.SrcIP, ip.DstIP, ip.Id)
+		return nil
+	}
+	if len(ip.Contents)+end > maxIPv4DatagramLen {
+		fmt.Printf("全長が65535バイトを超えるフラグメントを破棄: %v -> %v (ID %d)\n", ip.SrcIP, ip.DstIP, ip.Id)
+		return nil
+	}
+	if more && len(ip.Payload) == 0 {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, ok := r.pending[key]
+	if !ok {
+		d = &reassembly{nic: nic, total: -1, created: r.stack.clock.Now()}
+		r.pending[key] = d
+		d.timer = r.stack.clock.AfterFunc(config.Timeout, func() { r.expire(key, d) })
+	}
+
+	if !more {
+		if d.total >= 0 && d.total != end {
+			r.dropLocked(key, d, "最後のフラグメントが食い違っています")
+			return nil
+		}
+		d.total = end
+	}
+	if d.total >= 0 && (end > d.total || (len(d.fragments) > 0 && d.fragments[len(d.fragments)-1].end() > d.total)) {
+		r.dropLocked(key, d, "全長を超えるフラグメントがあります")
+		return nil
+	}
+
+	pieces, ok := d.uncovered(offset, ip.Payload)
+	if !ok {
+		// 同じ位置に異なるデータを送ってくるのは攻撃かもしれない(Teardrop)ので，データグラムごと捨てる
+		r.dropLocked(key, d, "重なったフラグメントのデータが一致しません")
+		return nil
+	}
+	if len(d.fragments)+len(pieces) > config.MaxFragments {
+		r.dropLocked(key, d, "フラグメントが多すぎます")
+		return nil
+	}
+	added := 0
+	for _, p := range pieces {
+		added += len(p.data)
+	}
+	if !r.reserveLocked(key, added, config.MemoryLimit) {
+		r.dropLocked(key, d, "再構築に使えるメモリが足りません")
+		return nil
+	}
+	for _, p := range pieces {
+		// 受信したフレームのバッファを参照しないようコピーする
+		p.data = append([]byte(nil), p.data...)
+		d.fragments = append(d.fragments, p)
+	}
+	sort.Slice(d.fragments, func(i, j int) bool { return d.fragments[i].offset < d.fragments[j].offset })
+	d.size += added
+	r.memory += added
+	if offset == 0 && d.header == nil {
+		d.header = append([]byte(nil), ip.Contents...)
+	}
+
+	if !d.complete() {
+		return nil
+	}
+	r.removeLocked(key, d)
+	return d.packet()
+}
+
+// 既に受け取った範囲を除いた部分を返す．重なった部分のデータが食い違っていればfalse
+func (d *reassembly) uncovered(offset int, data []byte) ([]fragment, bool) {
+	pieces := []fragment{{offset: offset, data: data}}
+	for _, f := range d.fragments {
+		var rest []fragment
+		for _, p := range pieces {
+			lo, hi := p.offset, p.end()
+			if f.offset > lo {
+				lo = f.offset
+			}
+			if f.end() < hi {
+				hi = f.end()
+			}
+			if lo >= hi {
+				rest = append(rest, p)
+				continue
+			}
+			if !bytes.Equal(p.data[lo-p.offset:hi-p.offset], f.data[lo-f.offset:hi-f.offset]) {
+				return nil, false
+			}
+			if p.offset < lo {
+				rest = append(rest, fragment{offset: p.offset, data: p.data[:lo-p.offset]})
+			}
+			if hi < p.end() {
+				rest = append(rest, fragment{offset: hi, data: p.data[hi-p.offset:]})
+			}
+		}
+		pieces = rest
+	}
+	return pieces, true
+}
+
+// 最初から最後まで隙間なく揃ったか
+func (d *reassembly) complete() bool {
+	if d.total < 0 || d.header == nil {
+		return false
+	}
+	next := 0
+	for _, f := range d.fragments {
+		if f.offset != next {
+			return false
+		}
+		next = f.end()
+	}
+	return next == d.total
+}
+
+// 最初のフラグメントのヘッダに揃ったデータ部をつなげ，1つのパケットとしてデコードし直す
+func (d *reassembly) packet() gopacket.Packet {
+	data := make([]byte, 0, len(d.header)+d.total)
+	data = append(data, d.header...)
+	for _, f := range d.fragments {
+		data = append(data, f.data...)
+	}
+	// 全長，フラグ(MFとオフセットを消す)，ヘッダチェックサムを書き直す
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)))
+	binary.BigEndian.PutUint16(data[6:8], binary.BigEndian.Uint16(data[6:8])&(uint16(layers.IPv4DontFragment)<<13))
+	binary.BigEndian.PutUint16(data[10:12], 0)
+	binary.BigEndian.PutUint16(data[10:12], ipv4HeaderChecksum(data[:len(d.header)]))
+	return gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.NoCopy)
+}
+
+// メモリの上限を超えるなら，他の古いデータグラムから捨てて空ける
+func (r *reassembler) reserveLocked(key fragmentKey, n, limit int) bool {
+	for r.memory+n > limit {
+		var oldestKey fragmentKey
+		var oldest *reassembly
+		for k, d := range r.pending {
+			if k != key && (oldest == nil || d.created.Before(oldest.created)) {
+				oldestKey, oldest = k, d
+			}
+		}
+		if oldest == nil {
+			return false
+		}
+		r.dropLocked(oldestKey, oldest, "再構築に使えるメモリが足りません")
+	}
+	return true
+}
+
+func (r *reassembler) dropLocked(key fragmentKey, d *reassembly, reason string) {
+	fmt.Printf("フラグメントの再構築を中止: %v -> %v (ID %d): %s\n", key.src, key.dst, key.id, reason)
+	r.removeLocked(key, d)
+}
+
+func (r *reassembler) removeLocked(key fragmentKey, d *reassembly) {
+	if r.pending[key] != d {
+		return
+	}
+	d.timer.Stop()
+	delete(r.pending, key)
+	r.memory -= d.size
+}
+
+// 時間内に揃わなかったデータグラムを捨てる
+// 最初のフラグメントを受け取っていればICMP時間超過(再構築タイムアウト)を返す(RFC 792)
+func (r *reassembler) expire(key fragmentKey, d *reassembly) {
+	r.mu.Lock()
+	if r.pending[key] != d {
+		r.mu.Unlock()
+		return
+	}
+	r.dropLocked(key, d, "タイムアウト")
+	var orig []byte
+	if d.header != nil && len(d.fragments) > 0 && d.fragments[0].offset == 0 {
+		orig = append(append([]byte(nil), d.header...), d.fragments[0].data...)
+	}
+	r.mu.Unlock()
+
+	if orig != nil && !d.nic.isKernelShared() && d.nic.hasAddress(key.dst.AsSlice()) {
+		r.stack.sendICMPError(key.dst.AsSlice(), key.src.AsSlice(), layers.ICMPv4TypeTimeExceeded, layers.ICMPv4CodeFragmentReassemblyTimeExceeded, orig)
+	}
+}
+
+// 再構築待ちのデータグラムをすべて捨てる
+func (r *reassembler) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, d := range r.pending {
+		r.removeLocked(key, d)
+	}
+}
+
+// IPv4ヘッダのチェックサム(RFC 791)
+func ipv4HeaderChecksum(header []byte) uint16 {
+	sum := addChecksum(0, header)
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
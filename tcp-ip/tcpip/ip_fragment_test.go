@@ -0,0 +1,347 @@
+package tcpip
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// フラグメントを直接送り込む相手(10.0.0.9)
+var fragSrcIP = net.IPv4(10, 0, 0, 9).To4()
+
+// パイプの片側だけにスタック(10.0.0.2/24)をつなぎ，もう片側のデバイスでフレームを直接読み書きする
+func rawPeer(t *testing.T, clock Clock) (*Stack, *PipeDevice) {
+	t.Helper()
+	raw, b := NewPipe(net.HardwareAddr{2, 0, 0, 0, 0, 9}, net.HardwareAddr{2, 0, 0, 0, 0, 2})
+	s := NewStackWithClock(clock)
+	s.SetDADConfig(DADConfig{})
+	s.AddNIC("b", b, ipn("10.0.0.2/24"))
+	if err := s.Neighbors().AddStatic(fragSrcIP, raw.HardwareAddr()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+		raw.Close()
+	})
+	return s, raw
+}
+
+// 10.0.0.9:1234から10.0.0.2:9000へのUDPデータグラム(IPヘッダを除く)
+func udpDatagramBytes(t *testing.T, payload []byte) []byte {
+	t.Helper()
+	ip := NewIPHeader(fragSrcIP, net.IPv4(10, 0, 0, 2).To4())
+	udp := NewUDPHeader(1234, 9000)
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// データグラムdataのoff以降をフラグメントとして送る
+func sendFragment(t *testing.T, dev *PipeDevice, id uint16, off int, more bool, data []byte) {
+	t.Helper()
+	ip := NewIPHeader(fragSrcIP, net.IPv4(10, 0, 0, 2).To4())
+	ip.Id = id
+	ip.FragOffset = uint16(off / 8)
+	if more {
+		ip.Flags = layers.IPv4MoreFragments
+	}
+	eth := NewEthernet(dev.HardwareAddr(), net.HardwareAddr{2, 0, 0, 0, 0, 2}, "IPv4")
+	frame, err := serializeFrame(&eth, ip, gopacket.Payload(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.WriteFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 再構築待ちのデータグラムの数とそのメモリ
+func reassemblyState(s *Stack) (int, int) {
+	r := s.fragments
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.pending), r.memory
+}
+
+// 再構築待ちのデータグラムの数がnになるのを待つ
+func waitReassembly(t *testing.T, s *Stack, n int) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		if pending, _ := reassemblyState(s); pending == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	pending, memory := reassemblyState(s)
+	t.Fatalf("再構築待ち: %d(%dバイト), 期待: %d", pending, memory, n)
+}
+
+// デバイスからフレームを読む
+func readFrame(t *testing.T, dev *PipeDevice) gopacket.Packet {
+	t.Helper()
+	ch := make(chan []byte, 1)
+	go func() {
+		frame, _ := dev.ReadFrame()
+		ch <- frame
+	}()
+	select {
+	case frame := <-ch:
+		return gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	case <-time.After(3 * time.Second):
+		t.Fatal("フレームが届きません")
+	}
+	return nil
+}
+
+func receiveUDP(t *testing.T, ch <-chan *udpDatagram) []byte {
+	t.Helper()
+	select {
+	case d := <-ch:
+		return d.payload
+	case <-time.After(3 * time.Second):
+		t.Fatal("UDPデータグラムが届きません")
+	}
+	return nil
+}
+
+// MTUを超えるデータグラムは8バイト単位のフラグメントに分けて送る
+func TestFragmentByMTU(t *testing.T) {
+	a, raw := NewPipe(net.HardwareAddr{2, 0, 0, 0, 0, 1}, net.HardwareAddr{2, 0, 0, 0, 0, 9})
+	a.SetMTU(576)
+	s := NewStack()
+	s.SetDADConfig(DADConfig{})
+	n := s.AddNIC("a", a, ipn("10.0.0.1/24"))
+	defer s.Close()
+	defer raw.Close()
+
+	payload := make([]byte, 1500)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	ip := NewIPHeader(net.IPv4(10, 0, 0, 1).To4(), fragSrcIP)
+	if err := n.writeIPv4(raw.HardwareAddr(), ip, NewUDPHeader(1234, 9000), gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	// UDPヘッダ(8バイト)+1500バイトを，556バイトに収まる8の倍数(552バイト)ずつに分ける
+	wantLens := []int{552, 552, 404}
+	var data []byte
+	for i, want := range wantLens {
+		p := readFrame(t, raw)
+		if len(p.Data()) > 576+ethernetHeaderLen {
+			t.Fatalf("%d番目のフラグメントがMTUを超えています: %dバイト", i, len(p.Data()))
+		}
+		frag := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		more := frag.Flags&layers.IPv4MoreFragments != 0
+		if frag.Id != ip.Id || int(frag.FragOffset)*8 != len(data) || more != (i < len(wantLens)-1) || len(frag.Payload) != want {
+			t.Fatalf("%d番目のフラグメント: ID=%d オフセット=%d MF=%v 長さ=%d", i, frag.Id, frag.FragOffset, more, len(frag.Payload))
+		}
+		if ipv4HeaderChecksum(frag.Contents) != 0 {
+			t.Fatalf("%d番目のフラグメントのヘッダチェックサムが不正です", i)
+		}
+		data = append(data, frag.Payload...)
+	}
+	if !bytes.Equal(data[8:], payload) {
+		t.Fatal("フラグメントをつなげても元のデータになりません")
+	}
+}
+
+// DFビットが立っていればMTUを超えても分けずにエラーを返す
+func TestFragmentDontFragment(t *testing.T) {
+	_, _, na, _ := twoStacks(t)
+	ip := NewIPHeader(net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4())
+	ip.Flags = layers.IPv4DontFragment
+	err := na.writeIPv4(net.HardwareAddr{2, 0, 0, 0, 0, 2}, ip, NewUDPHeader(1, 2), gopacket.Payload(make([]byte, 2000)))
+	if !errors.Is(err, ErrFragmentationNeeded) {
+		t.Fatalf("エラー: %v", err)
+	}
+}
+
+// MTUの小さいパイプ越しに，フラグメントに分けたUDPとICMPを組み立て直して受け取る
+func TestFragmentPipe(t *testing.T) {
+	sa, sb, na, nb := twoStacks(t)
+	na.dev.(*PipeDevice).SetMTU(600)
+	nb.dev.(*PipeDevice).SetMTU(600)
+	srv, err := sb.Bind(9000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	c, err := sa.Bind(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	msg := make([]byte, 20000)
+	for i := range msg {
+		msg[i] = byte(i * 13)
+	}
+	if _, err := c.WriteTo(msg, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 9000}); err != nil {
+		t.Fatal(err)
+	}
+	srv.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 65536)
+	n, _, err := srv.ReadFrom(buf)
+	if err != nil || !bytes.Equal(buf[:n], msg) {
+		t.Fatalf("受信: %dバイト %v", n, err)
+	}
+	// UDPで送れる最大の長さを超える
+	if _, err := c.WriteTo(make([]byte, 65508), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 9000}); err == nil {
+		t.Fatal("65535バイトを超えるデータグラムを送れました")
+	}
+
+	st, err := sa.Ping(net.IPv4(10, 0, 0, 2), PingOptions{Count: 1, Size: 4000, Timeout: 2 * time.Second}, nil)
+	if err != nil || st.Received != 1 {
+		t.Fatalf("ping: %+v %v", st, err)
+	}
+}
+
+// 順番が入れ替わったり重なったりしても組み立て，重なった部分が食い違えば捨てる
+func TestFragmentOverlap(t *testing.T) {
+	s, raw := rawPeer(t, SystemClock)
+	_, ch, err := s.bindUDP(9000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.unbindUDP(9000)
+	payload := make([]byte, 40)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	data := udpDatagramBytes(t, payload)
+
+	// 最後，重複，データが一致する重なり，最初の順
+	sendFragment(t, raw, 1, 32, false, data[32:])
+	sendFragment(t, raw, 1, 8, true, data[8:24])
+	sendFragment(t, raw, 1, 8, true, data[8:24])
+	sendFragment(t, raw, 1, 16, true, data[16:40])
+	sendFragment(t, raw, 1, 0, true, data[:16])
+	if got := receiveUDP(t, ch); !bytes.Equal(got, payload) {
+		t.Fatalf("受信: %v", got)
+	}
+	if pending, memory := reassemblyState(s); pending != 0 || memory != 0 {
+		t.Fatalf("再構築待ち: %d(%dバイト)", pending, memory)
+	}
+
+	// 同じ位置に異なるデータ(Teardrop)
+	sendFragment(t, raw, 2, 0, true, data[:16])
+	waitReassembly(t, s, 1)
+	bad := append([]byte(nil), data[8:24]...)
+	bad[0] ^= 0xff
+	sendFragment(t, raw, 2, 8, true, bad)
+	waitReassembly(t, s, 0)
+	sendFragment(t, raw, 2, 16, false, data[16:])
+	waitReassembly(t, s, 1)
+	select {
+	case d := <-ch:
+		t.Fatalf("食い違うフラグメントから組み立てました: %v", d.payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// 最後以外で長さが8の倍数でないフラグメントは捨てる
+	sendFragment(t, raw, 3, 0, true, data[:13])
+	time.Sleep(50 * time.Millisecond)
+	if pending, _ := reassemblyState(s); pending != 1 {
+		t.Fatalf("再構築待ち: %d", pending)
+	}
+}
+
+// 揃わないまま時間が過ぎたら捨て，ICMP時間超過(再構築タイムアウト)を返す
+func TestFragmentTimeout(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(1000, 0))
+	s, raw := rawPeer(t, clock)
+	s.SetReassemblyConfig(ReassemblyConfig{Timeout: 10 * time.Second})
+	data := udpDatagramBytes(t, make([]byte, 40))
+
+	sendFragment(t, raw, 7, 0, true, data[:24])
+	waitReassembly(t, s, 1)
+	clock.Advance(9 * time.Second)
+	if pending, _ := reassemblyState(s); pending != 1 {
+		t.Fatal("タイムアウトの前に捨てました")
+	}
+	clock.Advance(time.Second)
+	waitReassembly(t, s, 0)
+
+	p := readFrame(t, raw)
+	icmp, ok := p.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	if !ok || icmp.TypeCode != layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, layers.ICMPv4CodeFragmentReassemblyTimeExceeded) {
+		t.Fatalf("ICMP時間超過が届きません: %v", p)
+	}
+	// 元のデータグラムのヘッダとデータ部の先頭8バイトを含む
+	orig := gopacket.NewPacket(icmp.Payload, layers.LayerTypeIPv4, gopacket.Default)
+	if ip, ok := orig.Layer(layers.LayerTypeIPv4).(*layers.IPv4); !ok || ip.Id != 7 || !ip.SrcIP.Equal(fragSrcIP) {
+		t.Fatalf("時間超過に含まれるデータグラム: %v", orig)
+	}
+}
+
+// メモリの上限を超えたら古いデータグラムから捨てる．0の項目は既定値を使う
+func TestFragmentMemoryLimit(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(1000, 0))
+	s, raw := rawPeer(t, clock)
+	_, ch, err := s.bindUDP(9000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.unbindUDP(9000)
+	s.SetReassemblyConfig(ReassemblyConfig{MemoryLimit: 24})
+	if config := s.getReassemblyConfig(); config.Timeout != DefaultReassemblyConfig.Timeout || config.MaxFragments != DefaultReassemblyConfig.MaxFragments {
+		t.Fatalf("設定: %+v", config)
+	}
+	payload := make([]byte, 16)
+	data := udpDatagramBytes(t, payload)
+
+	sendFragment(t, raw, 3, 0, true, data[:16])
+	waitReassembly(t, s, 1)
+	clock.Advance(time.Second)
+	// 2つ目で32バイトになるので，古いID 3を捨てる
+	sendFragment(t, raw, 4, 0, true, data[:16])
+	for i := 0; i < 200 && !pendingID(s, 4); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if pending, memory := reassemblyState(s); pending != 1 || memory != 16 || !pendingID(s, 4) {
+		t.Fatalf("再構築待ち: %d(%dバイト)", pending, memory)
+	}
+	sendFragment(t, raw, 4, 16, false, data[16:])
+	if got := receiveUDP(t, ch); !bytes.Equal(got, payload) {
+		t.Fatalf("受信: %v", got)
+	}
+
+	// 1つのデータグラムでも上限を超えるなら捨てる
+	sendFragment(t, raw, 5, 0, true, make([]byte, 32))
+	time.Sleep(50 * time.Millisecond)
+	if pending, memory := reassemblyState(s); pending != 0 || memory != 0 {
+		t.Fatalf("再構築待ち: %d(%dバイト)", pending, memory)
+	}
+
+	// 設定を0に戻すと既定の上限(4MB)で組み立てる
+	s.SetReassemblyConfig(ReassemblyConfig{})
+	big := make([]byte, 2000)
+	data = udpDatagramBytes(t, big)
+	sendFragment(t, raw, 6, 1480, false, data[1480:])
+	sendFragment(t, raw, 6, 0, true, data[:1480])
+	if got := receiveUDP(t, ch); !bytes.Equal(got, big) {
+		t.Fatalf("受信: %dバイト", len(got))
+	}
+}
+
+// IDがidのデータグラムを再構築しているか
+func pendingID(s *Stack, id uint16) bool {
+	r := s.fragments
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k := range r.pending {
+		if k.id == id {
+			return true
+		}
+	}
+	return false
+}
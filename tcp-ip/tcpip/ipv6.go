@@ -0,0 +1,192 @@
+package tcpip
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// IPv6ヘッダの長さ(拡張ヘッダなし)
+const ipv6HeaderLen = 40
+
+// IPv6の最小リンクMTU(RFC 8200 Section 5)
+const ipv6MinMTU = 1280
+
+// すべてのノード宛て，すべてのルータ宛てのリンクローカルマルチキャストアドレス
+var (
+	ipv6AllNodes   = net.ParseIP("ff02::1")
+	ipv6AllRouters = net.ParseIP("ff02::2")
+)
+
+func NewIPv6Header(srcIP, dstIP net.IP) *layers.IPv6 {
+	return &layers.IPv6{
+		Version:    6,
+		HopLimit:   defaultTTL,
+		NextHeader: layers.IPProtocolUDP,
+		SrcIP:      srcIP,
+		DstIP:      dstIP,
+	}
+}
+
+// IPv4アドレスでないIPv6アドレスか
+func isIPv6(ip net.IP) bool {
+	return ip.To4() == nil && len(ip) == net.IPv6len
+}
+
+// 経路に従ってIPv4かIPv6のパケットを送信する
+func (s *Stack) sendIP(srcIP, dstIP net.IP, proto layers.IPProtocol, l ...gopacket.SerializableLayer) error {
+	if isIPv6(dstIP) {
+		return s.sendIPv6(srcIP, dstIP, proto, l...)
+	}
+	return s.sendIPv4(srcIP, dstIP, proto, l...)
+}
+
+// 経路に従ってIPv6パケットを送信する
+// srcIPがnilなら経路から選んだ送信元アドレスを使う
+func (s *Stack) sendIPv6(srcIP, dstIP net.IP, proto layers.IPProtocol, l ...gopacket.SerializableLayer) error {
+	nic, routeSrc, nextHop, err := s.route(dstIP)
+	if err != nil {
+		return err
+	}
+	if srcIP == nil {
+		srcIP = routeSrc
+	}
+
+	// 次の転送先のMACアドレスを近隣探索で取得(近隣テーブルにあればそれを使う)
+	dstMAC, err := s.neighbors.resolve(nic, srcIP, nextHop)
+	if err != nil {
+		return err
+	}
+
+	ip := NewIPv6Header(srcIP, dstIP)
+	ip.NextHeader = proto
+	return nic.writeIPv6(dstMAC, ip, l...)
+}
+
+// IPv6パケットを送信する
+// IPv6では途中のルータがフラグメントしないので，MTUを超えるパケットはエラーにする
+func (n *NIC) writeIPv6(dstMAC net.HardwareAddr, ip *layers.IPv6, l ...gopacket.SerializableLayer) error {
+	for _, layer := range l {
+		if c, ok := layer.(checksumLayer); ok {
+			c.SetNetworkLayerForChecksum(ip)
+		}
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		return fmt.Errorf("パケットのシリアライズに失敗: %v", err)
+	}
+	payload := buf.Bytes()
+	if mtu := n.MTU(); ipv6HeaderLen+len(payload) > mtu {
+		return fmt.Errorf("IPv6パケットが大きすぎます: %dバイト(MTU %d)", ipv6HeaderLen+len(payload), mtu)
+	}
+
+	ethernet := NewEthernet(n.HardwareAddr(), dstMAC, "IPv6")
+	return n.writeLayers(&ethernet, ip, gopacket.Payload(payload))
+}
+
+// 自分のアドレス宛て(またはマルチキャスト)のIPv6パケットか判定
+// 重複アドレス検出中のアドレス宛てには近隣探索のメッセージしか届かない
+func (n *NIC) acceptsIPv6(dst net.IP) bool {
+	if dst.Equal(ipv6AllNodes) {
+		return true
+	}
+	n.stack.mu.RLock()
+	defer n.stack.mu.RUnlock()
+	for _, a := range n.addrs {
+		if !isIPv6(a.IP) {
+			continue
+		}
+		if a.IP.Equal(dst) {
+			return true
+		}
+		if dst.Equal(solicitedNodeAddr(a.IP)) {
+			return true
+		}
+	}
+	for addr := range n.tentative {
+		if dst.Equal(solicitedNodeAddr(addr.AsSlice())) {
+			return true
+		}
+	}
+	return false
+}
+
+// 要請ノードマルチキャストアドレス(ff02::1:ff00:0/104 + 下位24ビット，RFC 4291 Section 2.7.1)
+func solicitedNodeAddr(ip net.IP) net.IP {
+	ip = ip.To16()
+	addr := net.ParseIP("ff02::1:ff00:0")
+	copy(addr[13:], ip[13:])
+	return addr
+}
+
+// IPv6マルチキャストアドレスに対応するMACアドレス(33:33 + 下位32ビット，RFC 2464 Section 7)
+func ipv6MulticastMAC(ip net.IP) net.HardwareAddr {
+	ip = ip.To16()
+	return net.HardwareAddr{0x33, 0x33, ip[12], ip[13], ip[14], ip[15]}
+}
+
+// アドレスのスコープ(RFC 4007)．大きいほど広い
+func ipv6Scope(ip net.IP) int {
+	switch {
+	case ip.IsLoopback(), ip.IsInterfaceLocalMulticast():
+		return 0x1
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+		return 0x2
+	case ip.IsMulticast():
+		return int(ip[1] & 0x0f)
+	}
+	return 0xe
+}
+
+// 宛先に対する送信元IPv6アドレスを選ぶ(RFC 6724 Section 5の一部)
+// 同じアドレス，スコープが合うもの，プレフィックスが長く一致するものの順に優先する
+func (n *NIC) selectSourceIPv6(dst net.IP) net.IP {
+	var best net.IP
+	for _, a := range n.Addresses() {
+		if !isIPv6(a.IP) {
+			continue
+		}
+		if a.IP.Equal(dst) {
+			return a.IP
+		}
+		if best == nil || betterSourceIPv6(a.IP, best, dst) {
+			best = a.IP
+		}
+	}
+	return best
+}
+
+func betterSourceIPv6(a, b, dst net.IP) bool {
+	// ルール2: 宛先のスコープ以上で，できるだけ狭いスコープのアドレス
+	as, bs, ds := ipv6Scope(a), ipv6Scope(b), ipv6Scope(dst)
+	if as != bs {
+		if as < bs {
+			return as >= ds
+		}
+		return bs < ds
+	}
+	// ルール8: 宛先と一致するプレフィックスが長いアドレス
+	return commonPrefixLen(a, dst) > commonPrefixLen(b, dst)
+}
+
+// 先頭から一致しているビット数
+func commonPrefixLen(a, b net.IP) int {
+	a, b = a.To16(), b.To16()
+	n := 0
+	for i := 0; i < net.IPv6len; i++ {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	return n
+}
@@ -0,0 +1,304 @@
+package tcpip
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// テストで待たずに済むように，要請までの遅延をなくして間隔を短くした近隣探索の設定
+var fastNDP = NDPConfig{
+	DADTransmits:               1,
+	RetransTimer:               50 * time.Millisecond,
+	RouterSolicitations:        1,
+	RouterSolicitationInterval: 10 * time.Millisecond,
+}
+
+// twoStacksの両方でIPv6を使い始める
+func v6Stacks(t *testing.T) (*Stack, *Stack, *NIC, *NIC) {
+	t.Helper()
+	sa, sb, na, nb := twoStacks(t)
+	sa.SetNDPConfig(fastNDP)
+	sb.SetNDPConfig(fastNDP)
+	errs := make(chan error, 2)
+	go func() { errs <- na.EnableIPv6() }()
+	go func() { errs <- nb.EnableIPv6() }()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sa, sb, na, nb
+}
+
+// condが成り立つまで待つ
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%sになりません", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// MACアドレスからリンクローカルアドレスを作り，近隣要請と近隣広告で相手のMACアドレスを知る
+func TestIPv6LinkLocal(t *testing.T) {
+	sa, _, na, nb := v6Stacks(t)
+	llA := linkLocalAddr(na.HardwareAddr())
+	llB := linkLocalAddr(nb.HardwareAddr())
+	if llA.String() != "fe80::ff:fe00:1" {
+		t.Fatalf("リンクローカルアドレス: %v", llA)
+	}
+	if !na.hasAddress(llA) || !nb.hasAddress(llB) {
+		t.Fatalf("アドレス: %v %v", na.Addresses(), nb.Addresses())
+	}
+
+	var replies []PingReply
+	stats, err := sa.Ping(llB, PingOptions{Count: 2, Interval: 20 * time.Millisecond, Timeout: 500 * time.Millisecond}, func(r PingReply) {
+		replies = append(replies, r)
+	})
+	if err != nil || stats.Received != 2 {
+		t.Fatalf("ping: %+v %v", stats, err)
+	}
+	if !replies[0].From.Equal(llB) {
+		t.Fatalf("応答の送信元: %v", replies[0].From)
+	}
+	found := false
+	for _, n := range sa.Neighbors().List() {
+		if n.IP.Equal(llB) && n.MAC.String() == nb.HardwareAddr().String() {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("近隣テーブル: %v", sa.Neighbors().List())
+	}
+}
+
+// リンクローカルアドレスでUDPとTCPを使う
+func TestIPv6UDPTCP(t *testing.T) {
+	sa, sb, _, nb := v6Stacks(t)
+	llB := linkLocalAddr(nb.HardwareAddr())
+
+	srv, err := sb.Bind(53)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	cl, err := sa.Bind(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		n, from, err := srv.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		srv.WriteTo(buf[:n], from)
+	}()
+	if _, err := cl.WriteTo([]byte("hello6"), &net.UDPAddr{IP: llB, Port: 53}); err != nil {
+		t.Fatal(err)
+	}
+	cl.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 100)
+	n, from, err := cl.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "hello6" || !from.(*net.UDPAddr).IP.Equal(llB) {
+		t.Fatalf("受信: %q %v %v", buf[:n], from, err)
+	}
+	// IPv6では途中でフラグメントしないので，MTUを超えるものは送れない
+	if _, err := cl.WriteTo(make([]byte, 1500), &net.UDPAddr{IP: llB, Port: 53}); err == nil {
+		t.Fatal("MTUを超えるデータグラムを送れました")
+	}
+
+	l, err := sb.Listen(nil, 80, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	c, err := sa.DialContext(ctx, "tcp6", net.JoinHostPort(llB.String(), "80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 20000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go c.Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(c, got); err != nil || string(got) != string(data) {
+		t.Fatalf("受信: %v", err)
+	}
+	c.Close()
+	if _, err := sa.DialContext(ctx, "tcp4", net.JoinHostPort(llB.String(), "80")); err == nil {
+		t.Fatal("tcp4でIPv6アドレスへ接続できました")
+	}
+	// 待ち受けていないポートへはRST
+	if _, err := sa.DialContext(ctx, "tcp", net.JoinHostPort(llB.String(), "81")); err == nil {
+		t.Fatal("待ち受けていないポートへ接続できました")
+	}
+}
+
+// 重複アドレス検出で，使われているアドレスや同時に検出しているアドレスは追加しない
+func TestIPv6DADConflict(t *testing.T) {
+	sa, sb, na, nb := v6Stacks(t)
+
+	// 相手が使っているアドレスには近隣広告が返ってくる
+	llA := linkLocalAddr(na.HardwareAddr())
+	if err := nb.AddAddress(net.IPNet{IP: llA, Mask: net.CIDRMask(64, 128)}); !errors.Is(err, ErrAddressConflict) {
+		t.Fatalf("エラー: %v", err)
+	}
+	if nb.hasAddress(llA) || nb.isTentative(llA) {
+		t.Fatal("衝突したアドレスが残っています")
+	}
+
+	// 同じアドレスを検出している相手の近隣要請(送信元::)を受け取ると衝突
+	sb.SetNDPConfig(NDPConfig{DADTransmits: 1, RetransTimer: 10 * time.Second})
+	ip := net.ParseIP("fe80::1234")
+	errc := make(chan error, 1)
+	go func() { errc <- nb.AddAddress(net.IPNet{IP: ip, Mask: net.CIDRMask(64, 128)}) }()
+	eventually(t, "検出中", func() bool { return nb.isTentative(ip) })
+	if err := sa.sendNeighborSolicitation(na, nil, ip); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrAddressConflict) {
+			t.Fatalf("エラー: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("衝突を検出しません")
+	}
+	if nb.hasAddress(ip) || nb.isTentative(ip) {
+		t.Fatal("衝突したアドレスが残っています")
+	}
+	// 検出中でなければ衝突として扱わない
+	if nb.tentativeConflict(ip) {
+		t.Fatal("検出中でないアドレスが衝突しました")
+	}
+}
+
+// ルータ広告からデフォルトルート，MTU，プレフィックスのグローバルアドレスを設定する
+func TestIPv6RouterAdvertisement(t *testing.T) {
+	sa, _, na, nb := v6Stacks(t)
+	router := net.ParseIP("fe80::1")
+	prefix := make([]byte, 30)
+	prefix[0] = 64
+	prefix[1] = prefixFlagOnLink | prefixFlagAutonomous
+	binary.BigEndian.PutUint32(prefix[2:], 86400)
+	binary.BigEndian.PutUint32(prefix[6:], 14400)
+	copy(prefix[14:], net.ParseIP("2001:db8::"))
+	mtu := make([]byte, 6)
+	binary.BigEndian.PutUint32(mtu[2:], 1400)
+	ra := &layers.ICMPv6RouterAdvertisement{
+		HopLimit:       64,
+		RouterLifetime: 1800,
+		Options: layers.ICMPv6Options{
+			{Type: layers.ICMPv6OptSourceAddress, Data: nb.HardwareAddr()},
+			{Type: layers.ICMPv6OptMTU, Data: mtu},
+			{Type: layers.ICMPv6OptPrefixInfo, Data: prefix},
+		},
+	}
+	if err := nb.writeNDP(router, ipv6AllNodes, ipv6MulticastMAC(ipv6AllNodes), layers.ICMPv6TypeRouterAdvertisement, ra); err != nil {
+		t.Fatal(err)
+	}
+	global := net.ParseIP("2001:db8::ff:fe00:1")
+	eventually(t, "グローバルアドレスの追加", func() bool { return na.hasAddress(global) })
+	if na.MTU() != 1400 {
+		t.Fatalf("MTU: %d", na.MTU())
+	}
+	if !na.hasIPv6Router() {
+		t.Fatalf("経路: %v", sa.Routes().List())
+	}
+
+	for _, tc := range []struct {
+		dst, src, next string
+	}{
+		// 外部宛てはグローバルアドレスからルータ経由
+		{"2001:db9::5", "2001:db8::ff:fe00:1", "fe80::1"},
+		// 同じプレフィックスはオンリンク
+		{"2001:db8::5", "2001:db8::ff:fe00:1", "2001:db8::5"},
+		// リンクローカル宛てはリンクローカルから
+		{"fe80::2", "fe80::ff:fe00:1", "fe80::2"},
+		// IPv4はそのまま
+		{"10.0.0.2", "10.0.0.1", "10.0.0.2"},
+	} {
+		nic, src, next, err := sa.route(net.ParseIP(tc.dst))
+		if err != nil || nic != na || !src.Equal(net.ParseIP(tc.src)) || !next.Equal(net.ParseIP(tc.next)) {
+			t.Errorf("%sへの経路: 送信元%v 次ホップ%v %v", tc.dst, src, next, err)
+		}
+	}
+
+	// ルータの寿命0でデフォルトルートを消す
+	ra.RouterLifetime = 0
+	ra.Options = ra.Options[:1]
+	if err := nb.writeNDP(router, ipv6AllNodes, ipv6MulticastMAC(ipv6AllNodes), layers.ICMPv6TypeRouterAdvertisement, ra); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "デフォルトルートの削除", func() bool { return !na.hasIPv6Router() })
+}
+
+// 近隣広告のSフラグとOフラグによる近隣テーブルの更新(RFC 4861 Section 7.2.5)
+func TestIPv6NeighborAdvertisementRules(t *testing.T) {
+	sa, _, na, _ := v6Stacks(t)
+	tbl := sa.Neighbors()
+	ip := net.ParseIP("fe80::99")
+	mac1 := net.HardwareAddr{2, 0, 0, 0, 0, 9}
+	mac2 := net.HardwareAddr{2, 0, 0, 0, 0, 10}
+	state := func() (NeighborState, string) {
+		for _, n := range tbl.List() {
+			if n.IP.Equal(ip) {
+				return n.State, n.MAC.String()
+			}
+		}
+		return -1, ""
+	}
+
+	// 要請していない広告ではエントリを作らない
+	tbl.handleAdvertisement(na, ip, mac1, false, true)
+	if st, _ := state(); st != -1 {
+		t.Fatalf("要請していない広告でエントリを作りました: %v", st)
+	}
+	tbl.learn(na, ip, mac1)
+	for _, tc := range []struct {
+		name                string
+		mac                 net.HardwareAddr
+		solicited, override bool
+		state               NeighborState
+		want                net.HardwareAddr
+	}{
+		{"要請への応答", mac1, true, false, NeighborReachable, mac1},
+		{"Oフラグのない別のアドレス", mac2, false, false, NeighborStale, mac1},
+		{"Oフラグのある別のアドレス", mac2, false, true, NeighborStale, mac2},
+	} {
+		tbl.handleAdvertisement(na, ip, tc.mac, tc.solicited, tc.override)
+		if st, m := state(); st != tc.state || m != tc.want.String() {
+			t.Errorf("%s: %v %s", tc.name, st, m)
+		}
+	}
+}
+
+// IPv6ではUDPのチェックサムを省略できない(RFC 8200 Section 8.1)
+func TestUDPChecksumIPv6(t *testing.T) {
+	if udpChecksumValid(net.ParseIP("fe80::1"), net.ParseIP("fe80::2"), &layers.UDP{}) {
+		t.Fatal("チェックサム0のデータグラムを受け取りました")
+	}
+}
@@ -0,0 +1,125 @@
+package tcpip
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/google/gopacket"
+)
+
+// Ethernetヘッダの長さ(デバイスが扱うフレームはFCSを含まない)
+const ethernetHeaderLen = 14
+
+// デバイスが閉じられた後に読み書きしたときのエラー
+var ErrLinkClosed = errors.New("リンクデバイスは閉じられています")
+
+// リンク層(Ethernet)のデバイスを抽象化するインタフェース
+// pcapで実際のNICを使うか，メモリ上のパイプを使うかを差し替えられる
+type LinkDevice interface {
+	// Ethernetフレームを1つ受信する(届くまでブロックする)
+	ReadFrame() ([]byte, error)
+	// Ethernetフレームを1つ送信する
+	WriteFrame(frame []byte) error
+	// 1フレームで運べるペイロードの最大長(Ethernetヘッダを除く)
+	MTU() int
+	// このデバイスのMACアドレス
+	HardwareAddr() net.HardwareAddr
+	// デバイスを閉じる
+	Close() error
+}
+
+// 複数のフレームを1回のシステムコールで送れるデバイス
+type BatchWriter interface {
+	// framesを順に送信し，送れたフレームの数を返す
+	WriteFrames(frames [][]byte) (int, error)
+}
+
+// インタフェースに割り当てられている最初のIPv4アドレスを取得
+func InterfaceIPv4(ifaceName string) (net.IP, error) {
+	ipnet, err := interfaceIPv4Net(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+	return ipnet.IP, nil
+}
+
+// インタフェースに割り当てられている最初のIPv4アドレスをサブネットマスク付きで取得
+func interfaceIPv4Net(ifaceName string) (*net.IPNet, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("インタフェースの取得に失敗: %v", err)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("IPアドレスの取得に失敗: %v", err)
+	}
+
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			if ip := ipnet.IP.To4(); ip != nil {
+				return &net.IPNet{IP: ip, Mask: ipnet.Mask[len(ipnet.Mask)-net.IPv4len:]}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("有効なIPv4アドレスが見つかりません")
+}
+
+// カーネルがインタフェースに割り当てたIPv6アドレスの一覧
+func interfaceIPv6Nets(ifaceName string) ([]net.IPNet, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("インタフェースの取得に失敗: %v", err)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("IPアドレスの取得に失敗: %v", err)
+	}
+
+	var nets []net.IPNet
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && isIPv6(ipnet.IP) {
+			nets = append(nets, *ipnet)
+		}
+	}
+	return nets, nil
+}
+
+// 層を並べてシリアライズし，1つのフレームのバイト列にする
+func serializeFrame(l ...gopacket.SerializableLayer) ([]byte, error) {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		return nil, fmt.Errorf("パケットのシリアライズに失敗: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// 複数のフレームを送信する．デバイスがBatchWriterならまとめて送る
+func writeFrames(dev LinkDevice, frames [][]byte) error {
+	if bw, ok := dev.(BatchWriter); ok {
+		for len(frames) > 0 {
+			n, err := bw.WriteFrames(frames)
+			if err == nil && n == 0 {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
+				return fmt.Errorf("パケットの送信に失敗: %v", err)
+			}
+			frames = frames[n:]
+		}
+		return nil
+	}
+	for _, frame := range frames {
+		if err := dev.WriteFrame(frame); err != nil {
+			return fmt.Errorf("パケットの送信に失敗: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,437 @@
+package tcpip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// 近隣探索のメッセージはリンクの外から届かないよう，ホップリミット255で送り255のものだけを受け取る(RFC 4861 Section 6.1)
+const ndpHopLimit = 255
+
+// 近隣広告のフラグ
+const (
+	ndpFlagRouter    = 0x80
+	ndpFlagSolicited = 0x40
+	ndpFlagOverride  = 0x20
+)
+
+// プレフィックス情報オプションのフラグ
+const (
+	prefixFlagOnLink     = 0x80
+	prefixFlagAutonomous = 0x40
+)
+
+// 近隣探索(RFC 4861)とアドレス自動設定(RFC 4862)のタイマ設定
+type NDPConfig struct {
+	// 重複アドレス検出で送る近隣要請の数(DupAddrDetectTransmits)
+	DADTransmits int
+	// 近隣要請の間隔(RetransTimer)
+	RetransTimer time.Duration
+	// 最初の要請までに待つ時間の上限(0からこの値までランダム)
+	MaxSolicitationDelay time.Duration
+	// ルータ要請を送る回数と間隔
+	RouterSolicitations        int
+	RouterSolicitationInterval time.Duration
+}
+
+// RFC 4861 Section 10，RFC 4862 Section 5.1の既定値
+var DefaultNDPConfig = NDPConfig{
+	DADTransmits:               1,
+	RetransTimer:               time.Second,
+	MaxSolicitationDelay:       time.Second,
+	RouterSolicitations:        3,
+	RouterSolicitationInterval: 4 * time.Second,
+}
+
+// 近隣探索のタイマ設定を変更する
+func (s *Stack) SetNDPConfig(config NDPConfig) {
+	s.mu.Lock()
+	s.ndpConfig = config
+	s.mu.Unlock()
+}
+
+func (s *Stack) getNDPConfig() NDPConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ndpConfig
+}
+
+// インタフェースでIPv6を使い始める
+// MACアドレスからリンクローカルアドレス(fe80::/64)を作り，重複アドレス検出を済ませてからルータ要請を送る
+// ルータ広告を受け取ると，そのプレフィックスからグローバルアドレスも作る(SLAAC)
+// カーネルと共有しているインタフェースでは，カーネルが重複アドレス検出を済ませたアドレスを借りる
+func (n *NIC) EnableIPv6() error {
+	n.stack.mu.Lock()
+	n.ipv6 = true
+	n.stack.mu.Unlock()
+
+	if n.isKernelShared() {
+		addrs, err := interfaceIPv6Nets(n.name)
+		if err != nil {
+			return err
+		}
+		for _, a := range addrs {
+			n.stack.mu.Lock()
+			n.addrs = append(n.addrs, a)
+			n.stack.mu.Unlock()
+			n.stack.addConnectedRoute(n, a)
+		}
+		return nil
+	}
+
+	addr := net.IPNet{IP: linkLocalAddr(n.HardwareAddr()), Mask: net.CIDRMask(64, 128)}
+	if err := n.AddAddress(addr); err != nil {
+		return err
+	}
+	go n.solicitRouters()
+	return nil
+}
+
+func (n *NIC) ipv6Enabled() bool {
+	n.stack.mu.RLock()
+	defer n.stack.mu.RUnlock()
+	return n.ipv6
+}
+
+// MACアドレスから作ったリンクローカルアドレス
+func linkLocalAddr(mac net.HardwareAddr) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	ip[0], ip[1] = 0xfe, 0x80
+	copy(ip[8:], interfaceID(mac))
+	return ip
+}
+
+// MACアドレスから作る修正EUI-64形式のインタフェース識別子(RFC 4291 Appendix A)
+// 間にff:feを挟み，U/Lビットを反転する
+func interfaceID(mac net.HardwareAddr) []byte {
+	return []byte{mac[0] ^ 0x02, mac[1], mac[2], 0xff, 0xfe, mac[3], mac[4], mac[5]}
+}
+
+// 重複アドレス検出(DAD)で衝突がないことを確かめてからIPv6アドレスを追加する(RFC 4862 Section 5.4)
+// 検出中のアドレスは仮(tentative)のアドレスとして，近隣探索のメッセージだけを受け取る
+func (n *NIC) addIPv6Address(addr net.IPNet) error {
+	ip := addr.IP.To16()
+	if n.hasAddress(ip) {
+		return nil
+	}
+	key := ipAddr(ip)
+	conflict := make(chan struct{})
+
+	n.stack.mu.Lock()
+	if n.tentative == nil {
+		n.tentative = make(map[netip.Addr]chan struct{})
+	}
+	if _, ok := n.tentative[key]; ok {
+		n.stack.mu.Unlock()
+		return fmt.Errorf("%vは重複アドレス検出中です", ip)
+	}
+	n.tentative[key] = conflict
+	n.stack.mu.Unlock()
+
+	err := n.detectDuplicate(ip, n.stack.getNDPConfig(), conflict)
+
+	n.stack.mu.Lock()
+	delete(n.tentative, key)
+	if err == nil {
+		n.addrs = append(n.addrs, net.IPNet{IP: ip, Mask: addr.Mask})
+	}
+	n.stack.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	n.stack.addConnectedRoute(n, net.IPNet{IP: ip, Mask: addr.Mask})
+	fmt.Printf("IPv6アドレスを追加[%s]: %v\n", n.name, ip)
+	return nil
+}
+
+// 送信元を未指定アドレス(::)にした近隣要請を送り，誰かがそのアドレスを使っていないか確かめる
+func (n *NIC) detectDuplicate(ip net.IP, config NDPConfig, conflict <-chan struct{}) error {
+	wait := func(d time.Duration) error {
+		timer := n.stack.clock.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-conflict:
+			return fmt.Errorf("%w: %v", ErrAddressConflict, ip)
+		case <-timer.C():
+			return nil
+		}
+	}
+
+	if err := wait(randDuration(0, config.MaxSolicitationDelay)); err != nil {
+		return err
+	}
+	for i := 0; i < config.DADTransmits; i++ {
+		if err := n.stack.sendNeighborSolicitation(n, nil, ip); err != nil {
+			return err
+		}
+		if err := wait(config.RetransTimer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// アドレスが重複アドレス検出中なら，衝突を知らせてtrueを返す
+func (n *NIC) tentativeConflict(ip net.IP) bool {
+	n.stack.mu.Lock()
+	defer n.stack.mu.Unlock()
+	conflict, ok := n.tentative[ipAddr(ip)]
+	if !ok {
+		return false
+	}
+	select {
+	case <-conflict:
+	default:
+		close(conflict)
+	}
+	return true
+}
+
+// アドレスが重複アドレス検出中か
+func (n *NIC) isTentative(ip net.IP) bool {
+	n.stack.mu.RLock()
+	defer n.stack.mu.RUnlock()
+	_, ok := n.tentative[ipAddr(ip)]
+	return ok
+}
+
+// ルータ広告を受け取るまでルータ要請を送る
+func (n *NIC) solicitRouters() {
+	config := n.stack.getNDPConfig()
+	sleep(n.stack.clock, randDuration(0, config.MaxSolicitationDelay))
+	for i := 0; i < config.RouterSolicitations; i++ {
+		if i > 0 {
+			sleep(n.stack.clock, config.RouterSolicitationInterval)
+		}
+		if n.hasIPv6Router() {
+			return
+		}
+		src := linkLocalAddr(n.HardwareAddr())
+		if !n.hasAddress(src) {
+			src = nil
+		}
+		if err := n.stack.sendRouterSolicitation(n, src); err != nil {
+			return
+		}
+	}
+}
+
+// インタフェースにIPv6のデフォルトルートがあるか
+func (n *NIC) hasIPv6Router() bool {
+	for _, r := range n.stack.routes.List() {
+		if r.Interface == n.name && r.Gateway != nil && isIPv6(r.Gateway) {
+			if ones, _ := r.Dest.Mask.Size(); ones == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 近隣探索のメッセージを送る
+func (n *NIC) writeNDP(srcIP, dstIP net.IP, dstMAC net.HardwareAddr, icmpType uint8, msg gopacket.SerializableLayer) error {
+	if srcIP == nil {
+		srcIP = net.IPv6unspecified
+	}
+	ip := NewIPv6Header(srcIP, dstIP)
+	ip.NextHeader = layers.IPProtocolICMPv6
+	ip.HopLimit = ndpHopLimit
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(icmpType, 0)}
+	return n.writeIPv6(dstMAC, ip, icmp, msg)
+}
+
+// 近隣要請を要請ノードマルチキャストアドレスへ送る(リプライの近隣広告は近隣テーブルが受け取る)
+// srcIPがnilなら重複アドレス検出のための要請になる
+func (s *Stack) sendNeighborSolicitation(nic *NIC, srcIP, targetIP net.IP) error {
+	dst := solicitedNodeAddr(targetIP)
+	ns := &layers.ICMPv6NeighborSolicitation{TargetAddress: targetIP.To16()}
+	if srcIP != nil {
+		// 相手が自分のMACアドレスを覚えられるように付ける
+		ns.Options = layers.ICMPv6Options{{Type: layers.ICMPv6OptSourceAddress, Data: nic.HardwareAddr()}}
+	}
+	if err := nic.writeNDP(srcIP, dst, ipv6MulticastMAC(dst), layers.ICMPv6TypeNeighborSolicitation, ns); err != nil {
+		return err
+	}
+	fmt.Printf("近隣要請を[%v]へ送信\n", targetIP)
+	return nil
+}
+
+// 近隣広告を送る．dstMACがnilなら全ノード宛てに送る
+func (s *Stack) sendNeighborAdvertisement(nic *NIC, targetIP, dstIP net.IP, dstMAC net.HardwareAddr, flags uint8) error {
+	if dstMAC == nil {
+		dstIP, dstMAC = ipv6AllNodes, ipv6MulticastMAC(ipv6AllNodes)
+	}
+	na := &layers.ICMPv6NeighborAdvertisement{
+		Flags:         flags,
+		TargetAddress: targetIP.To16(),
+		Options:       layers.ICMPv6Options{{Type: layers.ICMPv6OptTargetAddress, Data: nic.HardwareAddr()}},
+	}
+	if err := nic.writeNDP(targetIP, dstIP, dstMAC, layers.ICMPv6TypeNeighborAdvertisement, na); err != nil {
+		return err
+	}
+	fmt.Printf("近隣広告を[%v]へ送信: %v is-at %v\n", dstIP, targetIP, nic.HardwareAddr())
+	return nil
+}
+
+// ルータ要請を全ルータ宛てに送る
+func (s *Stack) sendRouterSolicitation(nic *NIC, srcIP net.IP) error {
+	rs := &layers.ICMPv6RouterSolicitation{}
+	if srcIP != nil {
+		rs.Options = layers.ICMPv6Options{{Type: layers.ICMPv6OptSourceAddress, Data: nic.HardwareAddr()}}
+	}
+	return nic.writeNDP(srcIP, ipv6AllRouters, ipv6MulticastMAC(ipv6AllRouters), layers.ICMPv6TypeRouterSolicitation, rs)
+}
+
+// リンク層アドレスオプションを探す
+func ndpLinkAddr(options layers.ICMPv6Options, typ layers.ICMPv6Opt) net.HardwareAddr {
+	for _, o := range options {
+		if o.Type == typ && len(o.Data) >= 6 {
+			return append(net.HardwareAddr(nil), o.Data[:6]...)
+		}
+	}
+	return nil
+}
+
+// 受信した近隣探索のメッセージを処理する
+func (n *NIC) handleNDP(ip *layers.IPv6, icmp *layers.ICMPv6, packet gopacket.Packet) {
+	if ip.HopLimit != ndpHopLimit || icmp.TypeCode.Code() != 0 {
+		return
+	}
+	// 自分が送ったメッセージ(キャプチャで戻ってきたもの)は無視する
+	if eth, ok := packet.LinkLayer().(*layers.Ethernet); ok && bytes.Equal(eth.SrcMAC, n.HardwareAddr()) {
+		return
+	}
+	switch icmp.TypeCode.Type() {
+	case layers.ICMPv6TypeNeighborSolicitation:
+		if l := packet.Layer(layers.LayerTypeICMPv6NeighborSolicitation); l != nil {
+			n.handleNeighborSolicitation(ip, l.(*layers.ICMPv6NeighborSolicitation))
+		}
+	case layers.ICMPv6TypeNeighborAdvertisement:
+		if l := packet.Layer(layers.LayerTypeICMPv6NeighborAdvertisement); l != nil {
+			n.handleNeighborAdvertisement(ip, l.(*layers.ICMPv6NeighborAdvertisement))
+		}
+	case layers.ICMPv6TypeRouterAdvertisement:
+		if l := packet.Layer(layers.LayerTypeICMPv6RouterAdvertisement); l != nil {
+			n.handleRouterAdvertisement(ip, l.(*layers.ICMPv6RouterAdvertisement))
+		}
+	}
+}
+
+// 自分のアドレスを問い合わせる近隣要請には近隣広告を返す
+func (n *NIC) handleNeighborSolicitation(ip *layers.IPv6, ns *layers.ICMPv6NeighborSolicitation) {
+	target := append(net.IP(nil), ns.TargetAddress...)
+	if ip.SrcIP.IsUnspecified() {
+		// 他のノードが同じアドレスの重複アドレス検出をしている
+		if n.tentativeConflict(target) {
+			fmt.Printf("IPv6アドレス%vは他のノードも使おうとしています\n", target)
+			return
+		}
+		if n.hasAddress(target) {
+			n.stack.sendNeighborAdvertisement(n, target, nil, nil, ndpFlagOverride)
+		}
+		return
+	}
+
+	mac := ndpLinkAddr(ns.Options, layers.ICMPv6OptSourceAddress)
+	if mac != nil {
+		n.stack.neighbors.learn(n, ip.SrcIP, mac)
+	}
+	if !n.hasAddress(target) || mac == nil {
+		return
+	}
+	src := append(net.IP(nil), ip.SrcIP...)
+	n.stack.sendReply(src, func() {
+		if err := n.stack.sendNeighborAdvertisement(n, target, src, mac, ndpFlagSolicited|ndpFlagOverride); err != nil {
+			fmt.Printf("近隣広告の送信に失敗: %v\n", err)
+		}
+	})
+}
+
+// 近隣広告で近隣テーブルを更新する．自分のアドレスを名乗るものは衝突として扱う
+func (n *NIC) handleNeighborAdvertisement(ip *layers.IPv6, na *layers.ICMPv6NeighborAdvertisement) {
+	target := append(net.IP(nil), na.TargetAddress...)
+	mac := ndpLinkAddr(na.Options, layers.ICMPv6OptTargetAddress)
+	if n.tentativeConflict(target) {
+		fmt.Printf("IPv6アドレス%vは他のホスト(%v)が使っています\n", target, mac)
+		return
+	}
+	if n.hasAddress(target) {
+		if mac != nil && !bytes.Equal(mac, n.HardwareAddr()) {
+			fmt.Printf("IPv6アドレスの衝突を検出: %v is-at %v\n", target, mac)
+		}
+		return
+	}
+	n.stack.neighbors.handleAdvertisement(n, target, mac, na.Flags&ndpFlagSolicited != 0, na.Flags&ndpFlagOverride != 0)
+}
+
+// ルータ広告からデフォルトルート，MTU，プレフィックスを設定する(SLAAC)
+func (n *NIC) handleRouterAdvertisement(ip *layers.IPv6, ra *layers.ICMPv6RouterAdvertisement) {
+	if !n.ipv6Enabled() || !ip.SrcIP.IsLinkLocalUnicast() {
+		return
+	}
+	router := append(net.IP(nil), ip.SrcIP...)
+	if mac := ndpLinkAddr(ra.Options, layers.ICMPv6OptSourceAddress); mac != nil {
+		n.stack.neighbors.learn(n, router, mac)
+	}
+
+	defaultRoute := net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	if ra.RouterLifetime > 0 {
+		n.stack.routes.AddDefault(router, n.name)
+	} else {
+		n.stack.routes.removeVia(defaultRoute, router, n.name)
+	}
+
+	for _, o := range ra.Options {
+		switch o.Type {
+		case layers.ICMPv6OptMTU:
+			if len(o.Data) == 6 {
+				if mtu := int(binary.BigEndian.Uint32(o.Data[2:])); mtu >= ipv6MinMTU {
+					n.setMTU(mtu)
+				}
+			}
+		case layers.ICMPv6OptPrefixInfo:
+			n.handlePrefix(o.Data)
+		}
+	}
+	fmt.Printf("ルータ広告を受信[%s]: ルータ %v (有効期間 %d秒)\n", n.name, router, ra.RouterLifetime)
+}
+
+// プレフィックス情報オプション(RFC 4861 Section 4.6.2)を処理する
+// オンリンクなら直接接続の経路を追加し，自動設定してよいならインタフェース識別子を付けたアドレスを作る
+func (n *NIC) handlePrefix(data []byte) {
+	if len(data) != 30 {
+		return
+	}
+	length, flags := int(data[0]), data[1]
+	valid := binary.BigEndian.Uint32(data[2:6])
+	prefix := net.IPNet{IP: append(net.IP(nil), data[14:30]...), Mask: net.CIDRMask(length, 128)}
+	if valid == 0 || prefix.IP.IsLinkLocalUnicast() || length > 128 {
+		return
+	}
+	prefix.IP = prefix.IP.Mask(prefix.Mask)
+
+	if flags&prefixFlagOnLink != 0 {
+		n.stack.routes.Add(Route{Dest: prefix, Interface: n.name})
+	}
+	// インタフェース識別子は64ビットなので，/64のプレフィックスだけ自動設定できる(RFC 4862 Section 5.5.3)
+	if flags&prefixFlagAutonomous == 0 || length != 64 {
+		return
+	}
+	ip := append(net.IP(nil), prefix.IP...)
+	copy(ip[8:], interfaceID(n.HardwareAddr()))
+	if n.hasAddress(ip) || n.isTentative(ip) {
+		return
+	}
+	go func() {
+		if err := n.AddAddress(net.IPNet{IP: ip, Mask: prefix.Mask}); err != nil {
+			fmt.Printf("IPv6アドレス%vを設定できませんでした: %v\n", ip, err)
+		}
+	}()
+}
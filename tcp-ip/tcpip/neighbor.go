@@ -0,0 +1,477 @@
+package tcpip
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// 近隣エントリの状態
+type NeighborState int
+
+const (
+	// ARPリクエスト(IPv6では近隣要請)を送ってリプライを待っている
+	NeighborIncomplete NeighborState = iota
+	// 最近確認できたのでそのまま使える
+	NeighborReachable
+	// 有効期限が切れているが使える(使うと裏で再確認する)
+	NeighborStale
+	// リプライが返ってこなかった
+	NeighborFailed
+	// 手動で登録した期限のないエントリ
+	NeighborStatic
+)
+
+func (st NeighborState) String() string {
+	switch st {
+	case NeighborIncomplete:
+		return "INCOMPLETE"
+	case NeighborReachable:
+		return "REACHABLE"
+	case NeighborStale:
+		return "STALE"
+	case NeighborFailed:
+		return "FAILED"
+	case NeighborStatic:
+		return "PERMANENT"
+	}
+	return fmt.Sprintf("NeighborState(%d)", int(st))
+}
+
+// 近隣テーブルのタイマ設定
+type NeighborConfig struct {
+	// REACHABLEのままでいられる時間(これを過ぎるとSTALE)
+	ReachableTime time.Duration
+	// STALEになってから削除されるまでの時間
+	StaleTime time.Duration
+	// FAILEDを覚えておく時間(この間は即座にエラーを返す)
+	FailedTime time.Duration
+	// ARPリクエスト，近隣要請の再送間隔
+	RetransTime time.Duration
+	// ARPリクエスト，近隣要請を送る回数
+	MaxRetries int
+}
+
+// 既定の設定(3回×1秒で以前のSendと同じく最大3秒待つ)
+var DefaultNeighborConfig = NeighborConfig{
+	ReachableTime: 30 * time.Second,
+	StaleTime:     60 * time.Second,
+	FailedTime:    3 * time.Second,
+	RetransTime:   time.Second,
+	MaxRetries:    3,
+}
+
+// 近隣テーブルの1エントリを表す
+type Neighbor struct {
+	IP      net.IP
+	MAC     net.HardwareAddr
+	State   NeighborState
+	NIC     string
+	Updated time.Time
+}
+
+type neighborEntry struct {
+	nic     *NIC
+	mac     net.HardwareAddr
+	state   NeighborState
+	updated time.Time
+	probed  time.Time
+	// 解決中のときだけ作られ，結果が出たら閉じられる
+	done chan struct{}
+}
+
+// IPアドレスからMACアドレスを引く近隣テーブル(ARPキャッシュとIPv6の近隣キャッシュ)
+type NeighborTable struct {
+	stack   *Stack
+	mu      sync.Mutex
+	config  NeighborConfig
+	entries map[netip.Addr]*neighborEntry
+}
+
+func newNeighborTable(s *Stack) *NeighborTable {
+	return &NeighborTable{
+		stack:   s,
+		config:  DefaultNeighborConfig,
+		entries: make(map[netip.Addr]*neighborEntry),
+	}
+}
+
+// スタックの近隣テーブル
+func (s *Stack) Neighbors() *NeighborTable {
+	return s.neighbors
+}
+
+// タイマ設定を変更する
+func (t *NeighborTable) SetConfig(config NeighborConfig) {
+	t.mu.Lock()
+	t.config = config
+	t.mu.Unlock()
+}
+
+// 時間経過を考慮した現在の状態
+func (t *NeighborTable) stateLocked(e *neighborEntry, now time.Time) NeighborState {
+	if e.state == NeighborReachable && now.Sub(e.updated) > t.config.ReachableTime {
+		return NeighborStale
+	}
+	return e.state
+}
+
+// 期限切れのエントリを削除する
+func (t *NeighborTable) expireLocked(now time.Time) {
+	for key, e := range t.entries {
+		switch t.stateLocked(e, now) {
+		case NeighborStale:
+			if now.Sub(e.updated) > t.config.ReachableTime+t.config.StaleTime {
+				delete(t.entries, key)
+			}
+		case NeighborFailed:
+			if now.Sub(e.updated) > t.config.FailedTime {
+				delete(t.entries, key)
+			}
+		}
+	}
+}
+
+// エントリの一覧をIPアドレス順に返す
+func (t *NeighborTable) List() []Neighbor {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.stack.clock.Now()
+	t.expireLocked(now)
+
+	list := make([]Neighbor, 0, len(t.entries))
+	for key, e := range t.entries {
+		n := Neighbor{
+			IP:      net.IP(key.AsSlice()),
+			MAC:     e.mac,
+			State:   t.stateLocked(e, now),
+			Updated: e.updated,
+		}
+		if e.nic != nil {
+			n.NIC = e.nic.name
+		}
+		list = append(list, n)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return bytes.Compare(list[i].IP, list[j].IP) < 0
+	})
+	return list
+}
+
+// 静的エントリ以外をすべて削除する
+func (t *NeighborTable) Flush() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, e := range t.entries {
+		if e.state != NeighborStatic && e.state != NeighborIncomplete {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// 期限のない静的エントリを登録する
+func (t *NeighborTable) AddStatic(ip net.IP, mac net.HardwareAddr) error {
+	if ip.To16() == nil {
+		return fmt.Errorf("無効なIPアドレス: %v", ip)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := ipAddr(ip)
+	e, ok := t.entries[key]
+	if !ok {
+		e = &neighborEntry{}
+		t.entries[key] = e
+	}
+	t.completeLocked(e, mac, NeighborStatic)
+	return nil
+}
+
+// エントリを削除する
+func (t *NeighborTable) Delete(ip net.IP) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, ipAddr(ip))
+}
+
+// エントリにMACアドレスを設定し，待っている解決があれば起こす
+func (t *NeighborTable) completeLocked(e *neighborEntry, mac net.HardwareAddr, state NeighborState) {
+	e.mac = append(net.HardwareAddr(nil), mac...)
+	e.state = state
+	e.updated = t.stack.clock.Now()
+	if e.done != nil {
+		close(e.done)
+		e.done = nil
+	}
+}
+
+// 受信したARPパケットでテーブルを更新する
+// リプライ，Gratuitous ARP，自分宛てのリクエストは新しくエントリを作り，
+// それ以外のリクエストは既存エントリだけを更新する
+func (t *NeighborTable) handleARP(p *arpPacket) {
+	arp := p.arp
+	senderIP := net.IP(arp.SourceProtAddress)
+	if len(senderIP) != net.IPv4len || senderIP.IsUnspecified() {
+		return
+	}
+	gratuitous := bytes.Equal(arp.SourceProtAddress, arp.DstProtAddress)
+	// 自分宛てのリクエストなら，相手もこちらと通信するはずなので覚えておく
+	targeted := arp.Operation == layers.ARPRequest && p.nic.hasAddress(arp.DstProtAddress)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := ipAddr(senderIP)
+	e, ok := t.entries[key]
+	if !ok {
+		if arp.Operation != layers.ARPReply && !gratuitous && !targeted {
+			return
+		}
+		e = &neighborEntry{}
+		t.entries[key] = e
+	}
+	if e.state == NeighborStatic {
+		return
+	}
+	e.nic = p.nic
+	t.completeLocked(e, arp.SourceHwAddress, NeighborReachable)
+}
+
+// ipのMACアドレスを，解決を待たずに使えるか
+func (t *NeighborTable) known(ip net.IP) bool {
+	now := t.stack.clock.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expireLocked(now)
+	e, ok := t.entries[ipAddr(ip)]
+	if !ok {
+		return false
+	}
+	switch t.stateLocked(e, now) {
+	case NeighborReachable, NeighborStatic, NeighborStale:
+		return true
+	}
+	return false
+}
+
+// dstへの次の転送先のMACアドレスを，解決を待たずに使えるか
+func (s *Stack) neighborKnown(dst net.IP) bool {
+	_, _, nextHop, err := s.route(dst)
+	return err == nil && s.neighbors.known(nextHop)
+}
+
+// 受信したパケットへの返信を送る
+// 次の転送先のMACアドレスが分かっていればその場で送り，解決を待つなら受信ゴルーチンを止めないよう別のゴルーチンで送る．
+// その場で送れば，仮想時計のAdvanceが返信を待ってから次のタイマーを発火させる
+func (s *Stack) sendReply(dst net.IP, send func()) {
+	if s.neighborKnown(dst) {
+		send()
+		return
+	}
+	go send()
+}
+
+// IPアドレスに対応するMACアドレスを解決する
+// 同じアドレスの解決が進行中なら新しくリクエストを送らずその結果を待つ
+func (t *NeighborTable) resolve(nic *NIC, srcIP, ip net.IP) (net.HardwareAddr, error) {
+	return t.resolveContext(context.Background(), nic, srcIP, ip)
+}
+
+// resolveと同じだが，ctxが終わったら解決を待たずに戻る
+// 同じアドレスを待っているほかの呼び出しのため，リクエストの再送は続ける
+func (t *NeighborTable) resolveContext(ctx context.Context, nic *NIC, srcIP, ip net.IP) (net.HardwareAddr, error) {
+	key := ipAddr(ip)
+	now := t.stack.clock.Now()
+
+	t.mu.Lock()
+	t.expireLocked(now)
+	if e, ok := t.entries[key]; ok {
+		switch t.stateLocked(e, now) {
+		case NeighborReachable, NeighborStatic:
+			mac := e.mac
+			t.mu.Unlock()
+			return mac, nil
+		case NeighborStale:
+			// 古いMACアドレスをそのまま使い，裏で確認し直す
+			mac := e.mac
+			probe := now.Sub(e.probed) > t.config.RetransTime
+			if probe {
+				e.probed = now
+			}
+			t.mu.Unlock()
+			if probe {
+				t.stack.solicit(nic, srcIP, ip)
+			}
+			return mac, nil
+		case NeighborFailed:
+			t.mu.Unlock()
+			return nil, resolveTimeout(ip)
+		case NeighborIncomplete:
+			// 進行中の解決に相乗りする
+			done := e.done
+			t.mu.Unlock()
+			select {
+			case <-done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			return t.result(e, ip)
+		}
+	}
+
+	e := &neighborEntry{
+		nic:   nic,
+		state: NeighborIncomplete,
+		done:  make(chan struct{}),
+	}
+	t.entries[key] = e
+	done := e.done
+	config := t.config
+	t.mu.Unlock()
+
+	if err := t.stack.solicit(nic, srcIP, ip); err != nil {
+		t.fail(e)
+		return nil, err
+	}
+	if ctx.Done() == nil {
+		t.retrySolicit(e, done, nic, srcIP, ip, config)
+		return t.result(e, ip)
+	}
+	go t.retrySolicit(e, done, nic, srcIP, ip, config)
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return t.result(e, ip)
+}
+
+// 最初のリクエストを送った後，解決する(doneが閉じる)までリクエストを再送する．上限に達したら失敗にする
+func (t *NeighborTable) retrySolicit(e *neighborEntry, done <-chan struct{}, nic *NIC, srcIP, ip net.IP, config NeighborConfig) {
+	for i := 1; ; i++ {
+		timer := t.stack.clock.NewTimer(config.RetransTime)
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+		if i >= config.MaxRetries {
+			break
+		}
+		if err := t.stack.solicit(nic, srcIP, ip); err != nil {
+			break
+		}
+	}
+	t.fail(e)
+}
+
+// IPv4ならARPリクエスト，IPv6なら近隣要請でMACアドレスを問い合わせる
+func (s *Stack) solicit(nic *NIC, srcIP, ip net.IP) error {
+	if isIPv6(ip) {
+		return s.sendNeighborSolicitation(nic, srcIP, ip)
+	}
+	return s.sendArpRequest(nic, srcIP, ip)
+}
+
+// 解決に失敗したことを記録し，待っている解決を起こす
+func (t *NeighborTable) fail(e *neighborEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e.state != NeighborIncomplete {
+		return
+	}
+	e.state = NeighborFailed
+	e.updated = t.stack.clock.Now()
+	if e.done != nil {
+		close(e.done)
+		e.done = nil
+	}
+}
+
+// 解決が終わったエントリから結果を取り出す
+func (t *NeighborTable) result(e *neighborEntry, ip net.IP) (net.HardwareAddr, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e.state == NeighborFailed || e.mac == nil {
+		return nil, resolveTimeout(ip)
+	}
+	return e.mac, nil
+}
+
+func resolveTimeout(ip net.IP) error {
+	if isIPv6(ip) {
+		return fmt.Errorf("タイムアウト: 近隣広告を受信できませんでした")
+	}
+	return fmt.Errorf("タイムアウト: ARPリプライを受信できませんでした")
+}
+
+// 近隣要請やルータ広告に付いていたリンク層アドレスを覚える(RFC 4861 Section 7.2.3)
+// MACアドレスが変わっていれば，到達できるかわからないのでSTALEにする
+func (t *NeighborTable) learn(nic *NIC, ip net.IP, mac net.HardwareAddr) {
+	if ip.IsUnspecified() {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := ipAddr(ip)
+	e, ok := t.entries[key]
+	if !ok {
+		e = &neighborEntry{}
+		t.entries[key] = e
+	}
+	if e.state == NeighborStatic || (ok && e.state != NeighborIncomplete && bytes.Equal(e.mac, mac)) {
+		return
+	}
+	e.nic = nic
+	t.completeLocked(e, mac, NeighborStale)
+}
+
+// 受信した近隣広告でテーブルを更新する(RFC 4861 Section 7.2.5)
+// 要請への応答ならREACHABLEにする．Overrideフラグがなければ既存のMACアドレスは書き換えない
+func (t *NeighborTable) handleAdvertisement(nic *NIC, ip net.IP, mac net.HardwareAddr, solicited, override bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.entries[ipAddr(ip)]
+	if !ok || e.state == NeighborStatic {
+		return
+	}
+	state := NeighborStale
+	if solicited {
+		state = NeighborReachable
+	}
+	if e.state == NeighborIncomplete {
+		if mac == nil {
+			return
+		}
+		e.nic = nic
+		t.completeLocked(e, mac, state)
+		return
+	}
+
+	changed := mac != nil && !bytes.Equal(e.mac, mac)
+	if changed && !override {
+		// 別のMACアドレスを名乗っているが上書きしない．確認し直すまでSTALEにしておく
+		if t.stateLocked(e, t.stack.clock.Now()) == NeighborReachable {
+			e.state = NeighborStale
+		}
+		return
+	}
+	if mac == nil {
+		mac = e.mac
+	}
+	if !solicited && !changed {
+		return
+	}
+	t.completeLocked(e, mac, state)
+}
@@ -0,0 +1,319 @@
+package tcpip
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// テストで使う近隣テーブルのタイマ設定
+var testNeighborConfig = NeighborConfig{
+	ReachableTime: 10 * time.Second,
+	StaleTime:     20 * time.Second,
+	FailedTime:    5 * time.Second,
+	RetransTime:   time.Second,
+	MaxRetries:    3,
+}
+
+// 仮想時計で動く10.0.0.2のスタックと，その相手になる生のパイプ
+// スタックが送ったARPリクエストの問い合わせ先は返すチャネルに届く
+func neighborPeer(t *testing.T) (*VirtualClock, *Stack, *PipeDevice, <-chan net.IP) {
+	t.Helper()
+	clock := NewVirtualClock(time.Unix(1000, 0))
+	s, raw := rawPeer(t, clock)
+	s.Neighbors().SetConfig(testNeighborConfig)
+	requests := make(chan net.IP, 64)
+	go func() {
+		for {
+			frame, err := raw.ReadFrame()
+			if err != nil {
+				return
+			}
+			pkt := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+			if arp, ok := pkt.Layer(layers.LayerTypeARP).(*layers.ARP); ok && arp.Operation == layers.ARPRequest {
+				requests <- net.IP(arp.DstProtAddress)
+			}
+		}
+	}()
+	return clock, s, raw, requests
+}
+
+// 生のパイプからARPパケットを送る
+func sendARP(t *testing.T, raw *PipeDevice, arp layers.ARP) {
+	t.Helper()
+	eth := NewEthernet(raw.HardwareAddr(), net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, "ARP")
+	frame, err := serializeFrame(&eth, &arp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := raw.WriteFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 近隣テーブルにあるipのエントリ
+func lookupNeighbor(s *Stack, ip net.IP) (Neighbor, bool) {
+	for _, n := range s.Neighbors().List() {
+		if n.IP.Equal(ip) {
+			return n, true
+		}
+	}
+	return Neighbor{}, false
+}
+
+// ipのエントリがstateになるのを待つ
+func waitNeighbor(t *testing.T, s *Stack, ip net.IP, state NeighborState) Neighbor {
+	t.Helper()
+	var n Neighbor
+	eventually(t, ip.String()+"が"+state.String(), func() bool {
+		var ok bool
+		n, ok = lookupNeighbor(s, ip)
+		return ok && n.State == state
+	})
+	return n
+}
+
+// 届いたARPリクエストの数(少し待って届かなくなるまで数える)
+func countRequests(requests <-chan net.IP, ip net.IP) int {
+	n := 0
+	for {
+		select {
+		case got := <-requests:
+			if got.Equal(ip) {
+				n++
+			}
+		case <-time.After(50 * time.Millisecond):
+			return n
+		}
+	}
+}
+
+// REACHABLEは期限が切れるとSTALEになり，さらに期限が切れると消える
+// STALEのエントリはそのまま使えるが，使うと裏でARPリクエストを送って確認し直す
+func TestNeighborExpiry(t *testing.T) {
+	clock, s, raw, requests := neighborPeer(t)
+	peer := net.IPv4(10, 0, 0, 7).To4()
+	sendARP(t, raw, NewArpReply(peer, raw.HardwareAddr(), net.IPv4(10, 0, 0, 2), net.HardwareAddr{2, 0, 0, 0, 0, 2}))
+	n := waitNeighbor(t, s, peer, NeighborReachable)
+	if n.MAC.String() != raw.HardwareAddr().String() || n.NIC != "b" || !n.Updated.Equal(clock.Now()) {
+		t.Fatalf("エントリ: %+v", n)
+	}
+
+	clock.Advance(testNeighborConfig.ReachableTime)
+	if n, _ := lookupNeighbor(s, peer); n.State != NeighborReachable {
+		t.Fatalf("ReachableTimeちょうどで%v", n.State)
+	}
+	clock.Advance(time.Nanosecond)
+	if n, _ := lookupNeighbor(s, peer); n.State != NeighborStale {
+		t.Fatalf("ReachableTimeを過ぎて%v", n.State)
+	}
+
+	// 使うと古いMACアドレスを返し，確認のリクエストを1回だけ送る
+	for i := 0; i < 2; i++ {
+		mac, err := s.Resolve(peer)
+		if err != nil || mac.String() != raw.HardwareAddr().String() {
+			t.Fatalf("STALEの解決: %v %v", mac, err)
+		}
+	}
+	if n := countRequests(requests, peer); n != 1 {
+		t.Fatalf("STALEの確認のリクエスト: %d回", n)
+	}
+
+	clock.Advance(testNeighborConfig.StaleTime)
+	if n, ok := lookupNeighbor(s, peer); ok {
+		t.Fatalf("期限が切れても残っています: %+v", n)
+	}
+}
+
+// リプライがなければRetransTimeごとにMaxRetries回リクエストを送って失敗し，
+// FailedTimeの間はリクエストを送らずにすぐエラーを返す
+func TestNeighborFailed(t *testing.T) {
+	clock, s, _, requests := neighborPeer(t)
+	peer := net.IPv4(10, 0, 0, 8).To4()
+	base := clock.Pending()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s.Resolve(peer)
+		errc <- err
+	}()
+	for i := 0; i < testNeighborConfig.MaxRetries; i++ {
+		select {
+		case got := <-requests:
+			if !got.Equal(peer) {
+				t.Fatalf("%d回目のリクエストの問い合わせ先: %v", i+1, got)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%d回目のリクエストが届きません", i+1)
+		}
+		if n := waitNeighbor(t, s, peer, NeighborIncomplete); n.MAC != nil {
+			t.Fatalf("解決中のエントリ: %+v", n)
+		}
+		eventually(t, "再送タイマの登録", func() bool { return clock.Pending() > base })
+		clock.AdvanceToNext()
+	}
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("リプライがないのに解決しました")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("解決が終わりません")
+	}
+	waitNeighbor(t, s, peer, NeighborFailed)
+	if n := countRequests(requests, peer); n != 0 {
+		t.Fatalf("上限を超えてリクエストを送りました: %d回", n)
+	}
+
+	if _, err := s.Resolve(peer); err == nil {
+		t.Fatal("FAILEDのエントリで解決しました")
+	}
+	if n := countRequests(requests, peer); n != 0 {
+		t.Fatalf("FAILEDの間にリクエストを送りました: %d回", n)
+	}
+	clock.Advance(testNeighborConfig.FailedTime + time.Nanosecond)
+	if n, ok := lookupNeighbor(s, peer); ok {
+		t.Fatalf("FailedTimeを過ぎても残っています: %+v", n)
+	}
+}
+
+// 同じアドレスの解決が同時に始まっても，リクエストは1回だけ送ってリプライを分け合う
+func TestNeighborResolveCoalesced(t *testing.T) {
+	_, s, raw, requests := neighborPeer(t)
+	peer := net.IPv4(10, 0, 0, 7).To4()
+
+	const callers = 5
+	var wg sync.WaitGroup
+	macs := make(chan net.HardwareAddr, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mac, err := s.Resolve(peer)
+			if err != nil {
+				t.Error(err)
+			}
+			macs <- mac
+		}()
+	}
+	select {
+	case <-requests:
+	case <-time.After(3 * time.Second):
+		t.Fatal("リクエストが届きません")
+	}
+	// 残りの呼び出しが進行中の解決に相乗りするのを待ってから答える
+	time.Sleep(50 * time.Millisecond)
+	sendARP(t, raw, NewArpReply(peer, raw.HardwareAddr(), net.IPv4(10, 0, 0, 2), net.HardwareAddr{2, 0, 0, 0, 0, 2}))
+	wg.Wait()
+	close(macs)
+	for mac := range macs {
+		if mac.String() != raw.HardwareAddr().String() {
+			t.Fatalf("解決したMACアドレス: %v", mac)
+		}
+	}
+	if n := countRequests(requests, peer); n != 0 {
+		t.Fatalf("リクエストを%d回送りました", n+1)
+	}
+}
+
+// Gratuitous ARPは新しいエントリを作り，既存のエントリのMACアドレスを書き換える
+// 自分宛てでないリクエストは知っている相手の分だけ更新し，静的エントリは書き換えない
+func TestNeighborGratuitousARP(t *testing.T) {
+	_, s, raw, _ := neighborPeer(t)
+	peer := net.IPv4(10, 0, 0, 7).To4()
+	oldMAC := net.HardwareAddr{2, 0, 0, 0, 0, 0x77}
+	newMAC := net.HardwareAddr{2, 0, 0, 0, 0, 0x78}
+
+	sendARP(t, raw, NewArpRequest(peer, oldMAC, peer))
+	if n := waitNeighbor(t, s, peer, NeighborReachable); n.MAC.String() != oldMAC.String() {
+		t.Fatalf("Gratuitous ARPで覚えたMACアドレス: %v", n.MAC)
+	}
+	sendARP(t, raw, NewArpRequest(peer, newMAC, peer))
+	eventually(t, "MACアドレスの更新", func() bool {
+		n, _ := lookupNeighbor(s, peer)
+		return n.MAC.String() == newMAC.String() && n.State == NeighborReachable
+	})
+
+	// 他のホスト宛てのリクエストの送信元は覚えないが，知っている相手なら更新する
+	other := net.IPv4(10, 0, 0, 6).To4()
+	sendARP(t, raw, NewArpRequest(other, oldMAC, net.IPv4(10, 0, 0, 5)))
+	sendARP(t, raw, NewArpRequest(peer, oldMAC, net.IPv4(10, 0, 0, 5)))
+	eventually(t, "既存エントリの更新", func() bool {
+		n, _ := lookupNeighbor(s, peer)
+		return n.MAC.String() == oldMAC.String()
+	})
+	if n, ok := lookupNeighbor(s, other); ok {
+		t.Fatalf("他のホスト宛てのリクエストでエントリを作りました: %+v", n)
+	}
+
+	// 静的エントリはGratuitous ARPでも変わらない(fragSrcIPはrawPeerが静的に登録している)
+	sendARP(t, raw, NewArpRequest(fragSrcIP, newMAC, fragSrcIP))
+	sendARP(t, raw, NewArpRequest(peer, newMAC, peer))
+	eventually(t, "後から送ったGratuitous ARPの反映", func() bool {
+		n, _ := lookupNeighbor(s, peer)
+		return n.MAC.String() == newMAC.String()
+	})
+	if n, _ := lookupNeighbor(s, fragSrcIP); n.State != NeighborStatic || n.MAC.String() != raw.HardwareAddr().String() {
+		t.Fatalf("静的エントリが書き換わりました: %+v", n)
+	}
+}
+
+// 静的エントリは期限がなく，Flushでも消えない
+func TestNeighborStaticAndFlush(t *testing.T) {
+	clock, s, raw, requests := neighborPeer(t)
+	static := net.IPv4(10, 0, 0, 50).To4()
+	staticMAC := net.HardwareAddr{2, 0, 0, 0, 0, 0x50}
+	if err := s.Neighbors().AddStatic(static, staticMAC); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Neighbors().AddStatic(net.IP{1, 2, 3}, staticMAC); err == nil {
+		t.Fatal("無効なIPアドレスを登録できました")
+	}
+	peer := net.IPv4(10, 0, 0, 7).To4()
+	sendARP(t, raw, NewArpReply(peer, raw.HardwareAddr(), net.IPv4(10, 0, 0, 2), net.HardwareAddr{2, 0, 0, 0, 0, 2}))
+	waitNeighbor(t, s, peer, NeighborReachable)
+
+	clock.Advance(time.Hour)
+	if n, ok := lookupNeighbor(s, static); !ok || n.State != NeighborStatic {
+		t.Fatalf("静的エントリ: %+v %v", n, ok)
+	}
+	mac, err := s.Resolve(static)
+	if err != nil || mac.String() != staticMAC.String() {
+		t.Fatalf("静的エントリの解決: %v %v", mac, err)
+	}
+	if n := countRequests(requests, static); n != 0 {
+		t.Fatalf("静的エントリにリクエストを送りました: %d回", n)
+	}
+
+	// 期限の切れた動的エントリも静的エントリで上書きできる
+	if err := s.Neighbors().AddStatic(peer, staticMAC); err != nil {
+		t.Fatal(err)
+	}
+	other := net.IPv4(10, 0, 0, 8).To4()
+	sendARP(t, raw, NewArpReply(other, raw.HardwareAddr(), net.IPv4(10, 0, 0, 2), net.HardwareAddr{2, 0, 0, 0, 0, 2}))
+	waitNeighbor(t, s, other, NeighborReachable)
+
+	s.Neighbors().Flush()
+	var got []string
+	for _, n := range s.Neighbors().List() {
+		got = append(got, n.IP.String()+" "+n.State.String())
+	}
+	want := []string{"10.0.0.7 PERMANENT", "10.0.0.9 PERMANENT", "10.0.0.50 PERMANENT"}
+	if len(got) != len(want) {
+		t.Fatalf("Flush後: %v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Flush後: %v, 期待: %v", got, want)
+		}
+	}
+
+	s.Neighbors().Delete(peer)
+	if _, ok := lookupNeighbor(s, peer); ok {
+		t.Fatal("Deleteで静的エントリが消えません")
+	}
+}
@@ -0,0 +1,60 @@
+//go:build cgo
+
+package tcpip
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// pcapで実際のネットワークインタフェースを読み書きするデバイス
+type PcapDevice struct {
+	handle *pcap.Handle
+	iface  *net.Interface
+}
+
+// OpenStackで実際のNICを開く(cgoが使えるのでpcapを使う)
+func openDevice(ifaceName string) (LinkDevice, error) {
+	return OpenPcap(ifaceName)
+}
+
+// 指定されたインタフェースのpcapハンドルを開く
+func OpenPcap(ifaceName string) (*PcapDevice, error) {
+	// パケットを送るために使用するインタフェース情報(例:有線LAN, 無線LAN)を取得
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("インタフェースの取得に失敗: %v", err)
+	}
+
+	// パケットキャプチャ用のハンドルを開く(パケットを送受信するための窓口)
+	handle, err := pcap.OpenLive(ifaceName, 65536, true, pcap.BlockForever)
+	if err != nil {
+		return nil, fmt.Errorf("pcapハンドルのオープンに失敗: %v", err)
+	}
+
+	return &PcapDevice{handle: handle, iface: iface}, nil
+}
+
+func (d *PcapDevice) ReadFrame() ([]byte, error) {
+	data, _, err := d.handle.ReadPacketData()
+	return data, err
+}
+
+func (d *PcapDevice) WriteFrame(frame []byte) error {
+	return d.handle.WritePacketData(frame)
+}
+
+func (d *PcapDevice) MTU() int {
+	return d.iface.MTU
+}
+
+func (d *PcapDevice) HardwareAddr() net.HardwareAddr {
+	return d.iface.HardwareAddr
+}
+
+func (d *PcapDevice) Close() error {
+	d.handle.Close()
+	return nil
+}
@@ -0,0 +1,29 @@
+//go:build !cgo
+
+package tcpip
+
+import (
+	"fmt"
+	"net"
+)
+
+// OpenStackで実際のNICを開く
+// cgoなしではlibpcapを使えないので，AF_PACKETでスタックが処理するフレームだけを受け取る
+func openDevice(ifaceName string) (LinkDevice, error) {
+	config := DefaultAFPacketConfig
+	config.Filter = StackBPFFilter()
+	return OpenAFPacket(ifaceName, config)
+}
+
+// pcapのデバイス(cgoなしのビルドでは使えない)
+type PcapDevice struct{}
+
+func OpenPcap(ifaceName string) (*PcapDevice, error) {
+	return nil, fmt.Errorf("pcapを使うにはcgoを有効にしてビルドしてください")
+}
+
+func (d *PcapDevice) ReadFrame() ([]byte, error)     { return nil, ErrLinkClosed }
+func (d *PcapDevice) WriteFrame(frame []byte) error  { return ErrLinkClosed }
+func (d *PcapDevice) MTU() int                       { return 0 }
+func (d *PcapDevice) HardwareAddr() net.HardwareAddr { return nil }
+func (d *PcapDevice) Close() error                   { return nil }
@@ -0,0 +1,115 @@
+package tcpip
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+)
+
+// パイプの既定MTU(Ethernetと同じ)
+const DefaultPipeMTU = 1500
+
+// 受信キューに溜められるフレーム数
+const pipeQueueLen = 256
+
+// メモリ上で2つのデバイスを直結するケーブルのようなもの
+// root権限やNICがなくても，2つのユーザランドスタックを通信させられる
+type PipeDevice struct {
+	mac       net.HardwareAddr
+	mu        sync.Mutex
+	mtu       int
+	loss      float64
+	rx        chan []byte
+	peer      *PipeDevice
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// 互いに接続された2つのパイプデバイスを作成
+func NewPipe(macA, macB net.HardwareAddr) (*PipeDevice, *PipeDevice) {
+	a := newPipeDevice(macA)
+	b := newPipeDevice(macB)
+	a.peer = b
+	b.peer = a
+	return a, b
+}
+
+func newPipeDevice(mac net.HardwareAddr) *PipeDevice {
+	return &PipeDevice{
+		mac:    mac,
+		mtu:    DefaultPipeMTU,
+		rx:     make(chan []byte, pipeQueueLen),
+		closed: make(chan struct{}),
+	}
+}
+
+// MTUを変更する
+func (d *PipeDevice) SetMTU(mtu int) {
+	d.mu.Lock()
+	d.mtu = mtu
+	d.mu.Unlock()
+}
+
+// 送信したフレームをrate(0から1)の確率で捨てる．損失のあるリンクを再現する
+func (d *PipeDevice) SetLoss(rate float64) {
+	d.mu.Lock()
+	d.loss = rate
+	d.mu.Unlock()
+}
+
+func (d *PipeDevice) ReadFrame() ([]byte, error) {
+	select {
+	case frame := <-d.rx:
+		return frame, nil
+	case <-d.closed:
+		return nil, ErrLinkClosed
+	}
+}
+
+func (d *PipeDevice) WriteFrame(frame []byte) error {
+	select {
+	case <-d.closed:
+		return ErrLinkClosed
+	default:
+	}
+	d.mu.Lock()
+	mtu, loss := d.mtu, d.loss
+	d.mu.Unlock()
+
+	// Ethernetヘッダ+MTUを超えるフレームは送れない
+	if len(frame) > mtu+ethernetHeaderLen {
+		return fmt.Errorf("フレームがMTUを超えています: %dバイト", len(frame))
+	}
+	if loss > 0 && rand.Float64() < loss {
+		return nil
+	}
+
+	// 呼び出し側がバッファを使い回しても壊れないようにコピーする
+	buf := make([]byte, len(frame))
+	copy(buf, frame)
+
+	select {
+	case d.peer.rx <- buf:
+	case <-d.peer.closed:
+		// 相手が閉じていればケーブルが抜けたのと同じで黙って捨てる
+	default:
+		// 受信キューが溢れたら実際のNICと同じく捨てる
+	}
+	return nil
+}
+
+func (d *PipeDevice) MTU() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.mtu
+}
+
+func (d *PipeDevice) HardwareAddr() net.HardwareAddr {
+	return d.mac
+}
+
+func (d *PipeDevice) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	return nil
+}
@@ -0,0 +1,146 @@
+package tcpip
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// テストで待たずに済むように短くしたアドレス衝突検出の設定
+var fastDAD = DADConfig{ProbeNum: 2, ProbeMin: 10 * time.Millisecond, ProbeMax: 20 * time.Millisecond, AnnounceWait: 20 * time.Millisecond, AnnounceNum: 1}
+
+// "10.0.0.1/24"のような文字列をアドレスとプレフィックスにする
+func ipn(s string) net.IPNet {
+	ip, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	n.IP = ip
+	return *n
+}
+
+// パイプでつないだ2つのスタック(10.0.0.1/24と10.0.0.2/24)
+func twoStacks(t *testing.T) (*Stack, *Stack, *NIC, *NIC) {
+	t.Helper()
+	a, b := NewPipe(net.HardwareAddr{2, 0, 0, 0, 0, 1}, net.HardwareAddr{2, 0, 0, 0, 0, 2})
+	sa, sb := NewStack(), NewStack()
+	sa.SetDADConfig(fastDAD)
+	sb.SetDADConfig(fastDAD)
+	na := sa.AddNIC("a", a, ipn("10.0.0.1/24"))
+	nb := sb.AddNIC("b", b, ipn("10.0.0.2/24"))
+	t.Cleanup(func() {
+		sa.Close()
+		sb.Close()
+	})
+	return sa, sb, na, nb
+}
+
+func TestPipeARP(t *testing.T) {
+	sa, sb, na, nb := twoStacks(t)
+	mac, err := sa.Resolve(net.IPv4(10, 0, 0, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mac.String() != nb.HardwareAddr().String() {
+		t.Fatalf("MACアドレスが違います: %v", mac)
+	}
+	// 要求を受け取った側も送信元を覚える(受信ゴルーチンが処理するまで少し待つ)
+	var l []Neighbor
+	for i := 0; i < 100; i++ {
+		if l = sb.Neighbors().List(); len(l) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(l) != 1 || l[0].MAC.String() != na.HardwareAddr().String() {
+		t.Fatalf("近隣テーブル: %v", l)
+	}
+}
+
+func TestPipePing(t *testing.T) {
+	sa, _, _, _ := twoStacks(t)
+	st, err := sa.Ping(net.IPv4(10, 0, 0, 2), PingOptions{Count: 3, Interval: 10 * time.Millisecond}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Transmitted != 3 || st.Received != 3 {
+		t.Fatalf("統計: %+v", st)
+	}
+}
+
+func TestPipeUDP(t *testing.T) {
+	sa, sb, _, _ := twoStacks(t)
+	srv, err := sb.Bind(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	cl, err := sa.Bind(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if _, err := cl.WriteTo([]byte("hello"), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 7}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	srv.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := srv.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Fatalf("受信したデータ: %q", buf[:n])
+	}
+	if ua := addr.(*net.UDPAddr); !ua.IP.Equal(net.IPv4(10, 0, 0, 1)) || ua.Port != int(cl.Port()) {
+		t.Fatalf("送信元: %v", addr)
+	}
+}
+
+func TestPipeTCP(t *testing.T) {
+	sa, sb, _, _ := twoStacks(t)
+	l, err := sb.Listen(nil, 80, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	c, err := sa.DialContext(ctx, "tcp", "10.0.0.2:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(3 * time.Second))
+
+	// MSSより大きいデータも分割されて順番どおりに届く
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go c.Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	for i := range data {
+		if got[i] != data[i] {
+			t.Fatalf("%dバイト目が違います", i)
+		}
+	}
+}
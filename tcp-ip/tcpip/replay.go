@@ -0,0 +1,87 @@
+package tcpip
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// キャプチャを受信経路に流し込むときの設定
+type ReplayOptions struct {
+	// 流し込むインタフェースの名前
+	// 空ならキャプチャのインタフェース名と同じ名前のNIC，なければ最初のNICに流す
+	Interface string
+	// キャプチャの時刻の間隔を保って流す(スタックの時計で待つ)．falseなら待たずに流す
+	// スタックの時計がVirtualClockなら，待つ代わりに時計をその間隔だけ進める
+	// (VirtualClockでは，falseでも前のフレームの処理が終わってから次を流す)
+	KeepTiming bool
+}
+
+// 記録したキャプチャのフレームを，デバイスから受信したのと同じように処理させる
+// 向きが送信のフレームはスタック自身が送り直すので流さない．
+// 向きのわからないフレームはすべて流し，自分宛てでないものは受信時と同じく捨てられる．
+// 流したフレームの数を返す
+func (s *Stack) Replay(r *CaptureReader, opts ReplayOptions) (int, error) {
+	var prev *CapturedFrame
+	count := 0
+	for {
+		f, err := r.ReadFrame()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		if f.Direction == CaptureOutbound || f.LinkType != layers.LinkTypeEthernet {
+			continue
+		}
+		nic, err := s.replayNIC(f, opts)
+		if err != nil {
+			return count, err
+		}
+		var gap time.Duration
+		if opts.KeepTiming && prev != nil && !f.Time.IsZero() {
+			gap = f.Time.Sub(prev.Time)
+		}
+		s.replayWait(gap)
+		prev = f
+		nic.receive(f.Data)
+		count++
+	}
+}
+
+// 次のフレームを流す前にdだけ待つ
+// 仮想時計は誰かが進めないと待ち終わらないので，自分で進めてその間のタイマーを発火させる．
+// Advanceは前のフレームの処理が終わるのを待つので，d=0でも流す順に処理される
+func (s *Stack) replayWait(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	if vc, ok := s.clock.(*VirtualClock); ok {
+		vc.Advance(d)
+		return
+	}
+	sleep(s.clock, d)
+}
+
+// キャプチャのフレームを流すNICを選ぶ
+func (s *Stack) replayNIC(f *CapturedFrame, opts ReplayOptions) (*NIC, error) {
+	name := opts.Interface
+	if name == "" {
+		name = f.Interface
+	}
+	if nic := s.nicByName(name); nic != nil {
+		return nic, nil
+	}
+	if opts.Interface != "" {
+		return nil, fmt.Errorf("インタフェースが見つかりません: %s", opts.Interface)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.nics) == 0 {
+		return nil, fmt.Errorf("フレームを流すインタフェースがありません")
+	}
+	return s.nics[0], nil
+}
@@ -0,0 +1,108 @@
+package tcpip
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// ホスト名をIPアドレスに解決するもの(resolverパッケージのResolverが満たす)
+// resolverはtcpipのUDPを使うので，tcpipからはこのインタフェースだけを見る
+type HostResolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// 接続先にホスト名を指定したときに使うリゾルバを設定する
+func (s *Stack) SetResolver(r HostResolver) {
+	s.mu.Lock()
+	s.resolver = r
+	s.mu.Unlock()
+}
+
+// DHCPで知ったDNSサーバ(resolver.Newに渡す)
+func (s *Stack) DNSServers() []net.IP {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]net.IP(nil), s.dnsServers...)
+}
+
+func (s *Stack) setDNSServers(servers []net.IP) {
+	s.mu.Lock()
+	s.dnsServers = append([]net.IP(nil), servers...)
+	s.mu.Unlock()
+}
+
+// IPアドレスかホスト名から接続先のIPアドレスを決める
+// networkの末尾が"4"か"6"ならそのファミリのアドレスだけを使う
+// ホスト名に複数のアドレスがあれば，RFC 6724 Section 6の一部に従って宛先を選ぶ
+func (s *Stack) lookupIP(ctx context.Context, network, host string) (net.IP, error) {
+	family := network[len(network)-1:]
+	if family != "4" && family != "6" {
+		family = ""
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !matchFamily(ip, family) {
+			return nil, fmt.Errorf("%sで使えないアドレス: %s", network, host)
+		}
+		return ip, nil
+	}
+
+	s.mu.RLock()
+	r := s.resolver
+	s.mu.RUnlock()
+	if r == nil {
+		return nil, fmt.Errorf("無効な宛先IPアドレス: %s", host)
+	}
+	ips, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []net.IP
+	for _, ip := range ips {
+		if matchFamily(ip, family) {
+			candidates = append(candidates, ip)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("%sのアドレスが見つかりません", host)
+	}
+	return s.selectDestination(candidates), nil
+}
+
+func matchFamily(ip net.IP, family string) bool {
+	switch family {
+	case "4":
+		return ip.To4() != nil
+	case "6":
+		return isIPv6(ip)
+	}
+	return ip.To16() != nil
+}
+
+// 経路がある宛先，送信元とスコープが合う宛先，IPv6の宛先の順に優先する
+func (s *Stack) selectDestination(ips []net.IP) net.IP {
+	score := func(ip net.IP) int {
+		nic, src, _, err := s.route(ip)
+		if err != nil || nic == nil {
+			return 0
+		}
+		n := 4
+		if ipv6Scope(src) >= ipv6Scope(ip) {
+			n += 2
+		}
+		if isIPv6(ip) {
+			n++
+		}
+		return n
+	}
+	best, bestScore := ips[0], -1
+	for _, ip := range ips {
+		if sc := score(ip); sc > bestScore {
+			best, bestScore = ip, sc
+		}
+	}
+	if ip4 := best.To4(); ip4 != nil {
+		return ip4
+	}
+	return best
+}
@@ -0,0 +1,296 @@
+package tcpip
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ルーティングテーブルの1エントリ
+type Route struct {
+	// 宛先のネットワーク(0.0.0.0/0，::/0ならデフォルトルート)
+	Dest net.IPNet
+	// 次に渡すルータ(nilなら宛先と同じセグメントにいる)
+	Gateway net.IP
+	// 送信に使うインタフェース名
+	Interface string
+	// 同じ長さのプレフィックスが複数あるときは小さいものを優先
+	Metric int
+}
+
+func (r Route) String() string {
+	gw := "直接接続"
+	if r.Gateway != nil {
+		gw = "via " + r.Gateway.String()
+	}
+	return fmt.Sprintf("%v %s dev %s metric %d", &r.Dest, gw, r.Interface, r.Metric)
+}
+
+// 宛先IPアドレスから次の転送先を決めるルーティングテーブル
+type RouteTable struct {
+	mu     sync.RWMutex
+	routes []Route
+}
+
+// スタックのルーティングテーブル
+func (s *Stack) Routes() *RouteTable {
+	return s.routes
+}
+
+// 経路を追加する
+// IPv4の経路は4バイト，IPv6の経路は16バイトのアドレスとマスクにそろえる
+func (t *RouteTable) Add(r Route) error {
+	dest, mask := r.Dest.IP.To4(), r.Dest.Mask
+	if isIPv6(r.Dest.IP) {
+		dest = r.Dest.IP
+		if len(mask) != net.IPv6len {
+			return fmt.Errorf("無効な宛先ネットワーク: %v", &r.Dest)
+		}
+	} else if len(mask) == net.IPv6len {
+		mask = mask[net.IPv6len-net.IPv4len:]
+	}
+	if dest == nil || len(mask) == 0 {
+		return fmt.Errorf("無効な宛先ネットワーク: %v", &r.Dest)
+	}
+	r.Dest = net.IPNet{IP: dest.Mask(mask), Mask: mask}
+	if r.Gateway != nil {
+		if isIPv6(dest) != isIPv6(r.Gateway) {
+			return fmt.Errorf("宛先とゲートウェイのアドレスファミリが異なります: %v via %v", &r.Dest, r.Gateway)
+		}
+		if !isIPv6(r.Gateway) {
+			r.Gateway = r.Gateway.To4()
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, old := range t.routes {
+		if old.Dest.String() == r.Dest.String() && old.Gateway.Equal(r.Gateway) && old.Interface == r.Interface {
+			t.routes[i] = r
+			return nil
+		}
+	}
+	t.routes = append(t.routes, r)
+	return nil
+}
+
+// デフォルトルート(ゲートウェイがIPv6なら::/0，それ以外は0.0.0.0/0)を追加する
+func (t *RouteTable) AddDefault(gateway net.IP, ifaceName string) error {
+	dest := net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+	if isIPv6(gateway) {
+		dest = net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	}
+	return t.Add(Route{
+		Dest:      dest,
+		Gateway:   gateway,
+		Interface: ifaceName,
+	})
+}
+
+// 宛先ネットワークが一致する経路をすべて削除する
+func (t *RouteTable) Remove(dest net.IPNet) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	routes := t.routes[:0]
+	for _, r := range t.routes {
+		if r.Dest.String() != dest.String() {
+			routes = append(routes, r)
+		}
+	}
+	t.routes = routes
+}
+
+// 宛先ネットワーク，ゲートウェイ，インタフェースがすべて一致する経路を削除する
+func (t *RouteTable) removeVia(dest net.IPNet, gateway net.IP, ifaceName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	routes := t.routes[:0]
+	for _, r := range t.routes {
+		if r.Interface != ifaceName || !r.Gateway.Equal(gateway) || r.Dest.String() != dest.String() {
+			routes = append(routes, r)
+		}
+	}
+	t.routes = routes
+}
+
+// インタフェースの直接接続の経路を削除する
+func (t *RouteTable) removeConnected(ifaceName string, dest net.IPNet) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	routes := t.routes[:0]
+	for _, r := range t.routes {
+		if r.Interface != ifaceName || r.Gateway != nil || r.Dest.String() != dest.String() {
+			routes = append(routes, r)
+		}
+	}
+	t.routes = routes
+}
+
+// 経路の一覧をプレフィックスの長い順に返す
+func (t *RouteTable) List() []Route {
+	t.mu.RLock()
+	list := append([]Route(nil), t.routes...)
+	t.mu.RUnlock()
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return routeLess(list[i], list[j])
+	})
+	return list
+}
+
+// 宛先に対する経路を最長一致で探す
+func (t *RouteTable) Lookup(dst net.IP) (Route, bool) {
+	return t.lookup(dst, func(Route) bool { return true })
+}
+
+func (t *RouteTable) lookup(dst net.IP, usable func(Route) bool) (Route, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var best Route
+	found := false
+	for _, r := range t.routes {
+		if !r.Dest.Contains(dst) || !usable(r) {
+			continue
+		}
+		if !found || routeLess(r, best) {
+			best = r
+			found = true
+		}
+	}
+	return best, found
+}
+
+// プレフィックスが長い方，同じならメトリックが小さい方を優先
+func routeLess(a, b Route) bool {
+	ao, _ := a.Dest.Mask.Size()
+	bo, _ := b.Dest.Mask.Size()
+	if ao != bo {
+		return ao > bo
+	}
+	return a.Metric < b.Metric
+}
+
+// /proc/net/routeの形式を解析する
+// アドレスはリトルエンディアンの16進数で書かれている
+func ParseProcNetRoute(r io.Reader) ([]Route, error) {
+	var routes []Route
+	scanner := bufio.NewScanner(r)
+	// 1行目は見出し
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		dest, err := parseProcIPv4(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		gateway, err := parseProcIPv4(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("フラグの解析に失敗: %v", err)
+		}
+		metric, err := strconv.Atoi(fields[6])
+		if err != nil {
+			return nil, fmt.Errorf("メトリックの解析に失敗: %v", err)
+		}
+		mask, err := parseProcIPv4(fields[7])
+		if err != nil {
+			return nil, err
+		}
+
+		// RTF_UPの立っていない経路は使えない
+		const rtfUp, rtfGateway = 0x1, 0x2
+		if flags&rtfUp == 0 {
+			continue
+		}
+		route := Route{
+			Dest:      net.IPNet{IP: dest, Mask: net.IPMask(mask)},
+			Interface: fields[0],
+			Metric:    metric,
+		}
+		if flags&rtfGateway != 0 {
+			route.Gateway = gateway
+		}
+		routes = append(routes, route)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("経路の読み込みに失敗: %v", err)
+	}
+	return routes, nil
+}
+
+func parseProcIPv4(s string) (net.IP, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != net.IPv4len {
+		return nil, fmt.Errorf("アドレスの解析に失敗: %s", s)
+	}
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(b))
+	return ip, nil
+}
+
+// 経路を読み込んでテーブルに追加する
+func (t *RouteTable) load(r io.Reader) error {
+	routes, err := ParseProcNetRoute(r)
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if err := t.Add(route); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 宛先へ送るためのインタフェース，送信元IPアドレス，近隣テーブルで解決すべき次の転送先を決める
+func (s *Stack) route(dstIP net.IP) (*NIC, net.IP, net.IP, error) {
+	// スタックに存在し，宛先と同じファミリのアドレスを持つインタフェースの経路だけを使う
+	v6 := isIPv6(dstIP)
+	r, ok := s.routes.lookup(dstIP, func(r Route) bool {
+		n := s.nicByName(r.Interface)
+		if n == nil {
+			return false
+		}
+		if v6 {
+			return n.selectSourceIPv6(dstIP) != nil
+		}
+		return n.primaryIPv4() != nil
+	})
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("宛先[%v]への経路が見つかりません", dstIP)
+	}
+	nic := s.nicByName(r.Interface)
+
+	nextHop := dstIP
+	if r.Gateway != nil && !r.Gateway.IsUnspecified() {
+		nextHop = r.Gateway
+	}
+
+	if v6 {
+		return nic, nic.selectSourceIPv6(dstIP), nextHop, nil
+	}
+
+	// 次の転送先と同じサブネットのアドレスを送信元にする
+	srcIP := nic.primaryIPv4()
+	for _, a := range nic.Addresses() {
+		if ip := a.IP.To4(); ip != nil && a.Contains(nextHop) {
+			srcIP = ip
+			break
+		}
+	}
+	return nic, srcIP, nextHop, nil
+}
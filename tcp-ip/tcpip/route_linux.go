@@ -0,0 +1,16 @@
+package tcpip
+
+import (
+	"fmt"
+	"os"
+)
+
+// カーネルのルーティングテーブル(/proc/net/route)を読み込む
+func (t *RouteTable) LoadSystem() error {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return fmt.Errorf("ルーティングテーブルの読み込みに失敗: %v", err)
+	}
+	defer f.Close()
+	return t.load(f)
+}
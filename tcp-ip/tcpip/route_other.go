@@ -0,0 +1,10 @@
+//go:build !linux
+
+package tcpip
+
+import "fmt"
+
+// カーネルのルーティングテーブルを読み込む(Linux以外では未対応なので手動で設定する)
+func (t *RouteTable) LoadSystem() error {
+	return fmt.Errorf("ルーティングテーブルの読み込みはLinuxのみ対応しています")
+}
@@ -0,0 +1,172 @@
+package tcpip
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// /proc/net/routeのアドレスはリトルエンディアンの16進数
+func TestParseProcNetRoute(t *testing.T) {
+	const header = "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"
+	for _, tc := range []struct {
+		name  string
+		lines string
+		want  []string
+		err   bool
+	}{
+		{
+			name: "ゲートウェイと直接接続",
+			lines: "eth0\t00000000\t0101A8C0\t0003\t0\t0\t100\t00000000\t0\t0\t0\n" +
+				"eth0\t0001A8C0\t00000000\t0001\t0\t0\t100\t00FFFFFF\t0\t0\t0\n" +
+				"docker0\t000011AC\t00000000\t0001\t0\t0\t0\t0000FFFF\t0\t0\t0\n",
+			want: []string{
+				"0.0.0.0/0 via 192.168.1.1 dev eth0 metric 100",
+				"192.168.1.0/24 直接接続 dev eth0 metric 100",
+				"172.17.0.0/16 直接接続 dev docker0 metric 0",
+			},
+		},
+		{
+			// RTF_GATEWAYがなければゲートウェイの欄は使わない
+			name:  "RTF_GATEWAYなし",
+			lines: "eth0\t0002000A\t0101A8C0\t0001\t0\t0\t5\t00FFFFFF\t0\t0\t0\n",
+			want:  []string{"10.0.2.0/24 直接接続 dev eth0 metric 5"},
+		},
+		{
+			name: "RTF_UPなしと短い行",
+			lines: "eth1\t0000000A\t00000000\t0000\t0\t0\t0\t000000FF\t0\t0\t0\n" +
+				"eth1\t0000000A\n",
+		},
+		{name: "不正なアドレス", lines: "eth0\tXYZ\t00000000\t0001\t0\t0\t0\t00000000\t0\t0\t0\n", err: true},
+		{name: "不正なフラグ", lines: "eth0\t00000000\t00000000\tzz\t0\t0\t0\t00000000\t0\t0\t0\n", err: true},
+		{name: "不正なメトリック", lines: "eth0\t00000000\t00000000\t0001\t0\t0\tx\t00000000\t0\t0\t0\n", err: true},
+	} {
+		routes, err := ParseProcNetRoute(strings.NewReader(header + tc.lines))
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: エラーになりません: %v", tc.name, routes)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		var got []string
+		for _, r := range routes {
+			got = append(got, r.String())
+		}
+		if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+			t.Errorf("%s:\n%s\n期待:\n%s", tc.name, strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+		}
+	}
+}
+
+// プレフィックスの長さを優先し，同じ長さならメトリックの小さい経路を選ぶ
+func TestRouteTableLookup(t *testing.T) {
+	tbl := &RouteTable{}
+	for _, r := range []Route{
+		{Dest: ipn("0.0.0.0/0"), Gateway: net.IPv4(10, 0, 0, 254), Interface: "eth0", Metric: 100},
+		{Dest: ipn("0.0.0.0/0"), Gateway: net.IPv4(10, 0, 0, 253), Interface: "eth1", Metric: 50},
+		{Dest: ipn("10.0.0.0/16"), Gateway: net.IPv4(10, 0, 0, 1), Interface: "eth0"},
+		{Dest: ipn("10.0.0.0/24"), Interface: "eth0"},
+		{Dest: ipn("10.0.0.128/25"), Interface: "eth1", Metric: 500},
+		{Dest: ipn("::/0"), Gateway: net.ParseIP("fe80::1"), Interface: "eth0"},
+		{Dest: ipn("2001:db8::/32"), Interface: "eth1"},
+	} {
+		if err := tbl.Add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		dst  string
+		want string
+	}{
+		{"10.0.0.200", "10.0.0.128/25 直接接続 dev eth1 metric 500"},
+		{"10.0.0.5", "10.0.0.0/24 直接接続 dev eth0 metric 0"},
+		{"10.0.5.5", "10.0.0.0/16 via 10.0.0.1 dev eth0 metric 0"},
+		{"8.8.8.8", "0.0.0.0/0 via 10.0.0.253 dev eth1 metric 50"},
+		{"2001:db8::1", "2001:db8::/32 直接接続 dev eth1 metric 0"},
+		{"2001:db9::1", "::/0 via fe80::1 dev eth0 metric 0"},
+	} {
+		r, ok := tbl.Lookup(net.ParseIP(tc.dst))
+		if !ok || r.String() != tc.want {
+			t.Errorf("%s: %v %v, 期待: %s", tc.dst, r, ok, tc.want)
+		}
+	}
+
+	// 使えない経路は飛ばす
+	r, ok := tbl.lookup(net.ParseIP("10.0.0.200"), func(r Route) bool { return r.Interface == "eth0" })
+	if !ok || r.String() != "10.0.0.0/24 直接接続 dev eth0 metric 0" {
+		t.Errorf("eth0だけの経路: %v %v", r, ok)
+	}
+	if _, ok := (&RouteTable{}).Lookup(net.IPv4(8, 8, 8, 8)); ok {
+		t.Error("空のテーブルで経路が見つかりました")
+	}
+
+	// 宛先とゲートウェイのファミリが異なる経路は追加できない
+	if err := tbl.Add(Route{Dest: ipn("10.1.0.0/16"), Gateway: net.ParseIP("fe80::1"), Interface: "eth0"}); err == nil {
+		t.Error("IPv4の宛先にIPv6のゲートウェイを追加できました")
+	}
+}
+
+// サブネットの外へはゲートウェイを次の転送先にし，その近隣を解決する
+func TestStackRouteGateway(t *testing.T) {
+	sa, _, na, nb := twoStacks(t)
+	if err := sa.Routes().AddDefault(net.IPv4(10, 0, 0, 2), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := na.AddAddress(ipn("192.168.5.1/24")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sa.Routes().Add(Route{Dest: ipn("172.16.0.0/16"), Gateway: net.IPv4(192, 168, 5, 254), Interface: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	// スタックにないインタフェースの経路は使わない
+	if err := sa.Routes().Add(Route{Dest: ipn("8.8.0.0/16"), Interface: "none"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		dst, src, next string
+	}{
+		{"8.8.8.8", "10.0.0.1", "10.0.0.2"},
+		{"10.0.0.5", "10.0.0.1", "10.0.0.5"},
+		// 次の転送先と同じサブネットのアドレスを送信元にする
+		{"172.16.1.1", "192.168.5.1", "192.168.5.254"},
+		{"192.168.5.7", "192.168.5.1", "192.168.5.7"},
+	} {
+		nic, src, next, err := sa.route(net.ParseIP(tc.dst))
+		if err != nil || nic != na || !src.Equal(net.ParseIP(tc.src)) || !next.Equal(net.ParseIP(tc.next)) {
+			t.Errorf("%sへの経路: 送信元%v 次ホップ%v %v", tc.dst, src, next, err)
+		}
+	}
+
+	// ゲートウェイのMACアドレスを解決して送る
+	c, err := sa.Bind(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.WriteTo([]byte("x"), &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 9}); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, n := range sa.Neighbors().List() {
+		if n.IP.Equal(net.IPv4(10, 0, 0, 2)) && n.MAC.String() == nb.HardwareAddr().String() {
+			found = true
+		}
+		if n.IP.Equal(net.IPv4(8, 8, 8, 8)) {
+			t.Errorf("宛先そのものを解決しました: %v", n)
+		}
+	}
+	if !found {
+		t.Fatalf("ゲートウェイを解決していません: %v", sa.Neighbors().List())
+	}
+
+	// 経路がなければエラー
+	sa.Routes().Remove(ipn("0.0.0.0/0"))
+	if _, _, _, err := sa.route(net.IPv4(8, 8, 8, 8)); err == nil {
+		t.Fatal("経路がないのに送信できます")
+	}
+}
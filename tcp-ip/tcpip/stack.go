@@ -0,0 +1,631 @@
+package tcpip
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// エンドポイントごとの受信キューの長さ
+const endpointQueueLen = 64
+
+// エフェメラルポートの範囲(RFC 6335)
+const (
+	ephemeralPortFirst = 49152
+	ephemeralPortLast  = 65535
+)
+
+// ユーザランドのTCP/IPスタック
+// インタフェースごとに1つの受信ゴルーチンがフレームを1度だけデコードし，
+// EtherType/IPプロトコル/ポート番号を見て登録済みのエンドポイントへチャネルで振り分ける
+type Stack struct {
+	mu   sync.RWMutex
+	nics []*NIC
+	wg   sync.WaitGroup
+	// タイマーと時刻に使う時計
+	clock Clock
+
+	neighbors  *NeighborTable
+	routes     *RouteTable
+	dadConfig  DADConfig
+	tcpConfig  TCPConfig
+	dhcpConfig DHCPConfig
+	ndpConfig  NDPConfig
+	// フラグメントの再構築
+	reassemblyConfig ReassemblyConfig
+	fragments        *reassembler
+	// 最後に送ったIPv4データグラムの識別子
+	ipID uint16
+	// 初期シーケンス番号を選ぶための秘密鍵
+	isnSecret [16]byte
+	// ホスト名を解決するリゾルバ(SetResolverで設定する)
+	resolver HostResolver
+	// DHCPで知ったDNSサーバ
+	dnsServers []net.IP
+	// 送受信したフレームを記録する(SetCaptureで設定する)
+	capture *CaptureWriter
+	// TCPのセグメントと状態遷移を渡す(SetTCPTracerで設定する)
+	tcpTracer TCPTracer
+
+	arpSubs map[chan *arpPacket]struct{}
+	udp     map[uint16]chan *udpDatagram
+	tcp     map[tcpKey]chan *tcpSegment
+	icmp    map[uint16]chan *icmpEcho
+}
+
+// スタックに接続されたネットワークインタフェース
+type NIC struct {
+	stack *Stack
+	name  string
+	dev   LinkDevice
+	addrs []net.IPNet
+	// アドレスごとに最後に防御した時刻
+	defended map[netip.Addr]time.Time
+	// カーネルと同じアドレスを共有している(カーネルの通信にRSTなどを返さない)
+	kernelShared bool
+	// DHCPなどで指定されたMTU(0ならデバイスのMTU)
+	mtu int
+	// EnableIPv6でIPv6を使い始めた
+	ipv6 bool
+	// 重複アドレス検出中のIPv6アドレス(衝突を見つけたらチャネルを閉じる)
+	tentative map[netip.Addr]chan struct{}
+}
+
+// 受信したARPパケット
+type arpPacket struct {
+	nic *NIC
+	arp *layers.ARP
+}
+
+// 受信したUDPデータグラム
+type udpDatagram struct {
+	nic *NIC
+	// 受信したIPヘッダ(*layers.IPv4か*layers.IPv6)と，その送信元と宛先
+	ip       gopacket.NetworkLayer
+	src, dst net.IP
+	udp      *layers.UDP
+	payload  []byte
+}
+
+// 受信したTCPセグメント
+type tcpSegment struct {
+	nic      *NIC
+	src, dst net.IP
+	tcp      *layers.TCP
+}
+
+// TCP接続を識別する4つ組
+// 待ち受け(Listen)は相手側を空にしたキーで登録する．localAddrも空ならすべてのアドレスで待ち受ける
+type tcpKey struct {
+	localAddr  netip.Addr
+	localPort  uint16
+	remoteAddr netip.Addr
+	remotePort uint16
+}
+
+// 新しいスタックを作成
+func NewStack() *Stack {
+	return NewStackWithClock(SystemClock)
+}
+
+// 指定した時計を使うスタックを作成
+// VirtualClockを渡すと，再送やタイムアウトを時計を進めて決定的に試せる
+func NewStackWithClock(clock Clock) *Stack {
+	s := &Stack{
+		clock:   clock,
+		arpSubs: make(map[chan *arpPacket]struct{}),
+		udp:     make(map[uint16]chan *udpDatagram),
+		tcp:     make(map[tcpKey]chan *tcpSegment),
+		icmp:    make(map[uint16]chan *icmpEcho),
+
+		dadConfig:  DefaultDADConfig,
+		tcpConfig:  DefaultTCPConfig,
+		dhcpConfig: DefaultDHCPConfig,
+		ndpConfig:  DefaultNDPConfig,
+		isnSecret:  newISNSecret(),
+
+		reassemblyConfig: DefaultReassemblyConfig,
+		ipID:             uint16(rand.Intn(1 << 16)),
+	}
+	s.fragments = newReassembler(s)
+	s.neighbors = newNeighborTable(s)
+	s.routes = &RouteTable{}
+	return s
+}
+
+// スタックが使っている時計
+func (s *Stack) Clock() Clock {
+	return s.clock
+}
+
+// pcap(cgoなしのビルドではAF_PACKET)で実際のインタフェースを開き，カーネルが割り当てたIPv4アドレスを借りてスタックを作成
+func OpenStack(ifaceName string) (*Stack, error) {
+	addr, err := interfaceIPv4Net(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	dev, err := openDevice(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	s := NewStack()
+	nic := s.AddNIC(ifaceName, dev, *addr)
+	nic.SetKernelShared(true)
+
+	// カーネルの経路を借りる(読めない環境では直接接続の経路だけになる)
+	if err := s.routes.LoadSystem(); err != nil {
+		fmt.Printf("システムの経路は使用しません: %v\n", err)
+	}
+	return s, nil
+}
+
+// デバイスをスタックに接続して受信を開始する
+// addrsは設定済みのアドレスとして扱い，プローブせずにGratuitous ARPでアナウンスだけする
+func (s *Stack) AddNIC(name string, dev LinkDevice, addrs ...net.IPNet) *NIC {
+	nic := &NIC{
+		stack: s,
+		name:  name,
+		dev:   dev,
+		addrs: addrs,
+	}
+
+	s.mu.Lock()
+	s.nics = append(s.nics, nic)
+	s.mu.Unlock()
+
+	for _, a := range addrs {
+		s.addConnectedRoute(nic, a)
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		nic.receiveLoop()
+	}()
+
+	config := s.getDADConfig()
+	for _, a := range addrs {
+		if ip := a.IP.To4(); ip != nil {
+			go nic.announce(ip, config)
+		}
+	}
+	return nic
+}
+
+// すべてのデバイスを閉じ，受信ゴルーチンの終了を待つ
+func (s *Stack) Close() error {
+	s.mu.RLock()
+	nics := append([]*NIC(nil), s.nics...)
+	s.mu.RUnlock()
+
+	for _, nic := range nics {
+		nic.dev.Close()
+	}
+	s.wg.Wait()
+	s.fragments.close()
+	return nil
+}
+
+// カーネルと同じアドレスを共有しているかを設定する
+// trueにすると，スタックが知らない接続へのRSTやエコーリプライをカーネルに任せる
+func (n *NIC) SetKernelShared(shared bool) {
+	n.stack.mu.Lock()
+	n.kernelShared = shared
+	n.stack.mu.Unlock()
+}
+
+func (n *NIC) isKernelShared() bool {
+	n.stack.mu.RLock()
+	defer n.stack.mu.RUnlock()
+	return n.kernelShared
+}
+
+// インタフェース名
+func (n *NIC) Name() string {
+	return n.name
+}
+
+// インタフェースのMTU．DHCPなどで指定されていればデバイスのMTUより小さくする
+func (n *NIC) MTU() int {
+	mtu := n.dev.MTU()
+	n.stack.mu.RLock()
+	defer n.stack.mu.RUnlock()
+	if n.mtu > 0 && n.mtu < mtu {
+		return n.mtu
+	}
+	return mtu
+}
+
+func (n *NIC) setMTU(mtu int) {
+	n.stack.mu.Lock()
+	n.mtu = mtu
+	n.stack.mu.Unlock()
+}
+
+// インタフェースのMACアドレス
+func (n *NIC) HardwareAddr() net.HardwareAddr {
+	return n.dev.HardwareAddr()
+}
+
+// 最初のIPv4アドレス
+func (n *NIC) primaryIPv4() net.IP {
+	n.stack.mu.RLock()
+	defer n.stack.mu.RUnlock()
+	for _, a := range n.addrs {
+		if ip := a.IP.To4(); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+// 名前からインタフェースを探す．見つからなければnil
+func (s *Stack) NIC(name string) *NIC {
+	return s.nicByName(name)
+}
+
+// 名前からインタフェースを探す
+func (s *Stack) nicByName(name string) *NIC {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, nic := range s.nics {
+		if nic.name == name {
+			return nic
+		}
+	}
+	return nil
+}
+
+// アドレスのサブネットへの直接接続の経路を追加する
+func (s *Stack) addConnectedRoute(nic *NIC, addr net.IPNet) {
+	if addr.IP.To16() == nil {
+		return
+	}
+	s.routes.Add(Route{
+		Dest:      net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask},
+		Interface: nic.name,
+	})
+}
+
+// デバイスからフレームを読み続ける
+func (n *NIC) receiveLoop() {
+	for {
+		frame, err := n.dev.ReadFrame()
+		if err != nil {
+			return
+		}
+		n.receive(frame)
+	}
+}
+
+// 受信したフレームを記録してから振り分ける
+func (n *NIC) receive(frame []byte) {
+	n.stack.record(n, frame, CaptureInbound)
+	n.stack.deliver(n, frame)
+}
+
+// 層を並べてシリアライズし，1つのフレームとして送信
+func (n *NIC) writeLayers(l ...gopacket.SerializableLayer) error {
+	frame, err := serializeFrame(l...)
+	if err != nil {
+		return err
+	}
+	n.stack.record(n, frame, CaptureOutbound)
+	if err := n.dev.WriteFrame(frame); err != nil {
+		return fmt.Errorf("パケットの送信に失敗: %v", err)
+	}
+	return nil
+}
+
+// 複数のフレームを記録してから送信する
+func (n *NIC) writeFrames(frames [][]byte) error {
+	for _, frame := range frames {
+		n.stack.record(n, frame, CaptureOutbound)
+	}
+	return writeFrames(n.dev, frames)
+}
+
+// 自分宛てのフレームか判定(ブロードキャスト・マルチキャストも受け取る)
+func (n *NIC) acceptsFrame(dst net.HardwareAddr) bool {
+	if len(dst) == 0 || dst[0]&0x01 != 0 {
+		return true
+	}
+	return dst.String() == n.dev.HardwareAddr().String()
+}
+
+// フレームを1度だけデコードし，該当するエンドポイントへ振り分ける
+func (s *Stack) deliver(nic *NIC, frame []byte) {
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.NoCopy)
+	ethLayer := packet.Layer(layers.LayerTypeEthernet)
+	if ethLayer == nil {
+		return
+	}
+	eth := ethLayer.(*layers.Ethernet)
+	if !nic.acceptsFrame(eth.DstMAC) {
+		return
+	}
+
+	switch eth.EthernetType {
+	case layers.EthernetTypeARP:
+		if arpLayer := packet.Layer(layers.LayerTypeARP); arpLayer != nil {
+			p := &arpPacket{nic: nic, arp: arpLayer.(*layers.ARP)}
+			s.neighbors.handleARP(p)
+			nic.handleARP(p.arp)
+			s.deliverARP(p)
+		}
+	case layers.EthernetTypeIPv4:
+		ipLayer := packet.Layer(layers.LayerTypeIPv4)
+		if ipLayer == nil {
+			return
+		}
+		ip := ipLayer.(*layers.IPv4)
+		if ip.Flags&layers.IPv4MoreFragments != 0 || ip.FragOffset != 0 {
+			// 自分宛てのフラグメントだけを集め，揃ったら1つのデータグラムとして扱う
+			if !nic.acceptsIPv4(ip.DstIP) {
+				return
+			}
+			if packet = s.fragments.add(nic, ip); packet == nil {
+				return
+			}
+			ip = packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		}
+		switch ip.Protocol {
+		case layers.IPProtocolICMPv4:
+			if icmpLayer := packet.Layer(layers.LayerTypeICMPv4); icmpLayer != nil {
+				s.handleICMP(nic, ip, icmpLayer.(*layers.ICMPv4))
+			}
+		default:
+			s.deliverTransport(nic, packet, ip, ip.SrcIP, ip.DstIP, ip.Protocol)
+		}
+	case layers.EthernetTypeIPv6:
+		ipLayer := packet.Layer(layers.LayerTypeIPv6)
+		if ipLayer == nil {
+			return
+		}
+		ip := ipLayer.(*layers.IPv6)
+		if !nic.ipv6Enabled() {
+			return
+		}
+		proto := ip.NextHeader
+		if ip.HopByHop != nil {
+			proto = ip.HopByHop.NextHeader
+		}
+		switch proto {
+		case layers.IPProtocolICMPv6:
+			if icmpLayer := packet.Layer(layers.LayerTypeICMPv6); icmpLayer != nil {
+				s.handleICMPv6(nic, ip, icmpLayer.(*layers.ICMPv6), packet)
+			}
+		case layers.IPProtocolIPv6Fragment:
+			// IPv6のフラグメントは再構築しない
+		default:
+			if nic.acceptsIPv6(ip.DstIP) && !nic.isTentative(ip.DstIP) {
+				s.deliverTransport(nic, packet, ip, ip.SrcIP, ip.DstIP, proto)
+			}
+		}
+	}
+}
+
+// IPヘッダより上のUDP/TCPを該当するエンドポイントへ振り分ける
+func (s *Stack) deliverTransport(nic *NIC, packet gopacket.Packet, ip gopacket.NetworkLayer, src, dst net.IP, proto layers.IPProtocol) {
+	switch proto {
+	case layers.IPProtocolUDP:
+		if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil {
+			udp := udpLayer.(*layers.UDP)
+			s.deliverUDP(&udpDatagram{nic: nic, ip: ip, src: src, dst: dst, udp: udp, payload: udp.Payload})
+		}
+	case layers.IPProtocolTCP:
+		if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
+			s.deliverTCP(&tcpSegment{nic: nic, src: src, dst: dst, tcp: tcpLayer.(*layers.TCP)})
+		}
+	}
+}
+
+// ARPパケットを購読しているすべてのエンドポイントへ配る
+func (s *Stack) deliverARP(p *arpPacket) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for ch := range s.arpSubs {
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
+
+// 宛先ポートにバインドされたエンドポイントへ配る
+// チェックサムが合わないデータグラムは捨て，誰もバインドしていないポートにはICMPポート到達不能を返す
+func (s *Stack) deliverUDP(d *udpDatagram) {
+	if !d.nic.acceptsIP(d.dst) {
+		return
+	}
+	if !udpChecksumValid(d.src, d.dst, d.udp) {
+		fmt.Printf("チェックサムが不正なUDPデータグラムを破棄: %v -> %v\n",
+			&net.UDPAddr{IP: d.src, Port: int(d.udp.SrcPort)}, &net.UDPAddr{IP: d.dst, Port: int(d.udp.DstPort)})
+		return
+	}
+
+	s.mu.RLock()
+	ch, ok := s.udp[uint16(d.udp.DstPort)]
+	s.mu.RUnlock()
+	if !ok {
+		// ブロードキャストやカーネルと共有しているアドレスでは返さない
+		if d.nic.hasAddress(d.dst) && !d.nic.isKernelShared() {
+			s.sendPortUnreachable(d.ip)
+		}
+		return
+	}
+	select {
+	case ch <- d:
+	default:
+		// 受信キューが溢れたら捨てる
+	}
+}
+
+// 4つ組が一致するTCP接続へ配る．なければそのポートで待ち受けているリスナへ配る
+func (s *Stack) deliverTCP(seg *tcpSegment) {
+	// TCPはユニキャストだけなので，ブロードキャストやマルチキャスト，ほかのホスト宛ては捨てる
+	if !seg.nic.hasAddress(seg.dst) {
+		return
+	}
+	key := tcpKey{
+		localAddr:  ipAddr(seg.dst),
+		localPort:  uint16(seg.tcp.DstPort),
+		remoteAddr: ipAddr(seg.src),
+		remotePort: uint16(seg.tcp.SrcPort),
+	}
+	s.traceSegment(TCPTraceReceive, key, seg.tcp, len(seg.tcp.Payload))
+
+	// 登録を外した後のエンドポイントへ入れないよう，ロックを持ったまま入れる
+	s.mu.RLock()
+	ch, ok := s.tcp[key]
+	if !ok {
+		ch, ok = s.tcp[tcpKey{localAddr: key.localAddr, localPort: key.localPort}]
+	}
+	if !ok {
+		ch, ok = s.tcp[tcpKey{localPort: key.localPort}]
+	}
+	if ok {
+		// 接続のゴルーチンが処理し終えるまで仮想時計を進めない
+		addWork(s.clock, 1)
+		select {
+		case ch <- seg:
+		default:
+			addWork(s.clock, -1)
+		}
+	}
+	s.mu.RUnlock()
+	if !ok {
+		// 待ち受けていないポートへのセグメントにはRSTを返す
+		if !seg.nic.isKernelShared() {
+			s.sendReply(seg.src, func() { s.sendTCPReset(seg) })
+		}
+	}
+}
+
+// 登録を外したエンドポイントに残ったセグメントを捨てる
+func (s *Stack) drainTCP(rx <-chan *tcpSegment) {
+	for {
+		select {
+		case <-rx:
+			addWork(s.clock, -1)
+		default:
+			return
+		}
+	}
+}
+
+// ARPパケットの購読を開始する．戻り値の関数で購読をやめる
+func (s *Stack) subscribeARP() (<-chan *arpPacket, func()) {
+	ch := make(chan *arpPacket, endpointQueueLen)
+	s.mu.Lock()
+	s.arpSubs[ch] = struct{}{}
+	s.mu.Unlock()
+
+	return ch, func() {
+		s.mu.Lock()
+		delete(s.arpSubs, ch)
+		s.mu.Unlock()
+	}
+}
+
+// UDPポートにエンドポイントを登録．portが0ならエフェメラルポートを選ぶ
+func (s *Stack) bindUDP(port uint16) (uint16, <-chan *udpDatagram, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if port == 0 {
+		p, err := s.ephemeralUDPPortLocked()
+		if err != nil {
+			return 0, nil, err
+		}
+		port = p
+	}
+	if _, ok := s.udp[port]; ok {
+		return 0, nil, fmt.Errorf("UDPポート%dは使用中です", port)
+	}
+	ch := make(chan *udpDatagram, endpointQueueLen)
+	s.udp[port] = ch
+	return port, ch, nil
+}
+
+// UDPポートの登録を解除
+func (s *Stack) unbindUDP(port uint16) {
+	s.mu.Lock()
+	delete(s.udp, port)
+	s.mu.Unlock()
+}
+
+// TCP接続の4つ組にエンドポイントを登録
+func (s *Stack) registerTCP(key tcpKey) (<-chan *tcpSegment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tcp[key]; ok {
+		return nil, fmt.Errorf("TCP接続[%v:%d - %v:%d]は使用中です",
+			key.localAddr, key.localPort, key.remoteAddr, key.remotePort)
+	}
+	ch := make(chan *tcpSegment, endpointQueueLen)
+	s.tcp[key] = ch
+	return ch, nil
+}
+
+// 使われていないTCPのエフェメラルポートを選ぶ
+func (s *Stack) ephemeralTCPPort() (uint16, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	used := make(map[uint16]bool)
+	for key := range s.tcp {
+		used[key.localPort] = true
+	}
+	return ephemeralPort(used)
+}
+
+// 使われていないUDPのエフェメラルポートを選ぶ
+// 呼び出し側がs.muを書き込みロックしていること
+func (s *Stack) ephemeralUDPPortLocked() (uint16, error) {
+	used := make(map[uint16]bool)
+	for port := range s.udp {
+		used[port] = true
+	}
+	return ephemeralPort(used)
+}
+
+// usedに含まれないエフェメラルポート(RFC 6335)をランダムに選ぶ
+func ephemeralPort(used map[uint16]bool) (uint16, error) {
+	n := ephemeralPortLast - ephemeralPortFirst + 1
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		port := uint16(ephemeralPortFirst + (start+i)%n)
+		if !used[port] {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("空いているエフェメラルポートがありません")
+}
+
+// TCP接続の登録を解除
+func (s *Stack) unregisterTCP(key tcpKey) {
+	s.mu.Lock()
+	delete(s.tcp, key)
+	s.mu.Unlock()
+}
+
+// 受信したパケットのバッファを参照しないようコピーする．IPv4アドレスは4バイトにそろえる
+func cloneIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return append(net.IP(nil), ip...)
+}
+
+// net.IPをマップのキーに使えるnetip.Addrへ変換
+func ipAddr(ip net.IP) netip.Addr {
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr.Unmap()
+}
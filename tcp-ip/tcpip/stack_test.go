@@ -0,0 +1,52 @@
+package tcpip
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+// dstIP宛てのSYNをフレームにする
+func synFrame(t *testing.T, dstMAC net.HardwareAddr, dstIP net.IP, port uint16) []byte {
+	t.Helper()
+	eth := NewEthernet(net.HardwareAddr{2, 0, 0, 0, 0, 9}, dstMAC, "IPv4")
+	ip := NewIPHeader(net.IPv4(10, 0, 0, 9), dstIP)
+	ip.Protocol = layers.IPProtocolTCP
+	tcp := newTCPHeader(40000, port, 1000, 0, flagSYN, 65535)
+	tcp.SetNetworkLayerForChecksum(ip)
+	frame, err := serializeFrame(&eth, ip, tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+// ブロードキャストやほかのホスト宛てのセグメントは，待ち受けていてもTCPに渡さずRSTも返さない
+func TestDeliverTCPDestination(t *testing.T) {
+	_, sb, _, nb := twoStacks(t)
+	if _, err := sb.Listen(nil, 80, 0); err != nil {
+		t.Fatal(err)
+	}
+	tr := NewTCPTrace()
+	sb.SetTCPTracer(tr)
+
+	for _, tc := range []struct {
+		name    string
+		mac     net.HardwareAddr
+		ip      net.IP
+		deliver bool
+	}{
+		{"自分宛て", nb.HardwareAddr(), net.IPv4(10, 0, 0, 2), true},
+		{"サブネットのブロードキャスト", layers.EthernetBroadcast, net.IPv4(10, 0, 0, 255), false},
+		{"ブロードキャスト", layers.EthernetBroadcast, net.IPv4bcast, false},
+		{"マルチキャスト", net.HardwareAddr{0x01, 0, 0x5e, 0, 0, 1}, net.IPv4(224, 0, 0, 1), false},
+		{"ほかのホスト", nb.HardwareAddr(), net.IPv4(10, 0, 0, 3), false},
+	} {
+		tr.Reset()
+		nb.receive(synFrame(t, tc.mac, tc.ip, 80))
+		if got := len(tr.Events()) > 0; got != tc.deliver {
+			t.Errorf("%s: TCPに渡したか=%v, 期待=%v", tc.name, got, tc.deliver)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package tcpip
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ポートから送ったフレームに加える障害(Linuxのnetemと同じようなもの)
+// 確率は0から1で，0ならその障害は起きない
+type Impairment struct {
+	// 届くまでの遅延
+	Delay time.Duration
+	// 遅延に加える-JitterからJitterまでの一様な揺らぎ(前後のフレームの順番が入れ替わることがある)
+	Jitter time.Duration
+	// フレームを捨てる確率
+	Loss float64
+	// フレームを2つ届ける確率
+	Duplicate float64
+	// 遅延させずにすぐ届ける確率．先に送ったフレームを追い越す
+	Reorder float64
+	// フレームの1ビットを反転させる確率
+	Corrupt float64
+	// 帯域(ビット毎秒)．0なら制限しない
+	Rate int64
+	// 帯域の制限で送信を待てるフレームの数．溢れたら捨てる(0ならpipeQueueLen)
+	QueueLimit int
+}
+
+// ポートごとの統計
+type SwitchPortStats struct {
+	// ポートから送られたフレームの数
+	Sent int
+	// 損失と送信キューの溢れで捨てたフレームの数
+	Dropped    int
+	Duplicated int
+	Reordered  int
+	Corrupted  int
+	// ポートに届いたフレームの数
+	Received int
+}
+
+// 複数のスタックをつなぐメモリ上のスイッチ
+// 送信元MACアドレスを学習し，知らない宛先とブロードキャストはすべてのポートへ流す．
+// ポートごとに遅延や損失などの障害を加えられ，乱数はシードから作るので同じ順に送れば同じフレームが捨てられる．
+// 遅延はスイッチの時計で測るので，VirtualClockを使えば実際に待たずに再送やタイムアウトを試せる
+type Switch struct {
+	clock Clock
+	seed  int64
+
+	mu    sync.Mutex
+	ports []*SwitchPort
+	// 学習したMACアドレスとそのポート
+	macs map[string]*SwitchPort
+	// これまでに作ったポートの数(ポートの乱数のシードに使う)
+	added int
+}
+
+// スイッチのポート．LinkDeviceとしてスタックにつなぐ
+type SwitchPort struct {
+	sw  *Switch
+	mac net.HardwareAddr
+	rx  chan []byte
+
+	mu         sync.Mutex
+	mtu        int
+	impairment Impairment
+	rng        *rand.Rand
+	// 帯域の制限で送信を待っているフレームが送り終わる時刻
+	queue []time.Time
+	stats SwitchPortStats
+
+	// 最後に読んだフレームをスタックがまだ処理しているか(次にReadFrameを呼んだら処理し終えたとみなす)
+	reading bool
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// clockで遅延を測り，seedから障害の乱数を作るスイッチを作成
+func NewSwitch(clock Clock, seed int64) *Switch {
+	return &Switch{
+		clock: clock,
+		seed:  seed,
+		macs:  make(map[string]*SwitchPort),
+	}
+}
+
+// MACアドレスがmacのポートを追加する
+// ポートの乱数のシードはスイッチのシードと追加した順番で決まる
+func (sw *Switch) AddPort(mac net.HardwareAddr) *SwitchPort {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	p := &SwitchPort{
+		sw:     sw,
+		mac:    mac,
+		rx:     make(chan []byte, pipeQueueLen),
+		mtu:    DefaultPipeMTU,
+		rng:    rand.New(rand.NewSource(sw.seed + int64(sw.added))),
+		closed: make(chan struct{}),
+	}
+	sw.added++
+	sw.ports = append(sw.ports, p)
+	return p
+}
+
+// このポートから送るフレームに加える障害を設定する
+func (p *SwitchPort) SetImpairment(imp Impairment) {
+	p.mu.Lock()
+	p.impairment = imp
+	p.mu.Unlock()
+}
+
+// MTUを変更する
+func (p *SwitchPort) SetMTU(mtu int) {
+	p.mu.Lock()
+	p.mtu = mtu
+	p.mu.Unlock()
+}
+
+// ポートの統計
+func (p *SwitchPort) Stats() SwitchPortStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+func (p *SwitchPort) ReadFrame() ([]byte, error) {
+	p.mu.Lock()
+	if p.reading {
+		p.reading = false
+		addWork(p.sw.clock, -1)
+	}
+	p.mu.Unlock()
+
+	select {
+	case frame := <-p.rx:
+		p.mu.Lock()
+		p.reading = true
+		p.mu.Unlock()
+		return frame, nil
+	case <-p.closed:
+		return nil, ErrLinkClosed
+	}
+}
+
+// スイッチへ送るフレームの1つ
+type switchDelivery struct {
+	frame []byte
+	// 今からどれだけ後に届くか
+	after time.Duration
+}
+
+func (p *SwitchPort) WriteFrame(frame []byte) error {
+	select {
+	case <-p.closed:
+		return ErrLinkClosed
+	default:
+	}
+
+	clock := p.sw.clock
+	p.mu.Lock()
+	if len(frame) > p.mtu+ethernetHeaderLen {
+		p.mu.Unlock()
+		return fmt.Errorf("フレームがMTUを超えています: %dバイト", len(frame))
+	}
+	deliveries := p.impairLocked(frame, clock.Now())
+	p.mu.Unlock()
+
+	for _, d := range deliveries {
+		if d.after <= 0 {
+			p.sw.forward(p, d.frame)
+			continue
+		}
+		frame := d.frame
+		clock.AfterFunc(d.after, func() { p.sw.forward(p, frame) })
+	}
+	return nil
+}
+
+// 障害を加え，フレームをいつ届けるかを決める
+func (p *SwitchPort) impairLocked(frame []byte, now time.Time) []switchDelivery {
+	imp := p.impairment
+	p.stats.Sent++
+	if p.chance(imp.Loss) {
+		p.stats.Dropped++
+		return nil
+	}
+	copies := 1
+	if p.chance(imp.Duplicate) {
+		p.stats.Duplicated++
+		copies = 2
+	}
+
+	// 送り終わったフレームを送信キューから除く
+	for len(p.queue) > 0 && !p.queue[0].After(now) {
+		p.queue = p.queue[1:]
+	}
+
+	var deliveries []switchDelivery
+	for i := 0; i < copies; i++ {
+		// 呼び出し側がバッファを使い回しても壊れないようにコピーする
+		buf := make([]byte, len(frame))
+		copy(buf, frame)
+		if len(buf) > 0 && p.chance(imp.Corrupt) {
+			p.stats.Corrupted++
+			buf[p.rng.Intn(len(buf))] ^= 1 << uint(p.rng.Intn(8))
+		}
+
+		// 帯域を制限するときは，前のフレームを送り終えてから送る
+		depart := now
+		if imp.Rate > 0 {
+			limit := imp.QueueLimit
+			if limit <= 0 {
+				limit = pipeQueueLen
+			}
+			if len(p.queue) >= limit {
+				p.stats.Dropped++
+				continue
+			}
+			if n := len(p.queue); n > 0 {
+				depart = p.queue[n-1]
+			}
+			depart = depart.Add(time.Duration(int64(len(buf)) * 8 * int64(time.Second) / imp.Rate))
+			p.queue = append(p.queue, depart)
+		}
+
+		delay := imp.Delay
+		if imp.Jitter > 0 {
+			delay += time.Duration(p.rng.Int63n(2*int64(imp.Jitter)+1)) - imp.Jitter
+		}
+		if p.chance(imp.Reorder) {
+			p.stats.Reordered++
+			delay = 0
+		}
+		if delay < 0 {
+			delay = 0
+		}
+		deliveries = append(deliveries, switchDelivery{frame: buf, after: depart.Add(delay).Sub(now)})
+	}
+	return deliveries
+}
+
+// 確率rateで当たる
+func (p *SwitchPort) chance(rate float64) bool {
+	return rate > 0 && p.rng.Float64() < rate
+}
+
+// 送信元を学習し，宛先のポートへフレームを届ける
+func (sw *Switch) forward(from *SwitchPort, frame []byte) {
+	if len(frame) < ethernetHeaderLen {
+		return
+	}
+	dst := net.HardwareAddr(frame[0:6])
+	src := net.HardwareAddr(frame[6:12])
+
+	sw.mu.Lock()
+	if src[0]&0x01 == 0 && !from.isClosed() {
+		sw.macs[string(src)] = from
+	}
+	var out []*SwitchPort
+	if p, ok := sw.macs[string(dst)]; ok && dst[0]&0x01 == 0 {
+		if p != from {
+			out = []*SwitchPort{p}
+		}
+	} else {
+		for _, p := range sw.ports {
+			if p != from {
+				out = append(out, p)
+			}
+		}
+	}
+	sw.mu.Unlock()
+
+	for i, p := range out {
+		buf := frame
+		if i > 0 {
+			buf = make([]byte, len(frame))
+			copy(buf, frame)
+		}
+		p.receive(buf)
+	}
+}
+
+// フレームを受信キューに入れる
+// 仮想時計は，スタックがフレームを読んで処理し終えるまで次のタイマーを発火させない
+func (p *SwitchPort) receive(frame []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.isClosed() {
+		return
+	}
+	addWork(p.sw.clock, 1)
+	select {
+	case p.rx <- frame:
+		p.stats.Received++
+	default:
+		// 受信キューが溢れたら実際のNICと同じく捨てる
+		addWork(p.sw.clock, -1)
+	}
+}
+
+func (p *SwitchPort) isClosed() bool {
+	select {
+	case <-p.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *SwitchPort) MTU() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.mtu
+}
+
+func (p *SwitchPort) HardwareAddr() net.HardwareAddr {
+	return p.mac
+}
+
+// ポートを閉じてスイッチから外す
+func (p *SwitchPort) Close() error {
+	p.closeOnce.Do(func() {
+		// 読まれずに残ったフレームを捨てる
+		p.mu.Lock()
+		close(p.closed)
+	drain:
+		for {
+			select {
+			case <-p.rx:
+				addWork(p.sw.clock, -1)
+			default:
+				break drain
+			}
+		}
+		p.mu.Unlock()
+		sw := p.sw
+		sw.mu.Lock()
+		for i, q := range sw.ports {
+			if q == p {
+				sw.ports = append(sw.ports[:i], sw.ports[i+1:]...)
+				break
+			}
+		}
+		for mac, q := range sw.macs {
+			if q == p {
+				delete(sw.macs, mac)
+			}
+		}
+		sw.mu.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,96 @@
+package tcpip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// スイッチにつないだn個のスタック(10.1.0.1/24から順に)
+func switchStacks(t *testing.T, clock Clock, sw *Switch, n int) ([]*Stack, []*SwitchPort) {
+	t.Helper()
+	var stacks []*Stack
+	var ports []*SwitchPort
+	for i := 0; i < n; i++ {
+		p := sw.AddPort(net.HardwareAddr{2, 0, 0, 0, 1, byte(i + 1)})
+		s := NewStackWithClock(clock)
+		s.SetDADConfig(DADConfig{})
+		s.AddNIC("sw", p, ipn(fmt.Sprintf("10.1.0.%d/24", i+1)))
+		stacks = append(stacks, s)
+		ports = append(ports, p)
+	}
+	t.Cleanup(func() {
+		for _, s := range stacks {
+			s.Close()
+		}
+	})
+	return stacks, ports
+}
+
+// 仮想時計のAdvanceはスタックの処理を待つので，損失のあるリンクでの再送は何度試しても同じ時刻に同じ順で起きる
+func TestSwitchRetransmitDeterministic(t *testing.T) {
+	run := func() (string, bool) {
+		clock := NewVirtualClock(time.Unix(1000, 0))
+		sw := NewSwitch(clock, 5)
+		stacks, ports := switchStacks(t, clock, sw, 2)
+		l, err := stacks[1].Listen(nil, 80, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		tr := NewTCPTrace()
+		stacks[0].SetTCPTracer(tr)
+
+		// 遅延も損失もないうちは，スイッチがその場でフレームを届けるので時計を進めずに接続できる
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		nc, err := stacks[0].DialContext(ctx, "tcp", "10.1.0.2:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := nc.(*TCPConnection)
+		defer c.Abort()
+
+		ports[0].SetImpairment(Impairment{Delay: 10 * time.Millisecond, Loss: 0.3})
+		ports[1].SetImpairment(Impairment{Delay: 10 * time.Millisecond, Loss: 0.1})
+		if _, err := c.Write(make([]byte, 16000)); err != nil {
+			t.Fatal(err)
+		}
+		advanceUntilAcked(t, clock, c)
+
+		// 同じセグメントを続けて再送したら，2回目までの間隔はRTO(RTTが短いので下限)の2倍になる
+		sent := make(map[uint32][]time.Time)
+		backoff := false
+		for _, ev := range tr.Events() {
+			if ev.Kind != TCPTraceSend || ev.Len == 0 {
+				continue
+			}
+			times := append(sent[ev.Seq], ev.Time)
+			sent[ev.Seq] = times
+			if n := len(times); n >= 3 && times[n-1].Sub(times[n-2]) == 2*minRTO {
+				backoff = true
+			}
+		}
+
+		var b strings.Builder
+		if err := tr.WriteDiagram(&b, tr.Flows()[0], TCPDiagramASCII); err != nil {
+			t.Fatal(err)
+		}
+		// 1行目はエフェメラルポートを含むので比べない
+		diagram := b.String()
+		return diagram[strings.Index(diagram, "\n")+1:], backoff
+	}
+
+	first, backoff := run()
+	if !backoff {
+		t.Fatalf("再送の間隔が倍になっていません:\n%s", first)
+	}
+	for i := 0; i < 3; i++ {
+		if got, _ := run(); got != first {
+			t.Fatalf("%d回目の結果が違います:\n%s\n最初:\n%s", i+2, got, first)
+		}
+	}
+}
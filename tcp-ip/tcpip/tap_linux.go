@@ -0,0 +1,260 @@
+package tcpip
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// /dev/net/tunのioctl(linux/if_tun.h)
+const (
+	tunSetIff = 0x400454ca
+	iffTap    = 0x0002
+	// フレームの前にパケット情報(4バイト)を付けない
+	iffNoPI = 0x1000
+)
+
+// TAPデバイスで仮想インタフェースを読み書きするデバイス
+// pcapと違ってカーネルのTCP/IPを通らないので，スタックが独自のMACアドレスとIPアドレスを持てる
+// カーネル側のインタフェースはTAPの向こうにつながった別のホストのように見える
+type TapDevice struct {
+	file *os.File
+	name string
+	mac  net.HardwareAddr
+	mtu  int
+}
+
+// ifreq構造体(linux/if.h)．名前の後ろは用途ごとに中身が変わる
+type ifreq struct {
+	name [syscall.IFNAMSIZ]byte
+	data [24]byte
+}
+
+func newIfreq(name string) (*ifreq, error) {
+	if len(name) >= syscall.IFNAMSIZ {
+		return nil, fmt.Errorf("インタフェース名が長すぎます: %s", name)
+	}
+	req := &ifreq{}
+	copy(req.name[:], name)
+	return req, nil
+}
+
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// TAPデバイスを開く．なければ作成し，閉じたときに削除される
+// nameに"tap%d"を渡すとカーネルが空いている名前を選ぶ．macがnilならランダムなローカルアドレスにする
+// カーネル側のインタフェースにアドレスを付けるならCreateTapを使う
+func OpenTap(name string, mac net.HardwareAddr) (*TapDevice, error) {
+	req, err := newIfreq(name)
+	if err != nil {
+		return nil, err
+	}
+	*(*uint16)(unsafe.Pointer(&req.data[0])) = iffTap | iffNoPI
+
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("/dev/net/tunのオープンに失敗: %v", err)
+	}
+	if err := ioctl(uintptr(fd), tunSetIff, unsafe.Pointer(req)); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("TAPデバイス%sの作成に失敗: %v", name, err)
+	}
+	// ノンブロッキングにしておくと，Closeで読み込み待ちのReadFrameを起こせる
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("TAPデバイスの設定に失敗: %v", err)
+	}
+
+	ifname := string(req.name[:clen(req.name[:])])
+	if mac == nil {
+		if mac, err = randomMAC(); err != nil {
+			syscall.Close(fd)
+			return nil, err
+		}
+	}
+	d := &TapDevice{
+		file: os.NewFile(uintptr(fd), "/dev/net/tun"),
+		name: ifname,
+		mac:  mac,
+		mtu:  1500,
+	}
+	if iface, err := net.InterfaceByName(ifname); err == nil {
+		d.mtu = iface.MTU
+	}
+	return d, nil
+}
+
+// NULで終わる文字列の長さ
+func clen(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
+
+// ローカル管理(U/Lビットが1)のユニキャストMACアドレスをランダムに作る
+func randomMAC() (net.HardwareAddr, error) {
+	mac := make(net.HardwareAddr, 6)
+	if _, err := rand.Read(mac); err != nil {
+		return nil, fmt.Errorf("MACアドレスの生成に失敗: %v", err)
+	}
+	mac[0] = mac[0]&^0x01 | 0x02
+	return mac, nil
+}
+
+// カーネル側のインタフェース名
+func (d *TapDevice) Name() string {
+	return d.name
+}
+
+func (d *TapDevice) ReadFrame() ([]byte, error) {
+	buf := make([]byte, ethernetHeaderLen+d.mtu)
+	n, err := d.file.Read(buf)
+	if err != nil {
+		if errors.Is(err, os.ErrClosed) {
+			return nil, ErrLinkClosed
+		}
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (d *TapDevice) WriteFrame(frame []byte) error {
+	if _, err := d.file.Write(frame); err != nil {
+		if errors.Is(err, os.ErrClosed) {
+			return ErrLinkClosed
+		}
+		return err
+	}
+	return nil
+}
+
+func (d *TapDevice) MTU() int {
+	return d.mtu
+}
+
+func (d *TapDevice) HardwareAddr() net.HardwareAddr {
+	return d.mac
+}
+
+// デバイスを閉じる．OpenTapが作成したインタフェースはカーネルから削除される
+func (d *TapDevice) Close() error {
+	return d.file.Close()
+}
+
+// 結合テスト用に，TAPデバイスを作ってカーネル側のインタフェースにhostAddrを付けて有効にする
+// スタックにはhostAddrと同じサブネットの別のアドレスを付ければ，カーネルと通信できる
+// Closeするとインタフェースごと削除される(root権限かCAP_NET_ADMINが必要)
+func CreateTap(name string, hostAddr net.IPNet) (*TapDevice, error) {
+	d, err := OpenTap(name, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := configureTap(d.name, hostAddr); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// カーネル側のインタフェースにアドレスを付けてリンクを上げる
+func configureTap(name string, addr net.IPNet) error {
+	if isIPv6(addr.IP) {
+		if err := setIPv6Addr(name, addr); err != nil {
+			return err
+		}
+	} else if err := setIPv4Addr(name, addr); err != nil {
+		return err
+	}
+	return setLinkUp(name)
+}
+
+// アドレス設定用のソケットでioctlを呼ぶ
+func sockIoctl(family int, req uintptr, arg unsafe.Pointer) error {
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("ソケットの作成に失敗: %v", err)
+	}
+	defer syscall.Close(fd)
+	return ioctl(uintptr(fd), req, arg)
+}
+
+// sockaddr_inをifreqに入れる
+func putSockaddrInet4(req *ifreq, ip net.IP) {
+	// sa_familyだけはホストのバイトオーダ
+	*(*uint16)(unsafe.Pointer(&req.data[0])) = syscall.AF_INET
+	copy(req.data[4:8], ip.To4())
+}
+
+func setIPv4Addr(name string, addr net.IPNet) error {
+	ip := addr.IP.To4()
+	mask := addr.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[net.IPv6len-net.IPv4len:]
+	}
+	if ip == nil || len(mask) != net.IPv4len {
+		return fmt.Errorf("無効なIPv4アドレス: %v", &addr)
+	}
+
+	req, err := newIfreq(name)
+	if err != nil {
+		return err
+	}
+	putSockaddrInet4(req, ip)
+	if err := sockIoctl(syscall.AF_INET, syscall.SIOCSIFADDR, unsafe.Pointer(req)); err != nil {
+		return fmt.Errorf("%sへのアドレスの設定に失敗: %v", name, err)
+	}
+	putSockaddrInet4(req, net.IP(mask))
+	if err := sockIoctl(syscall.AF_INET, syscall.SIOCSIFNETMASK, unsafe.Pointer(req)); err != nil {
+		return fmt.Errorf("%sへのサブネットマスクの設定に失敗: %v", name, err)
+	}
+	return nil
+}
+
+// in6_ifreq構造体(linux/ipv6.h)
+type in6Ifreq struct {
+	addr      [net.IPv6len]byte
+	prefixLen uint32
+	ifindex   int32
+}
+
+func setIPv6Addr(name string, addr net.IPNet) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("インタフェースの取得に失敗: %v", err)
+	}
+	ones, _ := addr.Mask.Size()
+	req := &in6Ifreq{prefixLen: uint32(ones), ifindex: int32(iface.Index)}
+	copy(req.addr[:], addr.IP.To16())
+	if err := sockIoctl(syscall.AF_INET6, syscall.SIOCSIFADDR, unsafe.Pointer(req)); err != nil {
+		return fmt.Errorf("%sへのアドレスの設定に失敗: %v", name, err)
+	}
+	return nil
+}
+
+func setLinkUp(name string) error {
+	req, err := newIfreq(name)
+	if err != nil {
+		return err
+	}
+	if err := sockIoctl(syscall.AF_INET, syscall.SIOCGIFFLAGS, unsafe.Pointer(req)); err != nil {
+		return fmt.Errorf("%sのフラグの取得に失敗: %v", name, err)
+	}
+	flags := *(*uint16)(unsafe.Pointer(&req.data[0]))
+	*(*uint16)(unsafe.Pointer(&req.data[0])) = flags | syscall.IFF_UP | syscall.IFF_RUNNING
+	if err := sockIoctl(syscall.AF_INET, syscall.SIOCSIFFLAGS, unsafe.Pointer(req)); err != nil {
+		return fmt.Errorf("%sを有効にできませんでした: %v", name, err)
+	}
+	return nil
+}
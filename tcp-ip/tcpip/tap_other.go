@@ -0,0 +1,26 @@
+//go:build !linux
+
+package tcpip
+
+import (
+	"fmt"
+	"net"
+)
+
+// TAPデバイス(Linux以外では未対応なのでpcapかパイプを使う)
+type TapDevice struct{}
+
+func OpenTap(name string, mac net.HardwareAddr) (*TapDevice, error) {
+	return nil, fmt.Errorf("TAPデバイスはLinuxのみ対応しています")
+}
+
+func CreateTap(name string, hostAddr net.IPNet) (*TapDevice, error) {
+	return nil, fmt.Errorf("TAPデバイスはLinuxのみ対応しています")
+}
+
+func (d *TapDevice) Name() string                   { return "" }
+func (d *TapDevice) ReadFrame() ([]byte, error)     { return nil, ErrLinkClosed }
+func (d *TapDevice) WriteFrame(frame []byte) error  { return ErrLinkClosed }
+func (d *TapDevice) MTU() int                       { return 0 }
+func (d *TapDevice) HardwareAddr() net.HardwareAddr { return nil }
+func (d *TapDevice) Close() error                   { return nil }
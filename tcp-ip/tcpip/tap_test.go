@@ -0,0 +1,136 @@
+//go:build linux
+
+package tcpip
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// capability(linux/capability.h)の番号
+const (
+	capNetAdmin = 12
+	capNetRaw   = 13
+)
+
+// プロセスが有効なcapabilityを持っているか
+func hasCapability(c uint) bool {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+			return err == nil && caps&(1<<c) != 0
+		}
+	}
+	return false
+}
+
+// カーネル側(10.9.0.1)からTAPの向こうのスタック(10.9.0.2)へpingを送る
+func TestTapKernelPingsStack(t *testing.T) {
+	if !hasCapability(capNetAdmin) || !hasCapability(capNetRaw) {
+		t.Skip("TAPデバイスの作成とICMPの送信にはCAP_NET_ADMINとCAP_NET_RAWが必要です")
+	}
+	dev, err := CreateTap("tcpiptest%d", ipn("10.9.0.1/24"))
+	if err != nil {
+		t.Skipf("TAPデバイスを作れません: %v", err)
+	}
+	name := dev.Name()
+	s := NewStack()
+	s.SetDADConfig(fastDAD)
+	s.AddNIC(name, dev, ipn("10.9.0.2/24"))
+	closed := false
+	defer func() {
+		if !closed {
+			s.Close()
+		}
+	}()
+
+	// カーネルのrawソケットでエコー要求を送る
+	conn, err := net.ListenPacket("ip4:icmp", "10.9.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	const id, seq = 0x4242, 1
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true},
+		&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), Id: id, Seq: seq},
+		gopacket.Payload("ping from kernel")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo(buf.Bytes(), &net.IPAddr{IP: net.IPv4(10, 9, 0, 2)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 他のプロセスのICMPも届くので，idとseqが一致するエコー応答を待つ
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	rb := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(rb)
+		if err != nil {
+			t.Fatalf("エコー応答が届きません: %v", err)
+		}
+		icmp := &layers.ICMPv4{}
+		if err := icmp.DecodeFromBytes(rb[:n], gopacket.NilDecodeFeedback); err != nil {
+			continue
+		}
+		if icmp.TypeCode.Type() != layers.ICMPv4TypeEchoReply || icmp.Id != id || icmp.Seq != seq {
+			continue
+		}
+		if !from.(*net.IPAddr).IP.Equal(net.IPv4(10, 9, 0, 2)) || string(icmp.Payload) != "ping from kernel" {
+			t.Fatalf("エコー応答: %v %q", from, icmp.Payload)
+		}
+		break
+	}
+
+	// スタックからもカーネルへ届く
+	stats, err := s.Ping(net.IPv4(10, 9, 0, 1), PingOptions{Count: 1, Timeout: time.Second}, nil)
+	if err != nil || stats.Received != 1 {
+		t.Fatalf("ping: %+v %v", stats, err)
+	}
+
+	// カーネルのTCPからスタックのリスナへつなぐ
+	l, err := s.Listen(nil, 8080, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c.Write([]byte("hello from userland"))
+		c.Close()
+	}()
+	c, err := net.DialTimeout("tcp", "10.9.0.2:8080", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(3 * time.Second))
+	b, err := io.ReadAll(c)
+	c.Close()
+	if string(b) != "hello from userland" {
+		t.Fatalf("受信: %q %v", b, err)
+	}
+
+	// スタックを閉じるとTAPデバイスも消える
+	closed = true
+	s.Close()
+	if _, err := net.InterfaceByName(name); err == nil {
+		t.Fatalf("インタフェース%sが残っています", name)
+	}
+}
@@ -1,16 +1,31 @@
 package tcpip
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 )
 
+var (
+	// 相手からRSTを受け取った
+	ErrConnectionReset = errors.New("接続がリセットされました")
+	// SYNに対してRSTが返ってきた
+	ErrConnectionRefused = errors.New("接続が拒否されました")
+	// 閉じた接続を使おうとした
+	ErrConnectionClosed = errors.New("接続は閉じられています")
+)
+
+// 最大セグメント生存時間(MSL)．TIME_WAITでは2MSL待つ
+const msl = 30 * time.Second
+
 // TCP接続の設定を表す構造体
+// SeqNumberとAckNumberはStartTCPConnectionが返す現在の値で，渡した値は使わない
 type TCPIP struct {
 	DestIP    string
 	DestPort  uint16
@@ -21,236 +36,511 @@ type TCPIP struct {
 
 // TCP接続を管理する構造体
 type TCPConnection struct {
-	handle    *pcap.Handle
-	ifaceName string
-	srcIP     net.IP
-	srcPort   uint16
-	dstIP     net.IP
-	dstPort   uint16
-	seqNumber uint32
-	ackNumber uint32
-	srcMAC    net.HardwareAddr
-	dstMAC    net.HardwareAddr
+	stack   *Stack
+	nic     *NIC
+	key     tcpKey
+	rx      <-chan *tcpSegment
+	srcIP   net.IP
+	srcPort uint16
+	dstIP   net.IP
+	dstPort uint16
+	srcMAC  net.HardwareAddr
+	dstMAC  net.HardwareAddr
+
+	mu    sync.Mutex
+	state TCPState
+	// 状態が変わるたびに閉じて作り直す(待っている側を起こす)
+	changed chan struct{}
+	// CLOSEDになったら閉じる
+	closed    chan struct{}
+	closeOnce sync.Once
+	// 接続が異常終了した理由
+	err error
+
+	// 送信シーケンス空間(RFC 793 Section 3.2)
+	iss    uint32 // 初期シーケンス番号
+	sndUna uint32 // 確認応答されていない最初のシーケンス番号
+	sndNxt uint32 // 次に送るシーケンス番号
+	sndWnd uint32 // 相手の受信ウィンドウ
+	sndWl1 uint32 // 最後にウィンドウを更新したセグメントのシーケンス番号
+	sndWl2 uint32 // 最後にウィンドウを更新したセグメントの確認応答番号
+	// 受信シーケンス空間
+	irs    uint32 // 相手の初期シーケンス番号
+	rcvNxt uint32 // 次に受け取るはずのシーケンス番号
+	// 最後に通知した受信ウィンドウ
+	rcvAdvertised uint32
+
+	// 1つのセグメントで送るデータの最大長(オプションを含む)
+	mss int
+
+	// TCPオプション(RFC 7323, RFC 2018)．SYNを送る前は申し出るかどうか，その後は使うかどうか
+	wsOK   bool
+	sackOK bool
+	tsOK   bool
+	// ウィンドウスケールのシフト数(相手が通知するウィンドウ，自分が通知するウィンドウ)
+	sndWscale uint8
+	rcvWscale uint8
+	// タイムスタンプ: 自分の時計のずれ，相手へ返すタイムスタンプ，最後に送った確認応答番号
+	tsOffset    uint32
+	tsRecent    uint32
+	lastAckSent uint32
+	// 最後に順番を追い越して受け取ったセグメントのシーケンス番号
+	lastOutOfOrder uint32
+	// 相手がSACKで通知してきた範囲の最も大きいシーケンス番号
+	highSacked uint32
+	// 送信バッファと受信バッファの大きさ
+	sndBufSize int
+	rcvBufSize int
+	// Writeされたがまだ送っていないデータ
+	sndBuf []byte
+	// 順番どおりに受け取り，まだReadされていないデータ
+	rcvBuf []byte
+	// 順番を追い越して届いたセグメント(先頭のシーケンス番号ごと)
+	rcvOutOfOrder map[uint32][]byte
+	// 先に届いたFINのシーケンス番号
+	rcvFinSeq     uint32
+	rcvFinPending bool
+	// 相手のFINを受け取った(これ以上データは来ない)
+	finReceived bool
+
+	// 再送キュー: 送ったが確認応答されていないセグメント(古い順)
+	rtxQueue []*txSegment
+	rtxTimer Timer
+	// 止めた再送タイマのコールバックを無視するための世代番号
+	rtxGen int
+	// 最も古いセグメントを続けて再送した回数とその上限
+	retries    int
+	maxRetries int
+	// 最後に再送した時刻
+	lastRetransmit time.Time
+
+	// 輻輳制御
+	cc CongestionControl
+	// 続けて届いた重複ACKの数
+	dupAcks int
+	// 高速回復中か，再送タイムアウトから回復中か
+	inRecovery  bool
+	rtoRecovery bool
+	// 損失を検出したときのSND.NXT．ここまで確認応答されたら回復が終わる
+	recover uint32
+	// RTTの推定値と再送タイムアウト(RFC 6298)
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+	stats  TCPStats
+
+	// ゼロウィンドウを調べるパーシストタイマ
+	persistTimer   Timer
+	persistGen     int
+	persistBackoff time.Duration
+
+	// Closeされ，送信バッファが空になったらFINを送る
+	finPending bool
+	// FINを送ったか
+	finSent bool
+	// TIME_WAITで待つ時間とそのタイマ
+	timeWait      time.Duration
+	timeWaitTimer Timer
+
+	// ReadとWriteの期限とそれを知らせるタイマ(net.Conn)
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     Timer
+	writeTimer    Timer
 }
 
 // 新しいTCP接続を作成
-func NewTCP(ifaceName string, srcPort uint16) *TCPConnection {
-	return &TCPConnection{
-		ifaceName: ifaceName,
-		srcPort:   srcPort,
-		seqNumber: 1000, // 初期シーケンス番号
+func NewTCP(s *Stack, srcPort uint16) *TCPConnection {
+	config := s.getTCPConfig()
+	cc, _ := NewCongestionControl(config.CongestionControl)
+	s.useClock(cc)
+	cc.Init(defaultMSS)
+	t := &TCPConnection{
+		stack:      s,
+		srcPort:    srcPort,
+		mss:        defaultMSS,
+		sndBufSize: config.SendBufferSize,
+		rcvBufSize: config.ReceiveBufferSize,
+		rto:        initialRTO,
+		maxRetries: config.MaxRetries,
+		cc:         cc,
+		changed:    make(chan struct{}),
+		closed:     make(chan struct{}),
+		timeWait:   2 * msl,
 	}
+	t.initOptions(config)
+	return t
 }
 
-// TCP接続を閉じる
-func (t *TCPConnection) Close() error {
-	if t.handle != nil {
-		t.handle.Close()
+// TCPヘッダのフラグ
+type tcpFlags uint8
+
+const (
+	flagFIN tcpFlags = 1 << iota
+	flagSYN
+	flagRST
+	flagPSH
+	flagACK
+)
+
+// "SYNACK"のような文字列をフラグに変換
+func parseTCPFlags(flags string) tcpFlags {
+	switch flags {
+	case "SYN":
+		return flagSYN
+	case "ACK":
+		return flagACK
+	case "FIN":
+		return flagFIN
+	case "RST":
+		return flagRST
+	case "SYNACK":
+		return flagSYN | flagACK
+	case "FINACK":
+		return flagFIN | flagACK
+	case "RSTACK":
+		return flagRST | flagACK
 	}
-	return nil
+	return 0
+}
+
+func (f tcpFlags) String() string {
+	s := ""
+	for _, n := range []struct {
+		flag tcpFlags
+		name string
+	}{{flagSYN, "SYN"}, {flagFIN, "FIN"}, {flagRST, "RST"}, {flagPSH, "PSH"}, {flagACK, "ACK"}} {
+		if f&n.flag != 0 {
+			s += n.name
+		}
+	}
+	return s
+}
+
+// 受信したTCPヘッダからフラグを取り出す
+func flagsOf(tcp *layers.TCP) tcpFlags {
+	var f tcpFlags
+	if tcp.FIN {
+		f |= flagFIN
+	}
+	if tcp.SYN {
+		f |= flagSYN
+	}
+	if tcp.RST {
+		f |= flagRST
+	}
+	if tcp.PSH {
+		f |= flagPSH
+	}
+	if tcp.ACK {
+		f |= flagACK
+	}
+	return f
 }
 
 // 新しいTCPヘッダを作成
 func NewTcpHeader(srcPort, dstPort uint16, seq, ack uint32, flags string) *layers.TCP {
-	tcp := &layers.TCP{
+	return newTCPHeader(srcPort, dstPort, seq, ack, parseTCPFlags(flags), 65535)
+}
+
+func newTCPHeader(srcPort, dstPort uint16, seq, ack uint32, flags tcpFlags, window uint16) *layers.TCP {
+	return &layers.TCP{
 		SrcPort:    layers.TCPPort(srcPort),
 		DstPort:    layers.TCPPort(dstPort),
 		Seq:        seq,
 		Ack:        ack,
 		DataOffset: 5,
-		Window:     65535,
+		Window:     window,
 		Checksum:   0,
 		Urgent:     0,
+		// TCPフラグを設定
+		FIN: flags&flagFIN != 0,
+		SYN: flags&flagSYN != 0,
+		RST: flags&flagRST != 0,
+		PSH: flags&flagPSH != 0,
+		ACK: flags&flagACK != 0,
 	}
-
-	// TCPフラグを設定
-	switch flags {
-	case "SYN":
-		tcp.SYN = true
-	case "ACK":
-		tcp.ACK = true
-	case "FIN":
-		tcp.FIN = true
-	case "SYNACK":
-		tcp.SYN = true
-		tcp.ACK = true
-	case "FINACK":
-		tcp.FIN = true
-		tcp.ACK = true
-	}
-
-	return tcp
 }
 
 // 接続の初期設定を行う
-func (t *TCPConnection) setupConnection(destIP string, destPort uint16) error {
-	// インタフェース情報を取得
-	iface, err := net.InterfaceByName(t.ifaceName)
-	if err != nil {
-		return fmt.Errorf("インタフェースの取得に失敗: %v", err)
+func (t *TCPConnection) setupConnection(ctx context.Context, destIP string, destPort uint16) error {
+	// すでにエンドポイントを登録済みなら何もしない
+	if t.rx != nil {
+		return nil
 	}
 
-	// 送信元IPアドレスを取得
-	addrs, err := iface.Addrs()
+	// 宛先IPアドレスを解析(ホスト名ならリゾルバで解決する)
+	dstIP, err := t.stack.lookupIP(ctx, "tcp", destIP)
 	if err != nil {
-		return fmt.Errorf("IPアドレスの取得に失敗: %v", err)
-	}
-
-	for _, addr := range addrs {
-		if ipnet, ok := addr.(*net.IPNet); ok {
-			if ipnet.IP.To4() != nil {
-				t.srcIP = ipnet.IP.To4()
-				break
-			}
-		}
-	}
-	if t.srcIP == nil {
-		return fmt.Errorf("有効なIPv4アドレスが見つかりません")
+		return err
 	}
+	t.dstIP = dstIP
 
-	// 宛先IPアドレスを解析
-	t.dstIP = net.ParseIP(destIP)
-	if t.dstIP == nil {
-		return fmt.Errorf("無効な宛先IPアドレス: %s", destIP)
+	// 経路から送信に使うインタフェース，送信元IPアドレス，次の転送先を選ぶ
+	nic, srcIP, nextHop, err := t.stack.route(t.dstIP)
+	if err != nil {
+		return err
 	}
+	t.nic = nic
+	t.srcIP = srcIP
+	t.setMSSLocked(mssFor(nic, t.dstIP))
 
 	t.dstPort = destPort
-	t.srcMAC = iface.HardwareAddr
+	t.srcMAC = nic.HardwareAddr()
 
 	// すでにMACアドレスがセットされていればARPをスキップ
 	if t.dstMAC == nil {
-		// ARPを使用して宛先MACアドレスを取得
-		arpReply, err := Send(t.ifaceName, t.dstIP)
+		// ARPを使用して次の転送先のMACアドレスを取得(近隣テーブルにあればそれを使う)
+		dstMAC, err := t.stack.neighbors.resolveContext(ctx, nic, srcIP, nextHop)
 		if err != nil {
-			return fmt.Errorf("ARPリクエストに失敗: %v", err)
+			// ctxが終わったときは，呼び出し側がerrors.Isで確かめられるようそのまま返す
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("MACアドレスの解決に失敗: %v", err)
 		}
-		t.dstMAC = net.HardwareAddr(arpReply.SourceHwAddress)
+		t.dstMAC = dstMAC
 	}
 
-	// パケットキャプチャ用のハンドルを開く
-	handle, err := pcap.OpenLive(t.ifaceName, 65536, true, pcap.BlockForever)
+	// 4つ組でエンドポイントを登録し，この接続宛てのセグメントだけを受け取る
+	t.key = tcpKey{
+		localAddr:  ipAddr(t.srcIP),
+		localPort:  t.srcPort,
+		remoteAddr: ipAddr(t.dstIP),
+		remotePort: t.dstPort,
+	}
+	rx, err := t.stack.registerTCP(t.key)
 	if err != nil {
-		return fmt.Errorf("pcapハンドルのオープンに失敗: %v", err)
+		return err
 	}
-	t.handle = handle
+	t.rx = rx
 
+	// 受信したセグメントで状態を進めるゴルーチンを起動
+	go t.loop()
 	return nil
 }
 
 // TCPパケットを送信
 func (t *TCPConnection) sendTCPPacket(tcp *layers.TCP, payload []byte) error {
-	// Ethernetヘッダを作成
-	ethernet := NewEthernet(t.srcMAC, t.dstMAC, "IPv4")
-
-	// IPヘッダを作成
-	ip := &layers.IPv4{
-		SrcIP:    t.srcIP,
-		DstIP:    t.dstIP,
-		Protocol: layers.IPProtocolTCP,
-		Version:  4,
-		TTL:      64,
+	t.stack.traceSegment(TCPTraceSend, t.key, tcp, len(payload))
+	l := []gopacket.SerializableLayer{tcp}
+	if len(payload) > 0 {
+		l = append(l, gopacket.Payload(payload))
 	}
 
-	// TCPヘッダのチェックサムを設定
-	tcp.SetNetworkLayerForChecksum(ip)
-
-	// パケットをシリアライズ
-	buf := gopacket.NewSerializeBuffer()
-	opts := gopacket.SerializeOptions{
-		FixLengths:       true,
-		ComputeChecksums: true,
+	if isIPv6(t.dstIP) {
+		ip := NewIPv6Header(t.srcIP, t.dstIP)
+		ip.NextHeader = layers.IPProtocolTCP
+		return t.nic.writeIPv6(t.dstMAC, ip, l...)
 	}
 
-	layers := []gopacket.SerializableLayer{&ethernet, ip, tcp}
-	if len(payload) > 0 {
-		layers = append(layers, gopacket.Payload(payload))
-	}
+	// IPヘッダを作成(セグメントはMSSで分けるのでフラグメントさせない)
+	ip := NewIPHeader(t.srcIP, t.dstIP)
+	ip.Protocol = layers.IPProtocolTCP
+	ip.Flags = layers.IPv4DontFragment
 
-	if err := gopacket.SerializeLayers(buf, opts, layers...); err != nil {
-		return fmt.Errorf("パケットのシリアライズに失敗: %v", err)
-	}
+	// パケットをシリアライズしてTCPパケットを送信
+	return t.nic.writeIPv4(t.dstMAC, ip, l...)
+}
 
-	// TCPパケットを送信
-	if err := t.handle.WritePacketData(buf.Bytes()); err != nil {
-		return fmt.Errorf("パケットの送信に失敗: %v", err)
+// 現在の受信状態でセグメントを送信(ACKフラグがあればrcvNxtを確認応答する)
+func (t *TCPConnection) sendSegmentLocked(flags tcpFlags, seq uint32, payload []byte) error {
+	var ack uint32
+	if flags&flagACK != 0 {
+		ack = t.rcvNxt
+		t.lastAckSent = ack
 	}
-
-	return nil
+	window := t.rcvWindowLocked()
+	var field uint16
+	if flags&flagSYN != 0 {
+		// SYNのウィンドウはスケールしない
+		if window > maxWindow {
+			window = maxWindow
+		}
+		field = uint16(window)
+	} else {
+		field = uint16(window >> t.rcvWscale)
+		window = uint32(field) << t.rcvWscale
+	}
+	t.rcvAdvertised = window
+	tcp := newTCPHeader(t.srcPort, t.dstPort, seq, ack, flags, field)
+	tcp.Options = t.optionsLocked(flags, len(payload))
+	t.stats.SegmentsSent++
+	return t.sendTCPPacket(tcp, payload)
 }
 
-// TCPパケットを受信
-func (t *TCPConnection) receiveTCPPacket(timeout time.Duration) (*layers.TCP, error) {
-	src := gopacket.NewPacketSource(t.handle, t.handle.LinkType())
-	timer := time.After(timeout)
+// 確認応答だけを送る
+func (t *TCPConnection) sendAckLocked() {
+	t.sendSegmentLocked(flagACK, t.sndNxt, nil)
+}
 
+// 受信したセグメントを1つずつ状態機械に渡す
+func (t *TCPConnection) loop() {
 	for {
 		select {
-		case packet := <-src.Packets():
-			// TCPレイヤを抽出
-			if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-				tcp := tcpLayer.(*layers.TCP)
-				// 宛先ポートと送信元ポートを確認
-				if tcp.DstPort == layers.TCPPort(t.srcPort) && tcp.SrcPort == layers.TCPPort(t.dstPort) {
-					return tcp, nil
-				}
+		case seg := <-t.rx:
+			t.mu.Lock()
+			t.handleSegment(seg.tcp)
+			t.mu.Unlock()
+			addWork(t.stack.clock, -1)
+		case <-t.closed:
+			t.stack.drainTCP(t.rx)
+			return
+		}
+	}
+}
+
+// 接続の現在の状態
+func (t *TCPConnection) State() TCPState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+// 接続がいずれかの状態になるまで待つ
+func (t *TCPConnection) WaitState(timeout time.Duration, states ...TCPState) error {
+	timer := t.stack.clock.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		t.mu.Lock()
+		for _, st := range states {
+			if t.state == st {
+				t.mu.Unlock()
+				return nil
 			}
-		case <-timer:
-			return nil, fmt.Errorf("タイムアウト: TCPパケットを受信できませんでした")
+		}
+		state, changed := t.state, t.changed
+		t.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C():
+			return fmt.Errorf("タイムアウト: %vのまま状態が変わりませんでした", state)
 		}
 	}
 }
 
-// TCP接続を開始
-func (t *TCPConnection) StartTCPConnection(tcpConfig TCPIP) (*TCPIP, error) {
+// 3Way Handshakeで接続を確立する
+// ctxが終わったら，アドレスの解決やSYNを送る前でも接続をやめる
+func (t *TCPConnection) connect(ctx context.Context, destIP string, destPort uint16) error {
 	// 接続の初期設定
-	if err := t.setupConnection(tcpConfig.DestIP, tcpConfig.DestPort); err != nil {
-		return nil, err
+	if err := t.setupConnection(ctx, destIP, destPort); err != nil {
+		return err
 	}
 
-	// TCPヘッダを作成
-	tcp := NewTcpHeader(t.srcPort, t.dstPort, t.seqNumber, t.ackNumber, tcpConfig.TcpFlag)
+	t.mu.Lock()
+	if t.state != StateClosed {
+		t.mu.Unlock()
+		return fmt.Errorf("接続はすでに%vです", t.state)
+	}
+	defer t.mu.Unlock()
+	// SYN_SENTになった後のctxの終わりは呼び出し側が見張る
+	if err := ctx.Err(); err != nil {
+		t.abortLocked(err)
+		return err
+	}
+	t.iss = t.stack.generateISN(t.key)
+	// SYNは1つのシーケンス番号を消費する
+	t.sndUna = t.iss
+	t.sndNxt = t.iss + 1
+	t.recover = t.iss
+	t.setStateLocked(StateSynSent)
+	t.sendReliableLocked(flagSYN, t.iss, nil)
+	fmt.Printf("TCP SYNパケットを[%v:%d]へ送信\n", t.dstIP, t.dstPort)
+
+	// SYN+ACKを受け取ってESTABLISHEDになるか，RSTや再送の上限でCLOSEDになるまで待つ
+	t.waitHandshakeLocked()
+	if t.state == StateClosed {
+		return t.err
+	}
+	return nil
+}
 
-	// TCPパケットを送信
-	if err := t.sendTCPPacket(tcp, nil); err != nil {
-		return nil, err
+// 3Way Handshakeが終わるまで待つ
+func (t *TCPConnection) waitHandshakeLocked() {
+	for t.state == StateSynSent || t.state == StateSynReceived {
+		t.waitLocked()
 	}
+}
 
-	fmt.Printf("TCP %sパケットを[%v:%d]へ送信\n", tcpConfig.TcpFlag, t.dstIP, t.dstPort)
+// TCP接続を閉じる
+// 送信バッファのデータを送り終えたらFINを送り，相手のFINを待つ状態へ進む．
+// 接続の後片付けはTIME_WAITやLAST_ACKが終わったときに行う
+func (t *TCPConnection) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch t.state {
+	case StateClosed:
+		return nil
+	case StateSynSent:
+		t.closeLocked()
+		return nil
+	case StateSynReceived, StateEstablished:
+		t.setStateLocked(StateFinWait1)
+	case StateCloseWait:
+		t.setStateLocked(StateLastAck)
+	default:
+		return nil
+	}
+	t.finPending = true
+	t.pushLocked()
+	return nil
+}
 
-	// レスポンスを受信(SYNの場合はSYN+ACKを待つ)
-	if tcpConfig.TcpFlag == "SYN" {
-		response, err := t.receiveTCPPacket(3 * time.Second)
-		if err != nil {
-			return nil, err
-		}
+// RSTを送って接続を即座に破棄する
+func (t *TCPConnection) Abort() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-		// シーケンス番号とACK番号を更新
-		t.seqNumber = tcpConfig.SeqNumber + 1
-		t.ackNumber = response.Seq + 1
+	switch t.state {
+	case StateClosed:
+		return
+	case StateSynReceived, StateEstablished, StateFinWait1, StateFinWait2, StateCloseWait:
+		t.sendSegmentLocked(flagRST, t.sndNxt, nil)
+	}
+	t.closeLocked()
+}
 
-		fmt.Printf("TCP SYN+ACKを受信: Seq=%d, Ack=%d\n", response.Seq, response.Ack)
+// FINを送る(FINも1つのシーケンス番号を消費する)
+func (t *TCPConnection) sendFinLocked() {
+	t.sendReliableLocked(flagFIN|flagACK, t.sndNxt, nil)
+	t.sndNxt++
+	t.finPending = false
+	t.finSent = true
+	fmt.Printf("TCP FINACKパケットを[%v:%d]へ送信\n", t.dstIP, t.dstPort)
+}
 
-		// ACKパケットを送信
-		ackHeader := NewTcpHeader(t.srcPort, t.dstPort, t.seqNumber, t.ackNumber, "ACK")
-		if err := t.sendTCPPacket(ackHeader, nil); err != nil {
-			return nil, fmt.Errorf("ACKパケットの送信に失敗: %v", err)
+// TCP接続を開始
+// TcpFlagが"SYN"なら3Way Handshakeを行い，"FIN"/"FINACK"なら接続を閉じる．
+// シーケンス番号と確認応答番号は接続の状態から決まるので，tcpConfigのものは使わない
+func (t *TCPConnection) StartTCPConnection(tcpConfig TCPIP) (*TCPIP, error) {
+	switch tcpConfig.TcpFlag {
+	case "SYN":
+		if err := t.connect(context.Background(), tcpConfig.DestIP, tcpConfig.DestPort); err != nil {
+			return nil, err
 		}
 		fmt.Printf("TCP ACKパケットを[%v:%d]へ送信\n", t.dstIP, t.dstPort)
-
-		return &TCPIP{
-			DestIP:    tcpConfig.DestIP,
-			DestPort:  tcpConfig.DestPort,
-			TcpFlag:   "SYNACK",
-			SeqNumber: t.seqNumber,
-			AckNumber: t.ackNumber,
-		}, nil
+		tcpConfig.TcpFlag = "SYNACK"
+	case "FIN", "FINACK":
+		if err := t.Close(); err != nil {
+			return nil, err
+		}
+		// 相手がFINを確認応答するまで待つ
+		if err := t.WaitState(3*time.Second, StateFinWait2, StateTimeWait, StateClosed); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("未対応のTCPフラグ: %s", tcpConfig.TcpFlag)
 	}
 
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	return &TCPIP{
 		DestIP:    tcpConfig.DestIP,
 		DestPort:  tcpConfig.DestPort,
 		TcpFlag:   tcpConfig.TcpFlag,
-		SeqNumber: t.seqNumber,
-		AckNumber: t.ackNumber,
+		SeqNumber: t.sndNxt,
+		AckNumber: t.rcvNxt,
 	}, nil
 }
@@ -0,0 +1,276 @@
+package tcpip
+
+import (
+	"fmt"
+	"time"
+)
+
+// 輻輳制御アルゴリズム
+// 接続は重複ACKの数え方や高速再送のタイミングを受け持ち，アルゴリズムは輻輳ウィンドウの増減を受け持つ
+// 大きさはすべてバイト数
+type CongestionControl interface {
+	// アルゴリズムの名前
+	Name() string
+	// MSSが決まったときに呼ばれ，輻輳ウィンドウを初期値にする
+	Init(mss int)
+	// 新しいデータがackedバイト確認応答された(高速回復中以外)．srttは現在の平滑化RTT
+	OnAck(acked int, srtt time.Duration)
+	// 3つ目の重複ACKでセグメントの損失を検出し，高速回復に入る
+	OnLoss(inFlight int)
+	// 高速回復中に重複ACKが届いた
+	OnDupAck()
+	// 高速回復中に，損失を検出した時点で送っていたデータの一部だけが確認応答された
+	// trueなら次の穴を再送して高速回復を続ける
+	OnPartialAck(acked int) bool
+	// 高速回復が終わった
+	OnRecoveryExit()
+	// 再送タイムアウトが起きた
+	OnRTO(inFlight int)
+	// 輻輳ウィンドウ
+	CongestionWindow() int
+	// スロースタートの閾値
+	SlowStartThreshold() int
+}
+
+// 使える輻輳制御アルゴリズムの名前
+var congestionControls = map[string]func() CongestionControl{
+	"reno":    func() CongestionControl { return &Reno{} },
+	"newreno": func() CongestionControl { return &NewReno{} },
+	"cubic":   func() CongestionControl { return &Cubic{} },
+}
+
+// 名前("reno"，"newreno"，"cubic")から輻輳制御アルゴリズムを作る
+func NewCongestionControl(name string) (CongestionControl, error) {
+	newCC, ok := congestionControls[name]
+	if !ok {
+		return nil, fmt.Errorf("未対応の輻輳制御アルゴリズム: %s", name)
+	}
+	return newCC(), nil
+}
+
+// 初期ウィンドウ(RFC 5681 Section 3.1)
+func initialWindow(mss int) int {
+	switch {
+	case mss > 2190:
+		return 2 * mss
+	case mss > 1095:
+		return 3 * mss
+	}
+	return 4 * mss
+}
+
+// スロースタート，輻輳回避，高速再送/高速回復を行うReno(RFC 5681)
+// 高速回復中に新しいACKが届いたら，部分的なACKでも回復を終える
+type Reno struct {
+	mss      int
+	cwnd     int
+	ssthresh int
+}
+
+func (r *Reno) Name() string { return "reno" }
+
+func (r *Reno) Init(mss int) {
+	r.mss = mss
+	r.cwnd = initialWindow(mss)
+	// 最初は損失が起きるまでスロースタートを続ける
+	r.ssthresh = 1<<31 - 1
+}
+
+func (r *Reno) OnAck(acked int, srtt time.Duration) {
+	if r.cwnd < r.ssthresh {
+		// スロースタート: ACKごとに最大1MSS増やす(RFC 3465)
+		if acked > r.mss {
+			acked = r.mss
+		}
+		r.cwnd += acked
+		return
+	}
+	// 輻輳回避: 1RTTでおよそ1MSS増やす
+	inc := r.mss * r.mss / r.cwnd
+	if inc < 1 {
+		inc = 1
+	}
+	r.cwnd += inc
+}
+
+func (r *Reno) OnLoss(inFlight int) {
+	r.ssthresh = r.halve(inFlight)
+	// 重複ACKを返した3つのセグメントは相手に届いているので，その分だけ膨らませる
+	r.cwnd = r.ssthresh + 3*r.mss
+}
+
+func (r *Reno) OnDupAck() {
+	r.cwnd += r.mss
+}
+
+func (r *Reno) OnPartialAck(acked int) bool {
+	return false
+}
+
+func (r *Reno) OnRecoveryExit() {
+	r.cwnd = r.ssthresh
+}
+
+func (r *Reno) OnRTO(inFlight int) {
+	r.ssthresh = r.halve(inFlight)
+	r.cwnd = r.mss
+}
+
+func (r *Reno) CongestionWindow() int { return r.cwnd }
+
+func (r *Reno) SlowStartThreshold() int { return r.ssthresh }
+
+// 送信中のデータの半分(最低2MSS)
+func (r *Reno) halve(inFlight int) int {
+	if half := inFlight / 2; half > 2*r.mss {
+		return half
+	}
+	return 2 * r.mss
+}
+
+// 部分的なACKで次の穴を再送し，損失を検出した時点のデータがすべて確認応答されるまで高速回復を続けるNewReno(RFC 6582)
+// 1つのウィンドウで複数のセグメントが失われても，再送タイムアウトを待たずに回復できる
+type NewReno struct {
+	Reno
+}
+
+func (r *NewReno) Name() string { return "newreno" }
+
+func (r *NewReno) OnPartialAck(acked int) bool {
+	// 確認応答された分だけウィンドウを縮め，再送する1セグメント分を足す
+	r.cwnd -= acked
+	if acked >= r.mss {
+		r.cwnd += r.mss
+	}
+	if r.cwnd < r.mss {
+		r.cwnd = r.mss
+	}
+	return true
+}
+
+// 接続が使う輻輳制御アルゴリズムを変更する
+func (t *TCPConnection) SetCongestionControl(cc CongestionControl) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stack.useClock(cc)
+	cc.Init(t.mss)
+	t.cc = cc
+}
+
+// 経過時間を使う輻輳制御(CUBIC)にスタックの時計を渡す
+func (s *Stack) useClock(cc CongestionControl) {
+	if c, ok := cc.(interface{ setClock(Clock) }); ok {
+		c.setClock(s.clock)
+	}
+}
+
+// MSSを決め，輻輳ウィンドウを初期化する
+func (t *TCPConnection) setMSSLocked(mss int) {
+	t.mss = mss
+	t.cc.Init(mss)
+}
+
+// 送ったが確認応答されていないデータの量
+func (t *TCPConnection) inFlightLocked() int {
+	return int(t.sndNxt - t.sndUna)
+}
+
+// 重複ACKか(RFC 5681 Section 2)
+// 未確認のデータがあり，データもSYN/FINもなく，確認応答番号とウィンドウが変わっていない
+func (t *TCPConnection) isDupAckLocked(ack uint32, window uint32, segLen int, syn, fin bool) bool {
+	return ack == t.sndUna && t.sndNxt != t.sndUna && segLen == 0 && !syn && !fin && window == t.sndWnd
+}
+
+// 重複ACKを数え，3つ目で高速再送して高速回復に入る
+func (t *TCPConnection) onDupAckLocked() {
+	t.dupAcks++
+	if t.inRecovery {
+		t.cc.OnDupAck()
+		// SACKで次の穴がわかれば，送っている量が輻輳ウィンドウに収まる範囲で再送する
+		if t.sackOK && t.pipeLocked() < t.cc.CongestionWindow() {
+			if seg := t.nextHoleLocked(); seg != nil {
+				t.retransmitLocked(seg)
+			}
+		}
+		return
+	}
+	// 再送タイムアウトの後，そのときに送っていたデータの重複ACKでは高速再送しない(RFC 6582 Section 3.2)
+	if t.dupAcks != 3 || !seqGT(t.sndUna, t.recover) || len(t.rtxQueue) == 0 {
+		return
+	}
+
+	t.inRecovery = true
+	t.recover = t.sndNxt
+	t.cc.OnLoss(t.inFlightLocked())
+	t.stats.FastRetransmits++
+	fmt.Printf("TCP高速再送[%v:%d]: Seq=%d\n", t.dstIP, t.dstPort, t.rtxQueue[0].seq)
+	t.retransmitLocked(t.rtxQueue[0])
+	t.armRetransmitTimerLocked()
+}
+
+// 新しいデータがackedバイト確認応答されたときの輻輳ウィンドウの更新
+func (t *TCPConnection) onNewAckLocked(acked int) {
+	t.dupAcks = 0
+
+	switch {
+	case t.inRecovery && seqGEQ(t.sndUna, t.recover):
+		// 損失を検出した時点のデータがすべて届いた
+		t.inRecovery = false
+		t.cc.OnRecoveryExit()
+	case t.inRecovery:
+		if t.cc.OnPartialAck(acked) && len(t.rtxQueue) > 0 {
+			// 次の穴を再送する
+			seg := t.nextHoleLocked()
+			if seg == nil && !t.rtxQueue[0].sacked {
+				seg = t.rtxQueue[0]
+			}
+			if seg != nil {
+				t.retransmitLocked(seg)
+			}
+		} else {
+			t.inRecovery = false
+			t.cc.OnRecoveryExit()
+		}
+	default:
+		t.cc.OnAck(acked, t.srtt)
+		if t.rtoRecovery {
+			t.goBackNLocked()
+		}
+	}
+}
+
+// 送ったが相手に届いたとわかっていないデータの量(SACKで受け取ったと通知された分を除く)
+func (t *TCPConnection) pipeLocked() int {
+	pipe := 0
+	for _, seg := range t.rtxQueue {
+		if !seg.sacked {
+			pipe += len(seg.data)
+		}
+	}
+	return pipe
+}
+
+// 再送タイムアウトの後，スロースタートしながら未確認のセグメントを順に再送する
+// (タイムアウトで再送したのは先頭のセグメントだけなので，続くセグメントも失われていると考える)
+func (t *TCPConnection) goBackNLocked() {
+	if seqGEQ(t.sndUna, t.recover) {
+		t.rtoRecovery = false
+		return
+	}
+	inFlight := 0
+	for _, seg := range t.rtxQueue {
+		if !seqLT(seg.seq, t.recover) {
+			break
+		}
+		if seg.sacked {
+			continue
+		}
+		if !seg.retransmitted {
+			if inFlight+len(seg.data) > t.cc.CongestionWindow() {
+				break
+			}
+			t.retransmitLocked(seg)
+		}
+		inFlight += len(seg.data)
+	}
+}
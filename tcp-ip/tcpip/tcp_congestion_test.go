@@ -0,0 +1,273 @@
+package tcpip
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"testing"
+	"time"
+)
+
+const ccMSS = 1000
+
+// 名前から作った輻輳制御アルゴリズムをMSS=1000で初期化する
+func newCC(t *testing.T, name string) CongestionControl {
+	t.Helper()
+	cc, err := NewCongestionControl(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Init(ccMSS)
+	return cc
+}
+
+func checkWindow(t *testing.T, what string, cc CongestionControl, cwnd, ssthresh int) {
+	t.Helper()
+	if got := cc.CongestionWindow(); got != cwnd {
+		t.Errorf("%s %s: cwnd=%d, 期待: %d", cc.Name(), what, got, cwnd)
+	}
+	if got := cc.SlowStartThreshold(); got != ssthresh {
+		t.Errorf("%s %s: ssthresh=%d, 期待: %d", cc.Name(), what, got, ssthresh)
+	}
+}
+
+func TestNewCongestionControl(t *testing.T) {
+	for _, name := range []string{"reno", "newreno", "cubic"} {
+		if cc := newCC(t, name); cc.Name() != name {
+			t.Errorf("%s: %s", name, cc.Name())
+		}
+	}
+	if _, err := NewCongestionControl("bbr"); err == nil {
+		t.Error("未対応のアルゴリズムを作れました")
+	}
+	s := NewStack()
+	defer s.Close()
+	if err := s.SetTCPConfig(TCPConfig{CongestionControl: "bbr"}); err == nil {
+		t.Error("未対応のアルゴリズムを設定できました")
+	}
+}
+
+// 初期ウィンドウから，ACKごとに最大1MSSずつ増やす(RFC 5681，RFC 3465)
+func TestCongestionControlSlowStart(t *testing.T) {
+	for _, name := range []string{"reno", "newreno", "cubic"} {
+		cc := newCC(t, name)
+		checkWindow(t, "初期", cc, 4*ccMSS, 1<<31-1)
+		cc.OnAck(ccMSS, 0)
+		checkWindow(t, "1MSSのACK", cc, 5*ccMSS, 1<<31-1)
+		cc.OnAck(3*ccMSS, 0)
+		checkWindow(t, "3MSSのACK", cc, 6*ccMSS, 1<<31-1)
+	}
+	for _, tc := range []struct{ mss, iw int }{{536, 4 * 536}, {1460, 3 * 1460}, {4000, 2 * 4000}} {
+		if got := initialWindow(tc.mss); got != tc.iw {
+			t.Errorf("MSS=%dの初期ウィンドウ: %d, 期待: %d", tc.mss, got, tc.iw)
+		}
+	}
+}
+
+// ssthresh以上では1RTT(cwndバイトの確認応答)でおよそ1MSS増やす
+func TestRenoCongestionAvoidance(t *testing.T) {
+	for _, name := range []string{"reno", "newreno"} {
+		cc := newCC(t, name)
+		cc.OnLoss(20 * ccMSS)
+		cc.OnRecoveryExit()
+		checkWindow(t, "高速回復の後", cc, 10*ccMSS, 10*ccMSS)
+		cc.OnAck(ccMSS, 0)
+		checkWindow(t, "1MSSのACK", cc, 10*ccMSS+100, 10*ccMSS)
+		for i := 1; i < 10; i++ {
+			cc.OnAck(ccMSS, 0)
+		}
+		if got := cc.CongestionWindow(); got <= 10*ccMSS+ccMSS*9/10 || got > 11*ccMSS {
+			t.Errorf("%s 1RTT後: cwnd=%d", name, got)
+		}
+	}
+}
+
+// 3つ目の重複ACKで閾値を下げ，重複ACKごとに膨らませ，回復が終わったら閾値に戻す
+func TestCongestionControlFastRecovery(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// 損失を検出した後のssthreshとcwnd
+		ssthresh, cwnd int
+	}{
+		// 送っていたデータ(20MSS)の半分
+		{"reno", 10 * ccMSS, 13 * ccMSS},
+		{"newreno", 10 * ccMSS, 13 * ccMSS},
+		// 損失したときのcwnd(20MSS)のβ(0.7)倍
+		{"cubic", 14 * ccMSS, 17 * ccMSS},
+	} {
+		cc := newCC(t, tc.name)
+		for cc.CongestionWindow() < 20*ccMSS {
+			cc.OnAck(ccMSS, 0)
+		}
+		cc.OnLoss(20 * ccMSS)
+		checkWindow(t, "損失", cc, tc.cwnd, tc.ssthresh)
+		cc.OnDupAck()
+		cc.OnDupAck()
+		checkWindow(t, "重複ACK", cc, tc.cwnd+2*ccMSS, tc.ssthresh)
+		cc.OnRecoveryExit()
+		checkWindow(t, "回復", cc, tc.ssthresh, tc.ssthresh)
+	}
+
+	// 閾値は2MSSより小さくしない
+	cc := newCC(t, "reno")
+	cc.OnLoss(ccMSS)
+	checkWindow(t, "小さいウィンドウでの損失", cc, 5*ccMSS, 2*ccMSS)
+}
+
+// NewRenoは部分的なACKで回復を続け，確認応答された分だけウィンドウを縮める(RFC 6582 Section 3.2)
+func TestNewRenoPartialAck(t *testing.T) {
+	reno := newCC(t, "reno")
+	reno.OnLoss(20 * ccMSS)
+	if reno.OnPartialAck(2 * ccMSS) {
+		t.Error("Renoが部分的なACKで高速回復を続けました")
+	}
+
+	cc := newCC(t, "newreno")
+	cc.OnLoss(20 * ccMSS)
+	checkWindow(t, "損失", cc, 13*ccMSS, 10*ccMSS)
+	for _, tc := range []struct {
+		acked, cwnd int
+	}{
+		// 確認応答された3MSSを引き，再送する1MSSを足す
+		{3 * ccMSS, 11 * ccMSS},
+		// 1MSS未満なら足さない
+		{500, 10*ccMSS + 500},
+		// 1MSSより小さくしない
+		{20 * ccMSS, ccMSS},
+	} {
+		if !cc.OnPartialAck(tc.acked) {
+			t.Fatalf("%dバイトの部分的なACKで高速回復を終えました", tc.acked)
+		}
+		checkWindow(t, "部分的なACK", cc, tc.cwnd, 10*ccMSS)
+	}
+	cc.OnRecoveryExit()
+	checkWindow(t, "回復", cc, 10*ccMSS, 10*ccMSS)
+}
+
+// 再送タイムアウトでは閾値を下げ，1MSSからスロースタートし直す
+func TestCongestionControlRTO(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		inFlight int
+		ssthresh int
+	}{
+		{"reno", 16 * ccMSS, 8 * ccMSS},
+		{"newreno", 16 * ccMSS, 8 * ccMSS},
+		// 閾値は2MSSより小さくしない
+		{"reno", 3 * ccMSS, 2 * ccMSS},
+		// CUBICは送っていた量ではなくcwndから求める
+		{"cubic", 16 * ccMSS, 14 * ccMSS},
+	} {
+		cc := newCC(t, tc.name)
+		for cc.CongestionWindow() < 20*ccMSS {
+			cc.OnAck(ccMSS, 0)
+		}
+		cc.OnRTO(tc.inFlight)
+		checkWindow(t, "RTO", cc, ccMSS, tc.ssthresh)
+		cc.OnAck(ccMSS, 0)
+		checkWindow(t, "RTO後のACK", cc, 2*ccMSS, tc.ssthresh)
+	}
+}
+
+// 損失の後，経過時間の3次関数でW_maxへ戻り，その近くではゆっくり増える(RFC 8312 Section 4.1)
+func TestCubicWindowGrowth(t *testing.T) {
+	const rtt = 100 * time.Millisecond
+	clock := NewVirtualClock(time.Unix(1000, 0))
+	c := &Cubic{}
+	c.setClock(clock)
+	c.Init(ccMSS)
+	for c.cwnd < 100*ccMSS {
+		c.OnAck(ccMSS, rtt)
+	}
+	c.OnLoss(c.cwnd)
+	c.OnRecoveryExit()
+	checkWindow(t, "損失", c, 70*ccMSS, 70*ccMSS)
+	if c.wMax != 100 {
+		t.Fatalf("W_max: %v", c.wMax)
+	}
+
+	// K = cbrt(W_max(1-β)/C) ≒ 4.2秒でW_maxに戻る
+	k := time.Duration(math.Cbrt(100*(1-cubicBeta)/cubicC) * float64(time.Second))
+	// 1RTTごとに，cwnd分のACKを受け取る
+	grow := func(d time.Duration) int {
+		before := c.cwnd
+		for end := clock.Now().Add(d); clock.Now().Before(end); clock.Advance(rtt) {
+			for acked := 0; acked < c.cwnd; acked += ccMSS {
+				c.OnAck(ccMSS, rtt)
+			}
+		}
+		return c.cwnd - before
+	}
+	first := grow(time.Second)
+	grow(k - 2*time.Second)
+	last := grow(time.Second)
+	if got := c.cwnd / ccMSS; got < 97 || got > 101 {
+		t.Fatalf("K秒後のcwnd: %dMSS", got)
+	}
+	if last >= first {
+		t.Errorf("W_maxの近くで増え方が遅くなりません: 最初の1秒で%d，最後の1秒で%d", first, last)
+	}
+	// W_maxを超えると，また速く増える
+	grow(2 * time.Second)
+	if after := grow(time.Second); after <= last {
+		t.Errorf("W_maxを超えても増え方が速くなりません: %d", after)
+	}
+
+	// 前回より小さいウィンドウで損失したら，W_maxをさらに下げる(高速収束)
+	c.cwnd = 80 * ccMSS
+	c.wMax = 100
+	c.OnLoss(c.cwnd)
+	if want := 80 * (1 + cubicBeta) / 2; math.Abs(c.wMax-want) > 1e-9 {
+		t.Errorf("高速収束のW_max: %v, 期待: %v", c.wMax, want)
+	}
+}
+
+// 損失のあるスイッチ越しに，アルゴリズムごとにデータを送る
+func TestCongestionControlTransfer(t *testing.T) {
+	msg := bytes.Repeat([]byte("0123456789abcdef"), 16*1024)
+	for _, name := range []string{"reno", "newreno", "cubic"} {
+		t.Run(name, func(t *testing.T) {
+			p := newTCPPair(t)
+			config := DefaultTCPConfig
+			config.CongestionControl = name
+			config.MaxRetries = 30
+			p.sa.SetTCPConfig(config)
+			p.dial(t)
+			if got := p.a.cc.Name(); got != name {
+				t.Fatalf("輻輳制御アルゴリズム: %s", got)
+			}
+			p.ports[0].SetImpairment(Impairment{Delay: 5 * time.Millisecond, Loss: 0.02})
+			p.ports[1].SetImpairment(Impairment{Delay: 5 * time.Millisecond})
+
+			done := make(chan []byte, 1)
+			go func() {
+				got, _ := io.ReadAll(p.b)
+				done <- got
+			}()
+			go func() {
+				p.a.Write(msg)
+				p.a.Close()
+			}()
+			var got []byte
+			for i := 0; got == nil && i < 100000; i++ {
+				select {
+				case got = <-done:
+				default:
+					if !p.clock.AdvanceToNext() {
+						time.Sleep(time.Millisecond)
+					}
+				}
+			}
+			if !bytes.Equal(got, msg) {
+				t.Fatalf("受信: %dバイト", len(got))
+			}
+			st := p.a.Stats()
+			if st.FastRetransmits == 0 {
+				t.Errorf("高速再送していません: %+v", st)
+			}
+			if st.SlowStartThreshold >= 1<<31-1 || st.CongestionWindow < ccMSS {
+				t.Errorf("輻輳ウィンドウ: %+v", st)
+			}
+		})
+	}
+}
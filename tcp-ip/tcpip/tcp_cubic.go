@@ -0,0 +1,120 @@
+package tcpip
+
+import (
+	"math"
+	"time"
+)
+
+// CUBICの定数(RFC 8312 Section 5)
+const (
+	cubicC    = 0.4
+	cubicBeta = 0.7
+)
+
+// 最後に損失が起きてからの経過時間の3次関数で輻輳ウィンドウを増やすCUBIC(RFC 8312)
+// 損失が起きたときのウィンドウ(W_max)の近くではゆっくり，離れると速く増やす．
+// スロースタートと高速回復はNewRenoと同じ
+type Cubic struct {
+	NewReno
+	// 直前に損失が起きたときのウィンドウ(セグメント数)
+	wMax float64
+	// ウィンドウがW_maxに戻るまでの時間(秒)
+	k float64
+	// 輻輳回避を始めた時刻
+	epochStart time.Time
+	// Renoと同じ増え方をしたときのウィンドウ(セグメント数)
+	wEst float64
+	// 1セグメント未満の増加分を貯めておく
+	cwndFrac float64
+	// 経過時間を測る時計(nilならSystemClock)
+	clock Clock
+}
+
+func (c *Cubic) Name() string { return "cubic" }
+
+func (c *Cubic) setClock(clock Clock) { c.clock = clock }
+
+func (c *Cubic) Init(mss int) {
+	c.NewReno.Init(mss)
+	c.wMax = 0
+	c.epochStart = time.Time{}
+	c.cwndFrac = 0
+}
+
+func (c *Cubic) OnAck(acked int, srtt time.Duration) {
+	if c.cwnd < c.ssthresh {
+		c.NewReno.OnAck(acked, srtt)
+		return
+	}
+
+	mss := float64(c.mss)
+	cwnd := float64(c.cwnd) / mss
+	clock := c.clock
+	if clock == nil {
+		clock = SystemClock
+	}
+	now := clock.Now()
+	if c.epochStart.IsZero() {
+		c.epochStart = now
+		c.wEst = cwnd
+		if c.wMax > cwnd {
+			c.k = math.Cbrt((c.wMax - cwnd) / cubicC)
+		} else {
+			// 損失が起きる前から輻輳回避に入ったときは，今のウィンドウを起点にする
+			c.k = 0
+			c.wMax = cwnd
+		}
+	}
+
+	// W_cubic(t+RTT): 1RTT後に目指すウィンドウ
+	t := now.Sub(c.epochStart).Seconds() + srtt.Seconds()
+	target := cubicC*math.Pow(t-c.k, 3) + c.wMax
+
+	// TCPフレンドリ領域: Renoより遅くならないようにする(RFC 8312 Section 4.2)
+	c.wEst += 3 * (1 - cubicBeta) / (1 + cubicBeta) * float64(acked) / mss / cwnd
+	if c.wEst > target {
+		target = c.wEst
+	}
+
+	// 1RTTかけてtargetに近づくよう，ACKごとに(target - cwnd) / cwndだけ増やす(RFC 8312 Section 4.3)
+	if target > cwnd {
+		c.cwndFrac += (target - cwnd) / cwnd * float64(acked) / mss
+	} else {
+		// targetを超えていても，ごくゆっくりは増やす
+		c.cwndFrac += 0.01 * float64(acked) / mss / cwnd
+	}
+	if c.cwndFrac >= 1 {
+		inc := math.Floor(c.cwndFrac)
+		c.cwnd += int(inc) * c.mss
+		c.cwndFrac -= inc
+	}
+}
+
+func (c *Cubic) OnLoss(inFlight int) {
+	c.reduce()
+	c.cwnd = c.ssthresh + 3*c.mss
+}
+
+func (c *Cubic) OnRTO(inFlight int) {
+	c.reduce()
+	c.cwnd = c.mss
+}
+
+// 損失が起きたのでW_maxを覚えてウィンドウをβ倍にする
+func (c *Cubic) reduce() {
+	cwnd := float64(c.cwnd) / float64(c.mss)
+	if cwnd < c.wMax {
+		// 高速収束: 前回より小さいウィンドウで損失したら，帯域を他の接続に譲る(RFC 8312 Section 4.6)
+		c.wMax = cwnd * (1 + cubicBeta) / 2
+	} else {
+		c.wMax = cwnd
+	}
+	c.epochStart = time.Time{}
+	c.cwndFrac = 0
+
+	ssthresh := int(float64(c.cwnd) * cubicBeta)
+	if ssthresh < 2*c.mss {
+		ssthresh = 2 * c.mss
+	}
+	c.ssthresh = ssthresh
+}
@@ -0,0 +1,41 @@
+package tcpip
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+)
+
+// 初期シーケンス番号の時計が1進む間隔(RFC 6528 Section 3)
+const isnTick = 4 * time.Microsecond
+
+// ISNのハッシュに使う秘密鍵を作る
+func newISNSecret() [16]byte {
+	var secret [16]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		// 乱数が得られなくても時計の分だけISNは変わる
+		binary.BigEndian.PutUint64(secret[:], uint64(time.Now().UnixNano()))
+	}
+	return secret
+}
+
+// 接続の4つ組から初期シーケンス番号を選ぶ(RFC 6528)
+// ISN = M + F(localip, localport, remoteip, remoteport, secretkey)
+// Mは4マイクロ秒ごとに進む時計，Fは秘密鍵付きのハッシュ．
+// 同じ4つ組では古い接続のセグメントと重ならないよう時間とともに増え，他の4つ組のISNからは予測できない
+func (s *Stack) generateISN(key tcpKey) uint32 {
+	h := sha256.New()
+	h.Write(s.isnSecret[:])
+	local, remote := key.localAddr.As16(), key.remoteAddr.As16()
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[:], key.localPort)
+	binary.BigEndian.PutUint16(ports[2:], key.remotePort)
+	h.Write(local[:])
+	h.Write(remote[:])
+	h.Write(ports[:])
+	f := binary.BigEndian.Uint32(h.Sum(nil))
+
+	m := uint32(s.clock.Now().UnixNano() / int64(isnTick))
+	return m + f
+}
@@ -0,0 +1,201 @@
+package tcpip
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// ISNは4つ組ごとに異なり，同じ4つ組なら4マイクロ秒ごとに1ずつ進む
+func TestGenerateISN(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(1000, 0))
+	s := NewStackWithClock(clock)
+	defer s.Close()
+	key := tcpKey{
+		localAddr:  netip.MustParseAddr("10.0.0.1"),
+		localPort:  49152,
+		remoteAddr: netip.MustParseAddr("10.0.0.2"),
+		remotePort: 80,
+	}
+
+	isn := s.generateISN(key)
+	if got := s.generateISN(key); got != isn {
+		t.Fatalf("同じ時刻の同じ4つ組でISNが変わりました: %d, %d", isn, got)
+	}
+	clock.Advance(1000 * isnTick)
+	if got := s.generateISN(key); got-isn != 1000 {
+		t.Fatalf("4ミリ秒でISNが%d進みました", got-isn)
+	}
+	// 32ビットを一周しても同じ規則で進む
+	clock.Advance(1 << 32 * isnTick)
+	if got := s.generateISN(key); got-isn != 1000 {
+		t.Fatalf("一周した後のISN: %d進みました", got-isn)
+	}
+
+	seen := map[uint32]tcpKey{s.generateISN(key): key}
+	for _, other := range []tcpKey{
+		{key.localAddr, 49153, key.remoteAddr, 80},
+		{key.localAddr, 49152, key.remoteAddr, 81},
+		{key.localAddr, 49152, netip.MustParseAddr("10.0.0.3"), 80},
+		{netip.MustParseAddr("10.0.0.4"), 49152, key.remoteAddr, 80},
+		// アドレスとポートを入れ替えても別の4つ組
+		{key.remoteAddr, 80, key.localAddr, 49152},
+	} {
+		isn := s.generateISN(other)
+		if prev, ok := seen[isn]; ok {
+			t.Fatalf("%vと%vのISNが同じです: %d", prev, other, isn)
+		}
+		seen[isn] = other
+	}
+
+	// 秘密鍵が違えば，同じ時刻の同じ4つ組でもISNは予測できない
+	s2 := NewStackWithClock(clock)
+	defer s2.Close()
+	if s2.generateISN(key) == s.generateISN(key) {
+		t.Fatal("別のスタックでISNが同じです")
+	}
+}
+
+// 接続ごとのISNはgenerateISNで選ばれ，同じ相手への接続でも送信元ポートが違えば異なる
+func TestTCPConnectionISN(t *testing.T) {
+	p := newTCPPair(t)
+	l, err := p.sb.Listen(nil, 80, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	isns := map[uint32]bool{}
+	for i := 0; i < 3; i++ {
+		c, err := p.sa.DialContext(context.Background(), "tcp", "10.1.0.2:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		a := c.(*TCPConnection)
+		if want := p.sa.generateISN(a.key); a.iss != want {
+			t.Fatalf("ISN: %d, 期待: %d", a.iss, want)
+		}
+		isns[a.iss] = true
+		p.clock.Advance(0)
+		b, err := l.AcceptTCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		if want := p.sb.generateISN(b.key); b.iss != want {
+			t.Fatalf("受動オープンのISN: %d, 期待: %d", b.iss, want)
+		}
+	}
+	if len(isns) != 3 {
+		t.Fatalf("接続のISNが重なりました: %v", isns)
+	}
+}
+
+// 生のパイプから10.0.0.9:80のTCPセグメントを送る
+func sendRawTCP(t *testing.T, raw *PipeDevice, dstPort uint16, seq, ack uint32, flags tcpFlags) {
+	t.Helper()
+	ip := NewIPHeader(fragSrcIP, net.IPv4(10, 0, 0, 2).To4())
+	ip.Protocol = layers.IPProtocolTCP
+	tcp := newTCPHeader(80, dstPort, seq, ack, flags, 65535)
+	tcp.SetNetworkLayerForChecksum(ip)
+	eth := NewEthernet(raw.HardwareAddr(), net.HardwareAddr{2, 0, 0, 0, 0, 2}, "IPv4")
+	frame, err := serializeFrame(&eth, ip, tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := raw.WriteFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 生のパイプに届いたTCPセグメント
+func readRawTCP(t *testing.T, raw *PipeDevice) *layers.TCP {
+	t.Helper()
+	for {
+		if tcp, ok := readFrame(t, raw).Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+			return tcp
+		}
+	}
+}
+
+// SYN_SENTで自分のSYNを確認応答していないSYN+ACKを受けたら，そのACKの位置からRSTを返して接続は待ち続ける
+// ACKが違うRSTは無視し，正しいSYN+ACKが届いたら接続を確立する
+func TestTCPSynSentRejectsWrongAck(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(1000, 0))
+	s, raw := rawPeer(t, clock)
+	tr := NewTCPTrace()
+	s.SetTCPTracer(tr)
+
+	type dialResult struct {
+		c   *TCPConnection
+		err error
+	}
+	done := make(chan dialResult, 1)
+	go func() {
+		c, err := s.DialContext(context.Background(), "tcp", "10.0.0.9:80")
+		if err != nil {
+			done <- dialResult{err: err}
+			return
+		}
+		done <- dialResult{c: c.(*TCPConnection)}
+	}()
+
+	syn := readRawTCP(t, raw)
+	if !syn.SYN || syn.ACK {
+		t.Fatalf("最初のセグメント: %+v", syn)
+	}
+	port, iss := uint16(syn.SrcPort), syn.Seq
+	const irs = 5000
+
+	for _, bad := range []uint32{iss, iss + 2, iss - 1000} {
+		sendRawTCP(t, raw, port, irs, bad, flagSYN|flagACK)
+		rst := readRawTCP(t, raw)
+		if !rst.RST || rst.ACK || rst.SYN || rst.Seq != bad {
+			t.Fatalf("Ack=%dのSYN+ACKへの応答: RST=%v ACK=%v SYN=%v Seq=%d", bad, rst.RST, rst.ACK, rst.SYN, rst.Seq)
+		}
+	}
+	sendRawTCP(t, raw, port, irs, iss+7, flagRST|flagACK)
+
+	sendRawTCP(t, raw, port, irs, iss+1, flagSYN|flagACK)
+	ack := readRawTCP(t, raw)
+	if !ack.ACK || ack.SYN || ack.RST || ack.Seq != iss+1 || ack.Ack != irs+1 {
+		t.Fatalf("SYN+ACKへの応答: %+v", ack)
+	}
+	var r dialResult
+	select {
+	case r = <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("接続が確立しません")
+	}
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	defer r.c.Close()
+	if st := r.c.State(); st != StateEstablished {
+		t.Fatalf("状態: %v", st)
+	}
+
+	// 確立するまでSYN_SENTのままで，RSTへのRSTは送っていない
+	var got []string
+	for _, ev := range tr.Events() {
+		switch ev.Kind {
+		case TCPTraceState:
+			got = append(got, ev.To.String())
+		case TCPTraceSend:
+			got = append(got, "送信 "+ev.Flags)
+		}
+	}
+	want := []string{"SYN_SENT", "送信 SYN", "送信 RST", "送信 RST", "送信 RST", "送信 ACK", "ESTABLISHED"}
+	if len(got) != len(want) {
+		t.Fatalf("イベント: %v, 期待: %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("イベント: %v, 期待: %v", got, want)
+		}
+	}
+}
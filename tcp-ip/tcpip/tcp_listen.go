@@ -0,0 +1,285 @@
+package tcpip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/google/gopacket/layers"
+)
+
+// 閉じたリスナでAcceptしようとした
+var ErrListenerClosed = errors.New("リスナは閉じられています")
+
+// backlogを指定しなかったときのキューの長さ
+const defaultBacklog = 128
+
+// ポートで接続を待ち受けるTCPリスナ
+// 受け取ったSYNにSYN+ACKを返し，3Way Handshakeが終わった接続をAcceptTCPで渡す
+type TCPListener struct {
+	stack   *Stack
+	key     tcpKey
+	rx      <-chan *tcpSegment
+	backlog int
+
+	mu sync.Mutex
+	// SYNキュー: SYN+ACKを返して相手のACKを待っている接続
+	pending map[tcpKey]*TCPConnection
+	// acceptキュー: 接続が確立してAcceptTCPを待っている接続
+	accept chan *TCPConnection
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// ipとportで接続の待ち受けを始める
+// ipがnilならすべてのアドレスで待ち受ける．backlogはSYNキューとacceptキューの長さ(0以下なら128)
+func (s *Stack) Listen(ip net.IP, port uint16, backlog int) (*TCPListener, error) {
+	var addr netip.Addr
+	if ip != nil {
+		if ip.To16() == nil {
+			return nil, fmt.Errorf("無効なIPアドレス: %v", ip)
+		}
+		if !s.hasLocalAddress(ip) {
+			return nil, fmt.Errorf("%v はこのスタックのアドレスではありません", ip)
+		}
+		addr = ipAddr(ip)
+	}
+	if backlog <= 0 {
+		backlog = defaultBacklog
+	}
+
+	key := tcpKey{localAddr: addr, localPort: port}
+	rx, err := s.registerTCP(key)
+	if err != nil {
+		return nil, fmt.Errorf("ポート%dはすでに待ち受け中です", port)
+	}
+
+	l := &TCPListener{
+		stack:   s,
+		key:     key,
+		rx:      rx,
+		backlog: backlog,
+		pending: make(map[tcpKey]*TCPConnection),
+		accept:  make(chan *TCPConnection, backlog),
+		done:    make(chan struct{}),
+	}
+	go l.loop()
+	return l, nil
+}
+
+// いずれかのインタフェースがそのアドレスを持っているか
+func (s *Stack) hasLocalAddress(ip net.IP) bool {
+	s.mu.RLock()
+	nics := append([]*NIC(nil), s.nics...)
+	s.mu.RUnlock()
+	for _, nic := range nics {
+		if nic.hasAddress(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 待ち受けているポート番号
+func (l *TCPListener) Port() uint16 {
+	return l.key.localPort
+}
+
+// 接続が確立するまで待ち，その接続を返す
+func (l *TCPListener) AcceptTCP() (*TCPConnection, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+// 待ち受けをやめる．SYNキューとacceptキューに残っている接続はRSTで破棄する
+func (l *TCPListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.stack.unregisterTCP(l.key)
+
+		l.mu.Lock()
+		close(l.done)
+		var conns []*TCPConnection
+		for _, c := range l.pending {
+			conns = append(conns, c)
+		}
+		l.pending = make(map[tcpKey]*TCPConnection)
+	drain:
+		for {
+			select {
+			case c := <-l.accept:
+				conns = append(conns, c)
+			default:
+				break drain
+			}
+		}
+		l.mu.Unlock()
+
+		for _, c := range conns {
+			c.Abort()
+		}
+	})
+	return nil
+}
+
+// リスナ宛てのセグメントを処理する
+func (l *TCPListener) loop() {
+	for {
+		select {
+		case seg := <-l.rx:
+			l.handleSegment(seg)
+			addWork(l.stack.clock, -1)
+		case <-l.done:
+			l.stack.drainTCP(l.rx)
+			return
+		}
+	}
+}
+
+// LISTEN状態でのセグメント処理(RFC 793 Section 3.9)
+func (l *TCPListener) handleSegment(seg *tcpSegment) {
+	tcp := seg.tcp
+	switch {
+	case tcp.RST:
+		return
+	case tcp.ACK:
+		// 存在しない接続へのACK
+		l.stack.sendReply(seg.src, func() { l.stack.sendTCPReset(seg) })
+		return
+	case !tcp.SYN:
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// キューがいっぱいならSYNを捨てる(相手が再送してくる)
+	if len(l.pending) >= l.backlog || len(l.accept) >= cap(l.accept) {
+		fmt.Printf("TCPリスナ[%d]のキューがいっぱいのためSYNを破棄\n", l.key.localPort)
+		return
+	}
+
+	c, err := l.newConnection(seg)
+	if err != nil {
+		fmt.Printf("TCP接続の作成に失敗: %v\n", err)
+		return
+	}
+	l.pending[c.key] = c
+	// 相手のMACアドレスが分かっていれば，その場でSYN+ACKを送る
+	if l.stack.neighborKnown(c.dstIP) {
+		c.mu.Lock()
+		l.sendSynAckLocked(c)
+		c.mu.Unlock()
+	}
+	go l.handshake(c)
+}
+
+// SYNを受け取った接続を作り，SYN_RECEIVEDにする
+func (l *TCPListener) newConnection(seg *tcpSegment) (*TCPConnection, error) {
+	c := NewTCP(l.stack, uint16(seg.tcp.DstPort))
+	c.nic = seg.nic
+	// 受信したパケットのバッファを参照しないようにコピーする
+	c.srcIP = cloneIP(seg.dst)
+	c.dstIP = cloneIP(seg.src)
+	c.dstPort = uint16(seg.tcp.SrcPort)
+	c.srcMAC = seg.nic.HardwareAddr()
+	c.key = tcpKey{
+		localAddr:  ipAddr(c.srcIP),
+		localPort:  c.srcPort,
+		remoteAddr: ipAddr(c.dstIP),
+		remotePort: c.dstPort,
+	}
+
+	rx, err := l.stack.registerTCP(c.key)
+	if err != nil {
+		return nil, err
+	}
+	c.rx = rx
+
+	c.mu.Lock()
+	c.irs = seg.tcp.Seq
+	c.rcvNxt = seg.tcp.Seq + 1
+	c.negotiateOptionsLocked(parseTCPOptions(seg.tcp.Options))
+	// SYNのウィンドウはスケールしない
+	c.sndWnd = uint32(seg.tcp.Window)
+	c.sndWl1 = seg.tcp.Seq
+	c.iss = l.stack.generateISN(c.key)
+	c.sndUna = c.iss
+	c.sndNxt = c.iss + 1
+	c.recover = c.iss
+	c.setStateLocked(StateSynReceived)
+	c.mu.Unlock()
+
+	go c.loop()
+	return c, nil
+}
+
+// 相手のMACアドレスを解決し，SYN+ACKを送る
+func (l *TCPListener) sendSynAckLocked(c *TCPConnection) error {
+	_, _, nextHop, err := l.stack.route(c.dstIP)
+	if err != nil {
+		return err
+	}
+	mac, err := l.stack.neighbors.resolve(c.nic, c.srcIP, nextHop)
+	if err != nil {
+		return err
+	}
+	c.dstMAC = mac
+	c.sendReliableLocked(flagSYN|flagACK, c.iss, nil)
+	fmt.Printf("TCP SYN+ACKパケットを[%v:%d]へ送信\n", c.dstIP, c.dstPort)
+	return nil
+}
+
+// SYN+ACKを送って相手のACKを待ち，確立した接続をacceptキューへ入れる
+func (l *TCPListener) handshake(c *TCPConnection) {
+	defer func() {
+		l.mu.Lock()
+		delete(l.pending, c.key)
+		l.mu.Unlock()
+	}()
+
+	// まだならMACアドレスを解決してからSYN+ACKを送る．その間に届いたセグメントは待たせる
+	c.mu.Lock()
+	if c.dstMAC == nil {
+		if err := l.sendSynAckLocked(c); err != nil {
+			c.abortLocked(err)
+			c.mu.Unlock()
+			return
+		}
+	}
+
+	// 相手のACKでESTABLISHEDになるか，再送の上限でCLOSEDになるまで待つ
+	c.waitHandshakeLocked()
+	closed := c.state == StateClosed
+	c.mu.Unlock()
+	if closed {
+		return
+	}
+
+	l.mu.Lock()
+	queued := false
+	select {
+	case <-l.done:
+	default:
+		select {
+		case l.accept <- c:
+			queued = true
+		default:
+			// acceptキューがいっぱい
+		}
+	}
+	l.mu.Unlock()
+	if !queued {
+		c.Abort()
+	}
+}
+
+// SYN_RECEIVEDで相手がSYNを再送してきたか(SYN+ACKが届かなかった)
+func (t *TCPConnection) isRetransmittedSyn(tcp *layers.TCP) bool {
+	return t.state == StateSynReceived && tcp.SYN && !tcp.ACK && tcp.Seq == t.irs
+}
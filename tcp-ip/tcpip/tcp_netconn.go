@@ -0,0 +1,149 @@
+package tcpip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// TCPConnectionとTCPListenerはnet.Conn，net.Listenerとして使える
+// (net/httpのhttp.Serveやhttp.TransportのDialContextにそのまま渡せる)
+var (
+	_ net.Conn     = (*TCPConnection)(nil)
+	_ net.Listener = (*TCPListener)(nil)
+)
+
+// 接続の自分側のアドレス
+func (t *TCPConnection) LocalAddr() net.Addr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return &net.TCPAddr{IP: t.srcIP, Port: int(t.srcPort)}
+}
+
+// 接続の相手側のアドレス
+func (t *TCPConnection) RemoteAddr() net.Addr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return &net.TCPAddr{IP: t.dstIP, Port: int(t.dstPort)}
+}
+
+// ReadとWriteの期限を設定する．ゼロ値なら期限なし
+func (t *TCPConnection) SetDeadline(d time.Time) error {
+	t.SetReadDeadline(d)
+	t.SetWriteDeadline(d)
+	return nil
+}
+
+// Readの期限を設定する．期限を過ぎるとReadはos.ErrDeadlineExceededを返す
+func (t *TCPConnection) SetReadDeadline(d time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.readDeadline = d
+	t.readTimer = t.resetDeadlineTimerLocked(t.readTimer, d)
+	return nil
+}
+
+// Writeの期限を設定する．期限を過ぎるとWriteはos.ErrDeadlineExceededを返す
+func (t *TCPConnection) SetWriteDeadline(d time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.writeDeadline = d
+	t.writeTimer = t.resetDeadlineTimerLocked(t.writeTimer, d)
+	return nil
+}
+
+// 期限になったら待っているRead/Writeを起こすタイマを動かし直す
+// 期限を変えたことに気づかせるため，今待っている側もすぐに起こす
+func (t *TCPConnection) resetDeadlineTimerLocked(timer Timer, d time.Time) Timer {
+	if timer != nil {
+		timer.Stop()
+		timer = nil
+	}
+	if !d.IsZero() {
+		timer = t.stack.clock.AfterFunc(d.Sub(t.stack.clock.Now()), func() {
+			t.mu.Lock()
+			t.wakeLocked()
+			t.mu.Unlock()
+		})
+	}
+	t.wakeLocked()
+	return timer
+}
+
+// 期限を過ぎたか
+func deadlineExceeded(clock Clock, d time.Time) bool {
+	return !d.IsZero() && !clock.Now().Before(d)
+}
+
+// 接続を待ち，net.Connとして返す
+func (l *TCPListener) Accept() (net.Conn, error) {
+	c, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// 待ち受けているアドレス
+func (l *TCPListener) Addr() net.Addr {
+	var ip net.IP
+	if l.key.localAddr.IsValid() {
+		ip = net.IP(l.key.localAddr.AsSlice())
+	}
+	return &net.TCPAddr{IP: ip, Port: int(l.key.localPort)}
+}
+
+// net.Dialと同じようにaddress("IPアドレス:ポート番号"または"ホスト名:ポート番号")へTCPで接続する
+// ホスト名はSetResolverで設定したリゾルバで解決する
+// 送信元ポートはエフェメラルポートから選ぶ．http.TransportのDialContextに渡せる
+func (s *Stack) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("未対応のネットワーク: %s", network)
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("無効なポート番号: %s", portStr)
+	}
+	dstIP, err := s.lookupIP(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+	srcPort, err := s.ephemeralTCPPort()
+	if err != nil {
+		return nil, err
+	}
+
+	t := NewTCP(s, srcPort)
+	// 3Way Handshakeの途中でctxが終わったら接続をやめる
+	// SYNを送る前に終わったときは，connectがSYNを送る前に確かめる
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.mu.Lock()
+			if t.state == StateSynSent {
+				t.abortLocked(ctx.Err())
+			}
+			t.mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	if err := t.connect(ctx, dstIP.String(), uint16(port)); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		t.Abort()
+		return nil, err
+	}
+	return t, nil
+}
@@ -0,0 +1,58 @@
+package tcpip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// 相手のMACアドレスを解決している間にctxが終わっても，再送を待たずにやめる
+func TestDialContextCancelDuringResolve(t *testing.T) {
+	sa, _, _, _ := twoStacks(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	// 10.0.0.3は誰も持っていないので，ARPリプライは返ってこない(既定では1秒ごとに3回送る)
+	_, err := sa.DialContext(ctx, "tcp", "10.0.0.3:80")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("エラー: %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("戻るまでに%vかかりました", d)
+	}
+	// 使わなかったエンドポイントは登録されていない
+	sa.mu.RLock()
+	n := len(sa.tcp)
+	sa.mu.RUnlock()
+	if n != 0 {
+		t.Fatalf("残っているエンドポイント: %d", n)
+	}
+}
+
+// SYNを送る前にctxが終わっていたら，SYNを送らずにやめる
+func TestDialContextCanceledBeforeSYN(t *testing.T) {
+	sa, sb, _, nb := twoStacks(t)
+	if _, err := sb.Listen(nil, 80, 0); err != nil {
+		t.Fatal(err)
+	}
+	// アドレスの解決はすぐに終わるので，SYNを送る直前で気づく
+	if err := sa.Neighbors().AddStatic(net.IPv4(10, 0, 0, 2), nb.HardwareAddr()); err != nil {
+		t.Fatal(err)
+	}
+	tr := NewTCPTrace()
+	sa.SetTCPTracer(tr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := sa.DialContext(ctx, "tcp", "10.0.0.2:80"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("エラー: %v", err)
+	}
+	for _, ev := range tr.Events() {
+		if ev.Kind == TCPTraceSend {
+			t.Fatalf("送ったセグメント: %+v", ev)
+		}
+	}
+}
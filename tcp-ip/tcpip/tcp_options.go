@@ -0,0 +1,317 @@
+package tcpip
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// ウィンドウスケールのシフト数の上限(RFC 7323 Section 2.3)
+	maxWindowScale = 14
+	// タイムスタンプオプション(NOP 2つ+10バイト)の長さ
+	timestampOptionLen = 12
+	// 1つのセグメントに載せるSACKブロックの最大数(タイムスタンプと一緒に載せられる数)
+	maxSACKBlocks = 3
+)
+
+// SACKで通知する，受け取り済みのシーケンス番号の範囲[left, right)
+type sackBlock struct {
+	left, right uint32
+}
+
+// 受信したセグメントのTCPオプション
+type tcpOptions struct {
+	mss           uint16
+	hasMSS        bool
+	windowScale   uint8
+	hasWScale     bool
+	sackPermitted bool
+	sack          []sackBlock
+	tsVal, tsEcr  uint32
+	hasTimestamp  bool
+}
+
+// 受信したTCPヘッダのオプションを読み取る．長さが合わないオプションは無視する
+func parseTCPOptions(options []layers.TCPOption) tcpOptions {
+	var o tcpOptions
+	for _, opt := range options {
+		data := opt.OptionData
+		switch opt.OptionType {
+		case layers.TCPOptionKindMSS:
+			if len(data) == 2 {
+				o.mss = binary.BigEndian.Uint16(data)
+				o.hasMSS = true
+			}
+		case layers.TCPOptionKindWindowScale:
+			if len(data) == 1 {
+				o.windowScale = data[0]
+				if o.windowScale > maxWindowScale {
+					o.windowScale = maxWindowScale
+				}
+				o.hasWScale = true
+			}
+		case layers.TCPOptionKindSACKPermitted:
+			o.sackPermitted = true
+		case layers.TCPOptionKindSACK:
+			for i := 0; i+8 <= len(data); i += 8 {
+				o.sack = append(o.sack, sackBlock{
+					left:  binary.BigEndian.Uint32(data[i:]),
+					right: binary.BigEndian.Uint32(data[i+4:]),
+				})
+			}
+		case layers.TCPOptionKindTimestamps:
+			if len(data) == 8 {
+				o.tsVal = binary.BigEndian.Uint32(data)
+				o.tsEcr = binary.BigEndian.Uint32(data[4:])
+				o.hasTimestamp = true
+			}
+		}
+	}
+	return o
+}
+
+func nopOption() layers.TCPOption {
+	return layers.TCPOption{OptionType: layers.TCPOptionKindNop, OptionLength: 1}
+}
+
+func mssOption(mss uint16) layers.TCPOption {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, mss)
+	return layers.TCPOption{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: data}
+}
+
+func windowScaleOption(shift uint8) layers.TCPOption {
+	return layers.TCPOption{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{shift}}
+}
+
+func sackPermittedOption() layers.TCPOption {
+	return layers.TCPOption{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2}
+}
+
+func timestampOption(tsVal, tsEcr uint32) layers.TCPOption {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, tsVal)
+	binary.BigEndian.PutUint32(data[4:], tsEcr)
+	return layers.TCPOption{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: data}
+}
+
+func sackOption(blocks []sackBlock) layers.TCPOption {
+	data := make([]byte, 8*len(blocks))
+	for i, b := range blocks {
+		binary.BigEndian.PutUint32(data[8*i:], b.left)
+		binary.BigEndian.PutUint32(data[8*i+4:], b.right)
+	}
+	return layers.TCPOption{OptionType: layers.TCPOptionKindSACK, OptionLength: uint8(2 + len(data)), OptionData: data}
+}
+
+// 受信バッファの大きさを通知できるウィンドウスケールのシフト数
+func windowScaleFor(bufSize int) uint8 {
+	var shift uint8
+	for bufSize>>shift > maxWindow && shift < maxWindowScale {
+		shift++
+	}
+	return shift
+}
+
+// 設定に従って，SYNで申し出るオプションを決める
+func (t *TCPConnection) initOptions(config TCPConfig) {
+	t.wsOK = !config.DisableWindowScale
+	if t.wsOK {
+		t.rcvWscale = windowScaleFor(t.rcvBufSize)
+	}
+	t.sackOK = !config.DisableSACK
+	t.tsOK = !config.DisableTimestamps
+	// タイムスタンプから起動時刻がわからないようランダムにずらす(RFC 7323 Section 5.4)
+	t.tsOffset = rand.Uint32()
+}
+
+// 相手のSYN(またはSYN+ACK)のオプションで，この接続で使うオプションを決める
+// 両方が申し出たオプションだけを使う
+func (t *TCPConnection) negotiateOptionsLocked(o tcpOptions) {
+	peerMSS := defaultMSS
+	if o.hasMSS {
+		peerMSS = int(o.mss)
+	}
+	mss := mssFor(t.nic, t.dstIP)
+	if peerMSS < mss {
+		mss = peerMSS
+	}
+	t.setMSSLocked(mss)
+
+	if t.wsOK && o.hasWScale {
+		t.sndWscale = o.windowScale
+	} else {
+		t.wsOK = false
+		t.sndWscale = 0
+		t.rcvWscale = 0
+	}
+	t.sackOK = t.sackOK && o.sackPermitted
+	t.tsOK = t.tsOK && o.hasTimestamp
+	if t.tsOK {
+		t.tsRecent = o.tsVal
+	}
+}
+
+// 送るセグメントに付けるオプション
+func (t *TCPConnection) optionsLocked(flags tcpFlags, payloadLen int) []layers.TCPOption {
+	var options []layers.TCPOption
+	if flags&flagSYN != 0 {
+		options = append(options, mssOption(uint16(mssFor(t.nic, t.dstIP))))
+		if t.wsOK {
+			options = append(options, nopOption(), windowScaleOption(t.rcvWscale))
+		}
+		if t.sackOK {
+			options = append(options, nopOption(), nopOption(), sackPermittedOption())
+		}
+	}
+	if t.tsOK {
+		// SYNでは相手のタイムスタンプをまだ知らないので0を返す
+		var tsEcr uint32
+		if flags&flagACK != 0 {
+			tsEcr = t.tsRecent
+		}
+		options = append(options, nopOption(), nopOption(), timestampOption(t.tsNow(), tsEcr))
+	}
+	if t.sackOK && flags&flagSYN == 0 && flags&flagACK != 0 {
+		// 受信の抜けより前に送った大きいセグメントを再送するときは，MSSに収まる数までブロックを減らす
+		blocks := t.sackBlocksLocked()
+		room := t.mss - payloadLen - 4
+		if t.tsOK {
+			room -= timestampOptionLen
+		}
+		if n := room / 8; len(blocks) > n {
+			if n < 0 {
+				n = 0
+			}
+			blocks = blocks[:n]
+		}
+		if len(blocks) > 0 {
+			options = append(options, nopOption(), nopOption(), sackOption(blocks))
+		}
+	}
+	return options
+}
+
+// 1つのセグメントに載せられるデータの長さ(MSSからオプションの分を引く，RFC 6691)
+func (t *TCPConnection) segmentSizeLocked() int {
+	size := t.mss
+	if t.tsOK {
+		size -= timestampOptionLen
+	}
+	if t.sackOK && len(t.rcvOutOfOrder) > 0 {
+		size -= 4 + 8*maxSACKBlocks
+	}
+	return size
+}
+
+// タイムスタンプの時計(ミリ秒)
+func (t *TCPConnection) tsNow() uint32 {
+	return uint32(t.stack.clock.Now().UnixNano()/int64(time.Millisecond)) + t.tsOffset
+}
+
+// 古いタイムスタンプのセグメントは，一周して戻ってきた古いシーケンス番号のものとして捨てる(PAWS, RFC 7323 Section 5)
+func (t *TCPConnection) pawsRejectLocked(tcp *layers.TCP, o tcpOptions) bool {
+	return t.tsOK && o.hasTimestamp && !tcp.RST && seqLT(o.tsVal, t.tsRecent)
+}
+
+// 確認応答済みの範囲から始まるセグメントのタイムスタンプを覚えて，相手へ返す(RFC 7323 Section 4.3)
+func (t *TCPConnection) updateTSRecentLocked(tcp *layers.TCP, o tcpOptions) {
+	if t.tsOK && o.hasTimestamp && seqLEQ(tcp.Seq, t.lastAckSent) {
+		t.tsRecent = o.tsVal
+	}
+}
+
+// タイムスタンプの返り値からRTTを測る(RFC 7323 Section 4)
+// 再送したセグメントへのACKでも正しく測れるのでKarnのアルゴリズムはいらない
+func (t *TCPConnection) timestampRTTLocked(o tcpOptions) {
+	if !t.tsOK || !o.hasTimestamp || o.tsEcr == 0 {
+		return
+	}
+	rtt := time.Duration(t.tsNow()-o.tsEcr) * time.Millisecond
+	if rtt < clockGranularity {
+		rtt = clockGranularity
+	}
+	t.updateRTOLocked(rtt)
+}
+
+// 順番を追い越して受け取っている範囲をSACKブロックにする
+// 最後に受け取ったセグメントを含むブロックを先頭にする(RFC 2018 Section 4)
+func (t *TCPConnection) sackBlocksLocked() []sackBlock {
+	if len(t.rcvOutOfOrder) == 0 {
+		return nil
+	}
+	var blocks []sackBlock
+	for seq, data := range t.rcvOutOfOrder {
+		blocks = append(blocks, sackBlock{left: seq, right: seq + uint32(len(data))})
+	}
+	sort.Slice(blocks, func(i, j int) bool { return seqLT(blocks[i].left, blocks[j].left) })
+
+	// 重なったりつながったりしているブロックをまとめる
+	merged := blocks[:1]
+	for _, b := range blocks[1:] {
+		last := &merged[len(merged)-1]
+		if seqLEQ(b.left, last.right) {
+			if seqGT(b.right, last.right) {
+				last.right = b.right
+			}
+			continue
+		}
+		merged = append(merged, b)
+	}
+
+	for i, b := range merged {
+		if seqLEQ(b.left, t.lastOutOfOrder) && seqLT(t.lastOutOfOrder, b.right) {
+			merged[0], merged[i] = merged[i], merged[0]
+			break
+		}
+	}
+	if len(merged) > maxSACKBlocks {
+		merged = merged[:maxSACKBlocks]
+	}
+	return merged
+}
+
+// 相手が受け取り済みと通知してきた範囲のセグメントに印を付ける(RFC 2018)
+func (t *TCPConnection) markSackedLocked(blocks []sackBlock) {
+	if !t.sackOK {
+		return
+	}
+	for _, b := range blocks {
+		// 確認応答済みや未送信の範囲を指すブロックは無視する
+		if !seqLT(b.left, b.right) || seqLEQ(b.right, t.sndUna) || seqGT(b.right, t.sndNxt) {
+			continue
+		}
+		for _, seg := range t.rtxQueue {
+			if seqLEQ(b.left, seg.seq) && seqLEQ(seg.seq+seg.seqLen(), b.right) {
+				seg.sacked = true
+			}
+		}
+		if seqGT(b.right, t.highSacked) {
+			t.highSacked = b.right
+		}
+	}
+}
+
+// 次に再送すべきセグメント
+// SACKが使えるなら，相手が受け取っていない穴のうちまだ再送していないものを選ぶ
+func (t *TCPConnection) nextHoleLocked() *txSegment {
+	if len(t.rtxQueue) == 0 {
+		return nil
+	}
+	if !t.sackOK {
+		return t.rtxQueue[0]
+	}
+	for _, seg := range t.rtxQueue {
+		if !seqLT(seg.seq, t.highSacked) {
+			break
+		}
+		if !seg.sacked && !seg.retransmitted {
+			return seg
+		}
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package tcpip
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// オプションを付けたTCPヘッダを組み立ててから読み直す
+func roundTripOptions(t *testing.T, options ...layers.TCPOption) tcpOptions {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	tcp := &layers.TCP{SrcPort: 1, DstPort: 2, ACK: true, Window: 100, Options: options}
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, tcp); err != nil {
+		t.Fatal(err)
+	}
+	decoded := &layers.TCP{}
+	if err := decoded.DecodeFromBytes(buf.Bytes(), gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	return parseTCPOptions(decoded.Options)
+}
+
+func TestTCPOptionsRoundTrip(t *testing.T) {
+	// SYNに付けるオプション
+	want := tcpOptions{
+		mss: 1460, hasMSS: true,
+		windowScale: 7, hasWScale: true,
+		sackPermitted: true,
+		tsVal:         0x01020304, tsEcr: 0, hasTimestamp: true,
+	}
+	got := roundTripOptions(t,
+		mssOption(1460),
+		nopOption(), windowScaleOption(7),
+		nopOption(), nopOption(), sackPermittedOption(),
+		nopOption(), nopOption(), timestampOption(0x01020304, 0))
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("SYNのオプション: %+v, 期待: %+v", got, want)
+	}
+
+	// タイムスタンプと一緒に載せられるだけのSACKブロック(40バイトに収まる)
+	blocks := []sackBlock{{1000, 2000}, {3000, 4500}, {0xfffffff0, 16}}
+	want = tcpOptions{sack: blocks, tsVal: 5, tsEcr: 0xa0b0c0d0, hasTimestamp: true}
+	got = roundTripOptions(t,
+		nopOption(), nopOption(), timestampOption(5, 0xa0b0c0d0),
+		nopOption(), nopOption(), sackOption(blocks))
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ACKのオプション: %+v, 期待: %+v", got, want)
+	}
+
+	// 長さが合わないオプションは無視し，大きすぎるシフト数は14にする
+	got = parseTCPOptions([]layers.TCPOption{
+		{OptionType: layers.TCPOptionKindMSS, OptionLength: 3, OptionData: []byte{1}},
+		{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 6, OptionData: []byte{1, 2, 3, 4}},
+		windowScaleOption(20),
+	})
+	if got.hasMSS || got.hasTimestamp || !got.hasWScale || got.windowScale != maxWindowScale {
+		t.Fatalf("不正なオプション: %+v", got)
+	}
+}
+
+// 両方が申し出たオプションだけを使う
+func TestTCPOptionsNegotiation(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		config       func(*TCPConfig)
+		ws, sack, ts bool
+		segmentSize  int
+	}{
+		{"すべて", func(*TCPConfig) {}, true, true, true, 1460 - timestampOptionLen},
+		{"ウィンドウスケールなし", func(c *TCPConfig) { c.DisableWindowScale = true }, false, true, true, 1460 - timestampOptionLen},
+		{"SACKなし", func(c *TCPConfig) { c.DisableSACK = true }, true, false, true, 1460 - timestampOptionLen},
+		{"タイムスタンプなし", func(c *TCPConfig) { c.DisableTimestamps = true }, true, true, false, 1460},
+	} {
+		p := newTCPPair(t)
+		// bだけがオプションを申し出ない
+		config := DefaultTCPConfig
+		tc.config(&config)
+		p.sb.SetTCPConfig(config)
+		p.dial(t)
+		for _, c := range []*TCPConnection{p.a, p.b} {
+			c.mu.Lock()
+			ws, sack, ts, size, mss := c.wsOK, c.sackOK, c.tsOK, c.segmentSizeLocked(), c.mss
+			c.mu.Unlock()
+			if ws != tc.ws || sack != tc.sack || ts != tc.ts {
+				t.Errorf("%s: ウィンドウスケール=%v SACK=%v タイムスタンプ=%v", tc.name, ws, sack, ts)
+			}
+			if mss != 1460 || size != tc.segmentSize {
+				t.Errorf("%s: MSS=%d セグメントの大きさ=%d", tc.name, mss, size)
+			}
+		}
+	}
+
+	// 相手がMSSを付けてこなければ536バイトにする(RFC 9293 Section 3.7.1)
+	p := newTCPPair(t)
+	p.dial(t)
+	c := p.a
+	c.mu.Lock()
+	c.negotiateOptionsLocked(tcpOptions{})
+	ws, sack, ts, mss, wscale := c.wsOK, c.sackOK, c.tsOK, c.mss, c.rcvWscale
+	c.mu.Unlock()
+	if ws || sack || ts || mss != defaultMSS || wscale != 0 {
+		t.Fatalf("オプションのない相手: ウィンドウスケール=%v SACK=%v タイムスタンプ=%v MSS=%d シフト数=%d", ws, sack, ts, mss, wscale)
+	}
+}
+
+// 64KiBを超える受信バッファはウィンドウスケールで通知する
+func TestTCPWindowScaleAbove64KiB(t *testing.T) {
+	for _, tc := range []struct {
+		bufSize int
+		shift   uint8
+	}{{maxWindow, 0}, {64 * 1024, 1}, {256 * 1024, 3}, {1 << 30, maxWindowScale}, {1 << 31, maxWindowScale}} {
+		if got := windowScaleFor(tc.bufSize); got != tc.shift {
+			t.Errorf("%dバイトのシフト数: %d, 期待: %d", tc.bufSize, got, tc.shift)
+		}
+	}
+
+	p := newTCPPair(t)
+	config := DefaultTCPConfig
+	config.ReceiveBufferSize = 256 * 1024
+	p.sa.SetTCPConfig(config)
+	p.sb.SetTCPConfig(config)
+	p.dial(t)
+	// bが送ったセグメントのウィンドウフィールドは16bitに収まる
+	p.b.Write([]byte("x"))
+	p.clock.Advance(0)
+	p.b.mu.Lock()
+	sndWscale, rcvWscale := p.b.sndWscale, p.b.rcvWscale
+	p.b.mu.Unlock()
+	p.a.mu.Lock()
+	sndWnd := p.a.sndWnd
+	p.a.mu.Unlock()
+	if sndWscale != 3 || rcvWscale != 3 {
+		t.Fatalf("シフト数: 送信%d 受信%d", sndWscale, rcvWscale)
+	}
+	if sndWnd != 256*1024 {
+		t.Fatalf("aが知ったbのウィンドウ: %d", sndWnd)
+	}
+}
+
+// SACKで受け取ったと通知されたセグメントを飛ばして，穴から再送する
+func TestTCPSACKRetransmitChoice(t *testing.T) {
+	s := NewStack()
+	defer s.Close()
+	c := NewTCP(s, 0)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sackOK = true
+	c.sndUna = 1000
+	for i := 0; i < 5; i++ {
+		c.rtxQueue = append(c.rtxQueue, &txSegment{seq: uint32(1000 + 100*i), flags: flagACK, data: make([]byte, 100)})
+	}
+	c.sndNxt = 1500
+	q := c.rtxQueue
+
+	// 2つ目と4つ目が届いた．未送信の範囲や確認応答済みの範囲を指すブロックは無視する
+	c.markSackedLocked([]sackBlock{{1100, 1200}, {1300, 1400}, {1400, 1600}, {500, 1000}})
+	for i, want := range []bool{false, true, false, true, false} {
+		if q[i].sacked != want {
+			t.Fatalf("%d番目のセグメントの印: %v", i, q[i].sacked)
+		}
+	}
+	if c.highSacked != 1400 {
+		t.Fatalf("SACKされた最大のシーケンス番号: %d", c.highSacked)
+	}
+	if seg := c.nextHoleLocked(); seg != q[0] {
+		t.Fatalf("最初の穴: %+v", seg)
+	}
+	q[0].retransmitted = true
+	if seg := c.nextHoleLocked(); seg != q[2] {
+		t.Fatalf("次の穴: %+v", seg)
+	}
+	// 最後にSACKされた範囲より後ろはまだ失われたとは言えない
+	q[2].retransmitted = true
+	if seg := c.nextHoleLocked(); seg != nil {
+		t.Fatalf("SACKされた範囲の後ろを再送しました: %+v", seg)
+	}
+	if pipe := c.pipeLocked(); pipe != 300 {
+		t.Fatalf("届いたとわかっていないデータ: %d", pipe)
+	}
+
+	// SACKが使えなければ先頭から
+	c.sackOK = false
+	if seg := c.nextHoleLocked(); seg != q[0] {
+		t.Fatalf("SACKなしの再送: %+v", seg)
+	}
+}
+
+// 受信側は，最後に受け取ったセグメントを含むブロックを先頭にしてSACKを返す
+func TestTCPSACKBlocks(t *testing.T) {
+	s := NewStack()
+	defer s.Close()
+	c := NewTCP(s, 0)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rcvOutOfOrder = map[uint32][]byte{
+		2000: make([]byte, 100),
+		2100: make([]byte, 100),
+		3000: make([]byte, 100),
+		4000: make([]byte, 50),
+		5000: make([]byte, 10),
+	}
+	c.lastOutOfOrder = 4000
+	want := []sackBlock{{4000, 4050}, {3000, 3100}, {2000, 2200}}
+	if got := c.sackBlocksLocked(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("SACKブロック: %v, 期待: %v", got, want)
+	}
+}
+
+// タイムスタンプがあれば再送したセグメントへのACKでもRTTを測る
+func TestTCPTimestampRTT(t *testing.T) {
+	p := newTCPPair(t)
+	p.dial(t)
+	c := p.a
+	p.impair(Impairment{Delay: 50 * time.Millisecond})
+	c.Write([]byte("a"))
+	advanceUntilAcked(t, p.clock, c)
+	before := c.Stats()
+	if before.SRTT != 100*time.Millisecond || before.RTTVar != 50*time.Millisecond {
+		t.Fatalf("SRTT=%v RTTVAR=%v", before.SRTT, before.RTTVar)
+	}
+
+	// 再送したセグメントのタイムスタンプが返ってくるので，測った値は往復の100ミリ秒
+	p.ports[0].SetImpairment(Impairment{Loss: 1})
+	c.Write([]byte("b"))
+	p.impair(Impairment{Delay: 50 * time.Millisecond})
+	advanceUntilAcked(t, p.clock, c)
+	after := c.Stats()
+	if after.Retransmits != before.Retransmits+1 {
+		t.Fatalf("再送: %d", after.Retransmits)
+	}
+	if after.SRTT != 100*time.Millisecond || after.RTTVar != 37500*time.Microsecond {
+		t.Fatalf("SRTT=%v RTTVAR=%v", after.SRTT, after.RTTVar)
+	}
+
+	// 返ってきたタイムスタンプから直接測る
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.srtt, c.rttvar = 0, 0
+	c.timestampRTTLocked(tcpOptions{hasTimestamp: true, tsEcr: c.tsNow() - 30})
+	if c.srtt != 30*time.Millisecond {
+		t.Fatalf("SRTT: %v", c.srtt)
+	}
+	// 0は相手がまだタイムスタンプを返していない
+	c.timestampRTTLocked(tcpOptions{hasTimestamp: true})
+	if c.srtt != 30*time.Millisecond {
+		t.Fatalf("tsEcr=0でRTTを測りました: %v", c.srtt)
+	}
+}
@@ -0,0 +1,243 @@
+package tcpip
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 再送の上限に達した
+var ErrConnectionTimedOut = errors.New("再送の上限に達したため接続を切断しました")
+
+// 再送タイマの設定(RFC 6298)
+const (
+	// RTTを測る前のRTO
+	initialRTO = time.Second
+	// RTOの下限と上限．RFC 6298は下限1秒としているが，Linuxと同じく200ミリ秒にする
+	minRTO = 200 * time.Millisecond
+	maxRTO = 60 * time.Second
+	// タイマの分解能(RFC 6298のG)
+	clockGranularity = time.Millisecond
+	// 同じセグメントを再送する回数の既定値
+	defaultMaxRetries = 8
+)
+
+// TCP接続の統計
+type TCPStats struct {
+	// 送信したセグメント数(再送を含む)
+	SegmentsSent int
+	// 再送したセグメント数
+	Retransmits int
+	// 再送タイマが満了した回数
+	Timeouts int
+	// 送ったゼロウィンドウプローブの数
+	WindowProbes int
+	// 重複ACKで高速再送した回数
+	FastRetransmits int
+	// 輻輳ウィンドウとスロースタートの閾値(バイト)
+	CongestionWindow   int
+	SlowStartThreshold int
+	// 平滑化したRTT，RTTの変動，現在のRTO
+	SRTT   time.Duration
+	RTTVar time.Duration
+	RTO    time.Duration
+}
+
+// 送ったが確認応答されていないセグメント
+type txSegment struct {
+	seq    uint32
+	flags  tcpFlags
+	data   []byte
+	sentAt time.Time
+	// 再送したセグメントのACKではRTTを測らない(Karnのアルゴリズム)
+	retransmitted bool
+	// 相手がSACKで受け取ったと通知してきた
+	sacked bool
+}
+
+// セグメントが消費するシーケンス番号の数(SYNとFINは1つずつ消費する)
+func (s *txSegment) seqLen() uint32 {
+	n := uint32(len(s.data))
+	if s.flags&flagSYN != 0 {
+		n++
+	}
+	if s.flags&flagFIN != 0 {
+		n++
+	}
+	return n
+}
+
+// 接続の統計を返す
+func (t *TCPConnection) Stats() TCPStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := t.stats
+	stats.SRTT = t.srtt
+	stats.RTTVar = t.rttvar
+	stats.RTO = t.currentRTOLocked()
+	stats.CongestionWindow = t.cc.CongestionWindow()
+	stats.SlowStartThreshold = t.cc.SlowStartThreshold()
+	return stats
+}
+
+// 同じセグメントを再送する回数の上限を変更する
+func (t *TCPConnection) SetMaxRetries(n int) {
+	t.mu.Lock()
+	t.maxRetries = n
+	t.mu.Unlock()
+}
+
+// セグメントを再送キューに入れてから送る
+// 送信に失敗しても再送タイマが送り直すので，エラーは返さない
+func (t *TCPConnection) sendReliableLocked(flags tcpFlags, seq uint32, data []byte) {
+	seg := &txSegment{
+		seq:    seq,
+		flags:  flags,
+		data:   append([]byte(nil), data...),
+		sentAt: t.stack.clock.Now(),
+	}
+	t.rtxQueue = append(t.rtxQueue, seg)
+	if err := t.sendSegmentLocked(flags, seq, seg.data); err != nil {
+		fmt.Printf("TCPセグメントの送信に失敗(再送します): %v\n", err)
+	}
+	// RFC 6298 5.1: タイマが動いていなければ動かす
+	if len(t.rtxQueue) == 1 {
+		t.armRetransmitTimerLocked()
+	}
+}
+
+// 確認応答された分を再送キューから取り除き，RTTを測ってタイマをやり直す
+func (t *TCPConnection) ackedLocked(ack uint32) {
+	now := t.stack.clock.Now()
+	var sample time.Duration
+	sampled, karn := false, false
+	for len(t.rtxQueue) > 0 {
+		seg := t.rtxQueue[0]
+		if seqGT(seg.seq+seg.seqLen(), ack) {
+			break
+		}
+		t.rtxQueue = t.rtxQueue[1:]
+		// 再送より前に送ったセグメントは，失われたセグメントの再送を待たされていたのでRTTに使わない
+		if seg.retransmitted || !seg.sentAt.After(t.lastRetransmit) {
+			karn = true
+		} else if !sampled {
+			sample = now.Sub(seg.sentAt)
+			sampled = true
+		}
+	}
+	// タイムスタンプが使えるならそちらで測る
+	if sampled && !karn && !t.tsOK {
+		t.updateRTOLocked(sample)
+	}
+
+	// 新しいデータが確認応答されたので再送回数とバックオフを戻す
+	t.retries = 0
+	if len(t.rtxQueue) == 0 {
+		// RFC 6298 5.2: すべて確認応答されたらタイマを止める
+		t.stopRetransmitTimerLocked()
+	} else {
+		// RFC 6298 5.3: 新しいデータが確認応答されたらタイマをやり直す
+		t.armRetransmitTimerLocked()
+	}
+}
+
+// RTTの測定値からSRTT，RTTVAR，RTOを計算する(RFC 6298 Section 2)
+func (t *TCPConnection) updateRTOLocked(r time.Duration) {
+	if t.srtt == 0 {
+		t.srtt = r
+		t.rttvar = r / 2
+	} else {
+		diff := t.srtt - r
+		if diff < 0 {
+			diff = -diff
+		}
+		t.rttvar = (3*t.rttvar + diff) / 4
+		t.srtt = (7*t.srtt + r) / 8
+	}
+	k := 4 * t.rttvar
+	if k < clockGranularity {
+		k = clockGranularity
+	}
+	t.rto = clampRTO(t.srtt + k)
+}
+
+// バックオフを含めた現在のRTO
+func (t *TCPConnection) currentRTOLocked() time.Duration {
+	rto := t.rto
+	for i := 0; i < t.retries && rto < maxRTO; i++ {
+		rto *= 2
+	}
+	return clampRTO(rto)
+}
+
+func clampRTO(rto time.Duration) time.Duration {
+	if rto < minRTO {
+		return minRTO
+	}
+	if rto > maxRTO {
+		return maxRTO
+	}
+	return rto
+}
+
+// 再送タイマをRTOで動かし直す
+func (t *TCPConnection) armRetransmitTimerLocked() {
+	t.stopRetransmitTimerLocked()
+	gen := t.rtxGen
+	t.rtxTimer = t.stack.clock.AfterFunc(t.currentRTOLocked(), func() {
+		t.onRetransmitTimeout(gen)
+	})
+}
+
+// 再送タイマを止める．すでに発火したコールバックは世代が違うので何もしない
+func (t *TCPConnection) stopRetransmitTimerLocked() {
+	t.rtxGen++
+	if t.rtxTimer != nil {
+		t.rtxTimer.Stop()
+		t.rtxTimer = nil
+	}
+}
+
+// 再送タイマの満了: 最も古いセグメントを再送し，RTOを2倍にする(RFC 6298 Section 5)
+// 2倍にしたRTOは，新しいデータが確認応答されるまで使い続ける
+func (t *TCPConnection) onRetransmitTimeout(gen int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if gen != t.rtxGen || len(t.rtxQueue) == 0 || t.state == StateClosed {
+		return
+	}
+
+	t.stats.Timeouts++
+	if t.retries >= t.maxRetries {
+		fmt.Printf("TCP再送の上限に達しました[%v:%d]\n", t.dstIP, t.dstPort)
+		t.abortLocked(ErrConnectionTimedOut)
+		return
+	}
+	if t.retries == 0 {
+		// 輻輳ウィンドウを1セグメントに戻し，そのとき送っていたデータを順に再送していく
+		t.cc.OnRTO(t.inFlightLocked())
+		t.recover = t.sndNxt
+		t.rtoRecovery = true
+		t.inRecovery = false
+		t.dupAcks = 0
+		// 相手が受信バッファから捨てているかもしれないのでSACKの情報を忘れる(RFC 2018 Section 8)
+		for _, seg := range t.rtxQueue {
+			seg.sacked = false
+		}
+		t.highSacked = t.sndUna
+	}
+	t.retries++
+
+	seg := t.rtxQueue[0]
+	fmt.Printf("TCP再送[%v:%d]: Seq=%d (%d回目, RTO=%v)\n", t.dstIP, t.dstPort, seg.seq, t.retries, t.currentRTOLocked())
+	t.retransmitLocked(seg)
+	t.armRetransmitTimerLocked()
+}
+
+// 再送キューのセグメントを送り直す
+func (t *TCPConnection) retransmitLocked(seg *txSegment) {
+	seg.retransmitted = true
+	t.lastRetransmit = t.stack.clock.Now()
+	t.stats.Retransmits++
+	t.sendSegmentLocked(seg.flags, seg.seq, seg.data)
+}
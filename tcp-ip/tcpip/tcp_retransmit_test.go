@@ -0,0 +1,150 @@
+package tcpip
+
+import (
+	"testing"
+	"time"
+)
+
+// 送ったデータがすべて確認応答されたか
+func allAcked(c *TCPConnection) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sndUna == c.sndNxt && len(c.sndBuf) == 0
+}
+
+// すべて確認応答されるまで，次のタイマーへ時計を進める
+func advanceUntilAcked(t *testing.T, clock *VirtualClock, c *TCPConnection) {
+	t.Helper()
+	for i := 0; i < 100 && !allAcked(c); i++ {
+		if !clock.AdvanceToNext() {
+			break
+		}
+	}
+	if !allAcked(c) {
+		t.Fatal("確認応答されませんでした")
+	}
+}
+
+// RTTの測定値からSRTT，RTTVAR，RTOを求める(RFC 6298 Section 2)
+func TestTCPRTOEstimate(t *testing.T) {
+	s := NewStack()
+	defer s.Close()
+	ms := time.Millisecond
+	for _, tc := range []struct {
+		name    string
+		samples []time.Duration
+		retries int
+		srtt    time.Duration
+		rttvar  time.Duration
+		rto     time.Duration
+	}{
+		{"最初の測定", []time.Duration{100 * ms}, 0, 100 * ms, 50 * ms, 300 * ms},
+		{"2回目の測定", []time.Duration{100 * ms, 200 * ms}, 0, 112500 * time.Microsecond, 62500 * time.Microsecond, 362500 * time.Microsecond},
+		{"下限", []time.Duration{10 * ms}, 0, 10 * ms, 5 * ms, minRTO},
+		{"上限", []time.Duration{50 * time.Second}, 0, 50 * time.Second, 25 * time.Second, maxRTO},
+		{"バックオフ", []time.Duration{100 * ms}, 3, 100 * ms, 50 * ms, 2400 * ms},
+		{"バックオフの上限", []time.Duration{100 * ms}, 10, 100 * ms, 50 * ms, maxRTO},
+	} {
+		c := NewTCP(s, 0)
+		c.mu.Lock()
+		for _, r := range tc.samples {
+			c.updateRTOLocked(r)
+		}
+		c.retries = tc.retries
+		srtt, rttvar, rto := c.srtt, c.rttvar, c.currentRTOLocked()
+		c.mu.Unlock()
+		if srtt != tc.srtt || rttvar != tc.rttvar || rto != tc.rto {
+			t.Errorf("%s: SRTT=%v RTTVAR=%v RTO=%v, 期待: %v %v %v", tc.name, srtt, rttvar, rto, tc.srtt, tc.rttvar, tc.rto)
+		}
+	}
+}
+
+// 再送したセグメントへの確認応答ではRTTを測らない(Karnのアルゴリズム)
+func TestTCPKarn(t *testing.T) {
+	p := newTCPPair(t)
+	// タイムスタンプがあると再送しても正しく測れるので使わない
+	config := DefaultTCPConfig
+	config.DisableTimestamps = true
+	p.sa.SetTCPConfig(config)
+	p.dial(t)
+	c := p.a
+
+	// 往復100ミリ秒で測る
+	p.impair(Impairment{Delay: 50 * time.Millisecond})
+	c.Write([]byte("a"))
+	advanceUntilAcked(t, p.clock, c)
+	before := c.Stats()
+	if before.SRTT != 100*time.Millisecond {
+		t.Fatalf("SRTT: %v", before.SRTT)
+	}
+
+	// 最初に送ったセグメントが失われ，再送したものへのACKは最初の送信から見るとRTO+100ミリ秒後に届く
+	p.ports[0].SetImpairment(Impairment{Loss: 1})
+	c.Write([]byte("b"))
+	p.impair(Impairment{Delay: 50 * time.Millisecond})
+	advanceUntilAcked(t, p.clock, c)
+	after := c.Stats()
+	if after.Retransmits != before.Retransmits+1 {
+		t.Fatalf("再送: %d", after.Retransmits)
+	}
+	if after.SRTT != before.SRTT || after.RTTVar != before.RTTVar {
+		t.Fatalf("再送したセグメントでRTTを測りました: SRTT=%v RTTVAR=%v", after.SRTT, after.RTTVar)
+	}
+
+	// 再送していないセグメントでは，また測る
+	p.impair(Impairment{Delay: 100 * time.Millisecond})
+	c.Write([]byte("c"))
+	advanceUntilAcked(t, p.clock, c)
+	if got := c.Stats().SRTT; got != 112500*time.Microsecond {
+		t.Fatalf("SRTT: %v", got)
+	}
+}
+
+// 再送タイマが切れるたびにRTOを2倍にし，再送の上限を超えたら接続を切る
+func TestTCPRetransmitBackoffAndAbort(t *testing.T) {
+	const retries = 4
+	p := newTCPPair(t)
+	p.dial(t)
+	c := p.a
+	c.SetMaxRetries(retries)
+	rto := c.Stats().RTO
+
+	// aが送るセグメントはすべて失われる
+	p.ports[0].SetImpairment(Impairment{Loss: 1})
+	c.Write([]byte("x"))
+	for i := 0; i < 100 && c.State() != StateClosed; i++ {
+		if !p.clock.AdvanceToNext() {
+			break
+		}
+	}
+	if st := c.State(); st != StateClosed {
+		t.Fatalf("状態: %v", st)
+	}
+	if _, err := c.Read(make([]byte, 1)); err != ErrConnectionTimedOut {
+		t.Fatalf("エラー: %v", err)
+	}
+	st := c.Stats()
+	if st.Retransmits != retries || st.Timeouts != retries+1 {
+		t.Fatalf("再送: %d, タイムアウト: %d", st.Retransmits, st.Timeouts)
+	}
+
+	// データを送った時刻と，切断した時刻
+	var sent []time.Time
+	var closed time.Time
+	for _, ev := range p.ta.Events() {
+		switch {
+		case ev.Kind == TCPTraceSend && ev.Len > 0:
+			sent = append(sent, ev.Time)
+		case ev.Kind == TCPTraceState && ev.To == StateClosed:
+			closed = ev.Time
+		}
+	}
+	if len(sent) != retries+1 {
+		t.Fatalf("送った回数: %d", len(sent))
+	}
+	for i, at := range append(sent[1:], closed) {
+		if got, want := at.Sub(sent[i]), rto<<uint(i); got != want {
+			t.Errorf("%d回目のタイムアウトまで: %v, 期待: %v", i+1, got, want)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package tcpip
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket/layers"
+)
+
+// TCP接続の状態(RFC 793 Section 3.2)
+type TCPState int
+
+const (
+	StateClosed TCPState = iota
+	StateSynSent
+	StateSynReceived
+	StateEstablished
+	StateFinWait1
+	StateFinWait2
+	StateClosing
+	StateTimeWait
+	StateCloseWait
+	StateLastAck
+)
+
+func (st TCPState) String() string {
+	switch st {
+	case StateClosed:
+		return "CLOSED"
+	case StateSynSent:
+		return "SYN_SENT"
+	case StateSynReceived:
+		return "SYN_RECEIVED"
+	case StateEstablished:
+		return "ESTABLISHED"
+	case StateFinWait1:
+		return "FIN_WAIT_1"
+	case StateFinWait2:
+		return "FIN_WAIT_2"
+	case StateClosing:
+		return "CLOSING"
+	case StateTimeWait:
+		return "TIME_WAIT"
+	case StateCloseWait:
+		return "CLOSE_WAIT"
+	case StateLastAck:
+		return "LAST_ACK"
+	}
+	return fmt.Sprintf("TCPState(%d)", int(st))
+}
+
+// シーケンス番号は32bitで一周するので，差の符号で大小を比べる
+func seqLT(a, b uint32) bool  { return int32(a-b) < 0 }
+func seqLEQ(a, b uint32) bool { return int32(a-b) <= 0 }
+func seqGT(a, b uint32) bool  { return int32(a-b) > 0 }
+func seqGEQ(a, b uint32) bool { return int32(a-b) >= 0 }
+
+// 状態を変えて，待っている側を起こす
+func (t *TCPConnection) setStateLocked(state TCPState) {
+	if t.state == state {
+		return
+	}
+	fmt.Printf("TCP状態[%v:%d]: %v -> %v\n", t.dstIP, t.dstPort, t.state, state)
+	t.stack.traceTCP(TCPTraceEvent{Flow: flowOf(t.key), Kind: TCPTraceState, From: t.state, To: state})
+	t.state = state
+	t.wakeLocked()
+}
+
+// 状態やバッファを待っている側(WaitState/Read/Write)を起こす
+func (t *TCPConnection) wakeLocked() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// CLOSEDにしてエンドポイントの登録を解除する
+func (t *TCPConnection) closeLocked() {
+	t.setStateLocked(StateClosed)
+	if t.timeWaitTimer != nil {
+		t.timeWaitTimer.Stop()
+	}
+	t.stopRetransmitTimerLocked()
+	t.stopPersistTimerLocked()
+	t.rtxQueue = nil
+	t.sndBuf = nil
+	t.closeOnce.Do(func() {
+		if t.rx != nil {
+			t.stack.unregisterTCP(t.key)
+		}
+		close(t.closed)
+	})
+}
+
+// エラーを記録して接続を終わらせる
+func (t *TCPConnection) abortLocked(err error) {
+	t.err = err
+	t.closeLocked()
+}
+
+// 受信したセグメントで状態を進める(RFC 793 Section 3.9 SEGMENT ARRIVES)
+func (t *TCPConnection) handleSegment(tcp *layers.TCP) {
+	opts := parseTCPOptions(tcp.Options)
+
+	switch t.state {
+	case StateClosed:
+		return
+	case StateSynSent:
+		t.handleSynSent(tcp, opts)
+		return
+	case StateSynReceived:
+		// SYN+ACKが相手に届かなかったので送り直す
+		if t.isRetransmittedSyn(tcp) {
+			t.sendSegmentLocked(flagSYN|flagACK, t.iss, nil)
+			return
+		}
+		// 同時オープンで相手のSYN+ACKが届いた．SYNは受け取り済みなので，ACKだけを処理する(RFC 793 Figure 8)
+		if tcp.SYN && tcp.ACK && tcp.Seq == t.irs && !tcp.RST {
+			if t.handleAckLocked(tcp, opts) {
+				t.sendAckLocked()
+			}
+			return
+		}
+	}
+
+	// 1. シーケンス番号が受信ウィンドウに入っているか，タイムスタンプが古くないか確かめる
+	if t.pawsRejectLocked(tcp, opts) || !t.acceptableLocked(tcp) {
+		if !tcp.RST {
+			t.sendAckLocked()
+		}
+		return
+	}
+	t.updateTSRecentLocked(tcp, opts)
+
+	// 2. RSTを確かめる
+	if tcp.RST {
+		switch t.state {
+		case StateSynReceived:
+			t.abortLocked(ErrConnectionRefused)
+		case StateEstablished, StateFinWait1, StateFinWait2, StateCloseWait:
+			t.abortLocked(ErrConnectionReset)
+		default:
+			t.closeLocked()
+		}
+		return
+	}
+
+	// 3. ウィンドウ内のSYNは異常なので接続をリセットする
+	if tcp.SYN {
+		t.sendSegmentLocked(flagRST, t.sndNxt, nil)
+		t.abortLocked(ErrConnectionReset)
+		return
+	}
+
+	// 4. ACKを確かめる
+	if !tcp.ACK {
+		return
+	}
+	if !t.handleAckLocked(tcp, opts) {
+		return
+	}
+
+	// 5. データを受け取る
+	if len(tcp.Payload) > 0 {
+		t.receiveDataLocked(tcp)
+	}
+
+	// 6. FINを確かめる．順番を追い越して届いたFINは，手前のデータがそろうまで取っておく
+	if tcp.FIN {
+		t.rcvFinSeq = tcp.Seq + uint32(len(tcp.Payload))
+		t.rcvFinPending = true
+	}
+	if t.rcvFinPending && t.rcvFinSeq == t.rcvNxt {
+		t.rcvFinPending = false
+		t.handleFinLocked()
+	}
+}
+
+// SYN_SENTでのセグメント処理
+func (t *TCPConnection) handleSynSent(tcp *layers.TCP, opts tcpOptions) {
+	// SYN+ACKはISN+1を確認応答していなければならない．それ以外のACKは古い接続のもの
+	if tcp.ACK && tcp.Ack != t.iss+1 {
+		fmt.Printf("自分のSYNを確認応答していないセグメントを破棄: Ack=%d (期待値%d)\n", tcp.Ack, t.iss+1)
+		if !tcp.RST {
+			t.sendTCPPacket(newTCPHeader(t.srcPort, t.dstPort, tcp.Ack, 0, flagRST, 0), nil)
+		}
+		return
+	}
+
+	if tcp.RST {
+		if tcp.ACK {
+			t.abortLocked(ErrConnectionRefused)
+		}
+		return
+	}
+
+	if !tcp.SYN {
+		return
+	}
+
+	t.irs = tcp.Seq
+	t.rcvNxt = tcp.Seq + 1
+	t.negotiateOptionsLocked(opts)
+	// SYNのウィンドウはスケールしない
+	t.sndWnd = uint32(tcp.Window)
+	t.sndWl1 = tcp.Seq
+	t.sndWl2 = tcp.Ack
+
+	if tcp.ACK {
+		// SYN+ACK: 自分のSYNが確認応答された
+		fmt.Printf("TCP SYN+ACKを受信: Seq=%d, Ack=%d\n", tcp.Seq, tcp.Ack)
+		t.sndUna = tcp.Ack
+		t.ackedLocked(tcp.Ack)
+		t.sendAckLocked()
+		t.setStateLocked(StateEstablished)
+		return
+	}
+
+	// 同時オープン: 相手も同時にSYNを送ってきた．再送キューのSYNをSYN+ACKにして送る
+	if len(t.rtxQueue) > 0 {
+		t.rtxQueue[0].flags |= flagACK
+		t.rtxQueue[0].retransmitted = true
+	}
+	t.sendSegmentLocked(flagSYN|flagACK, t.iss, nil)
+	t.setStateLocked(StateSynReceived)
+}
+
+// セグメントのシーケンス番号が受信ウィンドウに入っているか(RFC 793 Section 3.3)
+func (t *TCPConnection) acceptableLocked(tcp *layers.TCP) bool {
+	segLen := uint32(len(tcp.Payload))
+	if tcp.SYN {
+		segLen++
+	}
+	if tcp.FIN {
+		segLen++
+	}
+	wnd := t.rcvWindowLocked()
+	inWindow := func(seq uint32) bool {
+		return seqLEQ(t.rcvNxt, seq) && seqLT(seq, t.rcvNxt+wnd)
+	}
+
+	switch {
+	case segLen == 0 && wnd == 0:
+		return tcp.Seq == t.rcvNxt
+	case segLen == 0:
+		return inWindow(tcp.Seq)
+	case wnd == 0:
+		return false
+	default:
+		return inWindow(tcp.Seq) || inWindow(tcp.Seq+segLen-1)
+	}
+}
+
+// ACKで送信側の状態を進める．falseならこのセグメントの処理をやめる
+func (t *TCPConnection) handleAckLocked(tcp *layers.TCP, opts tcpOptions) bool {
+	if t.state == StateSynReceived {
+		if seqLT(t.sndUna, tcp.Ack) && seqLEQ(tcp.Ack, t.sndNxt) {
+			t.setStateLocked(StateEstablished)
+		} else {
+			t.sendTCPPacket(newTCPHeader(t.srcPort, t.dstPort, tcp.Ack, 0, flagRST, 0), nil)
+			return false
+		}
+	}
+
+	if seqGT(tcp.Ack, t.sndNxt) {
+		// まだ送っていないデータへのACK
+		t.sendAckLocked()
+		return false
+	}
+	t.markSackedLocked(opts.sack)
+	if seqLT(t.sndUna, tcp.Ack) {
+		acked := int(tcp.Ack - t.sndUna)
+		t.sndUna = tcp.Ack
+		t.timestampRTTLocked(opts)
+		t.ackedLocked(tcp.Ack)
+		t.onNewAckLocked(acked)
+		// 送信バッファに空きができた
+		t.wakeLocked()
+	} else if t.isDupAckLocked(tcp.Ack, uint32(tcp.Window)<<t.sndWscale, len(tcp.Payload), tcp.SYN, tcp.FIN) {
+		t.onDupAckLocked()
+	}
+	if seqLEQ(t.sndUna, tcp.Ack) {
+		t.updateWindowLocked(tcp)
+	}
+	// ウィンドウが開いた分だけ送信バッファのデータを送る
+	t.pushLocked()
+
+	finAcked := t.finSent && t.sndUna == t.sndNxt
+	switch t.state {
+	case StateFinWait1:
+		if finAcked {
+			t.setStateLocked(StateFinWait2)
+		}
+	case StateClosing:
+		if finAcked {
+			t.enterTimeWaitLocked()
+		}
+	case StateLastAck:
+		if finAcked {
+			t.closeLocked()
+			return false
+		}
+	}
+	return true
+}
+
+// 相手のFINを受け取る
+func (t *TCPConnection) handleFinLocked() {
+	t.rcvNxt++
+	t.finReceived = true
+	t.sendAckLocked()
+	// Readで待っている側にEOFを知らせる
+	t.wakeLocked()
+
+	switch t.state {
+	case StateSynReceived, StateEstablished:
+		t.setStateLocked(StateCloseWait)
+	case StateFinWait1:
+		// 自分のFINがまだ確認応答されていなければ同時クローズ
+		if t.finSent && t.sndUna == t.sndNxt {
+			t.enterTimeWaitLocked()
+		} else {
+			t.setStateLocked(StateClosing)
+		}
+	case StateFinWait2, StateTimeWait:
+		t.enterTimeWaitLocked()
+	}
+}
+
+// TIME_WAITに入り，2MSL後にCLOSEDにする(すでにTIME_WAITならタイマをやり直す)
+func (t *TCPConnection) enterTimeWaitLocked() {
+	t.setStateLocked(StateTimeWait)
+	if t.timeWaitTimer != nil {
+		t.timeWaitTimer.Stop()
+	}
+	t.timeWaitTimer = t.stack.clock.AfterFunc(t.timeWait, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.state == StateTimeWait {
+			t.closeLocked()
+		}
+	})
+}
+
+// どの接続にも属さないセグメントにRSTを返す(RFC 793 Section 3.4 Reset Generation)
+func (s *Stack) sendTCPReset(seg *tcpSegment) {
+	tcp := seg.tcp
+	if tcp.RST {
+		return
+	}
+
+	var rst *layers.TCP
+	if tcp.ACK {
+		rst = newTCPHeader(uint16(tcp.DstPort), uint16(tcp.SrcPort), tcp.Ack, 0, flagRST, 0)
+	} else {
+		segLen := uint32(len(tcp.Payload))
+		if tcp.SYN {
+			segLen++
+		}
+		if tcp.FIN {
+			segLen++
+		}
+		rst = newTCPHeader(uint16(tcp.DstPort), uint16(tcp.SrcPort), 0, tcp.Seq+segLen, flagRST|flagACK, 0)
+	}
+	s.traceSegment(TCPTraceSend, tcpKey{
+		localAddr:  ipAddr(seg.dst),
+		localPort:  uint16(tcp.DstPort),
+		remoteAddr: ipAddr(seg.src),
+		remotePort: uint16(tcp.SrcPort),
+	}, rst, 0)
+	s.sendIP(seg.dst, seg.src, layers.IPProtocolTCP, rst)
+}
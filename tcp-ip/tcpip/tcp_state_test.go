@@ -0,0 +1,264 @@
+package tcpip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// 仮想時計とスイッチでつないだ2つのスタックと，その間のTCP接続
+type tcpPair struct {
+	clock  *VirtualClock
+	ports  []*SwitchPort
+	sa, sb *Stack
+	// それぞれのスタックの状態遷移とセグメント
+	ta, tb *TCPTrace
+	a, b   *TCPConnection
+}
+
+func newTCPPair(t *testing.T) *tcpPair {
+	t.Helper()
+	clock := NewVirtualClock(time.Unix(1000, 0))
+	stacks, ports := switchStacks(t, clock, NewSwitch(clock, 1), 2)
+	p := &tcpPair{clock: clock, ports: ports, sa: stacks[0], sb: stacks[1], ta: NewTCPTrace(), tb: NewTCPTrace()}
+	// 遅延を入れても時計を進めずに送れるよう，互いのMACアドレスを登録しておく
+	if err := p.sa.Neighbors().AddStatic(net.IPv4(10, 1, 0, 2), ports[1].HardwareAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.sb.Neighbors().AddStatic(net.IPv4(10, 1, 0, 1), ports[0].HardwareAddr()); err != nil {
+		t.Fatal(err)
+	}
+	p.sa.SetTCPTracer(p.ta)
+	p.sb.SetTCPTracer(p.tb)
+	return p
+}
+
+// 両方のポートの障害を設定する
+func (p *tcpPair) impair(imp Impairment) {
+	for _, port := range p.ports {
+		port.SetImpairment(imp)
+	}
+}
+
+// aから能動オープンし，bのリスナで受動オープンする
+func (p *tcpPair) dial(t *testing.T) {
+	t.Helper()
+	l, err := p.sb.Listen(nil, 80, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	c, err := p.sa.DialContext(context.Background(), "tcp", "10.1.0.2:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.a = c.(*TCPConnection)
+	// 最後のACKをbが処理するのを待つ
+	p.clock.Advance(0)
+	if p.b, err = l.AcceptTCP(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 両側から同時にSYNを送る
+func (p *tcpPair) openSimultaneous(t *testing.T) {
+	t.Helper()
+	p.a = NewTCP(p.sa, 1000)
+	p.b = NewTCP(p.sb, 2000)
+	// 相手のSYNにRSTを返さないよう，先にエンドポイントを登録する
+	if err := p.a.setupConnection(context.Background(), "10.1.0.2", 2000); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.b.setupConnection(context.Background(), "10.1.0.1", 1000); err != nil {
+		t.Fatal(err)
+	}
+	// SYNが行き違うように遅延させる
+	p.impair(Impairment{Delay: 10 * time.Millisecond})
+	errc := make(chan error, 2)
+	go func() { errc <- p.a.connect(context.Background(), "10.1.0.2", 2000) }()
+	go func() { errc <- p.b.connect(context.Background(), "10.1.0.1", 1000) }()
+	for _, c := range []*TCPConnection{p.a, p.b} {
+		if err := c.WaitState(time.Second, StateSynSent); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.clock.Advance(20 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.impair(Impairment{})
+}
+
+// 能動クローズしてaをTIME_WAITにする
+func (p *tcpPair) closeActive() {
+	p.a.Close()
+	p.clock.Advance(0)
+	p.b.Close()
+	p.clock.Advance(0)
+}
+
+// トレースに記録した状態遷移の行き先
+func transitions(tr *TCPTrace) []TCPState {
+	var states []TCPState
+	for _, ev := range tr.Events() {
+		if ev.Kind == TCPTraceState {
+			states = append(states, ev.To)
+		}
+	}
+	return states
+}
+
+func TestTCPStateTransitions(t *testing.T) {
+	established := []TCPState{StateSynSent, StateEstablished}
+	accepted := []TCPState{StateSynReceived, StateEstablished}
+	for _, tc := range []struct {
+		name         string
+		run          func(t *testing.T, p *tcpPair)
+		wantA, wantB []TCPState
+	}{
+		{
+			name:  "能動オープンと受動オープン",
+			run:   func(t *testing.T, p *tcpPair) { p.dial(t) },
+			wantA: established,
+			wantB: accepted,
+		},
+		{
+			name:  "同時オープン",
+			run:   func(t *testing.T, p *tcpPair) { p.openSimultaneous(t) },
+			wantA: []TCPState{StateSynSent, StateSynReceived, StateEstablished},
+			wantB: []TCPState{StateSynSent, StateSynReceived, StateEstablished},
+		},
+		{
+			name: "能動クローズと受動クローズ",
+			run: func(t *testing.T, p *tcpPair) {
+				p.dial(t)
+				p.closeActive()
+			},
+			wantA: append(established, StateFinWait1, StateFinWait2, StateTimeWait),
+			wantB: append(accepted, StateCloseWait, StateLastAck, StateClosed),
+		},
+		{
+			name: "同時クローズ",
+			run: func(t *testing.T, p *tcpPair) {
+				p.dial(t)
+				// FINが行き違うように遅延させる
+				p.impair(Impairment{Delay: 10 * time.Millisecond})
+				p.a.Close()
+				p.b.Close()
+				p.clock.Advance(20 * time.Millisecond)
+			},
+			wantA: append(established, StateFinWait1, StateClosing, StateTimeWait),
+			wantB: append(accepted, StateFinWait1, StateClosing, StateTimeWait),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTCPPair(t)
+			tc.run(t, p)
+			if got := transitions(p.ta); fmt.Sprint(got) != fmt.Sprint(tc.wantA) {
+				t.Errorf("aの状態遷移: %v, 期待: %v", got, tc.wantA)
+			}
+			if got := transitions(p.tb); fmt.Sprint(got) != fmt.Sprint(tc.wantB) {
+				t.Errorf("bの状態遷移: %v, 期待: %v", got, tc.wantB)
+			}
+		})
+	}
+}
+
+// 同期した状態でウィンドウ内のRSTを受け取ると，どの状態からでもすぐにCLOSEDになる(RFC 793 Section 3.9)
+// 相手が閉じる前ならErrConnectionResetを記録する
+func TestTCPResetInSynchronizedStates(t *testing.T) {
+	// bが送るセグメントを捨てる
+	dropB := func(p *tcpPair) { p.ports[1].SetImpairment(Impairment{Loss: 1}) }
+	for _, tc := range []struct {
+		state   TCPState
+		prepare func(p *tcpPair)
+		err     error
+	}{
+		{StateEstablished, func(p *tcpPair) {}, ErrConnectionReset},
+		{StateFinWait1, func(p *tcpPair) {
+			// FINへのACKが届かない
+			dropB(p)
+			p.a.Close()
+		}, ErrConnectionReset},
+		{StateFinWait2, func(p *tcpPair) { p.a.Close() }, ErrConnectionReset},
+		{StateCloseWait, func(p *tcpPair) { p.b.Close() }, ErrConnectionReset},
+		{StateClosing, func(p *tcpPair) {
+			// FINは行き違い，bのACKは届かない
+			p.impair(Impairment{Delay: 10 * time.Millisecond})
+			p.a.Close()
+			p.b.Close()
+			dropB(p)
+			p.clock.Advance(10 * time.Millisecond)
+		}, nil},
+		{StateLastAck, func(p *tcpPair) {
+			p.b.Close()
+			p.clock.Advance(0)
+			dropB(p)
+			p.a.Close()
+		}, nil},
+		{StateTimeWait, func(p *tcpPair) { p.closeActive() }, nil},
+	} {
+		t.Run(tc.state.String(), func(t *testing.T) {
+			p := newTCPPair(t)
+			p.dial(t)
+			tc.prepare(p)
+			p.clock.Advance(0)
+			if st := p.a.State(); st != tc.state {
+				t.Fatalf("RSTを送る前の状態: %v", st)
+			}
+
+			// bのスタックから，aが次に受け取るシーケンス番号でRSTを送る
+			p.impair(Impairment{})
+			p.a.mu.Lock()
+			rst := newTCPHeader(p.b.srcPort, p.a.srcPort, p.a.rcvNxt, 0, flagRST, 0)
+			p.a.mu.Unlock()
+			if err := p.sb.sendIP(p.b.srcIP, p.a.srcIP, layers.IPProtocolTCP, rst); err != nil {
+				t.Fatal(err)
+			}
+			p.clock.Advance(0)
+
+			if st := p.a.State(); st != StateClosed {
+				t.Fatalf("RSTを受け取った後の状態: %v", st)
+			}
+			p.a.mu.Lock()
+			err := p.a.err
+			p.a.mu.Unlock()
+			if !errors.Is(err, tc.err) || (tc.err == nil && err != nil) {
+				t.Fatalf("エラー: %v, 期待: %v", err, tc.err)
+			}
+		})
+	}
+}
+
+// TIME_WAITは2MSL経つまで続く
+func TestTCPTimeWaitExpires(t *testing.T) {
+	p := newTCPPair(t)
+	p.dial(t)
+	p.closeActive()
+	if st := p.a.State(); st != StateTimeWait {
+		t.Fatalf("状態: %v", st)
+	}
+
+	p.clock.Advance(2*msl - time.Millisecond)
+	if st := p.a.State(); st != StateTimeWait {
+		t.Fatalf("2MSLより前に%vになりました", st)
+	}
+	p.clock.Advance(time.Millisecond)
+	if st := p.a.State(); st != StateClosed {
+		t.Fatalf("2MSL後の状態: %v", st)
+	}
+	// 登録を外したので，同じ4つ組で新しく接続できる
+	p.sa.mu.RLock()
+	_, ok := p.sa.tcp[p.a.key]
+	p.sa.mu.RUnlock()
+	if ok {
+		t.Fatal("TIME_WAITが終わってもエンドポイントが残っています")
+	}
+}
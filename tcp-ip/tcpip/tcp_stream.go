@@ -0,0 +1,169 @@
+package tcpip
+
+import (
+	"io"
+	"net"
+	"os"
+
+	"github.com/google/gopacket/layers"
+)
+
+// MTUがわからないときのMSS(RFC 1122 Section 4.2.2.6)
+const defaultMSS = 536
+
+// IPv4ヘッダ(20バイト)とTCPヘッダ(20バイト)の長さ
+const tcpIPv4HeaderLen = 40
+
+// IPv6ヘッダ(40バイト)とTCPヘッダ(20バイト)の長さ
+const tcpIPv6HeaderLen = 60
+
+// インタフェースのMTUと宛先のファミリから決めたMSS
+func mssFor(nic *NIC, dstIP net.IP) int {
+	headerLen := tcpIPv4HeaderLen
+	if isIPv6(dstIP) {
+		headerLen = tcpIPv6HeaderLen
+	}
+	mss := nic.MTU() - headerLen
+	if mss <= 0 {
+		return defaultMSS
+	}
+	return mss
+}
+
+// 受信したデータを読む
+// データが届くまで待ち，相手がFINを送ってきて読むものがなくなったらio.EOFを返す
+func (t *TCPConnection) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		if deadlineExceeded(t.stack.clock, t.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		if len(t.rcvBuf) > 0 {
+			n := copy(b, t.rcvBuf)
+			t.rcvBuf = t.rcvBuf[n:]
+			t.windowUpdateLocked()
+			return n, nil
+		}
+		if t.finReceived {
+			return 0, io.EOF
+		}
+		if t.state == StateClosed {
+			if t.err != nil {
+				return 0, t.err
+			}
+			return 0, ErrConnectionClosed
+		}
+		t.waitLocked()
+	}
+}
+
+// データを送信バッファに入れ，相手の受信ウィンドウに入る分をMSSごとのセグメントに分けて送る
+// 接続の確立中なら確立するまで待ち，送信バッファがいっぱいなら空くまで待つ
+func (t *TCPConnection) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.waitHandshakeLocked()
+
+	written := 0
+	for written < len(b) {
+		if deadlineExceeded(t.stack.clock, t.writeDeadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+		if t.state != StateEstablished && t.state != StateCloseWait {
+			if t.err != nil {
+				return written, t.err
+			}
+			return written, ErrConnectionClosed
+		}
+
+		// 送信バッファの空き(確認応答を待っているデータも含めて数える)
+		free := t.sndBufSize - len(t.sndBuf) - int(t.sndNxt-t.sndUna)
+		if free <= 0 {
+			t.waitLocked()
+			continue
+		}
+		n := len(b) - written
+		if n > free {
+			n = free
+		}
+		t.sndBuf = append(t.sndBuf, b[written:written+n]...)
+		written += n
+		t.pushLocked()
+	}
+	return written, nil
+}
+
+// ロックを外して，状態やバッファが変わるまで待つ
+func (t *TCPConnection) waitLocked() {
+	changed := t.changed
+	t.mu.Unlock()
+	<-changed
+	t.mu.Lock()
+}
+
+// データを受け取り，順番どおりにそろった分を受信バッファへ入れて確認応答する
+func (t *TCPConnection) receiveDataLocked(tcp *layers.TCP) {
+	switch t.state {
+	case StateEstablished, StateFinWait1, StateFinWait2:
+	default:
+		return
+	}
+
+	seq, data := tcp.Seq, tcp.Payload
+	// すでに受け取った部分を切り落とす
+	if seqLT(seq, t.rcvNxt) {
+		data = data[t.rcvNxt-seq:]
+		seq = t.rcvNxt
+	}
+	// 受信ウィンドウからはみ出した部分を切り落とす(相手が再送してくる)
+	if room := t.rcvWindowLocked() - (seq - t.rcvNxt); uint32(len(data)) > room {
+		data = data[:room]
+	}
+	if len(data) == 0 {
+		t.sendAckLocked()
+		return
+	}
+
+	if seq == t.rcvNxt {
+		t.rcvBuf = append(t.rcvBuf, data...)
+		t.rcvNxt += uint32(len(data))
+		t.reassembleLocked()
+		t.wakeLocked()
+	} else {
+		// 順番を追い越したセグメントは，受信したパケットのバッファを参照しないようにコピーして取っておく
+		if t.rcvOutOfOrder == nil {
+			t.rcvOutOfOrder = make(map[uint32][]byte)
+		}
+		t.lastOutOfOrder = seq
+		if len(data) > len(t.rcvOutOfOrder[seq]) {
+			t.rcvOutOfOrder[seq] = append([]byte(nil), data...)
+		}
+	}
+	t.sendAckLocked()
+}
+
+// 取っておいたセグメントのうち，rcvNxtにつながるものを受信バッファへ移す
+func (t *TCPConnection) reassembleLocked() {
+	for progressed := true; progressed; {
+		progressed = false
+		for seq, data := range t.rcvOutOfOrder {
+			end := seq + uint32(len(data))
+			if seqGT(seq, t.rcvNxt) {
+				continue
+			}
+			delete(t.rcvOutOfOrder, seq)
+			if seqLEQ(end, t.rcvNxt) {
+				// すでに受け取った範囲
+				continue
+			}
+			t.rcvBuf = append(t.rcvBuf, data[t.rcvNxt-seq:]...)
+			t.rcvNxt = end
+			progressed = true
+		}
+	}
+}
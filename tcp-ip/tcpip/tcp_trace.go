@@ -0,0 +1,384 @@
+package tcpip
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// トレースで接続を区別する自分側と相手側のアドレスとポート
+type TCPFlow struct {
+	Local  netip.AddrPort
+	Remote netip.AddrPort
+}
+
+func (f TCPFlow) String() string {
+	return fmt.Sprintf("%v - %v", f.Local, f.Remote)
+}
+
+func flowOf(key tcpKey) TCPFlow {
+	return TCPFlow{
+		Local:  netip.AddrPortFrom(key.localAddr, key.localPort),
+		Remote: netip.AddrPortFrom(key.remoteAddr, key.remotePort),
+	}
+}
+
+// トレースのイベントの種類
+type TCPTraceKind int
+
+const (
+	// セグメントを送った
+	TCPTraceSend TCPTraceKind = iota
+	// セグメントを受け取った(接続に配る前)
+	TCPTraceReceive
+	// 接続の状態が変わった
+	TCPTraceState
+)
+
+func (k TCPTraceKind) String() string {
+	switch k {
+	case TCPTraceSend:
+		return "送信"
+	case TCPTraceReceive:
+		return "受信"
+	case TCPTraceState:
+		return "状態"
+	}
+	return fmt.Sprintf("TCPTraceKind(%d)", int(k))
+}
+
+// トレースの1つのイベント
+type TCPTraceEvent struct {
+	// スタックの時計の時刻
+	Time time.Time
+	Flow TCPFlow
+	Kind TCPTraceKind
+
+	// セグメントのフラグ("SYNACK"など)，シーケンス番号，確認応答番号，ウィンドウ(ヘッダの値)とデータの長さ
+	Flags  string
+	Seq    uint32
+	Ack    uint32
+	Window uint16
+	Len    int
+
+	// 状態遷移の前後
+	From TCPState
+	To   TCPState
+}
+
+// TCPのセグメントと状態遷移を受け取るフック
+// スタックの受信ゴルーチンや接続のロックを持ったまま呼ばれるので，すぐに返すこと
+type TCPTracer interface {
+	TraceTCP(ev TCPTraceEvent)
+}
+
+// スタックのすべてのTCP接続のセグメントと状態遷移をtrに渡す．nilならトレースをやめる
+func (s *Stack) SetTCPTracer(tr TCPTracer) {
+	s.mu.Lock()
+	s.tcpTracer = tr
+	s.mu.Unlock()
+}
+
+// イベントに時刻を付けてトレーサに渡す
+func (s *Stack) traceTCP(ev TCPTraceEvent) {
+	s.mu.RLock()
+	tr := s.tcpTracer
+	s.mu.RUnlock()
+	if tr == nil {
+		return
+	}
+	ev.Time = s.clock.Now()
+	tr.TraceTCP(ev)
+}
+
+// 送受信したセグメントをトレースする．送るヘッダにはデータが付いていないので，データの長さは別に渡す
+func (s *Stack) traceSegment(kind TCPTraceKind, key tcpKey, tcp *layers.TCP, payloadLen int) {
+	s.traceTCP(TCPTraceEvent{
+		Flow:   flowOf(key),
+		Kind:   kind,
+		Flags:  flagsOf(tcp).String(),
+		Seq:    tcp.Seq,
+		Ack:    tcp.Ack,
+		Window: tcp.Window,
+		Len:    payloadLen,
+	})
+}
+
+// イベントをメモリに記録し，接続ごとのシーケンス図にするトレーサ
+type TCPTrace struct {
+	mu     sync.Mutex
+	events []TCPTraceEvent
+}
+
+// 空のトレースを作成
+func NewTCPTrace() *TCPTrace {
+	return &TCPTrace{}
+}
+
+func (tr *TCPTrace) TraceTCP(ev TCPTraceEvent) {
+	tr.mu.Lock()
+	tr.events = append(tr.events, ev)
+	tr.mu.Unlock()
+}
+
+// 記録したすべてのイベント(記録した順)
+func (tr *TCPTrace) Events() []TCPTraceEvent {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return append([]TCPTraceEvent(nil), tr.events...)
+}
+
+// 記録した接続(最初にイベントがあった順)
+func (tr *TCPTrace) Flows() []TCPFlow {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	var flows []TCPFlow
+	seen := make(map[TCPFlow]bool)
+	for _, ev := range tr.events {
+		if !seen[ev.Flow] {
+			seen[ev.Flow] = true
+			flows = append(flows, ev.Flow)
+		}
+	}
+	return flows
+}
+
+// 記録したイベントを捨てる
+func (tr *TCPTrace) Reset() {
+	tr.mu.Lock()
+	tr.events = nil
+	tr.mu.Unlock()
+}
+
+// シーケンス図の形式
+type TCPDiagramFormat int
+
+const (
+	// 端末で読めるテキストの図
+	TCPDiagramASCII TCPDiagramFormat = iota
+	// Mermaidの sequenceDiagram (GitHubのMarkdownで表示できる)
+	TCPDiagramMermaid
+	// PlantUMLのシーケンス図
+	TCPDiagramPlantUML
+)
+
+// 1つの接続のイベントをシーケンス図としてwに書く
+// 左が自分側，右が相手側で，状態遷移は自分側の注釈になる．
+// SYNを記録していれば，シーケンス番号と確認応答番号はISNからの相対値で表す(Wiresharkと同じ)
+func (tr *TCPTrace) WriteDiagram(w io.Writer, flow TCPFlow, format TCPDiagramFormat) error {
+	var events []TCPTraceEvent
+	for _, ev := range tr.Events() {
+		if ev.Flow == flow {
+			events = append(events, ev)
+		}
+	}
+	d := newTCPDiagram(flow, events)
+	switch format {
+	case TCPDiagramASCII:
+		return d.writeASCII(w)
+	case TCPDiagramMermaid:
+		return d.writeMermaid(w)
+	case TCPDiagramPlantUML:
+		return d.writePlantUML(w)
+	}
+	return fmt.Errorf("未対応のシーケンス図の形式です: %d", format)
+}
+
+// シーケンス図の1行
+type diagramRow struct {
+	time time.Duration
+	// 状態遷移なら注釈，そうでなければ矢印
+	note    string
+	label   string
+	send    bool
+	retrans bool
+}
+
+// 描く形式によらない図の中身
+type tcpDiagram struct {
+	local, remote string
+	rows          []diagramRow
+}
+
+func newTCPDiagram(flow TCPFlow, events []TCPTraceEvent) *tcpDiagram {
+	d := &tcpDiagram{local: flow.Local.String(), remote: flow.Remote.String()}
+	if len(events) == 0 {
+		return d
+	}
+
+	// 向きごとのISN(最初のSYNのシーケンス番号)
+	var localISN, remoteISN uint32
+	var localSYN, remoteSYN bool
+	for _, ev := range events {
+		if !strings.Contains(ev.Flags, "SYN") {
+			continue
+		}
+		switch {
+		case ev.Kind == TCPTraceSend && !localSYN:
+			localISN, localSYN = ev.Seq, true
+		case ev.Kind == TCPTraceReceive && !remoteSYN:
+			remoteISN, remoteSYN = ev.Seq, true
+		}
+	}
+
+	// 自分が送った最も大きいシーケンス番号．それより前を送り直したら再送
+	var sndMax uint32
+	sent := false
+	start := events[0].Time
+	for _, ev := range events {
+		row := diagramRow{time: ev.Time.Sub(start)}
+		if ev.Kind == TCPTraceState {
+			row.note = fmt.Sprintf("%v -> %v", ev.From, ev.To)
+			d.rows = append(d.rows, row)
+			continue
+		}
+
+		seq, ack := ev.Seq, ev.Ack
+		row.send = ev.Kind == TCPTraceSend
+		if row.send {
+			if localSYN {
+				seq -= localISN
+			}
+			if remoteSYN {
+				ack -= remoteISN
+			}
+			segLen := uint32(ev.Len)
+			if strings.Contains(ev.Flags, "SYN") || strings.Contains(ev.Flags, "FIN") {
+				segLen++
+			}
+			if segLen > 0 {
+				end := ev.Seq + segLen
+				row.retrans = sent && seqLT(ev.Seq, sndMax)
+				if !sent || seqGT(end, sndMax) {
+					sndMax, sent = end, true
+				}
+			}
+		} else {
+			if remoteSYN {
+				seq -= remoteISN
+			}
+			if localSYN {
+				ack -= localISN
+			}
+		}
+
+		label := fmt.Sprintf("%s seq=%d", ev.Flags, seq)
+		if strings.Contains(ev.Flags, "ACK") {
+			label += fmt.Sprintf(" ack=%d", ack)
+		}
+		label += fmt.Sprintf(" win=%d len=%d", ev.Window, ev.Len)
+		if row.retrans {
+			label += " (再送)"
+		}
+		row.label = label
+		d.rows = append(d.rows, row)
+	}
+	return d
+}
+
+// 端末での表示幅(全角文字は2つ分)
+func displayWidth(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= 0x1100 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// 経過時間(ミリ秒)の列と，自分側と相手側の2本の縦線の間に矢印を描く．再送は点線にする
+func (d *tcpDiagram) writeASCII(w io.Writer) error {
+	// 矢印の幅はいちばん長いラベルに合わせる
+	width := displayWidth(d.local) + displayWidth(d.remote) + 4
+	for _, row := range d.rows {
+		if n := displayWidth(row.label) + 10; n > width {
+			width = n
+		}
+	}
+
+	var b strings.Builder
+	header := "時刻(ms)"
+	fmt.Fprintf(&b, "%s%s  %s%s%s\n", strings.Repeat(" ", 14-displayWidth(header)), header, d.local,
+		strings.Repeat(" ", width+2-displayWidth(d.local)-displayWidth(d.remote)), d.remote)
+	for _, row := range d.rows {
+		ms := float64(row.time) / float64(time.Millisecond)
+		if row.note != "" {
+			fmt.Fprintf(&b, "%14.3f  %s\n", ms, row.note)
+			continue
+		}
+		// ラベルを矢印の中央に置く
+		pad := width - displayWidth(row.label) - 2
+		left := pad / 2
+		right := pad - left
+		line := "-"
+		if row.retrans {
+			line = "."
+		}
+		if row.send {
+			fmt.Fprintf(&b, "%14.3f  |%s %s %s>|\n", ms, strings.Repeat(line, left), row.label, strings.Repeat(line, right-1))
+		} else {
+			fmt.Fprintf(&b, "%14.3f  |<%s %s %s|\n", ms, strings.Repeat(line, left-1), row.label, strings.Repeat(line, right))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Mermaidのシーケンス図．再送は点線の矢印にする
+func (d *tcpDiagram) writeMermaid(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("sequenceDiagram\n")
+	fmt.Fprintf(&b, "    participant L as %s\n", d.local)
+	fmt.Fprintf(&b, "    participant R as %s\n", d.remote)
+	for _, row := range d.rows {
+		if row.note != "" {
+			fmt.Fprintf(&b, "    Note over L: %s\n", strings.Replace(row.note, "->", "→", 1))
+			continue
+		}
+		arrow := "->>"
+		if row.retrans {
+			arrow = "-->>"
+		}
+		if row.send {
+			fmt.Fprintf(&b, "    L%sR: %s\n", arrow, row.label)
+		} else {
+			fmt.Fprintf(&b, "    R%sL: %s\n", arrow, row.label)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// PlantUMLのシーケンス図．再送は点線の矢印にする
+func (d *tcpDiagram) writePlantUML(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("@startuml\n")
+	fmt.Fprintf(&b, "participant \"%s\" as L\n", d.local)
+	fmt.Fprintf(&b, "participant \"%s\" as R\n", d.remote)
+	for _, row := range d.rows {
+		if row.note != "" {
+			fmt.Fprintf(&b, "note over L: %s\n", strings.Replace(row.note, "->", "→", 1))
+			continue
+		}
+		arrow := "->"
+		if row.retrans {
+			arrow = "-->"
+		}
+		if row.send {
+			fmt.Fprintf(&b, "L %s R: %s\n", arrow, row.label)
+		} else {
+			fmt.Fprintf(&b, "R %s L: %s\n", arrow, row.label)
+		}
+	}
+	b.WriteString("@enduml\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
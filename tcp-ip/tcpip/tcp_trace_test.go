@@ -0,0 +1,124 @@
+package tcpip
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+var goldenFlow = TCPFlow{
+	Local:  netip.MustParseAddrPort("10.1.0.1:49152"),
+	Remote: netip.MustParseAddrPort("10.1.0.2:80"),
+}
+
+// 能動オープンしてデータを送り，最初の送信が失われて再送し，能動クローズするまでのトレース
+// ISNは自分側が1000，相手側が5000
+func goldenTrace() *TCPTrace {
+	start := time.Unix(1000, 0)
+	ms := time.Millisecond
+	tr := NewTCPTrace()
+	for _, ev := range []TCPTraceEvent{
+		{Time: start, Kind: TCPTraceState, From: StateClosed, To: StateSynSent},
+		{Time: start, Kind: TCPTraceSend, Flags: "SYN", Seq: 1000, Window: 65535},
+		{Time: start.Add(10 * ms), Kind: TCPTraceReceive, Flags: "SYNACK", Seq: 5000, Ack: 1001, Window: 65535},
+		{Time: start.Add(10 * ms), Kind: TCPTraceState, From: StateSynSent, To: StateEstablished},
+		{Time: start.Add(10 * ms), Kind: TCPTraceSend, Flags: "ACK", Seq: 1001, Ack: 5001, Window: 65535},
+		{Time: start.Add(10 * ms), Kind: TCPTraceSend, Flags: "PSHACK", Seq: 1001, Ack: 5001, Window: 65535, Len: 5},
+		{Time: start.Add(210500 * time.Microsecond), Kind: TCPTraceSend, Flags: "PSHACK", Seq: 1001, Ack: 5001, Window: 65535, Len: 5},
+		{Time: start.Add(220500 * time.Microsecond), Kind: TCPTraceReceive, Flags: "ACK", Seq: 5001, Ack: 1006, Window: 65530},
+		{Time: start.Add(230 * ms), Kind: TCPTraceSend, Flags: "FINACK", Seq: 1006, Ack: 5001, Window: 65535},
+		{Time: start.Add(230 * ms), Kind: TCPTraceState, From: StateEstablished, To: StateFinWait1},
+		{Time: start.Add(240 * ms), Kind: TCPTraceReceive, Flags: "ACK", Seq: 5001, Ack: 1007, Window: 65530},
+	} {
+		ev.Flow = goldenFlow
+		tr.TraceTCP(ev)
+	}
+	// 他の接続のイベントは図に入らない
+	tr.TraceTCP(TCPTraceEvent{Time: start, Flow: TCPFlow{Local: goldenFlow.Local, Remote: netip.MustParseAddrPort("10.1.0.3:80")}, Kind: TCPTraceSend, Flags: "SYN", Seq: 77})
+	return tr
+}
+
+func TestTCPDiagramGolden(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		format TCPDiagramFormat
+		want   string
+	}{
+		{"ASCII", TCPDiagramASCII, `      時刻(ms)  10.1.0.1:49152                            10.1.0.2:80
+         0.000  CLOSED -> SYN_SENT
+         0.000  |------------ SYN seq=0 win=65535 len=0 ----------->|
+        10.000  |<------ SYNACK seq=0 ack=1 win=65535 len=0 --------|
+        10.000  SYN_SENT -> ESTABLISHED
+        10.000  |--------- ACK seq=1 ack=1 win=65535 len=0 -------->|
+        10.000  |------- PSHACK seq=1 ack=1 win=65535 len=5 ------->|
+       210.500  |.... PSHACK seq=1 ack=1 win=65535 len=5 (再送) ...>|
+       220.500  |<-------- ACK seq=1 ack=6 win=65530 len=0 ---------|
+       230.000  |------- FINACK seq=6 ack=1 win=65535 len=0 ------->|
+       230.000  ESTABLISHED -> FIN_WAIT_1
+       240.000  |<-------- ACK seq=1 ack=7 win=65530 len=0 ---------|
+`},
+		{"Mermaid", TCPDiagramMermaid, `sequenceDiagram
+    participant L as 10.1.0.1:49152
+    participant R as 10.1.0.2:80
+    Note over L: CLOSED → SYN_SENT
+    L->>R: SYN seq=0 win=65535 len=0
+    R->>L: SYNACK seq=0 ack=1 win=65535 len=0
+    Note over L: SYN_SENT → ESTABLISHED
+    L->>R: ACK seq=1 ack=1 win=65535 len=0
+    L->>R: PSHACK seq=1 ack=1 win=65535 len=5
+    L-->>R: PSHACK seq=1 ack=1 win=65535 len=5 (再送)
+    R->>L: ACK seq=1 ack=6 win=65530 len=0
+    L->>R: FINACK seq=6 ack=1 win=65535 len=0
+    Note over L: ESTABLISHED → FIN_WAIT_1
+    R->>L: ACK seq=1 ack=7 win=65530 len=0
+`},
+		{"PlantUML", TCPDiagramPlantUML, `@startuml
+participant "10.1.0.1:49152" as L
+participant "10.1.0.2:80" as R
+note over L: CLOSED → SYN_SENT
+L -> R: SYN seq=0 win=65535 len=0
+R -> L: SYNACK seq=0 ack=1 win=65535 len=0
+note over L: SYN_SENT → ESTABLISHED
+L -> R: ACK seq=1 ack=1 win=65535 len=0
+L -> R: PSHACK seq=1 ack=1 win=65535 len=5
+L --> R: PSHACK seq=1 ack=1 win=65535 len=5 (再送)
+R -> L: ACK seq=1 ack=6 win=65530 len=0
+L -> R: FINACK seq=6 ack=1 win=65535 len=0
+note over L: ESTABLISHED → FIN_WAIT_1
+R -> L: ACK seq=1 ack=7 win=65530 len=0
+@enduml
+`},
+	} {
+		var b bytes.Buffer
+		if err := goldenTrace().WriteDiagram(&b, goldenFlow, tc.format); err != nil {
+			t.Fatal(err)
+		}
+		if got := b.String(); got != tc.want {
+			t.Errorf("%s:\n%s\n期待:\n%s", tc.name, got, tc.want)
+		}
+	}
+	if err := goldenTrace().WriteDiagram(&bytes.Buffer{}, goldenFlow, TCPDiagramFormat(99)); err == nil {
+		t.Error("未対応の形式でエラーになりません")
+	}
+}
+
+// 能動オープンではSYN_SENTに移ってからSYNを送る
+func TestTCPTraceConnect(t *testing.T) {
+	p := newTCPPair(t)
+	p.dial(t)
+	events := p.ta.Events()
+	if len(events) < 2 {
+		t.Fatalf("イベント: %v", events)
+	}
+	if ev := events[0]; ev.Kind != TCPTraceState || ev.From != StateClosed || ev.To != StateSynSent {
+		t.Fatalf("最初のイベント: %+v", ev)
+	}
+	if ev := events[1]; ev.Kind != TCPTraceSend || ev.Flags != "SYN" || ev.Seq != p.a.iss {
+		t.Fatalf("2つ目のイベント: %+v", ev)
+	}
+	flows := p.ta.Flows()
+	if len(flows) != 1 || flows[0].Remote != netip.MustParseAddrPort("10.1.0.2:80") {
+		t.Fatalf("接続: %v", flows)
+	}
+}
@@ -0,0 +1,202 @@
+package tcpip
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket/layers"
+)
+
+// TCPヘッダのウィンドウ(16bit)で通知できる最大値
+const maxWindow = 65535
+
+// TCP接続の設定
+type TCPConfig struct {
+	// 送信バッファの大きさ．送ったが確認応答されていないデータと，まだ送っていないデータの合計
+	SendBufferSize int
+	// 受信バッファの大きさ．空いている分を受信ウィンドウとして相手に通知する
+	ReceiveBufferSize int
+	// 同じセグメントを再送する回数の上限
+	MaxRetries int
+	// 輻輳制御アルゴリズムの名前("reno"，"newreno"，"cubic")
+	CongestionControl string
+	// SYNでウィンドウスケール，SACK，タイムスタンプを申し出ない
+	DisableWindowScale bool
+	DisableSACK        bool
+	DisableTimestamps  bool
+}
+
+// TCP接続の設定の既定値
+var DefaultTCPConfig = TCPConfig{
+	SendBufferSize:    64 * 1024,
+	ReceiveBufferSize: 64 * 1024,
+	MaxRetries:        defaultMaxRetries,
+	CongestionControl: "cubic",
+}
+
+// これから作るTCP接続の設定を変更する
+func (s *Stack) SetTCPConfig(config TCPConfig) error {
+	if config.CongestionControl != "" {
+		if _, err := NewCongestionControl(config.CongestionControl); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.tcpConfig = config
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Stack) getTCPConfig() TCPConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	config := s.tcpConfig
+	if config.SendBufferSize <= 0 {
+		config.SendBufferSize = DefaultTCPConfig.SendBufferSize
+	}
+	if config.ReceiveBufferSize <= 0 {
+		config.ReceiveBufferSize = DefaultTCPConfig.ReceiveBufferSize
+	}
+	if config.MaxRetries <= 0 {
+		config.MaxRetries = DefaultTCPConfig.MaxRetries
+	}
+	if config.CongestionControl == "" {
+		config.CongestionControl = DefaultTCPConfig.CongestionControl
+	}
+	return config
+}
+
+// 受信バッファの空き(相手に通知する受信ウィンドウ)
+func (t *TCPConnection) rcvWindowLocked() uint32 {
+	free := t.rcvBufSize - len(t.rcvBuf)
+	if free < 0 {
+		return 0
+	}
+	if limit := maxWindow << t.rcvWscale; free > limit {
+		return uint32(limit)
+	}
+	return uint32(free)
+}
+
+// 相手の受信ウィンドウを更新する
+// 古いセグメントで上書きしないよう，SND.WL1/SND.WL2より新しいセグメントだけを使う(RFC 793 Section 3.9)
+func (t *TCPConnection) updateWindowLocked(tcp *layers.TCP) {
+	if !(seqLT(t.sndWl1, tcp.Seq) || (t.sndWl1 == tcp.Seq && seqLEQ(t.sndWl2, tcp.Ack))) {
+		return
+	}
+	t.sndWnd = uint32(tcp.Window) << t.sndWscale
+	t.sndWl1 = tcp.Seq
+	t.sndWl2 = tcp.Ack
+	if t.sndWnd > 0 {
+		t.stopPersistTimerLocked()
+	}
+}
+
+// 相手の受信ウィンドウに入る分だけ送信バッファのデータを送る
+// Closeされていて送信バッファが空になったらFINも送る
+func (t *TCPConnection) pushLocked() {
+	switch t.state {
+	case StateEstablished, StateCloseWait, StateFinWait1, StateLastAck, StateClosing:
+	default:
+		return
+	}
+
+	for len(t.sndBuf) > 0 {
+		// 相手の受信ウィンドウと輻輳ウィンドウの小さい方のうち，まだ使っていない分
+		wnd := t.sndWnd
+		if cwnd := uint32(t.cc.CongestionWindow()); cwnd < wnd {
+			wnd = cwnd
+		}
+		usable := int(int32(t.sndUna + wnd - t.sndNxt))
+		if usable <= 0 {
+			break
+		}
+		n := len(t.sndBuf)
+		if size := t.segmentSizeLocked(); n > size {
+			n = size
+		}
+		if n > usable {
+			n = usable
+		}
+		flags := flagACK
+		if n == len(t.sndBuf) {
+			// 最後のセグメントにはすぐアプリケーションへ渡すようPSHを付ける
+			flags |= flagPSH
+		}
+		t.sendReliableLocked(flags, t.sndNxt, t.sndBuf[:n])
+		t.sndNxt += uint32(n)
+		t.sndBuf = t.sndBuf[n:]
+	}
+
+	if len(t.sndBuf) == 0 {
+		t.sndBuf = nil
+		if t.finPending {
+			t.sendFinLocked()
+		}
+		return
+	}
+
+	// 送りたいデータがあるのにウィンドウが0で，確認応答を待つセグメントもなければ
+	// 相手のウィンドウが開いたことを知らせるACKが失われても止まらないようパーシストタイマを動かす
+	if t.sndWnd == 0 && len(t.rtxQueue) == 0 && t.persistTimer == nil {
+		t.persistBackoff = t.currentRTOLocked()
+		t.armPersistTimerLocked()
+	}
+}
+
+// パーシストタイマを動かす
+func (t *TCPConnection) armPersistTimerLocked() {
+	gen := t.persistGen
+	t.persistTimer = t.stack.clock.AfterFunc(t.persistBackoff, func() {
+		t.onPersistTimeout(gen)
+	})
+}
+
+// パーシストタイマを止める
+func (t *TCPConnection) stopPersistTimerLocked() {
+	t.persistGen++
+	if t.persistTimer != nil {
+		t.persistTimer.Stop()
+		t.persistTimer = nil
+	}
+}
+
+// パーシストタイマの満了: ゼロウィンドウプローブを送り，間隔を2倍にして待つ
+// 相手がACKを返し続ける限り，ウィンドウが0のままでも接続は切らない(RFC 1122 Section 4.2.2.17)
+func (t *TCPConnection) onPersistTimeout(gen int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if gen != t.persistGen || t.state == StateClosed {
+		return
+	}
+	t.persistTimer = nil
+	if t.sndWnd > 0 || len(t.sndBuf) == 0 {
+		t.pushLocked()
+		return
+	}
+
+	// 受け取り済みのシーケンス番号(SND.UNA-1)でセグメントを送ると，相手は現在のウィンドウを付けたACKを返す
+	fmt.Printf("TCPゼロウィンドウプローブを[%v:%d]へ送信\n", t.dstIP, t.dstPort)
+	t.sendSegmentLocked(flagACK, t.sndUna-1, nil)
+	t.stats.WindowProbes++
+
+	t.persistBackoff = clampRTO(2 * t.persistBackoff)
+	t.armPersistTimerLocked()
+}
+
+// Readで受信バッファが空いたとき，十分に大きくなった受信ウィンドウを相手に知らせる
+// 少しずつ開いたウィンドウを知らせると小さなセグメントばかりになるので，
+// MSSか受信バッファの半分だけ開くまで待つ(RFC 1122 Section 4.2.3.3)
+func (t *TCPConnection) windowUpdateLocked() {
+	switch t.state {
+	case StateEstablished, StateFinWait1, StateFinWait2:
+	default:
+		return
+	}
+	threshold := t.mss
+	if half := t.rcvBufSize / 2; half < threshold {
+		threshold = half
+	}
+	if int(t.rcvWindowLocked())-int(t.rcvAdvertised) >= threshold {
+		t.sendAckLocked()
+	}
+}
@@ -0,0 +1,175 @@
+package tcpip
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// スタックの処理を進めながら，condが成り立つのを待つ
+func (p *tcpPair) poll(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		p.clock.Advance(0)
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%sになりません", what)
+}
+
+// 受信側が読まなくなると，送信側は通知されたウィンドウで止まり，ゼロウィンドウプローブを送り続ける．
+// 読み始めたらウィンドウの更新を受けて送信を再開する
+func TestTCPZeroWindowProbe(t *testing.T) {
+	const rcvBuf, sndBuf = 4000, 8000
+	p := newTCPPair(t)
+	config := DefaultTCPConfig
+	config.SendBufferSize = sndBuf
+	p.sa.SetTCPConfig(config)
+	config = DefaultTCPConfig
+	config.ReceiveBufferSize = rcvBuf
+	p.sb.SetTCPConfig(config)
+	p.dial(t)
+	a, b := p.a, p.b
+
+	// bはSYN+ACKで受信バッファの大きさをウィンドウとして通知する
+	for _, ev := range p.ta.Events() {
+		if ev.Kind == TCPTraceReceive && ev.Flags == "SYNACK" && ev.Window != rcvBuf {
+			t.Fatalf("SYN+ACKのウィンドウ: %d", ev.Window)
+		}
+	}
+
+	msg := make([]byte, 30000)
+	for i := range msg {
+		msg[i] = byte(i * 11)
+	}
+	go func() {
+		a.Write(msg)
+		a.Close()
+	}()
+
+	// bの受信バッファが一杯になり，aは残りを送信バッファに溜めて止まる
+	p.poll(t, "ゼロウィンドウ", func() bool {
+		b.mu.Lock()
+		full := len(b.rcvBuf) == rcvBuf && b.rcvWindowLocked() == 0
+		b.mu.Unlock()
+		a.mu.Lock()
+		stopped := a.sndWnd == 0 && a.sndUna == a.sndNxt && len(a.sndBuf) == sndBuf
+		a.mu.Unlock()
+		return full && stopped
+	})
+	a.mu.Lock()
+	sent := int(a.sndNxt - a.iss - 1)
+	a.mu.Unlock()
+	if sent != rcvBuf {
+		t.Fatalf("ウィンドウを超えて送りました: %dバイト", sent)
+	}
+
+	// パーシストタイマが切れるたびに，間隔を2倍にしながらプローブを送る
+	probes := func() []time.Time {
+		var at []time.Time
+		for _, ev := range p.ta.Events() {
+			if ev.Kind == TCPTraceSend && ev.Len == 0 && ev.Seq == a.iss+rcvBuf {
+				at = append(at, ev.Time)
+			}
+		}
+		return at
+	}
+	for i := 0; i < 4; i++ {
+		if !p.clock.AdvanceToNext() {
+			t.Fatal("パーシストタイマが動いていません")
+		}
+		p.clock.Advance(0)
+	}
+	at := probes()
+	if len(at) != 4 || a.Stats().WindowProbes != 4 {
+		t.Fatalf("プローブ: %v, 統計: %+v", at, a.Stats())
+	}
+	for i := 2; i < len(at); i++ {
+		if got, want := at[i].Sub(at[i-1]), 2*at[i-1].Sub(at[i-2]); got != want {
+			t.Errorf("%d回目のプローブの間隔: %v, 期待: %v", i+1, got, want)
+		}
+	}
+	// プローブに応えても，bの受信バッファは溢れない
+	b.mu.Lock()
+	if len(b.rcvBuf) != rcvBuf {
+		t.Fatalf("受信バッファ: %dバイト", len(b.rcvBuf))
+	}
+	b.mu.Unlock()
+
+	// bが読み始めると，ウィンドウの更新を受けたaが残りを送る
+	done := make(chan []byte, 1)
+	go func() {
+		got, _ := io.ReadAll(b)
+		done <- got
+	}()
+	var got []byte
+	for i := 0; got == nil && i < 10000; i++ {
+		select {
+		case got = <-done:
+		default:
+			p.clock.Advance(0)
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("受信: %dバイト", len(got))
+	}
+	if st := a.Stats(); st.WindowProbes != 4 || st.Timeouts != 0 {
+		t.Fatalf("ウィンドウが開いた後の統計: %+v", st)
+	}
+}
+
+// 受信ウィンドウは受信バッファの空きで，大きく開いたときだけ更新を知らせる
+func TestTCPWindowUpdate(t *testing.T) {
+	p := newTCPPair(t)
+	config := DefaultTCPConfig
+	config.ReceiveBufferSize = 4000
+	p.sb.SetTCPConfig(config)
+	p.dial(t)
+	a, b := p.a, p.b
+	a.Write(make([]byte, 4000))
+	p.poll(t, "ゼロウィンドウ", func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.sndWnd == 0 && a.sndUna == a.sndNxt
+	})
+
+	// 少し読んだだけでは知らせない(しきい値は受信バッファの半分)
+	acks := func() int {
+		n := 0
+		for _, ev := range p.tb.Events() {
+			if ev.Kind == TCPTraceSend && ev.Flags == "ACK" && ev.Len == 0 {
+				n++
+			}
+		}
+		return n
+	}
+	before := acks()
+	if _, err := io.ReadFull(b, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	p.clock.Advance(0)
+	if n := acks(); n != before {
+		t.Fatalf("1000バイト空いただけでウィンドウの更新を送りました")
+	}
+	b.mu.Lock()
+	if w := b.rcvWindowLocked(); w != 1000 {
+		t.Fatalf("受信ウィンドウ: %d", w)
+	}
+	b.mu.Unlock()
+
+	if _, err := io.ReadFull(b, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	p.poll(t, "ウィンドウの更新", func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.sndWnd == 2000
+	})
+	if n := acks(); n != before+1 {
+		t.Fatalf("ウィンドウの更新: %d回", n-before)
+	}
+}
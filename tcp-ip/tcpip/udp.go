@@ -6,7 +6,6 @@ import (
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 )
 
 // UDPパケットの構造体
@@ -47,78 +46,83 @@ func NewUDPPacket(srcMAC, dstMAC net.HardwareAddr, srcIP, dstIP net.IP, srcPort,
 	}
 }
 
-// UDPパケットを送信する関数
-func UdpSend(ifaceName string, dstIPStr string, srcPort, dstPort uint16, payload []byte) error {
-	// インタフェース情報を取得
-	iface, err := net.InterfaceByName(ifaceName)
-	if err != nil {
-		return fmt.Errorf("インタフェースの取得に失敗: %v", err)
+// UDPのチェックサムを確かめる(RFC 768)
+// IPv4でチェックサムが0なら送信側が計算していないので確かめない
+func udpChecksumValid(src, dst net.IP, udp *layers.UDP) bool {
+	// IPv6ではチェックサムを省略できない(RFC 8200 Section 8.1)
+	if udp.Checksum == 0 {
+		return !isIPv6(dst)
 	}
-
-	// インタフェースのIPアドレスを取得
-	addrs, err := iface.Addrs()
-	if err != nil {
-		return fmt.Errorf("IPアドレスの取得に失敗: %v", err)
+	if isIPv6(dst) {
+		src, dst = src.To16(), dst.To16()
+	} else {
+		src, dst = src.To4(), dst.To4()
 	}
+	if src == nil || dst == nil {
+		return false
+	}
+	length := len(udp.Contents) + len(udp.Payload)
+
+	// 疑似ヘッダ(送信元IP，宛先IP，プロトコル番号，UDP長)
+	var sum uint32
+	sum = addChecksum(sum, src)
+	sum = addChecksum(sum, dst)
+	sum += uint32(layers.IPProtocolUDP) + uint32(length)
+	sum = addChecksum(sum, udp.Contents)
+	sum = addChecksum(sum, udp.Payload)
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return sum == 0xffff
+}
 
-	// IPv4アドレスを選択
-	var srcIP net.IP
-	for _, addr := range addrs {
-		if ipnet, ok := addr.(*net.IPNet); ok {
-			if ipnet.IP.To4() != nil {
-				srcIP = ipnet.IP.To4()
-				break
-			}
-		}
+// 16ビットずつ1の補数和に足す．奇数長なら最後に0を補う
+func addChecksum(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
 	}
-	if srcIP == nil {
-		return fmt.Errorf("有効なIPv4アドレスが見つかりません")
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
 	}
+	return sum
+}
 
+// UDPパケットを送信する関数
+func (s *Stack) UdpSend(dstIPStr string, srcPort, dstPort uint16, payload []byte) error {
 	// 宛先IPアドレスを解析
 	dstIP := net.ParseIP(dstIPStr)
 	if dstIP == nil {
 		return fmt.Errorf("無効な宛先IPアドレス: %s", dstIPStr)
 	}
+	if isIPv6(dstIP) {
+		if err := s.sendIPv6(nil, dstIP, layers.IPProtocolUDP, NewUDPHeader(srcPort, dstPort), gopacket.Payload(payload)); err != nil {
+			return err
+		}
+		fmt.Printf("UDPパケットを[%v]:%dへ送信（送信元ポート: %d）\n", dstIP, dstPort, srcPort)
+		return nil
+	}
+
+	// 経路から送信に使うインタフェース，送信元IPアドレス，次の転送先を選ぶ
+	nic, srcIP, nextHop, err := s.route(dstIP)
+	if err != nil {
+		return err
+	}
 
 	// MACアドレスを取得(ARPを使用)
-	srcMAC := iface.HardwareAddr
+	srcMAC := nic.HardwareAddr()
 
-	// ARPを使用して宛先MACアドレスを取得
-	arpReply, err := Send(ifaceName, dstIP)
+	// ARPを使用して次の転送先のMACアドレスを取得(近隣テーブルにあればそれを使う)
+	dstMAC, err := s.neighbors.resolve(nic, srcIP, nextHop)
 	if err != nil {
 		return fmt.Errorf("ARPリクエストに失敗: %v", err)
 	}
-	dstMAC := net.HardwareAddr(arpReply.SourceHwAddress)
 
 	// UDPパケットを作成
 	udpPacket := NewUDPPacket(srcMAC, dstMAC, srcIP, dstIP, srcPort, dstPort, payload)
 
-	// パケットキャプチャ用のハンドルを開く
-	handle, err := pcap.OpenLive(ifaceName, 65536, true, pcap.BlockForever)
-	if err != nil {
-		return fmt.Errorf("pcapハンドルのオープンに失敗: %v", err)
-	}
-	defer handle.Close()
-
-	// パケットをシリアライズ
-	buf := gopacket.NewSerializeBuffer()
-	opts := gopacket.SerializeOptions{
-		FixLengths:       true,
-		ComputeChecksums: true,
-	}
-
-	if err := gopacket.SerializeLayers(buf, opts,
-		udpPacket.Ethernet,
-		udpPacket.IP,
-		udpPacket.UDP,
-		gopacket.Payload(udpPacket.Payload)); err != nil {
-		return fmt.Errorf("パケットのシリアライズに失敗: %v", err)
-	}
-
-	// UDPパケットを送信
-	if err := handle.WritePacketData(buf.Bytes()); err != nil {
-		return fmt.Errorf("パケットの送信に失敗: %v", err)
+	// パケットをシリアライズしてUDPパケットを送信
+	if err := nic.writeIPv4(dstMAC, udpPacket.IP, udpPacket.UDP, gopacket.Payload(udpPacket.Payload)); err != nil {
+		return err
 	}
 
 	fmt.Printf("UDPパケットを[%v:%d]へ送信（送信元ポート: %d）\n", dstIP, dstPort, srcPort)
@@ -129,8 +133,15 @@ func UdpSend(ifaceName string, dstIPStr string, srcPort, dstPort uint16, payload
 func UdpRequest(ifaceName string, dstIPStr string, srcPort, dstPort uint16, message string) error {
 	payload := []byte(message)
 
+	// インタフェースを開いてスタックを作成
+	s, err := OpenStack(ifaceName)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
 	// UDPパケットを送信
-	if err := UdpSend(ifaceName, dstIPStr, srcPort, dstPort, payload); err != nil {
+	if err := s.UdpSend(dstIPStr, srcPort, dstPort, payload); err != nil {
 		return fmt.Errorf("UDPパケットの送信に失敗: %v", err)
 	}
 
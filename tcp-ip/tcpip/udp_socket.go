@@ -0,0 +1,177 @@
+package tcpip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// UDPソケットが閉じられている
+var ErrUDPClosed = errors.New("UDPソケットは閉じられています")
+
+// IPv4ヘッダ(20バイト)とUDPヘッダ(8バイト)の長さ
+const udpIPv4HeaderLen = 28
+
+// ポートにバインドしたUDPソケット
+// net.PacketConnを満たすので，DNSなどのクライアントやサーバをそのまま載せられる
+type UDPConn struct {
+	stack *Stack
+	port  uint16
+	rx    <-chan *udpDatagram
+
+	mu sync.Mutex
+	// ReadFromとWriteToの期限
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// 期限が変わるたびに閉じて作り直す(待っているReadFromを起こす)
+	deadlineChanged chan struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var _ net.PacketConn = (*UDPConn)(nil)
+
+// UDPポートにバインドしてソケットを作る．portが0ならエフェメラルポートを選ぶ
+func (s *Stack) Bind(port uint16) (*UDPConn, error) {
+	port, rx, err := s.bindUDP(port)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPConn{
+		stack:           s,
+		port:            port,
+		rx:              rx,
+		deadlineChanged: make(chan struct{}),
+		closed:          make(chan struct{}),
+	}, nil
+}
+
+// バインドしているポート番号
+func (c *UDPConn) Port() uint16 {
+	return c.port
+}
+
+// データグラムを1つ受け取り，送信元のアドレスを返す
+// bに入りきらない分は捨てる
+func (c *UDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline, changed := c.readDeadline, c.deadlineChanged
+		c.mu.Unlock()
+
+		var timer Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := deadline.Sub(c.stack.clock.Now())
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = c.stack.clock.NewTimer(d)
+			timeout = timer.C()
+		}
+
+		var d *udpDatagram
+		var err error
+		select {
+		case d = <-c.rx:
+		case <-c.closed:
+			err = ErrUDPClosed
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-changed:
+			// 期限が変わったので測り直す
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if d != nil {
+			n := copy(b, d.payload)
+			return n, &net.UDPAddr{IP: d.src, Port: int(d.udp.SrcPort)}, nil
+		}
+	}
+}
+
+// addr(*net.UDPAddr)へデータグラムを送る
+func (c *UDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, ErrUDPClosed
+	default:
+	}
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	if deadlineExceeded(c.stack.clock, deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	dst, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("UDPのアドレスではありません: %v", addr)
+	}
+	if dst.IP.To16() == nil {
+		return 0, fmt.Errorf("無効な宛先IPアドレス: %v", dst.IP)
+	}
+	if err := c.stack.sendUDP(dst.IP, c.port, uint16(dst.Port), b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ソケットを閉じてポートを解放する．待っているReadFromはErrUDPClosedを返す
+func (c *UDPConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stack.unbindUDP(c.port)
+		close(c.closed)
+	})
+	return nil
+}
+
+// バインドしているアドレス(すべてのアドレスで受け取る)
+func (c *UDPConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{Port: int(c.port)}
+}
+
+// ReadFromとWriteToの期限を設定する．ゼロ値なら期限なし
+func (c *UDPConn) SetDeadline(d time.Time) error {
+	c.SetReadDeadline(d)
+	c.SetWriteDeadline(d)
+	return nil
+}
+
+// ReadFromの期限を設定する．期限を過ぎるとReadFromはos.ErrDeadlineExceededを返す
+func (c *UDPConn) SetReadDeadline(d time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = d
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	c.mu.Unlock()
+	return nil
+}
+
+// WriteToの期限を設定する
+func (c *UDPConn) SetWriteDeadline(d time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = d
+	c.mu.Unlock()
+	return nil
+}
+
+// 経路に従ってUDPデータグラムを送る
+// IPv4ではMTUを超えるデータグラムをフラグメントし，IPv6ではMTUを超えるとエラーになる
+func (s *Stack) sendUDP(dstIP net.IP, srcPort, dstPort uint16, payload []byte) error {
+	if limit := maxIPv4DatagramLen - udpIPv4HeaderLen; !isIPv6(dstIP) && len(payload) > limit {
+		return fmt.Errorf("UDPデータグラムが大きすぎます: %dバイト(最大%dバイト)", len(payload), limit)
+	}
+	return s.sendIP(nil, dstIP, layers.IPProtocolUDP, NewUDPHeader(srcPort, dstPort), gopacket.Payload(payload))
+}
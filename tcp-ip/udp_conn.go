@@ -1,17 +1,34 @@
 package main
 
-import "tcpip/tcpip"
+import (
+	"context"
+	"fmt"
+	"log"
+	"tcpip/resolver"
+	"tcpip/tcpip"
+)
 
 func main() {
 	interfaceName := "en0"
-	dstIP := "192.168.1.1"
+	dnsServer := "192.168.1.1"
+	host := "example.com"
 
-	// UDPパケットを送信(例:DNSポート53にメッセージを送信)
-	srcPort := uint16(49152)
-	dstPort := uint16(53)
-	message := "Hello UDP!"
+	stack, err := tcpip.OpenStack(interfaceName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer stack.Close()
 
-	if err := tcpip.UdpRequest(interfaceName, dstIP, srcPort, dstPort, message); err != nil {
-		panic(err)
+	// UDPでDNSサーバ(ポート53)に問い合わせる
+	r, err := resolver.New(stack, dnsServer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ips, err := r.LookupIP(context.Background(), host)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, ip := range ips {
+		fmt.Printf("%s: %v\n", host, ip)
 	}
 }